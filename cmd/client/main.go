@@ -2,67 +2,231 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"sync"
 	"syscall"
 	"time"
 
+	"gotunnel-pro/internal/cli"
 	"gotunnel-pro/internal/config"
 	"gotunnel-pro/internal/crypto"
 	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+	"gotunnel-pro/internal/signals"
 	"gotunnel-pro/internal/tunnel"
+	"gotunnel-pro/internal/version"
 )
 
 func main() {
+	tcpReadBuffer := flag.Int("tcp-read-buffer", 0, "Socket receive buffer size in bytes for the server connection and local services (0 = OS default)")
+	tcpWriteBuffer := flag.Int("tcp-write-buffer", 0, "Socket send buffer size in bytes for the server connection and local services (0 = OS default)")
+	tcpNoDelay := flag.Bool("tcp-no-delay", true, "Send small writes on the server connection and local services immediately instead of coalescing them")
+	tcpKeepAlive := flag.Duration("tcp-keepalive", 0, "TCP keepalive period for the server connection and local services (0 = Go default, negative = disabled)")
+	statusFile := flag.String("status-file", "", "Periodically write per-tunnel status as JSON to this file (empty = disabled)")
+	statusInterval := flag.Duration("status-interval", 10*time.Second, "How often to rewrite -status-file")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address, e.g. :9091 (empty = disabled)")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	validateOnly := flag.Bool("validate", false, "Validate the config and mTLS material, print a report and exit without starting")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String("gotunnel-client"))
+		return
+	}
+
+	tcpOptions := tunnel.TCPOptions{
+		ReadBufferBytes:  *tcpReadBuffer,
+		WriteBufferBytes: *tcpWriteBuffer,
+		NoDelay:          tcpNoDelay,
+		KeepAlivePeriod:  *tcpKeepAlive,
+	}
+	if err := tcpOptions.Validate(); err != nil {
+		fmt.Printf("Invalid flags: %v\n", err)
+		os.Exit(2)
+	}
+	if *statusFile != "" && *statusInterval <= 0 {
+		fmt.Printf("Invalid flags: status interval must be positive, got %s\n", *statusInterval)
+		os.Exit(2)
+	}
+
 	// Initialize configuration
 	configPath := os.Getenv("GOTUNNEL_CONFIG")
 	if configPath == "" {
 		configPath = "config/client.yaml"
 	}
 
-	cfg, err := config.LoadClientConfig(configPath)
+	if *validateOnly {
+		os.Exit(cli.RunValidation(configPath, func(path string) (cli.MTLSMaterial, error) {
+			loaded, err := config.LoadClientConfig(path)
+			if err != nil {
+				return cli.MTLSMaterial{}, err
+			}
+			return cli.MTLSMaterial{
+				CertFile: loaded.Client.CertFile,
+				KeyFile:  loaded.Client.KeyFile,
+				CAFile:   loaded.Client.CAFile,
+				IsServer: false,
+				Options:  loaded.TLS,
+			}, nil
+		}))
+	}
+
+	// Optionally retry startup while secrets are still being mounted, e.g.
+	// GOTUNNEL_STARTUP_RETRY=30s. This is separate from runtime reconnects.
+	startupRetry, _ := time.ParseDuration(os.Getenv("GOTUNNEL_STARTUP_RETRY"))
+	startupDeadline := time.Now().Add(startupRetry)
+
+	var cfg *config.ClientConfig
+	err := retryStartup(startupDeadline, func() error {
+		// Referenced files may still be mounting, and loading validates them
+		var err error
+		cfg, err = config.LoadClientConfig(configPath)
+		return err
+	}, func(err error, delay time.Duration) {
+		fmt.Printf("Failed to load config, retrying in %s: %v\n", delay, err)
+	})
 	if err != nil {
 		fmt.Printf("Failed to load config: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Initialize logger
-	logger := logging.NewLogger("gotunnel-client", cfg.Environment, parseLogLevel(cfg.LogLevel))
+	logger := logging.NewLogger("gotunnel-client", cfg.Environment, cli.ParseLogLevel(cfg.LogLevel))
+	logger.SetMaxFields(cfg.LogMaxFields)
+	cli.SetLogPrivacy(logger, cfg.LogPrivacy, cfg.LogPrivacyFields)
 	ctx := context.Background()
+	cli.SetupSyslog(ctx, logger)
+	cli.SetupAsyncLogging(ctx, logger)
+	cli.SetupLogSampling(ctx, logger)
+	if err := cli.SetupAuditLogging(logger); err != nil {
+		logger.Fatal(ctx, "Failed to set up audit logging", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	// Flushes buffered entries when logging asynchronously
+	defer logger.Close()
+	for _, setting := range cfg.IgnoredSettings() {
+		logger.Warn(ctx, "Config setting is ignored; the client reconnects a single session", map[string]interface{}{
+			"setting": setting,
+		})
+	}
+	shutdownTracing := cli.SetupTracing(ctx, logger, "gotunnel-client")
+	metrics.SetBuildInfo(version.Version, version.Commit)
+	metrics.SetTunnels(tunnel.TunnelNames(cfg.Tunnels))
+	// Every tunnel reports down until it is established
+	for _, spec := range cfg.Tunnels {
+		metrics.RecordTunnelDown(spec.Name)
+	}
 
 	// Load mTLS configuration
-	tlsConfig, err := crypto.LoadMTLSConfig(
-		cfg.Client.CertFile,
-		cfg.Client.KeyFile,
-		cfg.Client.CAFile,
-		false,
-	)
+	cfg.TLS.Logger = logger
+	var tlsConfig *tls.Config
+	err = retryStartup(startupDeadline, func() error {
+		var err error
+		tlsConfig, err = crypto.LoadMTLSConfig(
+			cfg.Client.CertFile,
+			cfg.Client.KeyFile,
+			cfg.Client.CAFile,
+			false,
+			cfg.TLS,
+		)
+		if err != nil && !retryableTLSError(err) {
+			return permanentError{err}
+		}
+		return err
+	}, func(err error, delay time.Duration) {
+		logger.Warn(ctx, "Failed to load mTLS configuration, retrying", map[string]interface{}{
+			"error": err.Error(),
+			"delay": delay.String(),
+		})
+	})
 	if err != nil {
 		logger.Fatal(ctx, "Failed to load mTLS configuration", map[string]interface{}{
 			"error": err.Error(),
 		})
 	}
 
-	// Create tunnel client
+	// Warn loudly when deployed with a certificate that expires soon
+	if notAfter, err := crypto.CheckCertExpiry(tlsConfig); err != nil {
+		logger.Warn(ctx, "Failed to inspect certificate expiry", map[string]interface{}{
+			"error": err.Error(),
+		})
+	} else if remaining := time.Until(notAfter); remaining < crypto.DefaultCertExpiryWarning {
+		logger.Warn(ctx, "Certificate expired or expiring soon", map[string]interface{}{
+			"not_after":      notAfter.UTC().Format(time.RFC3339),
+			"days_remaining": int(remaining.Hours() / 24),
+			"expired":        remaining < 0,
+		})
+	}
+
+	// Serve rotated certificates to new handshakes without a restart
+	certReloader, err := crypto.NewReloadableCertificate(cfg.Client.CertFile, cfg.Client.KeyFile, cfg.TLS.KeyPassword, logger)
+	if err != nil {
+		logger.Fatal(ctx, "Failed to load client certificate", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	certReloader.Apply(tlsConfig)
+	reloadCtx, stopReload := context.WithCancel(ctx)
+	defer stopReload()
+	go certReloader.Watch(reloadCtx, crypto.DefaultCertReloadInterval)
+
+	// Surface expired or soon-to-expire CA certificates
+	cli.WarnCAExpiry(ctx, logger, cfg.Client.CAFile)
+
+	// Create tunnel client, multiplexing every tunnel over one mTLS session
 	client := tunnel.NewClient(&tunnel.ClientConfig{
 		ServerAddr: cfg.Server.Address,
 		TLSConfig:  tlsConfig,
 		Tunnels:    cfg.Tunnels,
 		Logger:     logger,
-		Reconnect: tunnel.ReconnectConfig{
-			Enabled:     true,
-			MaxAttempts: 10,
-			Interval:    5 * time.Second,
-			Backoff:     2.0,
-			MaxBackoff:  60 * time.Second,
-		},
+		Reconnect:  cfg.Reconnect,
+		AuthToken:  os.Getenv("GOTUNNEL_AUTH_TOKEN"),
+		TCP:        tcpOptions,
+		Mux:        cfg.Mux,
+		Keepalive:  cfg.Keepalive,
 	})
 
-	// Setup graceful shutdown
+	// Export per-tunnel status for monitoring that reads files
+	statusCtx, stopStatus := context.WithCancel(ctx)
+	defer stopStatus()
+	if *statusFile != "" {
+		go tunnel.RunStatusFile(statusCtx, logger, *statusFile, *statusInterval, client.Stats)
+	}
+
+	// Serve metrics for Prometheus, behind the same GOTUNNEL_METRICS_*
+	// credentials as the server's
+	var metricsServer *http.Server
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", cli.MetricsAuth(metrics.MetricsHandler()))
+		metricsServer = &http.Server{
+			Addr:    *metricsAddr,
+			Handler: mux,
+		}
+		go func() {
+			logger.Info(ctx, "Starting metrics server", map[string]interface{}{
+				"address": *metricsAddr,
+			})
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error(ctx, "Metrics server error", map[string]interface{}{
+					"error": err.Error(),
+				})
+			}
+		}()
+	}
+
+	// Setup graceful shutdown and SIGHUP config reloads
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	controller := signals.NewController(logger)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -80,9 +244,8 @@ func main() {
 		}
 	}()
 
-	// Wait for shutdown signal
-	<-sigChan
-	logger.Info(ctx, "Shutdown signal received", nil)
+	// Serve reloads until a shutdown signal arrives
+	controller.Run(ctx, sigChan, reloadConfig(configPath, cfg, logger, client))
 
 	// Shutdown client
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -93,12 +256,115 @@ func main() {
 			"error": err.Error(),
 		})
 	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error(ctx, "Metrics server shutdown error", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	// Flush spans of connections that finished during shutdown
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Warn(ctx, "Failed to flush traces", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
 
 	wg.Wait()
 	logger.Info(ctx, "Client stopped gracefully", nil)
 }
 
-func parseLogLevel(level string) logging.Level {
-	// Same as server implementation
-	return logging.INFO
+// retryStartup calls load until it succeeds or deadline passes, backing off
+// between attempts so a brief race with secret mounting self-heals rather
+// than crashlooping. With a deadline in the past load runs exactly once.
+// A permanentError from load is returned without retrying.
+func retryStartup(deadline time.Time, load func() error, onRetry func(err error, delay time.Duration)) error {
+	delay := 500 * time.Millisecond
+	for {
+		err := load()
+		if err == nil {
+			return nil
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		onRetry(err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > 10*time.Second {
+			delay = 10 * time.Second
+		}
+	}
+}
+
+// permanentError marks a startup error that retrying can't fix
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// retryableTLSError reports whether loading the mTLS config may succeed on
+// a later attempt. Missing or unreadable files may still be mounting, but a
+// CA that doesn't parse, a wrong key password or invalid TLS options won't
+// fix themselves.
+func retryableTLSError(err error) bool {
+	if errors.Is(err, crypto.ErrCAParse) || errors.Is(err, crypto.ErrKeyPassword) {
+		return false
+	}
+	return errors.Is(err, crypto.ErrCertLoad) || errors.Is(err, crypto.ErrCACertRead)
+}
+
+// reloadConfig re-reads the config file on SIGHUP and applies the parts
+// that can change at runtime: logging and tunnel definitions. The server
+// address, certificates, TLS, reconnect, mux and keepalive settings need a
+// restart. The running config is left untouched unless the new one loads,
+// validates and its tunnels apply; the rest can't fail, so a reload is
+// applied entirely or not at all. Changes are compared with the last
+// applied config, so each one is warned about once.
+func reloadConfig(path string, current *config.ClientConfig, logger *logging.Logger, client *tunnel.Client) signals.ReloadFunc {
+	return func(ctx context.Context) error {
+		next, err := config.LoadClientConfig(path)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		// The logger is set at startup, not loaded, so it isn't a change
+		next.TLS.Logger = current.TLS.Logger
+
+		if err := client.UpdateTunnels(ctx, next.Tunnels); err != nil {
+			return fmt.Errorf("failed to apply tunnels: %w", err)
+		}
+		metrics.SetTunnels(tunnel.TunnelNames(next.Tunnels))
+		logger.SetLevel(cli.ParseLogLevel(next.LogLevel))
+		logger.SetMaxFields(next.LogMaxFields)
+		cli.SetLogPrivacy(logger, next.LogPrivacy, next.LogPrivacyFields)
+
+		if next.Server != current.Server || next.Client != current.Client {
+			logger.Warn(ctx, "Server address and certificate paths changed; restart to apply", nil)
+		}
+		if !reflect.DeepEqual(next.TLS, current.TLS) {
+			logger.Warn(ctx, "TLS settings changed; restart to apply", nil)
+		}
+		if next.Reconnect != current.Reconnect || next.Mux != current.Mux || next.Keepalive != current.Keepalive {
+			logger.Warn(ctx, "Reconnect, mux and keepalive settings changed; restart to apply", nil)
+		}
+		current = next
+		logger.Info(ctx, "Configuration reloaded", map[string]interface{}{
+			"log_level": next.LogLevel,
+			"tunnels":   len(next.Tunnels),
+		})
+		return nil
+	}
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotunnel-pro/internal/config"
+	"gotunnel-pro/internal/crypto"
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/tunnel"
+)
+
+func TestRetryableTLSError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"missing certificate", fmt.Errorf("%w: %w", crypto.ErrCertLoad, fs.ErrNotExist), true},
+		{"missing CA", fmt.Errorf("%w: %w", crypto.ErrCACertRead, fs.ErrNotExist), true},
+		{"wrong key password", fmt.Errorf("%w: %w", crypto.ErrCertLoad, crypto.ErrKeyPassword), false},
+		{"unparseable CA", crypto.ErrCAParse, false},
+		{"invalid TLS options", errors.New("invalid TLS options: unknown cipher suite"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryableTLSError(tt.err); got != tt.want {
+				t.Errorf("retryableTLSError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryStartup(t *testing.T) {
+	mounting := errors.New("secret not mounted yet")
+	tests := []struct {
+		name         string
+		deadline     time.Duration
+		errs         []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{"succeeds first time", 0, []error{nil}, nil, 1},
+		{"no retry without a deadline", 0, []error{mounting, nil}, mounting, 1},
+		{"retries until it succeeds", time.Minute, []error{mounting, mounting, nil}, nil, 3},
+		{"permanent error stops retrying", time.Minute, []error{permanentError{crypto.ErrCAParse}, nil}, crypto.ErrCAParse, 1},
+		// The second delay of 1s would end past the deadline
+		{"gives up at the deadline", 700 * time.Millisecond, []error{mounting, mounting, mounting}, mounting, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := retryStartup(time.Now().Add(tt.deadline), func() error {
+				attempts++
+				return tt.errs[attempts-1]
+			}, func(error, time.Duration) {})
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("retryStartup() = %v, want %v", err, tt.wantErr)
+			}
+			var permanent permanentError
+			if errors.As(err, &permanent) {
+				t.Errorf("retryStartup() = %#v, want the permanentError unwrapped", err)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+// writeClientConfig writes a client config with body appended into dir,
+// next to empty certificate files, and returns its path
+func writeClientConfig(t *testing.T, dir, body string) string {
+	t.Helper()
+	for _, name := range []string{"cert.pem", "key.pem", "ca.pem"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := strings.ReplaceAll(`
+server:
+  address: 127.0.0.1:8443
+client:
+  cert_file: DIR/cert.pem
+  key_file: DIR/key.pem
+  ca_file: DIR/ca.pem
+tunnels:
+  - name: web
+    local_addr: 127.0.0.1:0
+    remote_addr: 127.0.0.1:80
+`, "DIR", dir) + body
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloadConfigWarnsOncePerChange(t *testing.T) {
+	var out bytes.Buffer
+	logger := logging.NewLogger("gotunnel-test", "test", logging.INFO)
+	logger.SetOutput(&out)
+	dir := t.TempDir()
+	path := writeClientConfig(t, dir, "")
+	cfg, err := config.LoadClientConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Set at startup like main does
+	cfg.TLS.Logger = logger
+	client := tunnel.NewClient(&tunnel.ClientConfig{ServerAddr: cfg.Server.Address, Logger: logger})
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client.Shutdown(ctx)
+	})
+	reload := reloadConfig(path, cfg, logger, client)
+
+	// An unchanged file warns about nothing, the startup logger included
+	if err := reload(context.Background()); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if strings.Contains(out.String(), "restart to apply") {
+		t.Errorf("unchanged reload logged %s, want no restart warnings", out.String())
+	}
+
+	// A change is compared with the last reload, not startup
+	writeClientConfig(t, dir, "keepalive: 20s\n")
+	for range 2 {
+		if err := reload(context.Background()); err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+	}
+	if got := strings.Count(out.String(), "keepalive settings changed"); got != 1 {
+		t.Errorf("keepalive warnings = %d, want 1:\n%s", got, out.String())
+	}
+}
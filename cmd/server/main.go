@@ -1,36 +1,128 @@
 package main
 
 import (
+	"archive/zip"
 	"context"
-	"crypto/tls"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"gotunnel-pro/internal/cli"
 	"gotunnel-pro/internal/config"
 	"gotunnel-pro/internal/crypto"
 	"gotunnel-pro/internal/health"
 	"gotunnel-pro/internal/logging"
 	"gotunnel-pro/internal/metrics"
+	"gotunnel-pro/internal/signals"
 	"gotunnel-pro/internal/tunnel"
+	"gotunnel-pro/internal/version"
 )
 
 var (
 	logger *logging.Logger
-	cfg    *config.ServerConfig
+	// cfg is the running config. Reloads replace it, so code that runs
+	// once the server is up reads it through currentConfig.
+	cfg   *config.ServerConfig
+	cfgMu sync.RWMutex
+
+	// startTime is reported as uptime on /status
+	startTime = time.Now()
 )
 
+// shutdownGrace is how long shutdown may take beyond the drain timeout to
+// close sessions and HTTP servers and flush traces
+const shutdownGrace = 10 * time.Second
+
+// recentLogEntries is how many log entries are kept for the diagnostics
+// bundle
+const recentLogEntries = 500
+
 func main() {
 	// Initialize configuration
 	configPath := flag.String("config", "config/server.yaml", "Path to configuration file")
+	metricsLogInterval := flag.Duration("metrics-log-interval", 0, "Interval for logging metric snapshots (0 = disabled)")
+	ocspStapling := flag.Bool("ocsp-stapling", false, "Staple OCSP responses from the certificate's responder")
+	enablePprof := flag.Bool("enable-pprof", false, "Serve /debug/pprof/ on the metrics listener behind the admin token")
+	drainTimeout := flag.Duration("drain-timeout", tunnel.DefaultDrainTimeout, "How long shutdown waits for forwarded connections before force-closing them")
+	backendCloseWindow := flag.Duration("backend-close-window", 0, "Treat a backend that closes a new connection within this long without sending anything as refusing it (0 = disabled)")
+	idleScanInterval := flag.Duration("idle-scan-interval", 0, "Enforce tunnel idle timeouts with one scan of all connections per interval instead of a deadline per connection (0 = per-connection deadlines)")
+	drainLinger := flag.Duration("drain-linger", 0, "SO_LINGER for connections force-closed at the drain deadline (0 = OS default, negative = reset)")
+	maxConnections := flag.Int("max-connections", 0, "Maximum tunnel connections open at once across all clients (0 = unlimited)")
+	priorityReserve := flag.Int("priority-reserve", 0, "Connection slots held back from each lower tunnel priority while higher-priority connections are active")
+	warmupGrace := flag.Duration("warmup-grace", 0, "Reject tunnel connections for this long after startup (0 = accept immediately)")
+	warmupHold := flag.Bool("warmup-hold", false, "Hold connections arriving during -warmup-grace until it ends instead of rejecting them")
+	minTunnels := flag.Int("min-tunnels", 0, "Report not ready while fewer clients than this are connected (0 = no check)")
+	maxHandshakes := flag.Int("max-handshakes", 0, "Maximum TLS handshakes in progress at once (0 = unlimited)")
+	maxHandshakesPerIP := flag.Int("max-handshakes-per-ip", 0, "Maximum TLS handshakes in progress at once from one source IP (0 = unlimited)")
+	handshakeTimeout := flag.Duration("handshake-timeout", tunnel.DefaultTimeouts.Handshake, "How long a client may take to complete the TLS handshake")
+	readTimeout := flag.Duration("read-timeout", tunnel.DefaultTimeouts.Read, "How long a read on a client connection may block; keep it above the client keepalive interval (0 = no limit)")
+	writeTimeout := flag.Duration("write-timeout", tunnel.DefaultTimeouts.Write, "How long a write to a client or backend connection may block (0 = no limit)")
+	ioTimeout := flag.Duration("io-timeout", 0, "Absolute cap on any single read or write on a forwarded connection, as a safety net against hangs (0 = disabled)")
+	memoryThreshold := flag.Uint64("memory-threshold", 0, "Shed new client connections while process memory is above this many bytes (0 = use -memory-shed-percent)")
+	memoryShedPercent := flag.Int("memory-shed-percent", 0, "Shed new client connections above this percentage of the cgroup memory limit (0 = disabled)")
+	errorRateWindow := flag.Duration("error-rate-window", time.Minute, "Window over which -error-rate-degraded and -error-rate-unhealthy are measured")
+	errorRateDegraded := flag.Float64("error-rate-degraded", 0, "Report degraded while connection errors per second over -error-rate-window reach this rate (0 = disabled)")
+	errorRateUnhealthy := flag.Float64("error-rate-unhealthy", 0, "Report not ready while connection errors per second over -error-rate-window reach this rate (0 = disabled)")
+	healthSummaryThreshold := flag.Int("health-summary-threshold", 0, "Summarize /healthz output above this many checkers (0 = never)")
+	tcpReadBuffer := flag.Int("tcp-read-buffer", 0, "Socket receive buffer size in bytes for tunnel connections (0 = OS default)")
+	tcpWriteBuffer := flag.Int("tcp-write-buffer", 0, "Socket send buffer size in bytes for tunnel connections (0 = OS default)")
+	tcpNoDelay := flag.Bool("tcp-no-delay", true, "Send small writes on tunnel connections immediately instead of coalescing them")
+	tcpKeepAlive := flag.Duration("tcp-keepalive", 0, "TCP keepalive period for tunnel connections (0 = Go default, negative = disabled)")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	validateOnly := flag.Bool("validate", false, "Validate the config and mTLS material, print a report and exit without starting")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(version.String("gotunnel-server"))
+		return
+	}
+
+	tcpOptions := tunnel.TCPOptions{
+		ReadBufferBytes:  *tcpReadBuffer,
+		WriteBufferBytes: *tcpWriteBuffer,
+		NoDelay:          tcpNoDelay,
+		KeepAlivePeriod:  *tcpKeepAlive,
+	}
+	if err := tcpOptions.Validate(); err != nil {
+		fmt.Printf("Invalid flags: %v\n", err)
+		os.Exit(2)
+	}
+	if *memoryShedPercent < 0 || *memoryShedPercent > 100 {
+		fmt.Printf("Invalid flags: memory shed percent must be between 0 and 100, got %d\n", *memoryShedPercent)
+		os.Exit(2)
+	}
+
+	if *validateOnly {
+		os.Exit(cli.RunValidation(*configPath, func(path string) (cli.MTLSMaterial, error) {
+			loaded, err := config.LoadServerConfig(path)
+			if err != nil {
+				return cli.MTLSMaterial{}, err
+			}
+			return cli.MTLSMaterial{
+				CertFile: loaded.Server.CertFile,
+				KeyFile:  loaded.Server.KeyFile,
+				CAFile:   loaded.Server.CAFile,
+				IsServer: true,
+				Options:  loaded.TLS,
+			}, nil
+		}))
+	}
+
 	var err error
 	cfg, err = config.LoadServerConfig(*configPath)
 	if err != nil {
@@ -39,19 +131,49 @@ func main() {
 	}
 
 	// Initialize logger
-	logger = logging.NewLogger("gotunnel-server", cfg.Environment, parseLogLevel(cfg.LogLevel))
+	logger = logging.NewLogger("gotunnel-server", cfg.Environment, cli.ParseLogLevel(cfg.LogLevel))
+	logger.SetMaxFields(cfg.LogMaxFields)
+	cli.SetLogPrivacy(logger, cfg.LogPrivacy, cfg.LogPrivacyFields)
+	logger.SetRecentBuffer(recentLogEntries)
 	ctx := context.Background()
+	cli.SetupSyslog(ctx, logger)
+	cli.SetupAsyncLogging(ctx, logger)
+	cli.SetupLogSampling(ctx, logger)
+	if err := cli.SetupAuditLogging(logger); err != nil {
+		logger.Fatal(ctx, "Failed to set up audit logging", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	// Flushes buffered entries when logging asynchronously
+	defer logger.Close()
+	shutdownTracing := cli.SetupTracing(ctx, logger, "gotunnel-server")
+	metrics.SetBuildInfo(version.Version, version.Commit)
+	metrics.SetTunnels(cfg.TunnelNames())
+	if err := metrics.InitMetrics(metrics.MetricsConfig{
+		DurationBuckets: cfg.Metrics.DurationBuckets,
+	}); err != nil {
+		logger.Fatal(ctx, "Failed to initialize metrics", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
 
 	// Initialize health service
 	healthService := health.NewHealthService()
 	healthService.SetReady(true)
+	healthService.SetSummaryThreshold(*healthSummaryThreshold)
+	healthService.RegisterReadinessChecker(health.NewCertificateChecker(cfg.Server.CertFile, health.DefaultCertExpiryWarning))
+	if *errorRateDegraded > 0 || *errorRateUnhealthy > 0 {
+		healthService.RegisterReadinessChecker(health.NewErrorRateChecker(*errorRateWindow, *errorRateDegraded, *errorRateUnhealthy))
+	}
 
 	// Load mTLS configuration
+	cfg.TLS.Logger = logger
 	tlsConfig, err := crypto.LoadMTLSConfig(
 		cfg.Server.CertFile,
 		cfg.Server.KeyFile,
 		cfg.Server.CAFile,
 		true,
+		cfg.TLS,
 	)
 	if err != nil {
 		logger.Fatal(ctx, "Failed to load mTLS configuration", map[string]interface{}{
@@ -59,67 +181,206 @@ func main() {
 		})
 	}
 
+	// Warn loudly when deployed with a certificate that expires soon
+	if notAfter, err := crypto.CheckCertExpiry(tlsConfig); err != nil {
+		logger.Warn(ctx, "Failed to inspect certificate expiry", map[string]interface{}{
+			"error": err.Error(),
+		})
+	} else if remaining := time.Until(notAfter); remaining < crypto.DefaultCertExpiryWarning {
+		logger.Warn(ctx, "Certificate expired or expiring soon", map[string]interface{}{
+			"not_after":      notAfter.UTC().Format(time.RFC3339),
+			"days_remaining": int(remaining.Hours() / 24),
+			"expired":        remaining < 0,
+		})
+	}
+
+	// Serve rotated certificates to new handshakes without a restart
+	certReloader, err := crypto.NewReloadableCertificate(cfg.Server.CertFile, cfg.Server.KeyFile, cfg.TLS.KeyPassword, logger)
+	if err != nil {
+		logger.Fatal(ctx, "Failed to load server certificate", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	certReloader.Apply(tlsConfig)
+	reloadCtx, stopReload := context.WithCancel(ctx)
+	defer stopReload()
+	go certReloader.Watch(reloadCtx, crypto.DefaultCertReloadInterval)
+
+	if *ocspStapling {
+		stapler, err := crypto.NewOCSPStapler(certReloader.Certificate, cfg.Server.CAFile, logger)
+		if err != nil {
+			logger.Fatal(ctx, "Failed to set up OCSP stapling", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+		tlsConfig.GetCertificate = stapler.GetCertificate
+		go stapler.Run(reloadCtx, crypto.DefaultOCSPCheckInterval)
+	}
+
+	// Surface expired or soon-to-expire CA certificates
+	cli.WarnCAExpiry(ctx, logger, cfg.Server.CAFile)
+
+	// Identity gate and TLS policy, managed at runtime through the admin API
+	// The source was validated with the config
+	identityExtractor, _ := crypto.ParseIdentityExtractor(cfg.TLS.IdentitySource)
+	identityGate := crypto.NewIdentityGate(cfg.Identities.Allow, cfg.Identities.Deny, identityExtractor)
+	dynamicTLS := crypto.NewDynamicTLSConfig(tlsConfig)
+	maintenance := tunnel.NewMaintenanceMode()
+
+	// Optional bearer tokens required in addition to the client certificate,
+	// e.g. GOTUNNEL_AUTH_TOKENS=token1,token2
+	var tokenSource tunnel.TokenSource
+	if tokens := os.Getenv("GOTUNNEL_AUTH_TOKENS"); tokens != "" {
+		tokenSource = tunnel.NewStaticTokens(strings.Split(tokens, ","))
+	}
+
+	// Backends client tunnels may reach; nothing without an allowlist
+	var destinations *tunnel.DestinationPolicy
+	if len(cfg.Destinations) > 0 {
+		destinations, err = tunnel.NewDestinationPolicy(cfg.Destinations, logger)
+		if err != nil {
+			logger.Fatal(ctx, "Invalid destination policy", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+	} else {
+		logger.Warn(ctx, "No destinations configured; every tunnel destination will be denied", nil)
+	}
+
+	// Bound handshake CPU so one source can't starve the rest
+	var handshakes *tunnel.HandshakeLimiter
+	if *maxHandshakes > 0 || *maxHandshakesPerIP > 0 {
+		handshakes = tunnel.NewHandshakeLimiter(*maxHandshakes, *maxHandshakesPerIP)
+	}
+
+	// Shed new connections under memory pressure rather than be OOM-killed
+	var memoryGuard *tunnel.MemoryGuard
+	threshold := *memoryThreshold
+	if threshold == 0 && *memoryShedPercent > 0 {
+		var ok bool
+		if threshold, ok = tunnel.CgroupMemoryThreshold(*memoryShedPercent); !ok {
+			logger.Warn(ctx, "No cgroup memory limit found, memory shedding disabled", map[string]interface{}{
+				"memory_shed_percent": *memoryShedPercent,
+			})
+		}
+	}
+	if threshold > 0 {
+		memoryGuard = tunnel.NewMemoryGuard(threshold, nil, logger)
+	}
+
+	// Shed low-priority tunnels first when near the connection limit
+	var admission *tunnel.PriorityAdmission
+	if *maxConnections > 0 {
+		admission = tunnel.NewPriorityAdmission(*maxConnections, *priorityReserve)
+	}
+
 	// Create tunnel server
 	server := tunnel.NewServer(&tunnel.ServerConfig{
-		ListenAddr: cfg.Server.ListenAddr,
-		TLSConfig:  tlsConfig,
-		Logger:     logger,
-		Health:     healthService,
+		ListenAddr:         cfg.Server.ListenAddr,
+		TLSConfig:          dynamicTLS.Config(),
+		Logger:             logger,
+		Mux:                cfg.Mux,
+		Handshakes:         handshakes,
+		Admission:          admission,
+		Priorities:         cfg.TunnelPriorities(),
+		TunnelLimits:       tunnel.NewTunnelLimiter(cfg.TunnelMaxConns()),
+		ReverseTunnels:     cfg.ReverseTunnels(),
+		Backends:           cfg.TunnelBackends(),
+		IdentityGate:       identityGate,
+		Policy:             destinations,
+		Maintenance:        maintenance,
+		DrainTimeout:       *drainTimeout,
+		DrainLinger:        *drainLinger,
+		IdleScanInterval:   *idleScanInterval,
+		BackendCloseWindow: *backendCloseWindow,
+		TokenSource:        tokenSource,
+		Timeouts: tunnel.Timeouts{
+			Dial:      tunnel.DefaultTimeouts.Dial,
+			Read:      *readTimeout,
+			Write:     *writeTimeout,
+			Handshake: *handshakeTimeout,
+			IO:        *ioTimeout,
+		},
+		TCP:         tcpOptions,
+		MemoryGuard: memoryGuard,
+		Warmup:      tunnel.NewWarmup(*warmupGrace, *warmupHold),
+		Health:      healthService,
+		MinTunnels:  *minTunnels,
 	})
 
-	// Setup HTTP server for metrics and health checks
-	httpServer := setupHTTPServer(healthService)
+	// Setup HTTP servers for metrics and health checks
+	httpServers := setupHTTPServers(healthService, identityGate, dynamicTLS, maintenance, server.TunnelStates, server.Stats, *enablePprof)
+
+	// Periodic metric snapshots for sites without Prometheus
+	snapshotCtx, stopSnapshots := context.WithCancel(ctx)
+	defer stopSnapshots()
+	if *metricsLogInterval > 0 {
+		go logger.RunMetricsSnapshots(snapshotCtx, *metricsLogInterval, metrics.Snapshot)
+	}
 
-	// Setup graceful shutdown
+	// Setup graceful shutdown and SIGHUP config reloads
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	controller := signals.NewController(logger)
 
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(1 + len(httpServers))
 
-	// Start tunnel server
+	// Start tunnel server; cancelling serveCtx stops accepting connections
+	serveCtx, stopServing := context.WithCancel(ctx)
+	defer stopServing()
+	listenAddr := cfg.Server.ListenAddr
 	go func() {
 		defer wg.Done()
 		logger.Info(ctx, "Starting tunnel server", map[string]interface{}{
-			"address": cfg.Server.ListenAddr,
+			"address": listenAddr,
 		})
-		if err := server.Start(); err != nil {
+		if err := server.StartContext(serveCtx); err != nil {
 			logger.Error(ctx, "Tunnel server error", map[string]interface{}{
 				"error": err.Error(),
 			})
 		}
 	}()
 
-	// Start HTTP server
-	go func() {
-		defer wg.Done()
-		logger.Info(ctx, "Starting HTTP server", map[string]interface{}{
-			"address": cfg.Server.MetricsAddr,
-		})
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Error(ctx, "HTTP server error", map[string]interface{}{
-				"error": err.Error(),
+	// Start HTTP servers
+	for _, httpServer := range httpServers {
+		go func() {
+			defer wg.Done()
+			logger.Info(ctx, "Starting HTTP server", map[string]interface{}{
+				"address": httpServer.Addr,
 			})
-		}
-	}()
+			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error(ctx, "HTTP server error", map[string]interface{}{
+					"address": httpServer.Addr,
+					"error":   err.Error(),
+				})
+			}
+		}()
+	}
 
-	// Wait for shutdown signal
-	<-sigChan
-	logger.Info(ctx, "Shutdown signal received, initiating graceful shutdown", nil)
+	// Serve reloads until a shutdown signal arrives
+	controller.Run(ctx, sigChan, reloadConfig(*configPath, identityGate))
+	logger.Info(ctx, "Initiating graceful shutdown", nil)
+	stopServing()
 
-	// Initiate graceful shutdown
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Initiate graceful shutdown. The tunnel server drains forwarded
+	// connections for up to the drain timeout, leaving shutdownGrace to
+	// close sessions and flush traces.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout+shutdownGrace)
 	defer cancel()
 
 	// Mark as shutting down
 	healthService.SetShuttingDown(true)
 	healthService.SetReady(false)
 
-	// Shutdown HTTP server
-	if err := httpServer.Shutdown(shutdownCtx); err != nil {
-		logger.Error(ctx, "HTTP server shutdown error", map[string]interface{}{
-			"error": err.Error(),
-		})
+	// Shutdown HTTP servers
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error(ctx, "HTTP server shutdown error", map[string]interface{}{
+				"address": httpServer.Addr,
+				"error":   err.Error(),
+			})
+		}
 	}
 
 	// Shutdown tunnel server
@@ -129,17 +390,44 @@ func main() {
 		})
 	}
 
+	// Flush spans of connections that finished during shutdown
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Warn(ctx, "Failed to flush traces", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
 	// Wait for all goroutines to finish
 	wg.Wait()
 	logger.Info(ctx, "Graceful shutdown completed", nil)
 }
 
-func setupHTTPServer(healthService *health.HealthService) *http.Server {
+// setupHTTPServers builds the metrics and admin server, plus a separate
+// health server when server.health_addr names a different address. With no
+// separate health address the health endpoints share the metrics server and
+// the returned list holds just that one.
+func setupHTTPServers(healthService *health.HealthService, identityGate *crypto.IdentityGate, dynamicTLS *crypto.DynamicTLSConfig, maintenance *tunnel.MaintenanceMode, tunnelStates func() []tunnel.TunnelState, serverStats func() tunnel.ServerStats, enablePprof bool) []*http.Server {
 	mux := http.NewServeMux()
+	servers := []*http.Server{{
+		Addr:    cfg.Server.MetricsAddr,
+		Handler: logRequests(mux),
+	}}
 
-	// Health endpoints
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		result := healthService.Check(r.Context())
+	// Health endpoints stay unauthenticated for probes
+	healthMux := mux
+	if cfg.Server.HealthAddr != "" && cfg.Server.HealthAddr != cfg.Server.MetricsAddr {
+		healthMux = http.NewServeMux()
+		servers = append(servers, &http.Server{
+			Addr:    cfg.Server.HealthAddr,
+			Handler: logRequests(healthMux),
+		})
+	}
+
+	healthMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		// Liveness only: a failing dependency must not trigger restarts.
+		// Full per-check detail stays available behind ?verbose=true.
+		verbose := r.URL.Query().Get("verbose") == "true"
+		result := healthService.CheckKind(r.Context(), health.Liveness, verbose)
 		status := http.StatusOK
 
 		if result["status"] == "unhealthy" || healthService.IsShuttingDown() {
@@ -151,7 +439,7 @@ func setupHTTPServer(healthService *health.HealthService) *http.Server {
 		json.NewEncoder(w).Encode(result)
 	})
 
-	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+	healthMux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
 		if healthService.IsShuttingDown() {
 			w.WriteHeader(http.StatusServiceUnavailable)
 			w.Write([]byte("shutting down"))
@@ -164,30 +452,456 @@ func setupHTTPServer(healthService *health.HealthService) *http.Server {
 			return
 		}
 
+		if result := healthService.CheckReadiness(r.Context()); result["status"] == "unhealthy" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ready"))
 	})
 
-	// Metrics endpoint
-	mux.Handle("/metrics", metrics.MetricsHandler())
+	// Metrics endpoints, behind a bearer token or basic auth when
+	// GOTUNNEL_METRICS_TOKEN or GOTUNNEL_METRICS_USER/_PASSWORD are set
+	metricsAuth := cli.MetricsAuth
+	mux.Handle("/metrics", metricsAuth(metrics.MetricsHandler()))
 
-	return &http.Server{
-		Addr:    cfg.Server.MetricsAddr,
-		Handler: mux,
-	}
-}
-
-func parseLogLevel(level string) logging.Level {
-	switch level {
-	case "debug":
-		return logging.DEBUG
-	case "info":
-		return logging.INFO
-	case "warn":
-		return logging.WARN
-	case "error":
-		return logging.ERROR
-	default:
-		return logging.INFO
+	// Human-readable summary for incidents without Prometheus at hand
+	mux.Handle("/status", metricsAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(serverStatus(tunnelStates(), serverStats()))
+	})))
+
+	// Admin endpoints, disabled unless GOTUNNEL_ADMIN_TOKEN is set
+	adminToken := os.Getenv("GOTUNNEL_ADMIN_TOKEN")
+
+	mux.HandleFunc("/admin/identities", requireAdmin(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var req identityListsRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			identityGate.Update(req.Allow, req.Deny)
+			logger.Audit(r.Context(), "Updated certificate identity lists", map[string]interface{}{
+				"allow": req.Allow,
+				"deny":  req.Deny,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		allow, deny := identityGate.Lists()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(identityListsRequest{Allow: allow, Deny: deny})
+	}))
+
+	mux.HandleFunc("/admin/loglevel", requireAdmin(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var req logLevelRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			level, err := logging.ParseLevel(req.Level)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.SetLevel(level)
+			logger.Audit(r.Context(), "Changed log level", map[string]interface{}{
+				"level": level.String(),
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(logLevelRequest{Level: strings.ToLower(logger.GetLevel().String())})
+	}))
+
+	mux.HandleFunc("/tls", requireAdmin(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var policy crypto.TLSPolicy
+			if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			if err := dynamicTLS.Apply(policy); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Audit(r.Context(), "Applied new TLS policy", map[string]interface{}{
+				"min_version":   policy.MinVersion,
+				"cipher_suites": policy.CipherSuites,
+				"client_auth":   policy.ClientAuth,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dynamicTLS.Policy())
+	}))
+
+	mux.HandleFunc("/admin/maintenance", requireAdmin(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var req maintenanceRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Tunnel == "" {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			if req.Enabled {
+				maintenance.Enable(req.MaintenanceResponse)
+			} else {
+				maintenance.Disable(req.Tunnel)
+			}
+			logger.Audit(r.Context(), "Changed tunnel maintenance mode", map[string]interface{}{
+				"tunnel":  req.Tunnel,
+				"enabled": req.Enabled,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(maintenance.List())
+	}))
+
+	// Current tunnel state for control plane reconciliation
+	mux.HandleFunc("/tunnels/state", requireAdmin(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tunnel.NormalizeTunnelStates(tunnelStates()))
+	}))
+
+	mux.HandleFunc("/debug/bundle", requireAdmin(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="gotunnel-diagnostics.zip"`)
+		if err := writeDiagnosticsBundle(r.Context(), w, healthService, tunnelStates()); err != nil {
+			logger.Error(r.Context(), "Failed to write diagnostics bundle", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+	}))
+
+	// Profiles expose memory contents and internals, so they sit behind the
+	// admin token as well as being opt-in
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", requireAdmin(adminToken, pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", requireAdmin(adminToken, pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", requireAdmin(adminToken, pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", requireAdmin(adminToken, pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", requireAdmin(adminToken, pprof.Trace))
+	}
+
+	return servers
+}
+
+// logRequests gives each request an ID, taken from X-Request-ID when the
+// caller sent one, that is echoed in the response and carried in the
+// request context so handler logs correlate. Method, path, status and
+// duration are logged and recorded in the request metrics. Scrapes of
+// /metrics are only recorded, to keep them out of the log.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 128 {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		r = r.WithContext(logging.WithRequestID(r.Context(), requestID))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		duration := time.Since(start)
+
+		metrics.RecordRequest(r.Method, strconv.Itoa(rec.status), duration)
+		if r.URL.Path == "/metrics" {
+			return
+		}
+
+		fields := map[string]interface{}{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      rec.status,
+			"duration_ms": duration.Milliseconds(),
+			"remote_addr": r.RemoteAddr,
+		}
+		// Probes hit these endpoints constantly, so only failures are
+		// logged above debug
+		if rec.status >= http.StatusInternalServerError {
+			logger.Warn(r.Context(), "HTTP request failed", fields)
+		} else {
+			logger.Debug(r.Context(), "HTTP request", fields)
+		}
+	})
+}
+
+func newRequestID() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g.
+// to flush streamed profiles
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// requireAdmin rejects requests that don't carry the admin token in an
+// Authorization: Bearer header. An empty token disables the endpoint
+// entirely.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "admin API disabled", http.StatusForbidden)
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// currentConfig returns the running config, as last replaced by a reload
+func currentConfig() *config.ServerConfig {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return cfg
+}
+
+// writeDiagnosticsBundle writes a zip of the redacted effective config,
+// health results, tunnel states, a metrics snapshot and the recent log for
+// attaching to support tickets
+func writeDiagnosticsBundle(ctx context.Context, w io.Writer, healthService *health.HealthService, tunnelStates []tunnel.TunnelState) error {
+	var config map[string]interface{}
+	data, err := json.Marshal(currentConfig())
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	redactSecrets(config)
+
+	entries := []struct {
+		name  string
+		value interface{}
+	}{
+		{"config.json", config},
+		{"health.json", healthService.Check(ctx)},
+		{"tunnels.json", tunnel.NormalizeTunnelStates(tunnelStates)},
+		{"metrics.json", metrics.Snapshot()},
+	}
+
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		f, err := zw.Create(entry.name)
+		if err != nil {
+			return fmt.Errorf("failed to add %s: %w", entry.name, err)
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entry.value); err != nil {
+			return fmt.Errorf("failed to add %s: %w", entry.name, err)
+		}
+	}
+
+	f, err := zw.Create("recent.log")
+	if err != nil {
+		return fmt.Errorf("failed to add recent.log: %w", err)
+	}
+	for _, line := range logger.Recent() {
+		if _, err := f.Write(line); err != nil {
+			return fmt.Errorf("failed to add recent.log: %w", err)
+		}
+	}
+	return zw.Close()
+}
+
+// redactSecrets replaces values whose key looks secret, at any depth
+func redactSecrets(m map[string]interface{}) {
+	for k, v := range m {
+		lower := strings.ToLower(k)
+		if strings.Contains(lower, "password") || strings.Contains(lower, "secret") || strings.Contains(lower, "token") {
+			m[k] = "[REDACTED]"
+			continue
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			redactSecrets(nested)
+		}
+	}
+}
+
+// statusResponse is the body of /status
+type statusResponse struct {
+	Version       string         `json:"version"`
+	Uptime        string         `json:"uptime"`
+	UptimeSeconds int64          `json:"uptime_seconds"`
+	ActiveTunnels int            `json:"active_tunnels"`
+	Tunnels       []statusTunnel `json:"tunnels"`
+	tunnel.ServerStats
+	metrics.Status
+}
+
+// statusTunnel is a tunnel's entry on /status. Endpoints are left to the
+// admin-only /tunnels/state.
+type statusTunnel struct {
+	Name              string `json:"name"`
+	Type              string `json:"type"`
+	Enabled           bool   `json:"enabled"`
+	Draining          bool   `json:"draining"`
+	ActiveConnections int    `json:"active_connections"`
+}
+
+// serverStatus builds the /status body from the tunnel states, server
+// stats and metrics
+func serverStatus(states []tunnel.TunnelState, stats tunnel.ServerStats) statusResponse {
+	uptime := time.Since(startTime)
+	status := statusResponse{
+		Version:       version.Version,
+		Uptime:        uptime.Round(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+		Tunnels:       make([]statusTunnel, 0, len(states)),
+		ServerStats:   stats,
+		Status:        metrics.CurrentStatus(),
+	}
+	for _, state := range tunnel.NormalizeTunnelStates(states) {
+		if state.Enabled && !state.Draining {
+			status.ActiveTunnels++
+		}
+		status.Tunnels = append(status.Tunnels, statusTunnel{
+			Name:              state.Name,
+			Type:              state.Type,
+			Enabled:           state.Enabled,
+			Draining:          state.Draining,
+			ActiveConnections: state.ActiveConnections,
+		})
+	}
+	return status
+}
+
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type maintenanceRequest struct {
+	tunnel.MaintenanceResponse
+	Enabled bool `json:"enabled"`
+}
+
+type identityListsRequest struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// reloadConfig re-reads the config file on SIGHUP and applies the parts
+// that can change at runtime: logging, metrics buckets, the tunnel names
+// metrics are labelled with and the identity lists, replacing any set
+// through the admin API. Listen addresses, certificate paths and tunnel
+// policies need a restart. The running config is left untouched unless the
+// new one loads, validates and its metrics apply; the rest can't fail, so a
+// reload is applied entirely or not at all. Changes are compared with the
+// running config, which is then replaced, so each one is warned about once.
+// The request duration histogram is only rebuilt, losing its samples, when
+// the buckets change.
+func reloadConfig(path string, identityGate *crypto.IdentityGate) signals.ReloadFunc {
+	return func(ctx context.Context) error {
+		current := currentConfig()
+		next, err := config.LoadServerConfig(path)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		// The logger is set at startup, not loaded, so it isn't a change
+		next.TLS.Logger = current.TLS.Logger
+
+		if !slices.Equal(next.Metrics.DurationBuckets, current.Metrics.DurationBuckets) {
+			if err := metrics.InitMetrics(metrics.MetricsConfig{
+				DurationBuckets: next.Metrics.DurationBuckets,
+			}); err != nil {
+				return fmt.Errorf("failed to apply metrics config: %w", err)
+			}
+		}
+		metrics.SetTunnels(next.TunnelNames())
+		identityGate.Update(next.Identities.Allow, next.Identities.Deny)
+		logger.SetLevel(cli.ParseLogLevel(next.LogLevel))
+		logger.SetMaxFields(next.LogMaxFields)
+		cli.SetLogPrivacy(logger, next.LogPrivacy, next.LogPrivacyFields)
+
+		if next.Server != current.Server {
+			logger.Warn(ctx, "Server addresses and certificate paths changed; restart to apply", nil)
+		}
+		if !reflect.DeepEqual(next.TLS, current.TLS) {
+			logger.Warn(ctx, "TLS settings changed; restart to apply", nil)
+		}
+		if next.Mux != current.Mux || !reflect.DeepEqual(next.Destinations, current.Destinations) {
+			logger.Warn(ctx, "Mux settings and destinations changed; restart to apply", nil)
+		}
+		if !reflect.DeepEqual(next.Tunnels, current.Tunnels) {
+			logger.Warn(ctx, "Tunnel priorities, connection limits, reverse bindings and backend options changed; restart to apply", nil)
+		}
+		cfgMu.Lock()
+		cfg = next
+		cfgMu.Unlock()
+		logger.Info(ctx, "Configuration reloaded", map[string]interface{}{
+			"log_level": next.LogLevel,
+		})
+		return nil
 	}
 }
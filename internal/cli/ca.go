@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"context"
+	"time"
+
+	"gotunnel-pro/internal/crypto"
+	"gotunnel-pro/internal/logging"
+)
+
+// WarnCAExpiry logs a warning for each CA certificate in caFile that has
+// expired or expires soon, so PKI rot is surfaced at startup. The nearest
+// expiry is exported as a metric by crypto.CheckCAExpiry.
+func WarnCAExpiry(ctx context.Context, logger *logging.Logger, caFile string) {
+	caExpiries, err := crypto.CheckCAExpiry(caFile, crypto.DefaultCAExpiryWarning)
+	if err != nil {
+		logger.Warn(ctx, "Failed to inspect CA certificates", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	for _, ca := range caExpiries {
+		logger.Warn(ctx, "CA certificate expired or expiring soon", map[string]interface{}{
+			"subject":   ca.Subject,
+			"not_after": ca.NotAfter.UTC().Format(time.RFC3339),
+			"expired":   ca.Expired,
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// caCertificatePEM returns a self-signed CA certificate named cn that
+// expires at notAfter, PEM-encoded
+func caCertificatePEM(t *testing.T, cn string, notAfter time.Time) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestWarnCAExpiry(t *testing.T) {
+	expiredAt := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	bundle := append(
+		caCertificatePEM(t, "valid-root", time.Now().Add(365*24*time.Hour)),
+		caCertificatePEM(t, "expired-root", expiredAt)...,
+	)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, bundle, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	logger := logging.NewLogger("test", "test", logging.INFO)
+	logger.SetOutput(&out)
+	defer logger.Close()
+
+	WarnCAExpiry(context.Background(), logger, caFile)
+
+	logged := out.String()
+	if !strings.Contains(logged, "CA certificate expired or expiring soon") || !strings.Contains(logged, "CN=expired-root") {
+		t.Errorf("log = %q, want a warning naming the expired root", logged)
+	}
+	if strings.Contains(logged, "valid-root") {
+		t.Errorf("log = %q, want no warning for the valid root", logged)
+	}
+
+	// The metric tracks the nearest expiry across the whole bundle
+	var m dto.Metric
+	if err := metrics.Default.CAExpiry.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.GetGauge().GetValue(), float64(expiredAt.Unix()); got != want {
+		t.Errorf("CA expiry metric = %v, want %v", got, want)
+	}
+}
+
+func TestWarnCAExpiryUnreadableBundle(t *testing.T) {
+	var out bytes.Buffer
+	logger := logging.NewLogger("test", "test", logging.INFO)
+	logger.SetOutput(&out)
+	defer logger.Close()
+
+	WarnCAExpiry(context.Background(), logger, filepath.Join(t.TempDir(), "missing.pem"))
+
+	if !strings.Contains(out.String(), "Failed to inspect CA certificates") {
+		t.Errorf("log = %q, want an inspection failure warning", out.String())
+	}
+}
@@ -0,0 +1,189 @@
+// Package cli holds the startup plumbing shared by the server and client
+// binaries, configured from GOTUNNEL_* and OTEL_* environment variables
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/tracing"
+)
+
+// SetupSyslog switches logging to syslog when GOTUNNEL_LOG_SYSLOG is set,
+// e.g. to "local" or "udp://logs:514". If the daemon can't be reached the
+// logger keeps writing to stdout.
+func SetupSyslog(ctx context.Context, logger *logging.Logger) {
+	target := os.Getenv("GOTUNNEL_LOG_SYSLOG")
+	if target == "" {
+		return
+	}
+	facility, err := logging.ParseFacility(os.Getenv("GOTUNNEL_LOG_SYSLOG_FACILITY"))
+	if err == nil {
+		err = logger.SetSyslogOutput(target, facility)
+	}
+	if err != nil {
+		logger.Warn(ctx, "Failed to set up syslog, logging to stdout", map[string]interface{}{
+			"target": target,
+			"error":  err.Error(),
+		})
+	}
+}
+
+// SetupAuditLogging sends audit entries to the file named by
+// GOTUNNEL_AUDIT_LOG. Audit entries keep PII that log_privacy scrubs from
+// the operational log, so they are dropped when it is unset rather than
+// written to stdout, and a file that can't be opened is an error.
+func SetupAuditLogging(logger *logging.Logger) error {
+	path := os.Getenv("GOTUNNEL_AUDIT_LOG")
+	if path == "" {
+		return nil
+	}
+	return logger.SetAuditFile(path)
+}
+
+// SetupAsyncLogging buffers log writes when GOTUNNEL_LOG_ASYNC_BUFFER is set
+// to a number of entries, so a slow log sink can't stall the data path.
+// GOTUNNEL_LOG_ASYNC_OVERFLOW picks what happens when the buffer is full:
+// block (default), drop_newest or drop_oldest. GOTUNNEL_LOG_ASYNC_MAX_AGE
+// bounds how long an entry may wait, and GOTUNNEL_LOG_ASYNC_STALE picks
+// whether older entries are flushed (default) or dropped.
+func SetupAsyncLogging(ctx context.Context, logger *logging.Logger) {
+	size := os.Getenv("GOTUNNEL_LOG_ASYNC_BUFFER")
+	if size == "" {
+		return
+	}
+	bufferSize, err := strconv.Atoi(size)
+	if err == nil && bufferSize <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	if err != nil {
+		logger.Warn(ctx, "Invalid GOTUNNEL_LOG_ASYNC_BUFFER, logging synchronously", map[string]interface{}{
+			"value": size,
+			"error": err.Error(),
+		})
+		return
+	}
+	overflow, err := logging.ParseOverflowPolicy(os.Getenv("GOTUNNEL_LOG_ASYNC_OVERFLOW"))
+	if err != nil {
+		logger.Warn(ctx, "Invalid GOTUNNEL_LOG_ASYNC_OVERFLOW, logging synchronously", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+	var maxAge time.Duration
+	if value := os.Getenv("GOTUNNEL_LOG_ASYNC_MAX_AGE"); value != "" {
+		maxAge, err = time.ParseDuration(value)
+		if err == nil && maxAge < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+		if err != nil {
+			logger.Warn(ctx, "Invalid GOTUNNEL_LOG_ASYNC_MAX_AGE, logging synchronously", map[string]interface{}{
+				"value": value,
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+	stale, err := logging.ParseStalePolicy(os.Getenv("GOTUNNEL_LOG_ASYNC_STALE"))
+	if err != nil {
+		logger.Warn(ctx, "Invalid GOTUNNEL_LOG_ASYNC_STALE, logging synchronously", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+	logger.SetAsync(logging.AsyncOptions{
+		BufferSize: bufferSize,
+		Overflow:   overflow,
+		MaxAge:     maxAge,
+		Stale:      stale,
+	})
+}
+
+// SetupLogSampling throttles repeated log entries when
+// GOTUNNEL_LOG_SAMPLE_TICK is set: per tick, the first
+// GOTUNNEL_LOG_SAMPLE_FIRST entries of each level and message are written,
+// then every GOTUNNEL_LOG_SAMPLE_THEREAFTER-th (both default to 100)
+func SetupLogSampling(ctx context.Context, logger *logging.Logger) {
+	value := os.Getenv("GOTUNNEL_LOG_SAMPLE_TICK")
+	if value == "" {
+		return
+	}
+	tick, err := time.ParseDuration(value)
+	if err == nil && tick <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	if err != nil {
+		logger.Warn(ctx, "Invalid GOTUNNEL_LOG_SAMPLE_TICK, not sampling logs", map[string]interface{}{
+			"value": value,
+			"error": err.Error(),
+		})
+		return
+	}
+	counts := map[string]int{"GOTUNNEL_LOG_SAMPLE_FIRST": 100, "GOTUNNEL_LOG_SAMPLE_THEREAFTER": 100}
+	for name := range counts {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err == nil && n < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+		if err != nil {
+			logger.Warn(ctx, "Invalid "+name+", not sampling logs", map[string]interface{}{
+				"value": value,
+				"error": err.Error(),
+			})
+			return
+		}
+		counts[name] = n
+	}
+	logger.SetSampler(logging.NewTickSampler(tick, counts["GOTUNNEL_LOG_SAMPLE_FIRST"], counts["GOTUNNEL_LOG_SAMPLE_THEREAFTER"]))
+}
+
+// SetupTracing exports spans to the OTLP/HTTP collector named by
+// OTEL_EXPORTER_OTLP_ENDPOINT, with OTEL_EXPORTER_OTLP_HEADERS added to
+// each request. Without an endpoint tracing stays off. The returned
+// function flushes pending spans.
+func SetupTracing(ctx context.Context, logger *logging.Logger, serviceName string) func(context.Context) error {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return func(context.Context) error { return nil }
+	}
+	headers, err := tracing.ParseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		logger.Warn(ctx, "Invalid OTEL_EXPORTER_OTLP_HEADERS, tracing disabled", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return func(context.Context) error { return nil }
+	}
+	logger.Info(ctx, "Exporting traces", map[string]interface{}{
+		"endpoint": endpoint,
+	})
+	return tracing.SetExporter(tracing.NewOTLPExporter(endpoint, serviceName, headers), logger)
+}
+
+// SetLogPrivacy applies a config's log_privacy mode to fields, or to
+// logging.DefaultPIIFields when fields is empty. The mode must have been
+// validated; an unknown one turns privacy off.
+func SetLogPrivacy(logger *logging.Logger, mode string, fields []string) {
+	privacy, _ := logging.ParsePrivacyMode(mode)
+	if len(fields) == 0 {
+		fields = logging.DefaultPIIFields
+	}
+	logger.SetPrivacy(privacy, fields)
+}
+
+// ParseLogLevel parses a config log level, falling back to info for an
+// empty or unknown one
+func ParseLogLevel(level string) logging.Level {
+	parsed, err := logging.ParseLevel(level)
+	if err != nil {
+		return logging.INFO
+	}
+	return parsed
+}
@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotunnel-pro/internal/logging"
+)
+
+func TestSetupAuditLogging(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"unset drops audit entries", "", false},
+		{"file", filepath.Join(dir, "audit.log"), false},
+		{"unopenable file", filepath.Join(dir, "missing", "audit.log"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GOTUNNEL_AUDIT_LOG", tt.path)
+			var out bytes.Buffer
+			logger := logging.NewLogger("test", "test", logging.INFO)
+			logger.SetOutput(&out)
+			defer logger.Close()
+
+			err := SetupAuditLogging(logger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetupAuditLogging() error = %v, want error %v", err, tt.wantErr)
+			}
+			logger.Audit(context.Background(), "rejected client", map[string]interface{}{"identity": "mallory"})
+
+			// Audit entries keep PII, so they never reach the operational log
+			if strings.Contains(out.String(), "mallory") {
+				t.Errorf("operational log = %q, want no audit entry", out.String())
+			}
+			if tt.path != "" && !tt.wantErr {
+				data, err := os.ReadFile(tt.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(string(data), "mallory") {
+					t.Errorf("audit log = %q, want the audit entry", data)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// MetricsAuth guards next with the credentials in GOTUNNEL_METRICS_TOKEN or
+// GOTUNNEL_METRICS_USER/_PASSWORD, leaving it open when neither is set
+func MetricsAuth(next http.Handler) http.Handler {
+	return RequireMetricsAuth(
+		os.Getenv("GOTUNNEL_METRICS_TOKEN"),
+		os.Getenv("GOTUNNEL_METRICS_USER"),
+		os.Getenv("GOTUNNEL_METRICS_PASSWORD"),
+		next,
+	)
+}
+
+// RequireMetricsAuth guards the metrics handler with a bearer token, basic
+// auth, or both when both are configured. With neither it is left open.
+func RequireMetricsAuth(token, user, password string, next http.Handler) http.Handler {
+	if token == "" && user == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if user != "" {
+			givenUser, givenPassword, ok := r.BasicAuth()
+			userOK := subtle.ConstantTimeCompare([]byte(givenUser), []byte(user)) == 1
+			passwordOK := subtle.ConstantTimeCompare([]byte(givenPassword), []byte(password)) == 1
+			if ok && userOK && passwordOK {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"gotunnel-pro/internal/crypto"
+)
+
+// MTLSMaterial names the certificate, key and CA a binary loads at startup
+type MTLSMaterial struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// IsServer loads the material for the server side of the handshake
+	IsServer bool
+	Options  crypto.TLSOptions
+}
+
+// RunValidation loads the config at path with load, which validates it,
+// then loads the mTLS material it names without binding any ports. It
+// prints a report and returns the exit code, so CI can gate deploys on it.
+func RunValidation(path string, load func(path string) (MTLSMaterial, error)) int {
+	fmt.Printf("Validating %s\n", path)
+	material, err := load(path)
+	if !printCheck("config", err) {
+		fmt.Println("Validation failed")
+		return 1
+	}
+
+	tlsConfig, err := crypto.LoadMTLSConfig(
+		material.CertFile,
+		material.KeyFile,
+		material.CAFile,
+		material.IsServer,
+		material.Options,
+	)
+	ok := printCheck("mTLS material", err)
+	if err == nil {
+		printCertExpiry(tlsConfig)
+	}
+
+	if !ok {
+		fmt.Println("Validation failed")
+		return 1
+	}
+	fmt.Println("Validation passed")
+	return 0
+}
+
+// printCheck prints one line of the validation report, with the lines of
+// err indented below a failure, and reports whether the check passed
+func printCheck(name string, err error) bool {
+	if err == nil {
+		fmt.Printf("  %-15s ok\n", name+":")
+		return true
+	}
+	fmt.Printf("  %-15s FAIL\n", name+":")
+	for _, line := range strings.Split(err.Error(), "\n") {
+		fmt.Printf("    %s\n", line)
+	}
+	return false
+}
+
+// printCertExpiry adds the certificate expiry to the validation report,
+// flagging certificates close to expiry without failing validation
+func printCertExpiry(tlsConfig *tls.Config) {
+	notAfter, err := crypto.CheckCertExpiry(tlsConfig)
+	if err != nil {
+		return
+	}
+	remaining := time.Until(notAfter)
+	note := ""
+	if remaining < crypto.DefaultCertExpiryWarning {
+		note = " WARNING: expired or expiring soon"
+	}
+	fmt.Printf("  %-15s %s (%d days)%s\n", "cert expiry:", notAfter.UTC().Format(time.RFC3339), int(remaining.Hours()/24), note)
+}
@@ -0,0 +1,29 @@
+package cli
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunValidationFailsOnConfigOrMaterial(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	tests := []struct {
+		name string
+		load func(string) (MTLSMaterial, error)
+	}{
+		{"invalid config", func(string) (MTLSMaterial, error) {
+			return MTLSMaterial{}, errors.New("log_level: unknown log level \"loud\"")
+		}},
+		{"missing certificate", func(string) (MTLSMaterial, error) {
+			return MTLSMaterial{CertFile: missing, KeyFile: missing, CAFile: missing}, nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := RunValidation("config.yaml", tt.load); code != 1 {
+				t.Errorf("RunValidation() = %d, want 1", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+
+	"gotunnel-pro/internal/crypto"
+	"gotunnel-pro/internal/metrics"
+	"gotunnel-pro/internal/tunnel"
+)
+
+// DefaultMetricsAddr serves metrics and admin endpoints when the config
+// doesn't set server.metrics_addr
+const DefaultMetricsAddr = ":9090"
+
+// ServerConfig is the server's config file
+type ServerConfig struct {
+	Environment string                `yaml:"environment" json:"environment"`
+	LogLevel    string                `yaml:"log_level" json:"log_level"`
+	Server      ServerSettings        `yaml:"server" json:"server"`
+	TLS         crypto.TLSOptions     `yaml:"tls" json:"tls"`
+	Metrics     metrics.MetricsConfig `yaml:"metrics" json:"metrics"`
+	Mux         tunnel.MuxConfig      `yaml:"mux" json:"mux"`
+	// Destinations allowlists the backends client tunnels may reach.
+	// Empty denies every destination.
+	Destinations []tunnel.DestinationRule `yaml:"destinations" json:"destinations"`
+	Tunnels      []TunnelPolicy           `yaml:"tunnels" json:"tunnels"`
+	// Identities are the identity gate's lists of client identities, as
+	// read by tls.identity_source
+	Identities IdentityLists `yaml:"identities" json:"identities"`
+	// LogMaxFields caps the fields logged per entry, dropping the rest and
+	// counting them in fields_truncated. Zero is unlimited.
+	LogMaxFields int `yaml:"log_max_fields" json:"log_max_fields"`
+	// LogPrivacy is off (the default), hash, omit or redact, applied to
+	// the LogPrivacyFields of operational log entries
+	LogPrivacy string `yaml:"log_privacy" json:"log_privacy"`
+	// LogPrivacyFields are the PII field names LogPrivacy applies to.
+	// Empty uses logging.DefaultPIIFields.
+	LogPrivacyFields []string `yaml:"log_privacy_fields" json:"log_privacy_fields"`
+}
+
+// IdentityLists admit or reject clients by identity after the handshake.
+// Deny wins over Allow, and an empty Allow admits every identity that isn't
+// denied.
+type IdentityLists struct {
+	Allow []string `yaml:"allow" json:"allow,omitempty"`
+	Deny  []string `yaml:"deny" json:"deny,omitempty"`
+}
+
+// TunnelPolicy holds the server's settings for a tunnel announced by
+// clients, matched by name
+type TunnelPolicy struct {
+	Name string `yaml:"name" json:"name"`
+	// Priority is low, normal (the default) or high
+	Priority string `yaml:"priority" json:"priority"`
+	// MaxConns caps the tunnel's concurrent connections across all
+	// clients. 0 is unlimited.
+	MaxConns int `yaml:"max_conns" json:"max_conns"`
+	// Listen is the address the server listens on when a client serves
+	// the tunnel as a reverse tunnel. Empty rejects it as a reverse tunnel.
+	Listen string `yaml:"listen" json:"listen"`
+	// Client is the only identity allowed to serve the reverse tunnel.
+	// Empty allows any admitted client.
+	Client string `yaml:"client" json:"client"`
+	// HTTPHeaders sets X-Forwarded-For, X-Tunnel-Client and X-Tunnel-Name
+	// on the HTTP/1.x requests of the forward tunnel, replacing any the
+	// client sent
+	HTTPHeaders bool `yaml:"http_headers" json:"http_headers"`
+	// ProxyProtocol sends a PROXY protocol v2 header with the original
+	// client address when connecting to the forward tunnel's backend
+	ProxyProtocol bool `yaml:"proxy_protocol" json:"proxy_protocol"`
+}
+
+// TunnelPriorities returns the admission priority of each tunnel with a
+// policy. The config must have been validated.
+func (c *ServerConfig) TunnelPriorities() map[string]tunnel.Priority {
+	priorities := make(map[string]tunnel.Priority, len(c.Tunnels))
+	for _, policy := range c.Tunnels {
+		priorities[policy.Name], _ = tunnel.ParsePriority(policy.Priority)
+	}
+	return priorities
+}
+
+// ReverseTunnels returns the reverse binding of each tunnel with a listen
+// address
+func (c *ServerConfig) ReverseTunnels() map[string]tunnel.ReverseBinding {
+	bindings := make(map[string]tunnel.ReverseBinding)
+	for _, policy := range c.Tunnels {
+		if policy.Listen != "" {
+			bindings[policy.Name] = tunnel.ReverseBinding{Listen: policy.Listen, Client: policy.Client}
+		}
+	}
+	return bindings
+}
+
+// TunnelBackends returns the backend options of each tunnel with a policy
+func (c *ServerConfig) TunnelBackends() map[string]tunnel.BackendOptions {
+	backends := make(map[string]tunnel.BackendOptions, len(c.Tunnels))
+	for _, policy := range c.Tunnels {
+		backends[policy.Name] = tunnel.BackendOptions{
+			HTTPHeaders:   policy.HTTPHeaders,
+			ProxyProtocol: policy.ProxyProtocol,
+		}
+	}
+	return backends
+}
+
+// TunnelNames returns the names of the tunnels with a policy, which get
+// their own tunnel label on metrics
+func (c *ServerConfig) TunnelNames() []string {
+	names := make([]string, 0, len(c.Tunnels))
+	for _, policy := range c.Tunnels {
+		names = append(names, policy.Name)
+	}
+	return names
+}
+
+// TunnelMaxConns returns the connection limit of each tunnel with a policy
+func (c *ServerConfig) TunnelMaxConns() map[string]int {
+	limits := make(map[string]int, len(c.Tunnels))
+	for _, policy := range c.Tunnels {
+		limits[policy.Name] = policy.MaxConns
+	}
+	return limits
+}
+
+// ServerSettings holds the server's listen addresses and certificate paths
+type ServerSettings struct {
+	ListenAddr  string `yaml:"listen_addr" json:"listen_addr"`
+	MetricsAddr string `yaml:"metrics_addr" json:"metrics_addr"`
+	HealthAddr  string `yaml:"health_addr" json:"health_addr,omitempty"`
+	CertFile    string `yaml:"cert_file" json:"cert_file"`
+	KeyFile     string `yaml:"key_file" json:"key_file"`
+	CAFile      string `yaml:"ca_file" json:"ca_file"`
+}
+
+// ClientConfig is the client's config file
+type ClientConfig struct {
+	Environment string                 `yaml:"environment" json:"environment"`
+	LogLevel    string                 `yaml:"log_level" json:"log_level"`
+	Server      ServerEndpoint         `yaml:"server" json:"server"`
+	Client      ClientSettings         `yaml:"client" json:"client"`
+	TLS         crypto.TLSOptions      `yaml:"tls" json:"tls"`
+	Reconnect   tunnel.ReconnectConfig `yaml:"reconnect" json:"reconnect"`
+	Mux         tunnel.MuxConfig       `yaml:"mux" json:"mux"`
+	Tunnels     []tunnel.TunnelSpec    `yaml:"tunnels" json:"tunnels"`
+	// Keepalive is how often an idle session pings the server, to keep NAT
+	// mappings open and the server's read timeout from expiring. Zero uses
+	// tunnel.DefaultKeepaliveInterval.
+	Keepalive time.Duration `yaml:"keepalive" json:"keepalive"`
+	// LogMaxFields caps the fields logged per entry, dropping the rest and
+	// counting them in fields_truncated. Zero is unlimited.
+	LogMaxFields int `yaml:"log_max_fields" json:"log_max_fields"`
+	// LogPrivacy is off (the default), hash, omit or redact, applied to
+	// the LogPrivacyFields of operational log entries
+	LogPrivacy string `yaml:"log_privacy" json:"log_privacy"`
+	// LogPrivacyFields are the PII field names LogPrivacy applies to.
+	// Empty uses logging.DefaultPIIFields.
+	LogPrivacyFields []string `yaml:"log_privacy_fields" json:"log_privacy_fields"`
+}
+
+// IgnoredSettings returns the settings the config sets that are accepted
+// for compatibility but have no effect, so they can be warned about
+func (c *ClientConfig) IgnoredSettings() []string {
+	var ignored []string
+	if c.Reconnect.MaxConcurrent != 0 {
+		ignored = append(ignored, "reconnect.max_concurrent")
+	}
+	return ignored
+}
+
+// ServerEndpoint is the server a client connects to
+type ServerEndpoint struct {
+	Address string `yaml:"address" json:"address"`
+}
+
+// ClientSettings holds the client's certificate paths
+type ClientSettings struct {
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+	CAFile   string `yaml:"ca_file" json:"ca_file"`
+}
+
+// LoadServerConfig reads the server config at path, applies GOTUNNEL_*
+// environment overrides and validates the result
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	cfg := &ServerConfig{}
+	if err := readYAML(path, cfg); err != nil {
+		return nil, err
+	}
+	applyEnvOverrides(map[string]*string{
+		"GOTUNNEL_ENVIRONMENT":         &cfg.Environment,
+		"GOTUNNEL_LOG_LEVEL":           &cfg.LogLevel,
+		"GOTUNNEL_LOG_PRIVACY":         &cfg.LogPrivacy,
+		"GOTUNNEL_SERVER_LISTEN_ADDR":  &cfg.Server.ListenAddr,
+		"GOTUNNEL_SERVER_METRICS_ADDR": &cfg.Server.MetricsAddr,
+		"GOTUNNEL_SERVER_HEALTH_ADDR":  &cfg.Server.HealthAddr,
+		"GOTUNNEL_SERVER_CERT_FILE":    &cfg.Server.CertFile,
+		"GOTUNNEL_SERVER_KEY_FILE":     &cfg.Server.KeyFile,
+		"GOTUNNEL_SERVER_CA_FILE":      &cfg.Server.CAFile,
+		"GOTUNNEL_TLS_IDENTITY_SOURCE": &cfg.TLS.IdentitySource,
+	})
+	applyEnvListOverride("GOTUNNEL_LOG_PRIVACY_FIELDS", &cfg.LogPrivacyFields)
+	if cfg.Server.MetricsAddr == "" {
+		cfg.Server.MetricsAddr = DefaultMetricsAddr
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// LoadClientConfig reads the client config at path, applies GOTUNNEL_*
+// environment overrides and validates the result
+func LoadClientConfig(path string) (*ClientConfig, error) {
+	cfg := &ClientConfig{}
+	if err := readYAML(path, cfg); err != nil {
+		return nil, err
+	}
+	applyEnvOverrides(map[string]*string{
+		"GOTUNNEL_ENVIRONMENT":      &cfg.Environment,
+		"GOTUNNEL_LOG_LEVEL":        &cfg.LogLevel,
+		"GOTUNNEL_LOG_PRIVACY":      &cfg.LogPrivacy,
+		"GOTUNNEL_SERVER_ADDRESS":   &cfg.Server.Address,
+		"GOTUNNEL_CLIENT_CERT_FILE": &cfg.Client.CertFile,
+		"GOTUNNEL_CLIENT_KEY_FILE":  &cfg.Client.KeyFile,
+		"GOTUNNEL_CLIENT_CA_FILE":   &cfg.Client.CAFile,
+	})
+	applyEnvListOverride("GOTUNNEL_LOG_PRIVACY_FIELDS", &cfg.LogPrivacyFields)
+	if cfg.Reconnect == (tunnel.ReconnectConfig{}) {
+		cfg.Reconnect = tunnel.DefaultReconnectConfig()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return cfg, nil
+}
+
+func readYAML(path string, out interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, out); err != nil {
+		return fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnvOverrides sets each field from the environment variable named
+// after its YAML path, e.g. GOTUNNEL_SERVER_LISTEN_ADDR for
+// server.listen_addr. Precedence is env > file > defaults.
+func applyEnvOverrides(overrides map[string]*string) {
+	for name, field := range overrides {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = value
+		}
+	}
+}
+
+// applyEnvListOverride sets a list field from a comma-separated environment
+// variable, e.g. GOTUNNEL_LOG_PRIVACY_FIELDS=remote_addr,identity
+func applyEnvListOverride(name string, field *[]string) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return
+	}
+	*field = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*field = append(*field, item)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFiles creates empty files named names in dir
+func writeFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeConfig writes content to a config file in a directory that also
+// holds the certificate files it references, and returns the file's path.
+// DIR in content is replaced by the directory.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeFiles(t, dir, "cert.pem", "key.pem", "ca.pem", "env-cert.pem", "env-key.pem", "env-ca.pem")
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(strings.ReplaceAll(content, "DIR", dir)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const serverYAML = `
+environment: production
+log_level: info
+server:
+  listen_addr: ":8443"
+  metrics_addr: ":9090"
+  health_addr: ":9091"
+  cert_file: DIR/cert.pem
+  key_file: DIR/key.pem
+  ca_file: DIR/ca.pem
+`
+
+const clientYAML = `
+environment: production
+log_level: info
+server:
+  address: tunnel.example.com:8443
+client:
+  cert_file: DIR/cert.pem
+  key_file: DIR/key.pem
+  ca_file: DIR/ca.pem
+`
+
+func TestLoadServerConfigEnvOverrides(t *testing.T) {
+	path := writeConfig(t, serverYAML)
+	dir := filepath.Dir(path)
+
+	tests := []struct {
+		env   string
+		value string
+		field func(*ServerConfig) string
+	}{
+		{"GOTUNNEL_ENVIRONMENT", "staging", func(c *ServerConfig) string { return c.Environment }},
+		{"GOTUNNEL_LOG_LEVEL", "debug", func(c *ServerConfig) string { return c.LogLevel }},
+		{"GOTUNNEL_LOG_PRIVACY", "hash", func(c *ServerConfig) string { return c.LogPrivacy }},
+		{"GOTUNNEL_LOG_PRIVACY_FIELDS", "identity,remote_addr", func(c *ServerConfig) string { return strings.Join(c.LogPrivacyFields, ",") }},
+		{"GOTUNNEL_SERVER_LISTEN_ADDR", ":9443", func(c *ServerConfig) string { return c.Server.ListenAddr }},
+		{"GOTUNNEL_TLS_IDENTITY_SOURCE", "uri", func(c *ServerConfig) string { return c.TLS.IdentitySource }},
+		{"GOTUNNEL_SERVER_METRICS_ADDR", "127.0.0.1:9100", func(c *ServerConfig) string { return c.Server.MetricsAddr }},
+		{"GOTUNNEL_SERVER_HEALTH_ADDR", ":9101", func(c *ServerConfig) string { return c.Server.HealthAddr }},
+		{"GOTUNNEL_SERVER_CERT_FILE", filepath.Join(dir, "env-cert.pem"), func(c *ServerConfig) string { return c.Server.CertFile }},
+		{"GOTUNNEL_SERVER_KEY_FILE", filepath.Join(dir, "env-key.pem"), func(c *ServerConfig) string { return c.Server.KeyFile }},
+		{"GOTUNNEL_SERVER_CA_FILE", filepath.Join(dir, "env-ca.pem"), func(c *ServerConfig) string { return c.Server.CAFile }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			cfg, err := LoadServerConfig(path)
+			if err != nil {
+				t.Fatalf("LoadServerConfig: %v", err)
+			}
+			if got := tt.field(cfg); got != tt.value {
+				t.Errorf("%s: got %q, want %q", tt.env, got, tt.value)
+			}
+		})
+	}
+}
+
+func TestLoadClientConfigEnvOverrides(t *testing.T) {
+	path := writeConfig(t, clientYAML)
+	dir := filepath.Dir(path)
+
+	tests := []struct {
+		env   string
+		value string
+		field func(*ClientConfig) string
+	}{
+		{"GOTUNNEL_ENVIRONMENT", "staging", func(c *ClientConfig) string { return c.Environment }},
+		{"GOTUNNEL_LOG_LEVEL", "debug", func(c *ClientConfig) string { return c.LogLevel }},
+		{"GOTUNNEL_LOG_PRIVACY", "redact", func(c *ClientConfig) string { return c.LogPrivacy }},
+		{"GOTUNNEL_SERVER_ADDRESS", "other.example.com:443", func(c *ClientConfig) string { return c.Server.Address }},
+		{"GOTUNNEL_CLIENT_CERT_FILE", filepath.Join(dir, "env-cert.pem"), func(c *ClientConfig) string { return c.Client.CertFile }},
+		{"GOTUNNEL_CLIENT_KEY_FILE", filepath.Join(dir, "env-key.pem"), func(c *ClientConfig) string { return c.Client.KeyFile }},
+		{"GOTUNNEL_CLIENT_CA_FILE", filepath.Join(dir, "env-ca.pem"), func(c *ClientConfig) string { return c.Client.CAFile }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			cfg, err := LoadClientConfig(path)
+			if err != nil {
+				t.Fatalf("LoadClientConfig: %v", err)
+			}
+			if got := tt.field(cfg); got != tt.value {
+				t.Errorf("%s: got %q, want %q", tt.env, got, tt.value)
+			}
+		})
+	}
+}
+
+func TestLoadServerConfigDefaults(t *testing.T) {
+	path := writeConfig(t, strings.Replace(serverYAML, "  metrics_addr: \":9090\"\n", "", 1))
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig: %v", err)
+	}
+	if cfg.Server.MetricsAddr != DefaultMetricsAddr {
+		t.Errorf("metrics_addr = %q, want %q", cfg.Server.MetricsAddr, DefaultMetricsAddr)
+	}
+}
+
+func TestServerConfigValidateReportsEveryProblem(t *testing.T) {
+	cfg := &ServerConfig{
+		LogLevel: "loud",
+		Server: ServerSettings{
+			ListenAddr:  "8443",
+			MetricsAddr: ":9090",
+			CertFile:    filepath.Join(t.TempDir(), "missing.pem"),
+		},
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate accepted an invalid config")
+	}
+	for _, want := range []string{"log_level", "server.listen_addr", "server.cert_file", "server.key_file is required", "server.ca_file is required"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadClientConfigRejectsInvalidReconnect(t *testing.T) {
+	path := writeConfig(t, clientYAML+`
+reconnect:
+  enabled: true
+  interval: -5s
+  backoff: 2.0
+`)
+	_, err := LoadClientConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "reconnect interval") {
+		t.Fatalf("LoadClientConfig error = %v, want a reconnect interval error", err)
+	}
+}
+
+func TestLoadClientConfigIgnoresReconnectMaxConcurrent(t *testing.T) {
+	path := writeConfig(t, clientYAML+`
+reconnect:
+  enabled: true
+  interval: 5s
+  backoff: 2.0
+  max_concurrent: 4
+`)
+	cfg, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("LoadClientConfig: %v", err)
+	}
+	if got := cfg.IgnoredSettings(); !slices.Equal(got, []string{"reconnect.max_concurrent"}) {
+		t.Errorf("IgnoredSettings() = %v, want [reconnect.max_concurrent]", got)
+	}
+
+	cfg, err = LoadClientConfig(writeConfig(t, clientYAML))
+	if err != nil {
+		t.Fatalf("LoadClientConfig: %v", err)
+	}
+	if got := cfg.IgnoredSettings(); len(got) != 0 {
+		t.Errorf("IgnoredSettings() = %v, want none", got)
+	}
+}
+
+func TestLoadConfigLogMaxFields(t *testing.T) {
+	cfg, err := LoadClientConfig(writeConfig(t, clientYAML+"log_max_fields: 12\n"))
+	if err != nil {
+		t.Fatalf("LoadClientConfig: %v", err)
+	}
+	if cfg.LogMaxFields != 12 {
+		t.Errorf("log_max_fields = %d, want 12", cfg.LogMaxFields)
+	}
+
+	_, err = LoadServerConfig(writeConfig(t, serverYAML+"log_max_fields: -1\n"))
+	if err == nil || !strings.Contains(err.Error(), "log_max_fields must not be negative") {
+		t.Errorf("LoadServerConfig error = %v, want a log_max_fields error", err)
+	}
+}
+
+func TestLoadConfigLogPrivacy(t *testing.T) {
+	cfg, err := LoadServerConfig(writeConfig(t, serverYAML+"log_privacy: redact\nlog_privacy_fields: [identity]\n"))
+	if err != nil {
+		t.Fatalf("LoadServerConfig: %v", err)
+	}
+	if cfg.LogPrivacy != "redact" || len(cfg.LogPrivacyFields) != 1 || cfg.LogPrivacyFields[0] != "identity" {
+		t.Errorf("log_privacy = %q %v, want redact [identity]", cfg.LogPrivacy, cfg.LogPrivacyFields)
+	}
+
+	_, err = LoadClientConfig(writeConfig(t, clientYAML+"log_privacy: scramble\n"))
+	if err == nil || !strings.Contains(err.Error(), `log_privacy: unknown privacy mode "scramble"`) {
+		t.Errorf("LoadClientConfig error = %v, want a log_privacy error", err)
+	}
+}
+
+func TestLoadClientConfigKeepalive(t *testing.T) {
+	cfg, err := LoadClientConfig(writeConfig(t, clientYAML+"keepalive: 10s\n"))
+	if err != nil {
+		t.Fatalf("LoadClientConfig: %v", err)
+	}
+	if cfg.Keepalive != 10*time.Second {
+		t.Errorf("keepalive = %s, want 10s", cfg.Keepalive)
+	}
+
+	_, err = LoadClientConfig(writeConfig(t, clientYAML+"keepalive: -1s\n"))
+	if err == nil || !strings.Contains(err.Error(), "keepalive must not be negative") {
+		t.Errorf("LoadClientConfig error = %v, want a keepalive error", err)
+	}
+}
+
+func TestLoadServerConfigDurationBuckets(t *testing.T) {
+	path := writeConfig(t, serverYAML+`
+metrics:
+  duration_buckets: [0.1, 0.5, 2]
+`)
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig: %v", err)
+	}
+	want := []float64{0.1, 0.5, 2}
+	if len(cfg.Metrics.DurationBuckets) != len(want) {
+		t.Fatalf("duration_buckets = %v, want %v", cfg.Metrics.DurationBuckets, want)
+	}
+	for i := range want {
+		if cfg.Metrics.DurationBuckets[i] != want[i] {
+			t.Fatalf("duration_buckets = %v, want %v", cfg.Metrics.DurationBuckets, want)
+		}
+	}
+}
+
+func TestLoadServerConfigRejectsRepeatedBucket(t *testing.T) {
+	path := writeConfig(t, serverYAML+`
+metrics:
+  duration_buckets: [0.1, 0.5, 0.5, 2]
+`)
+	_, err := LoadServerConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "strictly increasing") {
+		t.Fatalf("LoadServerConfig error = %v, want a duration_buckets error", err)
+	}
+}
+
+func TestLoadServerConfigReverseTunnels(t *testing.T) {
+	path := writeConfig(t, serverYAML+`
+tunnels:
+  - name: ssh
+    listen: 0.0.0.0:2222
+    client: edge-1
+  - name: web
+    priority: high
+`)
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig: %v", err)
+	}
+	bindings := cfg.ReverseTunnels()
+	if len(bindings) != 1 || bindings["ssh"].Listen != "0.0.0.0:2222" || bindings["ssh"].Client != "edge-1" {
+		t.Errorf("ReverseTunnels() = %+v, want only ssh on 0.0.0.0:2222 for edge-1", bindings)
+	}
+}
+
+func TestLoadServerConfigIdentitySource(t *testing.T) {
+	cfg, err := LoadServerConfig(writeConfig(t, serverYAML+"tls:\n  identity_source: uri,cn\n"))
+	if err != nil {
+		t.Fatalf("LoadServerConfig: %v", err)
+	}
+	if cfg.TLS.IdentitySource != "uri,cn" {
+		t.Errorf("identity_source = %q, want uri,cn", cfg.TLS.IdentitySource)
+	}
+
+	_, err = LoadServerConfig(writeConfig(t, serverYAML+"tls:\n  identity_source: serial\n"))
+	if err == nil || !strings.Contains(err.Error(), "tls.identity_source") {
+		t.Fatalf("LoadServerConfig error = %v, want a tls.identity_source error", err)
+	}
+}
+
+func TestLoadServerConfigIdentities(t *testing.T) {
+	cfg, err := LoadServerConfig(writeConfig(t, serverYAML+"identities:\n  allow: [edge-1, edge-2]\n  deny: [edge-2]\n"))
+	if err != nil {
+		t.Fatalf("LoadServerConfig: %v", err)
+	}
+	if !slices.Equal(cfg.Identities.Allow, []string{"edge-1", "edge-2"}) || !slices.Equal(cfg.Identities.Deny, []string{"edge-2"}) {
+		t.Errorf("identities = %+v, want allow [edge-1 edge-2] and deny [edge-2]", cfg.Identities)
+	}
+
+	_, err = LoadServerConfig(writeConfig(t, serverYAML+"identities:\n  deny: [\"\"]\n"))
+	if err == nil || !strings.Contains(err.Error(), "identities") {
+		t.Fatalf("LoadServerConfig error = %v, want an identities error", err)
+	}
+}
+
+func TestLoadServerConfigTunnelBackends(t *testing.T) {
+	path := writeConfig(t, serverYAML+`
+tunnels:
+  - name: web
+    http_headers: true
+  - name: db
+    proxy_protocol: true
+`)
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig: %v", err)
+	}
+	backends := cfg.TunnelBackends()
+	if !backends["web"].HTTPHeaders || backends["web"].ProxyProtocol {
+		t.Errorf("TunnelBackends()[web] = %+v, want http_headers only", backends["web"])
+	}
+	if backends["db"].HTTPHeaders || !backends["db"].ProxyProtocol {
+		t.Errorf("TunnelBackends()[db] = %+v, want proxy_protocol only", backends["db"])
+	}
+}
+
+func TestLoadServerConfigRejectsHTTPHeadersOnReverseTunnel(t *testing.T) {
+	path := writeConfig(t, serverYAML+`
+tunnels:
+  - name: ssh
+    listen: 0.0.0.0:2222
+    http_headers: true
+`)
+	_, err := LoadServerConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "http_headers requires a forward tunnel") {
+		t.Fatalf("LoadServerConfig error = %v, want an http_headers error", err)
+	}
+}
+
+func TestLoadServerConfigRejectsReverseClientWithoutListen(t *testing.T) {
+	path := writeConfig(t, serverYAML+`
+tunnels:
+  - name: ssh
+    client: edge-1
+`)
+	_, err := LoadServerConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "client requires listen") {
+		t.Fatalf("LoadServerConfig error = %v, want a listen error", err)
+	}
+}
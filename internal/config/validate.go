@@ -0,0 +1,151 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"gotunnel-pro/internal/crypto"
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/tunnel"
+)
+
+// Validate checks the config up front and reports every problem at once,
+// rather than failing on the first one deep inside TLS setup
+func (c *ServerConfig) Validate() error {
+	errs := []error{
+		validateLogLevel(c.LogLevel),
+		validateLogMaxFields(c.LogMaxFields),
+		validateLogPrivacy(c.LogPrivacy),
+		validateAddr("server.listen_addr", c.Server.ListenAddr),
+		validateFile("server.cert_file", c.Server.CertFile),
+		validateFile("server.key_file", c.Server.KeyFile),
+		validateFile("server.ca_file", c.Server.CAFile),
+		validateAddr("server.metrics_addr", c.Server.MetricsAddr),
+		c.Metrics.Validate(),
+		validateIdentitySource(c.TLS.IdentitySource),
+	}
+	if _, err := tunnel.NewDestinationPolicy(c.Destinations, nil); err != nil {
+		errs = append(errs, fmt.Errorf("destinations: %w", err))
+	}
+	names := make(map[string]struct{}, len(c.Tunnels))
+	for i, policy := range c.Tunnels {
+		if policy.Name == "" {
+			errs = append(errs, fmt.Errorf("tunnels[%d]: name is required", i))
+		} else if _, ok := names[policy.Name]; ok {
+			errs = append(errs, fmt.Errorf("tunnels[%d]: duplicate tunnel name %q", i, policy.Name))
+		}
+		names[policy.Name] = struct{}{}
+		if _, err := tunnel.ParsePriority(policy.Priority); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %q: %w", policy.Name, err))
+		}
+		if policy.MaxConns < 0 {
+			errs = append(errs, fmt.Errorf("tunnel %q: max_conns must not be negative", policy.Name))
+		}
+		if policy.Listen != "" {
+			errs = append(errs, validateAddr(fmt.Sprintf("tunnel %q: listen", policy.Name), policy.Listen))
+		} else if policy.Client != "" {
+			errs = append(errs, fmt.Errorf("tunnel %q: client requires listen", policy.Name))
+		}
+		if policy.HTTPHeaders && policy.Listen != "" {
+			errs = append(errs, fmt.Errorf("tunnel %q: http_headers requires a forward tunnel", policy.Name))
+		}
+		if policy.ProxyProtocol && policy.Listen != "" {
+			errs = append(errs, fmt.Errorf("tunnel %q: proxy_protocol requires a forward tunnel", policy.Name))
+		}
+	}
+	if c.Server.HealthAddr != "" {
+		errs = append(errs, validateAddr("server.health_addr", c.Server.HealthAddr))
+	}
+	if slices.Contains(c.Identities.Allow, "") || slices.Contains(c.Identities.Deny, "") {
+		errs = append(errs, fmt.Errorf("identities: allow and deny entries must not be empty"))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks the config up front and reports every problem at once.
+// It also defaults each tunnel's protocol to TCP.
+func (c *ClientConfig) Validate() error {
+	return errors.Join(
+		validateLogLevel(c.LogLevel),
+		validateLogMaxFields(c.LogMaxFields),
+		validateLogPrivacy(c.LogPrivacy),
+		validateAddr("server.address", c.Server.Address),
+		validateFile("client.cert_file", c.Client.CertFile),
+		validateFile("client.key_file", c.Client.KeyFile),
+		validateFile("client.ca_file", c.Client.CAFile),
+		c.Reconnect.Validate(),
+		tunnel.ValidateTunnelSpecs(c.Tunnels),
+		validateKeepalive(c.Keepalive),
+	)
+}
+
+// validateIdentitySource checks that source only names known certificate
+// fields
+func validateIdentitySource(source string) error {
+	if _, err := crypto.ParseIdentityExtractor(source); err != nil {
+		return fmt.Errorf("tls.identity_source: %w", err)
+	}
+	return nil
+}
+
+// validateKeepalive checks that interval is not negative
+func validateKeepalive(interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("keepalive must not be negative, got %s", interval)
+	}
+	return nil
+}
+
+// validateAddr checks that addr is a host:port pair
+func validateAddr(field, addr string) error {
+	if addr == "" {
+		return fmt.Errorf("%s is required", field)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%s %q is not a valid host:port: %w", field, addr, err)
+	}
+	return nil
+}
+
+// validateFile checks that path is set and readable
+func validateFile(field, path string) error {
+	if path == "" {
+		return fmt.Errorf("%s is required", field)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	return f.Close()
+}
+
+// validateLogMaxFields checks that max is not negative
+func validateLogMaxFields(max int) error {
+	if max < 0 {
+		return fmt.Errorf("log_max_fields must not be negative, got %d", max)
+	}
+	return nil
+}
+
+// validateLogPrivacy checks that mode is empty or a known privacy mode
+func validateLogPrivacy(mode string) error {
+	if _, err := logging.ParsePrivacyMode(mode); err != nil {
+		return fmt.Errorf("log_privacy: %w", err)
+	}
+	return nil
+}
+
+// validateLogLevel checks that level is empty or a known level
+func validateLogLevel(level string) error {
+	if level == "" {
+		return nil
+	}
+	if _, err := logging.ParseLevel(level); err != nil {
+		return fmt.Errorf("log_level: %w", err)
+	}
+	return nil
+}
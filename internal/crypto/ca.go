@@ -0,0 +1,131 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+// DefaultCAExpiryWarning is how far ahead of expiry a CA certificate is reported
+const DefaultCAExpiryWarning = 30 * 24 * time.Hour
+
+// DefaultCertExpiryWarning is how far ahead of expiry the certificate
+// loaded at startup is reported
+const DefaultCertExpiryWarning = 30 * 24 * time.Hour
+
+// ReadCABundle reads the PEM CA certificates at path, which is either a
+// bundle file or a directory. For a directory every .pem and .crt file in
+// it is read, in name order, and concatenated; subdirectories are skipped.
+func ReadCABundle(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return os.ReadFile(path)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if !entry.IsDir() && (ext == ".pem" || ext == ".crt") {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no .pem or .crt files in CA directory %s", path)
+	}
+	sort.Strings(names)
+
+	var bundle []byte
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(path, name))
+		if err != nil {
+			return nil, err
+		}
+		bundle = append(bundle, data...)
+		bundle = append(bundle, '\n')
+	}
+	return bundle, nil
+}
+
+// CAExpiry describes a CA certificate that has expired or is about to
+type CAExpiry struct {
+	Subject  string
+	NotAfter time.Time
+	Expired  bool
+}
+
+// CheckCAExpiry inspects every certificate in the CA bundle and returns those
+// that have expired or expire within warnWithin, so PKI rot is surfaced at
+// startup rather than as confusing verification failures. The nearest expiry
+// across the bundle is recorded as a metric.
+func CheckCAExpiry(caFile string, warnWithin time.Duration) ([]CAExpiry, error) {
+	data, err := ReadCABundle(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificate: %w", err)
+	}
+
+	now := time.Now()
+	var nearest time.Time
+	var expiring []CAExpiry
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+		}
+
+		if nearest.IsZero() || cert.NotAfter.Before(nearest) {
+			nearest = cert.NotAfter
+		}
+		if cert.NotAfter.Sub(now) < warnWithin {
+			expiring = append(expiring, CAExpiry{
+				Subject:  cert.Subject.String(),
+				NotAfter: cert.NotAfter,
+				Expired:  now.After(cert.NotAfter),
+			})
+		}
+	}
+
+	if !nearest.IsZero() {
+		metrics.SetCAExpiry(float64(nearest.Unix()))
+	}
+	return expiring, nil
+}
+
+// CheckCertExpiry returns the expiry of the certificate in tlsConfig and
+// records it as a metric, so a certificate about to expire can be flagged
+// at startup
+func CheckCertExpiry(tlsConfig *tls.Config) (time.Time, error) {
+	if len(tlsConfig.Certificates) == 0 {
+		return time.Time{}, errors.New("no certificate configured")
+	}
+	leaf := leafOf(&tlsConfig.Certificates[0])
+	if leaf == nil {
+		return time.Time{}, errors.New("failed to parse certificate")
+	}
+	metrics.SetCertificateExpiry(float64(leaf.NotAfter.Unix()))
+	return leaf.NotAfter, nil
+}
@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+)
+
+// DescribeHandshakeError turns a TLS handshake error into a short,
+// actionable description of its cause, e.g. "unknown CA". The result is
+// drawn from a fixed set so it can be used as a rate-limiting key.
+func DescribeHandshakeError(err error) string {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalidCert      x509.CertificateInvalidError
+		hostname         x509.HostnameError
+		recordHeader     tls.RecordHeaderError
+	)
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &unknownAuthority):
+		return "peer certificate signed by unknown CA"
+	case errors.As(err, &invalidCert):
+		if invalidCert.Reason == x509.Expired {
+			return "peer certificate expired or not yet valid"
+		}
+		return "peer certificate invalid"
+	case errors.As(err, &hostname):
+		return "peer certificate does not match host name"
+	case errors.As(err, &recordHeader):
+		return "peer is not speaking TLS"
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "client didn't provide a certificate"),
+		strings.Contains(msg, "certificate required"):
+		return "client certificate required but not provided"
+	case strings.Contains(msg, "remote error: tls: unknown certificate authority"):
+		return "peer rejected our certificate: unknown CA"
+	case strings.Contains(msg, "remote error: tls: bad certificate"):
+		return "peer rejected our certificate"
+	case strings.Contains(msg, "remote error: tls: expired certificate"):
+		return "peer rejected our certificate as expired"
+	case strings.Contains(msg, "protocol version"),
+		strings.Contains(msg, "unsupported versions"):
+		return "no mutually supported TLS version"
+	case strings.Contains(msg, "no cipher suite supported"),
+		strings.Contains(msg, "handshake failure"):
+		return "no mutually supported cipher suite or parameters"
+	case strings.Contains(msg, "i/o timeout"):
+		return "handshake timed out"
+	case strings.Contains(msg, "connection reset"), strings.Contains(msg, "EOF"):
+		return "connection closed by peer during handshake"
+	default:
+		return "unclassified handshake error"
+	}
+}
@@ -0,0 +1,166 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IdentitySource names the certificate field a client identity is read from
+type IdentitySource string
+
+const (
+	IdentityCN    IdentitySource = "cn"
+	IdentityDNS   IdentitySource = "dns"
+	IdentityURI   IdentitySource = "uri"
+	IdentityEmail IdentitySource = "email"
+)
+
+// IdentityExtractor derives a client identity from a certificate. Sources
+// are tried in order and the first non-empty value wins, so "uri,cn" prefers
+// a URI SAN and falls back to the CN.
+type IdentityExtractor struct {
+	sources []IdentitySource
+}
+
+// DefaultIdentityExtractor uses the subject CN
+var DefaultIdentityExtractor = &IdentityExtractor{sources: []IdentitySource{IdentityCN}}
+
+// ParseIdentityExtractor parses a comma-separated list of identity sources.
+// An empty spec returns DefaultIdentityExtractor.
+func ParseIdentityExtractor(spec string) (*IdentityExtractor, error) {
+	if spec == "" {
+		return DefaultIdentityExtractor, nil
+	}
+
+	e := &IdentityExtractor{}
+	for _, name := range strings.Split(spec, ",") {
+		source := IdentitySource(strings.TrimSpace(name))
+		switch source {
+		case IdentityCN, IdentityDNS, IdentityURI, IdentityEmail:
+			e.sources = append(e.sources, source)
+		default:
+			return nil, fmt.Errorf("unknown identity source %q", name)
+		}
+	}
+	return e, nil
+}
+
+// Identity returns the identity of cert, or "" if no configured source has a value
+func (e *IdentityExtractor) Identity(cert *x509.Certificate) string {
+	for _, source := range e.sources {
+		switch source {
+		case IdentityCN:
+			if cert.Subject.CommonName != "" {
+				return cert.Subject.CommonName
+			}
+		case IdentityDNS:
+			if len(cert.DNSNames) > 0 {
+				return cert.DNSNames[0]
+			}
+		case IdentityURI:
+			if len(cert.URIs) > 0 {
+				return cert.URIs[0].String()
+			}
+		case IdentityEmail:
+			if len(cert.EmailAddresses) > 0 {
+				return cert.EmailAddresses[0]
+			}
+		}
+	}
+	return ""
+}
+
+// PeerIdentity returns the identity of the verified peer leaf certificate
+func (e *IdentityExtractor) PeerIdentity(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return e.Identity(state.PeerCertificates[0])
+}
+
+// IdentityGate admits or rejects peers by certificate identity after the
+// TLS handshake. Deny entries take precedence; an empty allow list admits
+// every identity that is not denied.
+type IdentityGate struct {
+	mu        sync.RWMutex
+	allow     map[string]struct{}
+	deny      map[string]struct{}
+	extractor *IdentityExtractor
+}
+
+// NewIdentityGate creates an identity gate from allow and deny lists of
+// identities as derived by extractor. A nil extractor uses the CN.
+func NewIdentityGate(allow, deny []string, extractor *IdentityExtractor) *IdentityGate {
+	if extractor == nil {
+		extractor = DefaultIdentityExtractor
+	}
+	g := &IdentityGate{extractor: extractor}
+	g.Update(allow, deny)
+	return g
+}
+
+// Update atomically replaces the allow and deny lists
+func (g *IdentityGate) Update(allow, deny []string) {
+	allowSet := toSet(allow)
+	denySet := toSet(deny)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.allow = allowSet
+	g.deny = denySet
+}
+
+// Lists returns the current allow and deny lists in sorted order
+func (g *IdentityGate) Lists() (allow, deny []string) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return fromSet(g.allow), fromSet(g.deny)
+}
+
+// Check returns an error if the verified peer certificate is not admitted
+func (g *IdentityGate) Check(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no peer certificate presented")
+	}
+	id := g.extractor.Identity(state.PeerCertificates[0])
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if _, ok := g.deny[id]; ok {
+		return fmt.Errorf("certificate identity %q is denied", id)
+	}
+	if len(g.allow) == 0 {
+		return nil
+	}
+	if _, ok := g.allow[id]; ok {
+		return nil
+	}
+	return fmt.Errorf("certificate identity %q is not allowed", id)
+}
+
+// Extractor returns the identity extractor used by the gate
+func (g *IdentityGate) Extractor() *IdentityExtractor {
+	return g.extractor
+}
+
+func toSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+func fromSet(set map[string]struct{}) []string {
+	values := make([]string, 0, len(set))
+	for v := range set {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
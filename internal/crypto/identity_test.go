@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+)
+
+// identityCert returns a certificate carrying every field identities are
+// read from
+func identityCert() *x509.Certificate {
+	return &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "edge-1"},
+		DNSNames:       []string{"edge-1.example.com", "edge.example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/edge-1"}},
+		EmailAddresses: []string{"ops@example.com"},
+	}
+}
+
+func TestIdentityExtractor(t *testing.T) {
+	tests := []struct {
+		source string
+		cert   *x509.Certificate
+		want   string
+	}{
+		{"", identityCert(), "edge-1"},
+		{"cn", identityCert(), "edge-1"},
+		{"dns", identityCert(), "edge-1.example.com"},
+		{"uri", identityCert(), "spiffe://example.com/edge-1"},
+		{"email", identityCert(), "ops@example.com"},
+		// Sources are tried in order until one has a value
+		{"uri,cn", identityCert(), "spiffe://example.com/edge-1"},
+		{"uri, cn", &x509.Certificate{Subject: pkix.Name{CommonName: "edge-1"}}, "edge-1"},
+		{"dns", &x509.Certificate{Subject: pkix.Name{CommonName: "edge-1"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			extractor, err := ParseIdentityExtractor(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := extractor.Identity(tt.cert); got != tt.want {
+				t.Errorf("Identity() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIdentityExtractorRejectsUnknownSource(t *testing.T) {
+	if _, err := ParseIdentityExtractor("uri,serial"); err == nil {
+		t.Error("ParseIdentityExtractor(uri,serial) succeeded, want an error")
+	}
+}
+
+func TestAllowClientsMatchesExtractedIdentity(t *testing.T) {
+	uri, err := ParseIdentityExtractor("uri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		cns       []string
+		dnsNames  []string
+		extractor *IdentityExtractor
+		wantErr   bool
+	}{
+		{"CN with default extractor", []string{"edge-1"}, nil, nil, false},
+		{"URI identity", []string{"spiffe://example.com/edge-1"}, nil, uri, false},
+		// The CN is allowed, but the identity the gate and logs use isn't
+		{"CN without URI identity", []string{"edge-1"}, nil, uri, true},
+		{"DNS name that isn't the identity", nil, []string{"edge.example.com"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig := &tls.Config{}
+			AllowClients(tlsConfig, tt.cns, tt.dnsNames, tt.extractor)
+			err := tlsConfig.VerifyPeerCertificate(nil, [][]*x509.Certificate{{identityCert()}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyPeerCertificate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
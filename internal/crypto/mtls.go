@@ -3,37 +3,171 @@ package crypto
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
-	"os"
+	"net"
+	"strings"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// TLSOptions selects the protocol versions and cipher suites, using the
+// names accepted by ParseTLSVersion and ParseCipherSuites. Unset values
+// keep the TLS 1.3-only default. Cipher suites only apply to TLS 1.2.
+type TLSOptions struct {
+	MinVersion   string   `yaml:"min_version" json:"min_version,omitempty"`
+	MaxVersion   string   `yaml:"max_version" json:"max_version,omitempty"`
+	CipherSuites []string `yaml:"cipher_suites" json:"cipher_suites,omitempty"`
+	// IdentitySource is the comma-separated list of certificate fields a
+	// server reads client identities from, see ParseIdentityExtractor.
+	// Empty uses the CN.
+	IdentitySource string `yaml:"identity_source" json:"identity_source,omitempty"`
+	// AllowedCNs and AllowedDNSNames restrict which verified client
+	// certificates a server accepts. A client whose identity, read from
+	// IdentitySource, is in either list is allowed; with both empty any
+	// client signed by the CA is.
+	AllowedCNs      []string `yaml:"allowed_cns" json:"allowed_cns,omitempty"`
+	AllowedDNSNames []string `yaml:"allowed_dns_names" json:"allowed_dns_names,omitempty"`
+	// KeyPassword decrypts an encrypted private key. Use "env:NAME" to
+	// read it from an environment variable. See LoadKeyPair.
+	KeyPassword string `yaml:"key_password" json:"key_password,omitempty"`
+	// PinnedKeys are base64 SHA-256 SPKI hashes, see PinSPKI. When set the
+	// peer's public key must match one of them.
+	PinnedKeys []string `yaml:"pinned_keys" json:"pinned_keys,omitempty"`
+	// Logger audits pin mismatches. It is set by the caller, not loaded
+	// from configuration.
+	Logger *logging.Logger `yaml:"-" json:"-"`
+}
+
+// apply validates the options and sets them on tlsConfig
+func (o TLSOptions) apply(tlsConfig *tls.Config) error {
+	if o.MinVersion != "" {
+		minVersion, err := ParseTLSVersion(o.MinVersion)
+		if err != nil {
+			return err
+		}
+		if minVersion < tls.VersionTLS12 {
+			return fmt.Errorf("minimum TLS version %s is not allowed", o.MinVersion)
+		}
+		tlsConfig.MinVersion = minVersion
+	}
+
+	if o.MaxVersion != "" {
+		maxVersion, err := ParseTLSVersion(o.MaxVersion)
+		if err != nil {
+			return err
+		}
+		if maxVersion < tlsConfig.MinVersion {
+			return fmt.Errorf("maximum TLS version %s is below the minimum %s", o.MaxVersion, tlsVersionName(tlsConfig.MinVersion))
+		}
+		tlsConfig.MaxVersion = maxVersion
+	}
+
+	suites, err := ParseCipherSuites(o.CipherSuites)
+	if err != nil {
+		return err
+	}
+	tlsConfig.CipherSuites = suites
+	return nil
+}
+
+// Errors returned by LoadMTLSConfig, wrapping the underlying cause so
+// callers can also check for e.g. fs.ErrNotExist or ErrKeyPassword
+var (
+	ErrCertLoad   = errors.New("failed to load certificate")
+	ErrCACertRead = errors.New("failed to load CA certificate")
+	ErrCAParse    = errors.New("failed to parse CA certificate")
 )
 
-// LoadMTLSConfig creates a mutual TLS configuration for both client and server
-func LoadMTLSConfig(certFile, keyFile, caFile string, isServer bool) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// LoadMTLSConfig creates a mutual TLS configuration for both client and
+// server. caFile may be a bundle file or a directory of PEM files, see
+// ReadCABundle.
+func LoadMTLSConfig(certFile, keyFile, caFile string, isServer bool, opts TLSOptions) (*tls.Config, error) {
+	cert, err := LoadKeyPair(certFile, keyFile, opts.KeyPassword)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load certificate: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrCertLoad, err)
 	}
 
-	caCert, err := os.ReadFile(caFile)
+	caCert, err := ReadCABundle(caFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load CA certificate: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrCACertRead, err)
 	}
 
 	caCertPool := x509.NewCertPool()
 	if !caCertPool.AppendCertsFromPEM(caCert) {
-		return nil, fmt.Errorf("failed to parse CA certificate")
+		return nil, ErrCAParse
 	}
 
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		RootCAs:      caCertPool,
 		MinVersion:   tls.VersionTLS13,
+		// TLS 1.3 never renegotiates; be explicit for legacy TLS 1.2 peers
+		Renegotiation: tls.RenegotiateNever,
+	}
+	if err := opts.apply(tlsConfig); err != nil {
+		return nil, fmt.Errorf("invalid TLS options: %w", err)
 	}
 
 	if isServer {
+		extractor, err := ParseIdentityExtractor(opts.IdentitySource)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS options: %w", err)
+		}
 		tlsConfig.ClientCAs = caCertPool
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		AllowClients(tlsConfig, opts.AllowedCNs, opts.AllowedDNSNames, extractor)
+	}
+	if err := PinSPKI(tlsConfig, opts.PinnedKeys, opts.Logger); err != nil {
+		return nil, fmt.Errorf("invalid TLS options: %w", err)
 	}
 
 	return tlsConfig, nil
 }
+
+// AllowClients rejects verified client certificates whose identity, as
+// derived by extractor, is absent from both allowlists, at handshake time.
+// Matching the identity the identity gate and logs use means they agree on
+// who a client is. Rejections are counted as unauthorized_cert. Empty
+// lists leave tlsConfig unchanged. A nil extractor uses the CN.
+func AllowClients(tlsConfig *tls.Config, cns, dnsNames []string, extractor *IdentityExtractor) {
+	if len(cns) == 0 && len(dnsNames) == 0 {
+		return
+	}
+	if extractor == nil {
+		extractor = DefaultIdentityExtractor
+	}
+	allowed := toSet(append(append([]string(nil), cns...), dnsNames...))
+
+	next := tlsConfig.VerifyPeerCertificate
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			metrics.RecordConnectionError("unauthorized_cert")
+			return fmt.Errorf("no verified client certificate")
+		}
+
+		id := extractor.Identity(verifiedChains[0][0])
+		if _, ok := allowed[id]; ok && id != "" {
+			return nil
+		}
+
+		metrics.RecordConnectionError("unauthorized_cert")
+		return fmt.Errorf("client certificate identity %q is not in the allowlist", id)
+	}
+}
+
+// IsRenegotiationAttempt reports whether err was caused by the peer attempting
+// a TLS renegotiation, which is always refused with a no_renegotiation alert
+func IsRenegotiationAttempt(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "local error" {
+		return false
+	}
+	return strings.HasSuffix(opErr.Err.Error(), "no renegotiation")
+}
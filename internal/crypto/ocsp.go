@@ -0,0 +1,361 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// DefaultOCSPCheckInterval is how often the stapler checks whether the
+// staple is due for a refresh or the certificate was rotated
+const DefaultOCSPCheckInterval = time.Minute
+
+// ocspRetryInterval is how long to wait after a failed fetch
+const ocspRetryInterval = 5 * time.Minute
+
+// OCSPStapler fetches OCSP responses for the server certificate from the
+// issuer's responder and staples them to handshakes. The staple is
+// refreshed halfway to its NextUpdate and whenever the certificate
+// changes. Responses are not signature checked here; clients verify the
+// staple they receive.
+type OCSPStapler struct {
+	certificate func() *tls.Certificate
+	issuers     []*x509.Certificate
+	client      *http.Client
+	logger      *logging.Logger
+
+	mu        sync.RWMutex
+	staple    []byte
+	serial    *big.Int
+	refreshAt time.Time
+}
+
+// NewOCSPStapler creates a stapler for the certificate returned by
+// certificate, e.g. ReloadableCertificate.Certificate. The issuer is taken
+// from the certificate chain, falling back to the CA certificates in caFile,
+// a bundle file or directory (see ReadCABundle).
+func NewOCSPStapler(certificate func() *tls.Certificate, caFile string, logger *logging.Logger) (*OCSPStapler, error) {
+	var issuers []*x509.Certificate
+	if caFile != "" {
+		data, err := ReadCABundle(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA certificate: %w", err)
+		}
+		issuers, err = parseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+		}
+	}
+
+	return &OCSPStapler{
+		certificate: certificate,
+		issuers:     issuers,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		logger:      logger,
+	}, nil
+}
+
+// GetCertificate returns the current certificate with the OCSP staple
+// attached when one is held for it
+func (s *OCSPStapler) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := s.certificate()
+	leaf := leafOf(cert)
+	if leaf == nil {
+		return cert, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.staple == nil || s.serial.Cmp(leaf.SerialNumber) != 0 {
+		return cert, nil
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = s.staple
+	return &stapled, nil
+}
+
+// Run refreshes the staple when due, checking every interval until ctx is
+// cancelled
+func (s *OCSPStapler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if s.due() {
+			if err := s.Refresh(ctx); err != nil {
+				s.logger.Warn(ctx, "Failed to refresh OCSP staple", map[string]interface{}{
+					"error": err.Error(),
+				})
+				s.mu.Lock()
+				s.refreshAt = time.Now().Add(ocspRetryInterval)
+				s.mu.Unlock()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// due reports whether the staple is stale or belongs to a rotated certificate
+func (s *OCSPStapler) due() bool {
+	leaf := leafOf(s.certificate())
+	if leaf == nil || len(leaf.OCSPServer) == 0 {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.serial == nil || s.serial.Cmp(leaf.SerialNumber) != 0 {
+		return true
+	}
+	return !time.Now().Before(s.refreshAt)
+}
+
+// Refresh fetches a new OCSP response for the current certificate
+func (s *OCSPStapler) Refresh(ctx context.Context) error {
+	cert := s.certificate()
+	leaf := leafOf(cert)
+	if leaf == nil {
+		return fmt.Errorf("no certificate to staple")
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return fmt.Errorf("certificate has no OCSP responder")
+	}
+	issuer := s.issuerOf(cert, leaf)
+	if issuer == nil {
+		return fmt.Errorf("issuer of %s not found", leaf.Subject)
+	}
+
+	certID, err := newOCSPCertID(leaf, issuer)
+	if err != nil {
+		return err
+	}
+	request, err := asn1.Marshal(ocspRequest{
+		TBSRequest: ocspTBSRequest{RequestList: []ocspRequestEntry{{Cert: certID}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode OCSP request: %w", err)
+	}
+
+	raw, err := s.fetch(ctx, leaf.OCSPServer[0], request)
+	if err != nil {
+		return err
+	}
+	single, err := parseOCSPResponse(raw, leaf.SerialNumber)
+	if err != nil {
+		return err
+	}
+
+	// Refresh halfway to NextUpdate so a slow responder never leaves us
+	// stapling an expired response
+	refreshAt := time.Now().Add(time.Hour)
+	if !single.NextUpdate.IsZero() {
+		refreshAt = single.ThisUpdate.Add(single.NextUpdate.Sub(single.ThisUpdate) / 2)
+		metrics.SetOCSPNextUpdate(float64(single.NextUpdate.Unix()))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.staple = raw
+	s.serial = leaf.SerialNumber
+	s.refreshAt = refreshAt
+	return nil
+}
+
+func (s *OCSPStapler) fetch(ctx context.Context, url string, request []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query OCSP responder: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCSP response: %w", err)
+	}
+	return body, nil
+}
+
+// issuerOf finds the certificate that signed leaf in the chain or CA file
+func (s *OCSPStapler) issuerOf(cert *tls.Certificate, leaf *x509.Certificate) *x509.Certificate {
+	candidates := s.issuers
+	for _, der := range cert.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			candidates = append([]*x509.Certificate{c}, candidates...)
+		}
+	}
+	for _, c := range candidates {
+		if leaf.CheckSignatureFrom(c) == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+var (
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidOCSPBasicResp = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+)
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequestEntry struct {
+	Cert ocspCertID
+}
+
+type ocspTBSRequest struct {
+	RequestList []ocspRequestEntry
+}
+
+type ocspRequest struct {
+	TBSRequest ocspTBSRequest
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []ocspSingleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID           ocspCertID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+func newOCSPCertID(leaf, issuer *x509.Certificate) (ocspCertID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ocspCertID{}, fmt.Errorf("failed to parse issuer public key: %w", err)
+	}
+
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  leaf.SerialNumber,
+	}, nil
+}
+
+// parseOCSPResponse returns the response for serial, requiring it to be good
+func parseOCSPResponse(raw []byte, serial *big.Int) (ocspSingleResponse, error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(raw, &resp); err != nil {
+		return ocspSingleResponse{}, fmt.Errorf("failed to parse OCSP response: %w", err)
+	}
+	if resp.Status != 0 {
+		return ocspSingleResponse{}, fmt.Errorf("OCSP responder returned status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasicResp) {
+		return ocspSingleResponse{}, fmt.Errorf("unsupported OCSP response type %s", resp.Response.ResponseType)
+	}
+
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return ocspSingleResponse{}, fmt.Errorf("failed to parse OCSP response: %w", err)
+	}
+
+	for _, single := range basic.TBSResponseData.Responses {
+		if single.CertID.SerialNumber.Cmp(serial) != 0 {
+			continue
+		}
+		switch {
+		case bool(single.Good):
+			if !single.NextUpdate.IsZero() && time.Now().After(single.NextUpdate) {
+				return ocspSingleResponse{}, fmt.Errorf("OCSP response expired at %s", single.NextUpdate.UTC().Format(time.RFC3339))
+			}
+			return single, nil
+		case bool(single.Unknown):
+			return ocspSingleResponse{}, fmt.Errorf("OCSP responder doesn't know the certificate")
+		default:
+			return ocspSingleResponse{}, fmt.Errorf("certificate was revoked at %s", single.Revoked.RevocationTime.UTC().Format(time.RFC3339))
+		}
+	}
+	return ocspSingleResponse{}, fmt.Errorf("OCSP response doesn't cover serial %s", serial)
+}
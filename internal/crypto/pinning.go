@@ -0,0 +1,69 @@
+package crypto
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+
+	"gotunnel-pro/internal/logging"
+)
+
+// SPKIHash returns the base64 SHA-256 hash of a certificate's public key,
+// in the format accepted by PinSPKI
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// PinSPKI requires the peer's leaf public key to match one of pins, each a
+// base64 SHA-256 SPKI hash. Listing several pins allows key rotation. The
+// check runs after normal chain verification, so pinning adds to CA trust
+// rather than replacing it. Mismatches are rejected and audited.
+func PinSPKI(tlsConfig *tls.Config, pins []string, logger *logging.Logger) error {
+	if len(pins) == 0 {
+		return nil
+	}
+
+	pinSet := make(map[string]struct{}, len(pins))
+	for _, pin := range pins {
+		raw, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(raw) != sha256.Size {
+			return fmt.Errorf("invalid SPKI pin %q: must be a base64 SHA-256 hash", pin)
+		}
+		pinSet[pin] = struct{}{}
+	}
+
+	next := tlsConfig.VerifyPeerCertificate
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no peer certificate presented")
+		}
+
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse peer certificate: %w", err)
+		}
+
+		hash := SPKIHash(leaf)
+		if _, ok := pinSet[hash]; ok {
+			return nil
+		}
+
+		if logger != nil {
+			logger.Audit(context.Background(), "Peer public key does not match any pin", map[string]interface{}{
+				"subject":   leaf.Subject.String(),
+				"spki_hash": hash,
+			})
+		}
+		return fmt.Errorf("peer public key %s does not match any pinned key", hash)
+	}
+	return nil
+}
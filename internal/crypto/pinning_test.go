@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key to dir, returning their paths and the parsed certificate. The
+// certificate doubles as its own CA.
+func writeTestCertificate(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	t.Helper()
+	return writeCertificate(t, dir, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gotunnel-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	})
+}
+
+// writeCertificate self-signs template with a fresh key and writes the
+// certificate and key to cert.pem and key.pem in dir, replacing any there
+func writeCertificate(t *testing.T, dir string, template *x509.Certificate) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+// pinnedHandshake runs a handshake between a server and a client loaded
+// with LoadMTLSConfig, the client pinning the key pin returns for the
+// server's certificate, and returns the certificate and the client's error
+func pinnedHandshake(t *testing.T, pin func(*x509.Certificate) string) (*x509.Certificate, error) {
+	t.Helper()
+	certFile, keyFile, cert := writeTestCertificate(t, t.TempDir())
+	serverTLS, err := LoadMTLSConfig(certFile, keyFile, certFile, true, TLSOptions{})
+	if err != nil {
+		t.Fatalf("load server config: %v", err)
+	}
+	clientTLS, err := LoadMTLSConfig(certFile, keyFile, certFile, false, TLSOptions{PinnedKeys: []string{pin(cert)}})
+	if err != nil {
+		t.Fatalf("load client config: %v", err)
+	}
+	clientTLS.ServerName = "127.0.0.1"
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go func() {
+		server := tls.Server(serverConn, serverTLS)
+		server.Handshake()
+		server.Close()
+	}()
+	return cert, tls.Client(clientConn, clientTLS).Handshake()
+}
+
+func TestLoadMTLSConfigAcceptsPinnedKey(t *testing.T) {
+	if _, err := pinnedHandshake(t, SPKIHash); err != nil {
+		t.Fatalf("handshake with the server's pinned key: %v", err)
+	}
+}
+
+func TestLoadMTLSConfigRejectsUnpinnedKey(t *testing.T) {
+	cert, err := pinnedHandshake(t, func(*x509.Certificate) string {
+		other := sha256.Sum256([]byte("some other key"))
+		return base64.StdEncoding.EncodeToString(other[:])
+	})
+	if err == nil {
+		t.Fatal("handshake succeeded although the server's key is not pinned")
+	}
+	if want := SPKIHash(cert); !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %v, want it to name the server's key %s", err, want)
+	}
+}
+
+func TestLoadMTLSConfigRejectsInvalidPin(t *testing.T) {
+	certFile, keyFile, _ := writeTestCertificate(t, t.TempDir())
+	if _, err := LoadMTLSConfig(certFile, keyFile, certFile, false, TLSOptions{PinnedKeys: []string{"not-a-hash"}}); err == nil {
+		t.Fatal("LoadMTLSConfig accepted an invalid pin")
+	}
+}
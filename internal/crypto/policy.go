@@ -0,0 +1,176 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// TLSPolicy is the part of the server TLS configuration that can be changed
+// at runtime
+type TLSPolicy struct {
+	MinVersion   string   `json:"min_version"`
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+	ClientAuth   string   `json:"client_auth"`
+}
+
+// DynamicTLSConfig lets the TLS policy of a running server be swapped
+// atomically. New handshakes use the latest policy while established
+// connections keep the parameters they negotiated.
+type DynamicTLSConfig struct {
+	mu      sync.RWMutex
+	base    *tls.Config
+	current *tls.Config
+	policy  TLSPolicy
+}
+
+// NewDynamicTLSConfig wraps the server TLS config loaded at startup
+func NewDynamicTLSConfig(base *tls.Config) *DynamicTLSConfig {
+	return &DynamicTLSConfig{
+		base:    base,
+		current: base,
+		policy: TLSPolicy{
+			MinVersion:   tlsVersionName(base.MinVersion),
+			CipherSuites: cipherSuiteNames(base.CipherSuites),
+			ClientAuth:   clientAuthName(base.ClientAuth),
+		},
+	}
+}
+
+// Config returns the TLS config to listen with. It defers every handshake
+// to the current policy.
+func (d *DynamicTLSConfig) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			d.mu.RLock()
+			defer d.mu.RUnlock()
+			return d.current, nil
+		},
+	}
+}
+
+// Policy returns the policy currently applied
+func (d *DynamicTLSConfig) Policy() TLSPolicy {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.policy
+}
+
+// Apply validates policy and swaps it in for new handshakes. Versions below
+// TLS 1.2, insecure cipher suites and client auth modes that admit clients
+// without a verified certificate are rejected.
+func (d *DynamicTLSConfig) Apply(policy TLSPolicy) error {
+	minVersion, err := ParseTLSVersion(policy.MinVersion)
+	if err != nil {
+		return err
+	}
+	if minVersion < tls.VersionTLS12 {
+		return fmt.Errorf("minimum TLS version %s is not allowed", policy.MinVersion)
+	}
+
+	suites, err := ParseCipherSuites(policy.CipherSuites)
+	if err != nil {
+		return err
+	}
+
+	clientAuth, err := parseClientAuth(policy.ClientAuth)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	next := d.base.Clone()
+	next.MinVersion = minVersion
+	next.CipherSuites = suites
+	next.ClientAuth = clientAuth
+	d.current = next
+	d.policy = policy
+	return nil
+}
+
+// ParseTLSVersion parses a version name such as "TLS1.2" or "TLS1.3"
+func ParseTLSVersion(name string) (uint16, error) {
+	switch name {
+	case "TLS1.0":
+		return tls.VersionTLS10, nil
+	case "TLS1.1":
+		return tls.VersionTLS11, nil
+	case "TLS1.2":
+		return tls.VersionTLS12, nil
+	case "TLS1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version %q", name)
+	}
+}
+
+// ParseCipherSuites resolves cipher suite names to IDs. Only suites Go
+// considers secure are accepted.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseClientAuth(name string) (tls.ClientAuthType, error) {
+	switch name {
+	case "", "require_and_verify":
+		return tls.RequireAndVerifyClientCert, nil
+	case "none", "request", "require_any", "verify_if_given":
+		return tls.NoClientCert, fmt.Errorf("client auth mode %q would admit unverified clients", name)
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q", name)
+	}
+}
+
+func clientAuthName(auth tls.ClientAuthType) string {
+	switch auth {
+	case tls.RequireAndVerifyClientCert:
+		return "require_and_verify"
+	default:
+		return auth.String()
+	}
+}
+
+func cipherSuiteNames(ids []uint16) []string {
+	if len(ids) == 0 {
+		return nil
+	}
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = tls.CipherSuiteName(id)
+	}
+	return names
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
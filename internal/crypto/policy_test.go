@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startDynamicTLSServer serves an echo over TLS with d's config on a
+// loopback listener and returns its address
+func startDynamicTLSServer(t *testing.T, d *DynamicTLSConfig) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", d.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialTLS connects to addr with clientTLS capped at maxVersion
+func dialTLS(addr string, clientTLS *tls.Config, maxVersion uint16) (*tls.Conn, error) {
+	config := clientTLS.Clone()
+	config.MinVersion = tls.VersionTLS12
+	config.MaxVersion = maxVersion
+	return tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+}
+
+// echo checks that conn still carries data
+func echo(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v, want the echoed ping", buf, err)
+	}
+}
+
+func TestDynamicTLSConfigAppliesToNewHandshakes(t *testing.T) {
+	certFile, keyFile, _ := writeTestCertificate(t, t.TempDir())
+	serverTLS, err := LoadMTLSConfig(certFile, keyFile, certFile, true, TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS, err := LoadMTLSConfig(certFile, keyFile, certFile, false, TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS.ServerName = "127.0.0.1"
+
+	d := NewDynamicTLSConfig(serverTLS)
+	if err := d.Apply(TLSPolicy{MinVersion: "TLS1.2"}); err != nil {
+		t.Fatalf("Apply(TLS1.2) error = %v", err)
+	}
+	addr := startDynamicTLSServer(t, d)
+
+	existing, err := dialTLS(addr, clientTLS, tls.VersionTLS12)
+	if err != nil {
+		t.Fatalf("TLS 1.2 handshake before the change: %v", err)
+	}
+	defer existing.Close()
+	echo(t, existing)
+
+	if err := d.Apply(TLSPolicy{MinVersion: "TLS1.3"}); err != nil {
+		t.Fatalf("Apply(TLS1.3) error = %v", err)
+	}
+	if got := d.Policy().MinVersion; got != "TLS1.3" {
+		t.Errorf("Policy().MinVersion = %q, want TLS1.3", got)
+	}
+
+	if conn, err := dialTLS(addr, clientTLS, tls.VersionTLS12); err == nil {
+		conn.Close()
+		t.Error("TLS 1.2 handshake succeeded after raising the minimum to TLS 1.3")
+	}
+	conn, err := dialTLS(addr, clientTLS, tls.VersionTLS13)
+	if err != nil {
+		t.Fatalf("TLS 1.3 handshake after the change: %v", err)
+	}
+	conn.Close()
+
+	// The connection negotiated under the old policy stays up
+	echo(t, existing)
+}
+
+func TestDynamicTLSConfigRejectsUnsafePolicies(t *testing.T) {
+	d := NewDynamicTLSConfig(&tls.Config{MinVersion: tls.VersionTLS13, ClientAuth: tls.RequireAndVerifyClientCert})
+	tests := []struct {
+		name   string
+		policy TLSPolicy
+	}{
+		{"TLS 1.0", TLSPolicy{MinVersion: "TLS1.0"}},
+		{"TLS 1.1", TLSPolicy{MinVersion: "TLS1.1"}},
+		{"unknown version", TLSPolicy{MinVersion: "SSL3"}},
+		{"insecure cipher suite", TLSPolicy{MinVersion: "TLS1.2", CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}},
+		{"unverified clients", TLSPolicy{MinVersion: "TLS1.2", ClientAuth: "request"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := d.Apply(tt.policy); err == nil {
+				t.Errorf("Apply(%+v) succeeded, want it rejected", tt.policy)
+			}
+			if got := d.Policy().MinVersion; got != "TLS1.3" {
+				t.Errorf("policy min version = %q after a rejected change, want TLS1.3 kept", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package crypto
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// DefaultCertReloadInterval is how often certificate files are re-stat'ed
+const DefaultCertReloadInterval = time.Minute
+
+// ReloadableCertificate serves a keypair that is reloaded from disk when
+// the files change, so rotated certificates are picked up by new
+// handshakes without restarting or dropping existing connections
+type ReloadableCertificate struct {
+	certFile    string
+	keyFile     string
+	keyPassword string
+	logger      *logging.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	version string
+}
+
+// NewReloadableCertificate loads the initial keypair from certFile and
+// keyFile, decrypting the key with keyPassword if set as in LoadKeyPair
+func NewReloadableCertificate(certFile, keyFile, keyPassword string, logger *logging.Logger) (*ReloadableCertificate, error) {
+	r := &ReloadableCertificate{certFile: certFile, keyFile: keyFile, keyPassword: keyPassword, logger: logger}
+
+	cert, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.cert = cert
+	r.version, _ = r.stat()
+	return r, nil
+}
+
+// Apply makes tlsConfig serve the current certificate through the
+// GetCertificate and GetClientCertificate callbacks instead of a fixed
+// Certificates list
+func (r *ReloadableCertificate) Apply(tlsConfig *tls.Config) {
+	tlsConfig.Certificates = nil
+	tlsConfig.GetCertificate = r.GetCertificate
+	tlsConfig.GetClientCertificate = r.GetClientCertificate
+}
+
+// GetCertificate returns the current certificate for server handshakes
+func (r *ReloadableCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate returns the current certificate for client handshakes
+func (r *ReloadableCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// Certificate returns the certificate currently being served
+func (r *ReloadableCertificate) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// Reload loads and validates the keypair from disk and swaps it in. On
+// failure the previous certificate stays in use.
+func (r *ReloadableCertificate) Reload(ctx context.Context) error {
+	version, _ := r.stat()
+
+	cert, err := r.load()
+	if err != nil {
+		metrics.RecordCertReload(false)
+		return err
+	}
+
+	r.mu.Lock()
+	old := r.cert
+	r.cert = cert
+	r.version = version
+	r.mu.Unlock()
+
+	metrics.RecordCertReload(true)
+	if leaf := leafOf(cert); leaf != nil {
+		metrics.SetCertificateExpiry(float64(leaf.NotAfter.Unix()))
+	}
+	r.logger.Audit(ctx, "Reloaded TLS certificate", NewCertRotation(old, cert).Fields())
+	return nil
+}
+
+// Watch re-stats the certificate files every interval until ctx is
+// cancelled and reloads them when they change
+func (r *ReloadableCertificate) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		version, err := r.stat()
+		if err != nil {
+			r.logger.Warn(ctx, "Failed to stat TLS certificate files", map[string]interface{}{
+				"error": err.Error(),
+			})
+			continue
+		}
+
+		r.mu.RLock()
+		changed := version != r.version
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := r.Reload(ctx); err != nil {
+			r.logger.Error(ctx, "Failed to reload TLS certificate, keeping the current one", map[string]interface{}{
+				"cert_file": r.certFile,
+				"error":     err.Error(),
+			})
+			// Don't retry the same broken files every tick
+			r.mu.Lock()
+			r.version = version
+			r.mu.Unlock()
+		}
+	}
+}
+
+// load reads the keypair and checks that it is usable before it is served
+func (r *ReloadableCertificate) load() (*tls.Certificate, error) {
+	cert, err := LoadKeyPair(r.certFile, r.keyFile, r.keyPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	leaf := leafOf(&cert)
+	if leaf == nil {
+		return nil, fmt.Errorf("failed to parse certificate")
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate is not valid at %s", now.UTC().Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// stat returns a value that changes whenever either file is replaced
+func (r *ReloadableCertificate) stat() (string, error) {
+	var version string
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		version += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return version, nil
+}
@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestReloadableCertificateAuditsRotation(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, oldCert := writeTestCertificate(t, dir)
+
+	var audit bytes.Buffer
+	logger := logging.NewLogger("test", "test", logging.INFO)
+	logger.SetAuditOutput(&audit)
+	defer logger.Close()
+
+	r, err := NewReloadableCertificate(certFile, keyFile, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, newCert := writeCertificate(t, dir, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gotunnel-rotated"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(2 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	})
+
+	reloads := counterValue(t, metrics.Default.CertReloads)
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if got := counterValue(t, metrics.Default.CertReloads); got != reloads+1 {
+		t.Errorf("cert reloads = %v, want %v", got, reloads+1)
+	}
+	if got := r.Certificate().Leaf.SerialNumber; got.Cmp(newCert.SerialNumber) != 0 {
+		t.Errorf("serving serial %v, want %v", got, newCert.SerialNumber)
+	}
+
+	var entry struct {
+		Message string            `json:"message"`
+		Fields  map[string]string `json:"fields"`
+	}
+	if err := json.Unmarshal(audit.Bytes(), &entry); err != nil {
+		t.Fatalf("audit entry %q: %v", audit.String(), err)
+	}
+	want := map[string]string{
+		"old_subject":   oldCert.Subject.String(),
+		"old_serial":    "1",
+		"old_not_after": oldCert.NotAfter.UTC().Format(time.RFC3339),
+		"new_subject":   newCert.Subject.String(),
+		"new_serial":    "2",
+		"new_not_after": newCert.NotAfter.UTC().Format(time.RFC3339),
+	}
+	for key, value := range want {
+		if entry.Fields[key] != value {
+			t.Errorf("audit field %s = %q, want %q", key, entry.Fields[key], value)
+		}
+	}
+}
+
+func TestReloadableCertificateKeepsCertificateOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeTestCertificate(t, dir)
+
+	var audit bytes.Buffer
+	logger := logging.NewLogger("test", "test", logging.INFO)
+	logger.SetAuditOutput(&audit)
+	defer logger.Close()
+
+	r, err := NewReloadableCertificate(certFile, keyFile, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	failures := counterValue(t, metrics.Default.CertReloadFailures)
+	if err := r.Reload(context.Background()); err == nil {
+		t.Fatal("Reload() succeeded with a corrupt certificate")
+	}
+	if got := counterValue(t, metrics.Default.CertReloadFailures); got != failures+1 {
+		t.Errorf("cert reload failures = %v, want %v", got, failures+1)
+	}
+	if got := r.Certificate().Leaf.SerialNumber; got.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("serving serial %v after a failed reload, want %v", got, cert.SerialNumber)
+	}
+	if audit.Len() != 0 {
+		t.Errorf("audit log = %q, want no rotation event", audit.String())
+	}
+}
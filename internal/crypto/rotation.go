@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+)
+
+// CertRotation describes a successful certificate reload for audit logging
+type CertRotation struct {
+	OldSubject  string
+	OldSerial   string
+	OldNotAfter time.Time
+	NewSubject  string
+	NewSerial   string
+	NewNotAfter time.Time
+}
+
+// NewCertRotation describes the rotation from oldCert to newCert. Either may
+// be nil, e.g. on the initial load.
+func NewCertRotation(oldCert, newCert *tls.Certificate) CertRotation {
+	var r CertRotation
+	if leaf := leafOf(oldCert); leaf != nil {
+		r.OldSubject = leaf.Subject.String()
+		r.OldSerial = leaf.SerialNumber.String()
+		r.OldNotAfter = leaf.NotAfter
+	}
+	if leaf := leafOf(newCert); leaf != nil {
+		r.NewSubject = leaf.Subject.String()
+		r.NewSerial = leaf.SerialNumber.String()
+		r.NewNotAfter = leaf.NotAfter
+	}
+	return r
+}
+
+// Fields returns the rotation as log fields for the audit event
+func (r CertRotation) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"old_subject": r.OldSubject,
+		"old_serial":  r.OldSerial,
+		"new_subject": r.NewSubject,
+		"new_serial":  r.NewSerial,
+	}
+	if !r.OldNotAfter.IsZero() {
+		fields["old_not_after"] = r.OldNotAfter.UTC().Format(time.RFC3339)
+	}
+	if !r.NewNotAfter.IsZero() {
+		fields["new_not_after"] = r.NewNotAfter.UTC().Format(time.RFC3339)
+	}
+	return fields
+}
+
+// leafOf returns the parsed leaf of cert, parsing it if tls didn't already
+func leafOf(cert *tls.Certificate) *x509.Certificate {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
@@ -2,8 +2,15 @@ package health
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
 	"sync"
 	"time"
+
+	"gotunnel-pro/internal/metrics"
 )
 
 type HealthChecker interface {
@@ -11,23 +18,84 @@ type HealthChecker interface {
 	Name() string
 }
 
+// DegradedError is returned by checkers that are impaired but still serving.
+// A degraded check doesn't make the service unhealthy.
+type DegradedError struct {
+	Err error
+}
+
+func (e *DegradedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DegradedError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultCheckTimeout bounds a checker registered without its own timeout
+const DefaultCheckTimeout = 2 * time.Second
+
+// errCheckTimeout is reported for a checker that didn't finish in time
+var errCheckTimeout = errors.New("timeout")
+
+// CheckKind selects which probe a checker contributes to
+type CheckKind int
+
+const (
+	// AllChecks selects every checker, including ones registered for
+	// liveness or readiness only
+	AllChecks CheckKind = iota
+	// Liveness checks fail only when the process itself is broken and
+	// should be restarted
+	Liveness
+	// Readiness checks fail when the process can't serve, e.g. because a
+	// dependency is down, without triggering a restart
+	Readiness
+)
+
+type registeredChecker struct {
+	checker HealthChecker
+	timeout time.Duration
+	kind    CheckKind
+}
+
 type HealthService struct {
-	checkers     map[string]HealthChecker
-	mu           sync.RWMutex
-	ready        bool
-	shuttingDown bool
+	checkers         map[string]registeredChecker
+	mu               sync.RWMutex
+	ready            bool
+	shuttingDown     bool
+	summaryThreshold int
 }
 
 func NewHealthService() *HealthService {
 	return &HealthService{
-		checkers: make(map[string]HealthChecker),
+		checkers: make(map[string]registeredChecker),
 	}
 }
 
+// RegisterChecker registers a checker for both liveness and readiness
 func (h *HealthService) RegisterChecker(checker HealthChecker) {
+	h.RegisterCheckerWithTimeout(checker, AllChecks, DefaultCheckTimeout)
+}
+
+// RegisterLivenessChecker registers a checker that only affects liveness
+func (h *HealthService) RegisterLivenessChecker(checker HealthChecker) {
+	h.RegisterCheckerWithTimeout(checker, Liveness, DefaultCheckTimeout)
+}
+
+// RegisterReadinessChecker registers a checker that only affects readiness,
+// so a failing dependency doesn't cause restarts
+func (h *HealthService) RegisterReadinessChecker(checker HealthChecker) {
+	h.RegisterCheckerWithTimeout(checker, Readiness, DefaultCheckTimeout)
+}
+
+// RegisterCheckerWithTimeout registers a checker of the given kind that is
+// reported unhealthy if it doesn't complete within timeout. AllChecks
+// registers it for both liveness and readiness.
+func (h *HealthService) RegisterCheckerWithTimeout(checker HealthChecker, kind CheckKind, timeout time.Duration) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	h.checkers[checker.Name()] = checker
+	h.checkers[checker.Name()] = registeredChecker{checker: checker, timeout: timeout, kind: kind}
 }
 
 func (h *HealthService) SetReady(ready bool) {
@@ -42,41 +110,180 @@ func (h *HealthService) SetShuttingDown(shuttingDown bool) {
 	h.shuttingDown = shuttingDown
 }
 
-func (h *HealthService) Check(ctx context.Context) map[string]interface{} {
+func (h *HealthService) IsReady() bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	return h.ready
+}
+
+func (h *HealthService) IsShuttingDown() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.shuttingDown
+}
+
+// SetSummaryThreshold summarizes Check results once more than n checkers
+// are registered: only counts and failing checks are reported, which keeps
+// probes cheap with many checkers. Zero always reports full detail.
+func (h *HealthService) SetSummaryThreshold(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.summaryThreshold = n
+}
+
+// Check runs all checkers, summarizing the results if there are more than
+// the summary threshold
+func (h *HealthService) Check(ctx context.Context) map[string]interface{} {
+	return h.CheckKind(ctx, AllChecks, false)
+}
+
+// CheckLiveness runs the checkers that apply to liveness
+func (h *HealthService) CheckLiveness(ctx context.Context) map[string]interface{} {
+	return h.CheckKind(ctx, Liveness, false)
+}
+
+// CheckReadiness runs the checkers that apply to readiness
+func (h *HealthService) CheckReadiness(ctx context.Context) map[string]interface{} {
+	return h.CheckKind(ctx, Readiness, false)
+}
+
+// CheckKind runs the checkers that apply to kind. Unless verbose is set the
+// results are summarized above the summary threshold. Each check and the
+// batch as a whole report their duration so slow checkers stand out; checks
+// stay keyed by name, which encoding/json writes in sorted order.
+func (h *HealthService) CheckKind(ctx context.Context, kind CheckKind, verbose bool) map[string]interface{} {
+	// Copy what's needed so slow checks don't hold the lock
+	h.mu.RLock()
+	checkers := make(map[string]registeredChecker, len(h.checkers))
+	for name, c := range h.checkers {
+		if kind == AllChecks || c.kind == AllChecks || c.kind == kind {
+			checkers[name] = c
+		}
+	}
+	summarize := !verbose && h.summaryThreshold > 0 && len(checkers) > h.summaryThreshold
+	ready := h.ready
+	shuttingDown := h.shuttingDown
+	h.mu.RUnlock()
+
+	counts := map[string]int{"healthy": 0, "degraded": 0, "unhealthy": 0}
 
 	result := make(map[string]interface{})
 	result["status"] = "healthy"
 	result["timestamp"] = time.Now().UTC().Format(time.RFC3339)
-	result["ready"] = h.ready
-	result["shutting_down"] = h.shuttingDown
-
-	checkResults := make(map[string]interface{})
-	for name, checker := range h.checkers {
-		if err := checker.Check(ctx); err != nil {
-			checkResults[name] = map[string]interface{}{
-				"status": "unhealthy",
-				"error":  err.Error(),
+	result["ready"] = ready
+	result["shutting_down"] = shuttingDown
+
+	start := time.Now()
+	outcomes := runCheckers(ctx, checkers)
+	result["duration_ms"] = durationMillis(time.Since(start))
+
+	checkResults := make(map[string]interface{}, len(outcomes))
+	for name, outcome := range outcomes {
+		check := map[string]interface{}{
+			"duration_ms": durationMillis(outcome.duration),
+		}
+
+		var degraded *DegradedError
+		if errors.As(outcome.err, &degraded) {
+			counts["degraded"]++
+			check["status"] = "degraded"
+			check["error"] = outcome.err.Error()
+			if result["status"] == "healthy" {
+				result["status"] = "degraded"
 			}
+		} else if outcome.err != nil {
+			counts["unhealthy"]++
+			check["status"] = "unhealthy"
+			check["error"] = outcome.err.Error()
 			result["status"] = "unhealthy"
 		} else {
-			checkResults[name] = map[string]interface{}{
-				"status": "healthy",
+			counts["healthy"]++
+			if summarize {
+				continue
 			}
+			check["status"] = "healthy"
 		}
+		checkResults[name] = check
 	}
 	result["checks"] = checkResults
+	if summarize {
+		result["summary"] = counts
+	}
 
 	return result
 }
 
+// durationMillis returns d in milliseconds with microsecond precision
+func durationMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// checkOutcome is the result of running one checker
+type checkOutcome struct {
+	err      error
+	duration time.Duration
+}
+
+// runCheckers runs every checker concurrently, each under its own timeout
+func runCheckers(ctx context.Context, checkers map[string]registeredChecker) map[string]checkOutcome {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]checkOutcome, len(checkers))
+	)
+
+	for name, c := range checkers {
+		wg.Add(1)
+		go func(name string, c registeredChecker) {
+			defer wg.Done()
+			start := time.Now()
+			err := runChecker(ctx, c)
+			duration := time.Since(start)
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[name] = checkOutcome{err: err, duration: duration}
+		}(name, c)
+	}
+	wg.Wait()
+	return results
+}
+
+// runChecker returns errCheckTimeout if c doesn't finish within its
+// timeout, even if the checker ignores ctx
+func runChecker(ctx context.Context, c registeredChecker) error {
+	checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.checker.Check(checkCtx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-checkCtx.Done():
+		return errCheckTimeout
+	}
+}
+
+// DefaultCertExpiryWarning is how close to expiry the certificate check fails
+const DefaultCertExpiryWarning = 7 * 24 * time.Hour
+
 type CertificateChecker struct {
-	certFile string
+	certFile   string
+	warnWithin time.Duration
 }
 
-func NewCertificateChecker(certFile string) *CertificateChecker {
-	return &CertificateChecker{certFile: certFile}
+// NewCertificateChecker creates a checker that fails once the leaf
+// certificate in certFile expires within warnWithin. A zero warnWithin uses
+// DefaultCertExpiryWarning.
+func NewCertificateChecker(certFile string, warnWithin time.Duration) *CertificateChecker {
+	if warnWithin == 0 {
+		warnWithin = DefaultCertExpiryWarning
+	}
+	return &CertificateChecker{certFile: certFile, warnWithin: warnWithin}
 }
 
 func (c *CertificateChecker) Name() string {
@@ -84,16 +291,49 @@ func (c *CertificateChecker) Name() string {
 }
 
 func (c *CertificateChecker) Check(ctx context.Context) error {
-	//  TODO: Implement certificate expiry check
+	data, err := os.ReadFile(c.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate: %w", err)
+	}
+
+	// The leaf is the first certificate in the file
+	var block *pem.Block
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("no certificate found in %s", c.certFile)
+		}
+		if block.Type == "CERTIFICATE" {
+			break
+		}
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	metrics.SetCertificateExpiry(float64(cert.NotAfter.Unix()))
+
+	remaining := time.Until(cert.NotAfter)
+	if remaining <= 0 {
+		return fmt.Errorf("certificate expired at %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if remaining < c.warnWithin {
+		return fmt.Errorf("certificate expires at %s, within %s", cert.NotAfter.UTC().Format(time.RFC3339), c.warnWithin)
+	}
 	return nil
 }
 
 type TunnelConnectionChecker struct {
 	minConnections int
+	count          func() int
 }
 
-func NewTunnelConnectionChecker(minConnections int) *TunnelConnectionChecker {
-	return &TunnelConnectionChecker{minConnections: minConnections}
+// NewTunnelConnectionChecker creates a checker that fails while count,
+// typically the tunnel server's ActiveConnectionCount, is below
+// minConnections. A nil count always fails.
+func NewTunnelConnectionChecker(minConnections int, count func() int) *TunnelConnectionChecker {
+	return &TunnelConnectionChecker{minConnections: minConnections, count: count}
 }
 
 func (t *TunnelConnectionChecker) Name() string {
@@ -101,6 +341,103 @@ func (t *TunnelConnectionChecker) Name() string {
 }
 
 func (t *TunnelConnectionChecker) Check(ctx context.Context) error {
-	// Implement connection count check
+	if t.count == nil {
+		return fmt.Errorf("no tunnel connection count configured")
+	}
+	if connected := t.count(); connected < t.minConnections {
+		return fmt.Errorf("only %d of %d required tunnels connected", connected, t.minConnections)
+	}
 	return nil
 }
+
+// ListenerChecker fails once the tunnel listener has stopped accepting
+// connections. Only a restart brings it back, so it belongs on liveness.
+type ListenerChecker struct {
+	stopped func() error
+}
+
+// NewListenerChecker creates a checker that fails with the error stopped,
+// typically the tunnel server's ListenErr, returns. A nil stopped always
+// fails.
+func NewListenerChecker(stopped func() error) *ListenerChecker {
+	return &ListenerChecker{stopped: stopped}
+}
+
+func (l *ListenerChecker) Name() string {
+	return "tunnel_listener"
+}
+
+func (l *ListenerChecker) Check(ctx context.Context) error {
+	if l.stopped == nil {
+		return fmt.Errorf("no tunnel listener state configured")
+	}
+	return l.stopped()
+}
+
+type errorSample struct {
+	at    time.Time
+	total float64
+}
+
+// ErrorRateChecker reports degraded or unhealthy when the connection error
+// rate over a sliding window crosses the configured thresholds (errors per
+// second). It catches systemic failures that individual checks miss.
+type ErrorRateChecker struct {
+	mu            sync.Mutex
+	window        time.Duration
+	degradedRate  float64
+	unhealthyRate float64
+	errorTotal    func() float64
+	now           func() time.Time
+	samples       []errorSample
+}
+
+// NewErrorRateChecker creates an error rate checker over the connection
+// error metrics. A zero threshold disables that level.
+func NewErrorRateChecker(window time.Duration, degradedRate, unhealthyRate float64) *ErrorRateChecker {
+	return &ErrorRateChecker{
+		window:        window,
+		degradedRate:  degradedRate,
+		unhealthyRate: unhealthyRate,
+		errorTotal:    metrics.ConnectionErrorTotal,
+		now:           time.Now,
+	}
+}
+
+func (e *ErrorRateChecker) Name() string {
+	return "connection_error_rate"
+}
+
+func (e *ErrorRateChecker) Check(ctx context.Context) error {
+	rate := e.sample()
+
+	if e.unhealthyRate > 0 && rate >= e.unhealthyRate {
+		return fmt.Errorf("connection error rate %.2f/s exceeds %.2f/s", rate, e.unhealthyRate)
+	}
+	if e.degradedRate > 0 && rate >= e.degradedRate {
+		return &DegradedError{Err: fmt.Errorf("connection error rate %.2f/s exceeds %.2f/s", rate, e.degradedRate)}
+	}
+	return nil
+}
+
+// sample records the current error total and returns the rate over the window
+func (e *ErrorRateChecker) sample() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	e.samples = append(e.samples, errorSample{at: now, total: e.errorTotal()})
+
+	// Keep one sample at or before the window start as the baseline
+	cutoff := now.Add(-e.window)
+	for len(e.samples) > 2 && !e.samples[1].at.After(cutoff) {
+		e.samples = e.samples[1:]
+	}
+
+	oldest, latest := e.samples[0], e.samples[len(e.samples)-1]
+	elapsed := latest.at.Sub(oldest.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return (latest.total - oldest.total) / elapsed
+}
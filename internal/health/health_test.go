@@ -0,0 +1,143 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTunnelConnectionChecker(t *testing.T) {
+	connected := 0
+	checker := NewTunnelConnectionChecker(2, func() int { return connected })
+
+	err := checker.Check(context.Background())
+	if err == nil || err.Error() != "only 0 of 2 required tunnels connected" {
+		t.Errorf("Check() with no tunnels = %v, want the shortfall reported", err)
+	}
+	connected = 2
+	if err := checker.Check(context.Background()); err != nil {
+		t.Errorf("Check() with enough tunnels = %v, want nil", err)
+	}
+
+	if err := NewTunnelConnectionChecker(1, nil).Check(context.Background()); err == nil {
+		t.Error("Check() without a count source passed, want an error")
+	}
+}
+
+func TestCheckReportsDurationsByName(t *testing.T) {
+	h := NewHealthService()
+	h.RegisterReadinessChecker(NewTunnelConnectionChecker(1, func() int { return 0 }))
+
+	result := h.CheckReadiness(context.Background())
+	if result["status"] != "unhealthy" {
+		t.Errorf("status = %v, want unhealthy", result["status"])
+	}
+	if _, ok := result["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms = %v, want the batch duration", result["duration_ms"])
+	}
+	checks, ok := result["checks"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("checks = %T, want a map keyed by checker name", result["checks"])
+	}
+	check, ok := checks["tunnel_connections"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("checks = %v, want tunnel_connections", checks)
+	}
+	if _, ok := check["duration_ms"].(float64); !ok || check["status"] != "unhealthy" {
+		t.Errorf("tunnel_connections = %v, want its status and duration_ms", check)
+	}
+}
+
+func TestErrorRateCheckerThresholds(t *testing.T) {
+	var total float64
+	now := time.Unix(1700000000, 0)
+	checker := NewErrorRateChecker(10*time.Second, 1, 5)
+	checker.errorTotal = func() float64 { return total }
+	checker.now = func() time.Time { return now }
+
+	// step advances the clock by 5s after adding errors, then checks
+	step := func(errs float64) error {
+		total += errs
+		now = now.Add(5 * time.Second)
+		return checker.Check(context.Background())
+	}
+
+	if err := checker.Check(context.Background()); err != nil {
+		t.Fatalf("Check() with one sample = %v, want nil", err)
+	}
+	if err := step(2); err != nil {
+		t.Errorf("Check() at 0.4/s = %v, want nil", err)
+	}
+
+	// 10 errors over the 10s window is 1/s
+	var degraded *DegradedError
+	if err := step(8); !errors.As(err, &degraded) {
+		t.Errorf("Check() at 1/s = %v, want degraded", err)
+	}
+
+	// A burst of 60 errors is 6.8/s over the window
+	err := step(60)
+	if err == nil || errors.As(err, &degraded) {
+		t.Errorf("Check() at 6.8/s = %v, want unhealthy", err)
+	}
+
+	// Once the burst leaves the window the rate recovers
+	step(0)
+	step(0)
+	if err := step(0); err != nil {
+		t.Errorf("Check() after the burst = %v, want nil", err)
+	}
+}
+
+func TestErrorRateCheckerFailsReadiness(t *testing.T) {
+	var total float64
+	now := time.Unix(1700000000, 0)
+	checker := NewErrorRateChecker(time.Minute, 1, 0)
+	checker.errorTotal = func() float64 { return total }
+	checker.now = func() time.Time { return now }
+
+	h := NewHealthService()
+	h.RegisterReadinessChecker(checker)
+	h.CheckReadiness(context.Background())
+
+	total, now = 30, now.Add(10*time.Second)
+	if result := h.CheckReadiness(context.Background()); result["status"] != "degraded" {
+		t.Errorf("readiness status = %v, want degraded", result["status"])
+	}
+	if result := h.CheckLiveness(context.Background()); result["status"] != "healthy" {
+		t.Errorf("liveness status = %v, want healthy", result["status"])
+	}
+}
+
+func TestCheckKindSummarizesUnlessVerbose(t *testing.T) {
+	h := NewHealthService()
+	h.SetSummaryThreshold(2)
+	h.RegisterLivenessChecker(NewTunnelConnectionChecker(0, func() int { return 0 }))
+	h.RegisterLivenessChecker(NewErrorRateChecker(time.Minute, 0, 0))
+	h.RegisterLivenessChecker(NewCertificateChecker("", DefaultCertExpiryWarning))
+
+	summary := h.CheckKind(context.Background(), Liveness, false)
+	counts, ok := summary["summary"].(map[string]int)
+	if !ok || counts["healthy"] != 2 || counts["unhealthy"] != 1 || counts["degraded"] != 0 {
+		t.Errorf("summary = %v, want 2 healthy and 1 unhealthy", summary["summary"])
+	}
+	checks := summary["checks"].(map[string]interface{})
+	if _, ok := checks["certificate"]; !ok || len(checks) != 1 {
+		t.Errorf("summarized checks = %v, want only the failing certificate check", checks)
+	}
+
+	verbose := h.CheckKind(context.Background(), Liveness, true)
+	if _, ok := verbose["summary"]; ok {
+		t.Errorf("verbose result has a summary: %v", verbose["summary"])
+	}
+	checks = verbose["checks"].(map[string]interface{})
+	for _, name := range []string{"tunnel_connections", "connection_error_rate", "certificate"} {
+		if _, ok := checks[name]; !ok {
+			t.Errorf("verbose checks = %v, missing %s", checks, name)
+		}
+	}
+	if verbose["status"] != "unhealthy" || summary["status"] != "unhealthy" {
+		t.Errorf("status = %v (verbose), %v (summary), want unhealthy", verbose["status"], summary["status"])
+	}
+}
@@ -0,0 +1,284 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+// DefaultAsyncBufferSize is the number of entries buffered in async mode
+// when AsyncOptions.BufferSize is zero
+const DefaultAsyncBufferSize = 1024
+
+// OverflowPolicy decides what an async logger does with an entry when its
+// buffer is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room, as a synchronous logger would wait on
+	// the output
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the entry being logged
+	OverflowDropNewest
+	// OverflowDropOldest discards the oldest buffered entry to make room
+	OverflowDropOldest
+)
+
+// ParseOverflowPolicy parses "block", "drop_newest" or "drop_oldest"
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "block":
+		return OverflowBlock, nil
+	case "drop_newest":
+		return OverflowDropNewest, nil
+	case "drop_oldest":
+		return OverflowDropOldest, nil
+	default:
+		return 0, fmt.Errorf("unknown log overflow policy %q", name)
+	}
+}
+
+// StalePolicy decides what an async logger does with entries that have
+// waited in its buffer longer than AsyncOptions.MaxAge
+type StalePolicy int
+
+const (
+	// StaleFlush has the next goroutine that logs write the buffered
+	// entries itself, oldest first, instead of waiting for the drain
+	StaleFlush StalePolicy = iota
+	// StaleDrop discards stale entries when they reach the front of the
+	// buffer
+	StaleDrop
+)
+
+// ParseStalePolicy parses "flush" or "drop"
+func ParseStalePolicy(name string) (StalePolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "flush":
+		return StaleFlush, nil
+	case "drop":
+		return StaleDrop, nil
+	default:
+		return 0, fmt.Errorf("unknown log stale policy %q", name)
+	}
+}
+
+// AsyncOptions configures asynchronous logging
+type AsyncOptions struct {
+	// BufferSize is the number of entries held while the output catches
+	// up. Zero uses DefaultAsyncBufferSize.
+	BufferSize int
+	Overflow   OverflowPolicy
+	// MaxAge bounds how long an entry may wait in the buffer before Stale
+	// applies to it. Zero lets entries wait indefinitely.
+	MaxAge time.Duration
+	Stale  StalePolicy
+}
+
+// SetAsync makes the logger hand entries to a buffer drained by a
+// background goroutine, so a slow output such as a remote syslog or a full
+// pipe doesn't stall every goroutine that logs. Entries dropped by the
+// overflow or stale policy are counted in metrics; audit entries are never
+// dropped. Close flushes the buffer, so call it before exiting. Set the
+// output first: SetOutput and SetSyslogOutput flush and replace the buffer.
+func (l *Logger) SetAsync(opts AsyncOptions) {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultAsyncBufferSize
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w, ok := l.output.(*asyncWriter); ok {
+		// Keep the underlying output rather than stacking buffers
+		w.close()
+		l.output, l.ownsOutput = w.out, w.closeOut
+	}
+	w := &asyncWriter{
+		out:      l.output,
+		closeOut: l.ownsOutput,
+		overflow: opts.Overflow,
+		size:     opts.BufferSize,
+		maxAge:   opts.MaxAge,
+		stale:    opts.Stale,
+		now:      time.Now,
+		done:     make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	go w.run()
+	l.output = w
+	l.ownsOutput = true
+}
+
+// asyncWriter queues each Write and writes it to out from its own
+// goroutine. Loggers derived with WithFields share it, so it is safe for
+// concurrent use.
+type asyncWriter struct {
+	out      io.Writer
+	closeOut bool
+	overflow OverflowPolicy
+	size     int
+	maxAge   time.Duration
+	stale    StalePolicy
+	now      func() time.Time
+	done     chan struct{}
+	// outMu serializes writes to out. It is taken before mu, and held
+	// while an entry is taken off the queue, so entries reach out in order.
+	outMu sync.Mutex
+
+	// mu guards queue and closed; cond is signalled when either changes
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []asyncEntry
+	closed bool
+}
+
+// asyncEntry is a queued write. keep entries are never dropped.
+type asyncEntry struct {
+	data   []byte
+	keep   bool
+	queued time.Time
+}
+
+func (w *asyncWriter) run() {
+	defer close(w.done)
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		done := len(w.queue) == 0
+		w.mu.Unlock()
+		if done {
+			return
+		}
+
+		w.outMu.Lock()
+		w.mu.Lock()
+		// A stale flush may have emptied the queue in the meantime
+		entries := w.take(1)
+		w.mu.Unlock()
+		for _, entry := range entries {
+			if w.stale == StaleDrop && !entry.keep && w.isStale(entry) {
+				metrics.RecordLogStale()
+				continue
+			}
+			w.out.Write(entry.data)
+		}
+		w.outMu.Unlock()
+	}
+}
+
+// take removes up to n entries from the front of the queue. Callers hold mu.
+func (w *asyncWriter) take(n int) []asyncEntry {
+	n = min(n, len(w.queue))
+	entries := w.queue[:n:n]
+	w.queue = w.queue[n:]
+	if n > 0 {
+		w.cond.Broadcast()
+	}
+	return entries
+}
+
+func (w *asyncWriter) isStale(entry asyncEntry) bool {
+	return w.maxAge > 0 && w.now().Sub(entry.queued) > w.maxAge
+}
+
+func (w *asyncWriter) writeOut(p []byte) (int, error) {
+	w.outMu.Lock()
+	defer w.outMu.Unlock()
+	return w.out.Write(p)
+}
+
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	return w.write(p, false)
+}
+
+// writeBlocking queues p regardless of the overflow policy, waiting for
+// room if needed
+func (w *asyncWriter) writeBlocking(p []byte) (int, error) {
+	return w.write(p, true)
+}
+
+func (w *asyncWriter) write(p []byte, keep bool) (int, error) {
+	entry := asyncEntry{data: bytes.Clone(p), keep: keep, queued: w.now()}
+	overflow := w.overflow
+	if keep {
+		overflow = OverflowBlock
+	}
+
+	w.mu.Lock()
+	if w.stale == StaleFlush && len(w.queue) > 0 && w.isStale(w.queue[0]) {
+		w.mu.Unlock()
+		return w.flush(p)
+	}
+	for !w.closed && len(w.queue) >= w.size {
+		switch overflow {
+		case OverflowDropNewest:
+			w.mu.Unlock()
+			metrics.RecordLogOverflow()
+			return len(p), nil
+		case OverflowDropOldest:
+			oldest := w.take(1)[0]
+			if oldest.keep {
+				// Write it out of turn rather than lose it
+				w.mu.Unlock()
+				w.writeOut(oldest.data)
+				w.mu.Lock()
+			} else {
+				metrics.RecordLogOverflow()
+			}
+		default:
+			w.cond.Wait()
+		}
+	}
+	if w.closed {
+		// Entries logged during shutdown still reach the output
+		w.mu.Unlock()
+		return w.writeOut(p)
+	}
+	w.queue = append(w.queue, entry)
+	w.cond.Broadcast()
+	w.mu.Unlock()
+	return len(p), nil
+}
+
+// flush writes the buffered entries and then p from the calling goroutine,
+// for when the drain has fallen more than maxAge behind
+func (w *asyncWriter) flush(p []byte) (int, error) {
+	w.outMu.Lock()
+	defer w.outMu.Unlock()
+	w.mu.Lock()
+	entries := w.take(len(w.queue))
+	w.mu.Unlock()
+	for _, entry := range entries {
+		w.out.Write(entry.data)
+	}
+	return w.out.Write(p)
+}
+
+// close stops queueing and waits for the buffered entries to be written
+func (w *asyncWriter) close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.cond.Broadcast()
+	w.mu.Unlock()
+	<-w.done
+}
+
+// Close flushes the buffer and closes the output if the logger owned it
+func (w *asyncWriter) Close() error {
+	w.close()
+	if closer, ok := w.out.(io.Closer); ok && w.closeOut {
+		return closer.Close()
+	}
+	return nil
+}
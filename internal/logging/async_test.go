@@ -0,0 +1,196 @@
+package logging
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+// stalledWriter blocks its first Write until release is closed, standing in
+// for a sink that has stopped accepting data
+type stalledWriter struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newStalledWriter() *stalledWriter {
+	return &stalledWriter{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.started)
+		<-w.release
+	})
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *stalledWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// fakeClock is a settable time source for asyncWriter.now
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newStalledAsync returns an async writer whose drain is stuck writing "a"
+func newStalledAsync(t *testing.T, opts AsyncOptions) (*asyncWriter, *stalledWriter, *fakeClock) {
+	t.Helper()
+	out := newStalledWriter()
+	l := NewLogger("gotunnel-test", "test", INFO)
+	l.SetOutput(out)
+	l.SetAsync(opts)
+	w := l.output.(*asyncWriter)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	w.now = clock.Now
+
+	w.Write([]byte("a\n"))
+	select {
+	case <-out.started:
+	case <-time.After(time.Second):
+		t.Fatal("drain never started writing")
+	}
+	return w, out, clock
+}
+
+func staleDropped(t *testing.T) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metrics.Default.LogEntriesStale.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestAsyncDropsStaleEntries(t *testing.T) {
+	w, out, clock := newStalledAsync(t, AsyncOptions{BufferSize: 10, MaxAge: time.Second, Stale: StaleDrop})
+	before := staleDropped(t)
+
+	w.Write([]byte("b\n"))
+	w.writeBlocking([]byte("audit\n"))
+	clock.Advance(2 * time.Second)
+	w.Write([]byte("c\n"))
+
+	close(out.release)
+	w.Close()
+
+	if got, want := out.String(), "a\naudit\nc\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if got := staleDropped(t) - before; got != 1 {
+		t.Errorf("stale entries counted = %v, want 1", got)
+	}
+}
+
+func TestAsyncFlushesStaleEntries(t *testing.T) {
+	w, out, clock := newStalledAsync(t, AsyncOptions{BufferSize: 10, MaxAge: time.Second, Stale: StaleFlush})
+
+	w.Write([]byte("b\n"))
+	clock.Advance(500 * time.Millisecond)
+	w.Write([]byte("c\n"))
+	clock.Advance(time.Second)
+
+	written := make(chan struct{})
+	go func() {
+		w.Write([]byte("d\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write returned while the output was stalled, want it to flush synchronously")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(out.release)
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("write never returned after the output recovered")
+	}
+	// The caller wrote the backlog itself, so it is out before Close
+	if got, want := out.String(), "a\nb\nc\nd\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	w.Close()
+}
+
+func TestAsyncKeepsFreshEntriesQueued(t *testing.T) {
+	w, out, clock := newStalledAsync(t, AsyncOptions{BufferSize: 10, MaxAge: time.Second, Stale: StaleFlush})
+
+	w.Write([]byte("b\n"))
+	clock.Advance(500 * time.Millisecond)
+	// Nothing is stale yet, so this must not wait on the stalled output
+	done := make(chan struct{})
+	go func() {
+		w.Write([]byte("c\n"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write blocked although no entry was stale")
+	}
+
+	close(out.release)
+	w.Close()
+	if got, want := out.String(), "a\nb\nc\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestAsyncWithoutMaxAgeNeverDropsEntries(t *testing.T) {
+	w, out, clock := newStalledAsync(t, AsyncOptions{BufferSize: 10, Stale: StaleDrop})
+	before := staleDropped(t)
+
+	w.Write([]byte("b\n"))
+	clock.Advance(time.Hour)
+	w.Write([]byte("c\n"))
+
+	close(out.release)
+	w.Close()
+	if got, want := out.String(), "a\nb\nc\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if got := staleDropped(t) - before; got != 0 {
+		t.Errorf("stale entries counted = %v, want 0", got)
+	}
+}
+
+func TestParseStalePolicy(t *testing.T) {
+	for name, want := range map[string]StalePolicy{"": StaleFlush, "flush": StaleFlush, "DROP": StaleDrop} {
+		got, err := ParseStalePolicy(name)
+		if err != nil || got != want {
+			t.Errorf("ParseStalePolicy(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseStalePolicy("discard"); err == nil {
+		t.Error("ParseStalePolicy accepted an unknown policy")
+	}
+}
@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DevelopmentEnvironment is the environment whose loggers default to the
+// ConsoleFormatter
+const DevelopmentEnvironment = "development"
+
+const (
+	colorReset  = "\x1b[0m"
+	colorGray   = "\x1b[90m"
+	colorBlue   = "\x1b[34m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorRed    = "\x1b[31m"
+	colorBold   = "\x1b[1m"
+)
+
+// consoleMessageWidth pads messages so the fields after them line up
+const consoleMessageWidth = 40
+
+// ConsoleFormatter renders entries as short aligned lines for reading in a
+// terminal during development, e.g. "15:04:05 INF msg key=value"
+type ConsoleFormatter struct {
+	TimestampFormat string
+	// Color enables ANSI colors
+	Color bool
+}
+
+// NewConsoleFormatter creates a console formatter for entries written to w,
+// with colors only when w is a terminal and NO_COLOR isn't set
+func NewConsoleFormatter(w io.Writer) *ConsoleFormatter {
+	return &ConsoleFormatter{Color: isTerminal(w) && os.Getenv("NO_COLOR") == ""}
+}
+
+func (f *ConsoleFormatter) Format(entry LogEntry) ([]byte, error) {
+	timestampFormat := f.TimestampFormat
+	if timestampFormat == "" {
+		timestampFormat = time.TimeOnly
+	}
+
+	var buf bytes.Buffer
+	f.colored(&buf, colorGray, time.Now().Format(timestampFormat))
+	buf.WriteByte(' ')
+	level, color := consoleLevel(entry.Level)
+	f.colored(&buf, color, level)
+	buf.WriteByte(' ')
+	buf.WriteString(entry.Message)
+
+	pairs := make([][2]string, 0, len(entry.Fields)+4)
+	for _, id := range [][2]string{
+		{"trace_id", entry.TraceID},
+		{"span_id", entry.SpanID},
+		{"request_id", entry.RequestID},
+		{"caller", entry.Caller},
+	} {
+		if id[1] != "" {
+			pairs = append(pairs, id)
+		}
+	}
+	keys := make([]string, 0, len(entry.Fields))
+	for k := range entry.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pairs = append(pairs, [2]string{k, fmt.Sprint(entry.Fields[k])})
+	}
+
+	if len(pairs) > 0 {
+		if pad := consoleMessageWidth - len(entry.Message); pad > 0 {
+			buf.WriteString(strings.Repeat(" ", pad))
+		}
+	}
+	for _, pair := range pairs {
+		buf.WriteByte(' ')
+		f.colored(&buf, colorGray, pair[0]+"=")
+		value := pair[1]
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *ConsoleFormatter) colored(buf *bytes.Buffer, color, s string) {
+	if !f.Color {
+		buf.WriteString(s)
+		return
+	}
+	buf.WriteString(color)
+	buf.WriteString(s)
+	buf.WriteString(colorReset)
+}
+
+// consoleLevel returns the three letter code and color for a level name
+func consoleLevel(level string) (string, string) {
+	switch level {
+	case "DEBUG":
+		return "DBG", colorBlue
+	case "INFO":
+		return "INF", colorGreen
+	case "WARN":
+		return "WRN", colorYellow
+	case "ERROR":
+		return "ERR", colorRed
+	case "FATAL":
+		return "FTL", colorBold + colorRed
+	case "AUDIT":
+		return "AUD", colorBold
+	}
+	if len(level) > 3 {
+		level = level[:3]
+	}
+	return level, ""
+}
+
+// isTerminal reports whether w is a character device such as a TTY
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
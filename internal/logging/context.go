@@ -0,0 +1,32 @@
+package logging
+
+import "context"
+
+// ctxKey is the type of context keys used by the logger, so they can't
+// collide with keys from other packages
+type ctxKey string
+
+const (
+	// TraceIDKey is the context key for the trace ID added to log entries
+	TraceIDKey ctxKey = "trace_id"
+	// SpanIDKey is the context key for the span ID added to log entries
+	SpanIDKey ctxKey = "span_id"
+	// RequestIDKey is the context key for the HTTP request ID added to log
+	// entries
+	RequestIDKey ctxKey = "request_id"
+)
+
+// WithTraceID returns a context whose log entries carry traceID
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, TraceIDKey, traceID)
+}
+
+// WithSpanID returns a context whose log entries carry spanID
+func WithSpanID(ctx context.Context, spanID string) context.Context {
+	return context.WithValue(ctx, SpanIDKey, spanID)
+}
+
+// WithRequestID returns a context whose log entries carry requestID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, RequestIDKey, requestID)
+}
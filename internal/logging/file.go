@@ -0,0 +1,135 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotateRetryInterval is how long a file that failed to rotate keeps
+// growing before rotation is tried again
+const rotateRetryInterval = time.Minute
+
+// RotationOptions controls size-based rotation of a log file.
+// Zero values disable the corresponding limit.
+type RotationOptions struct {
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+}
+
+// rotatingFile is an io.WriteCloser that rotates the underlying file once it
+// exceeds MaxSizeMB. The current file is renamed with a timestamp suffix and
+// a fresh file opened; rotation only happens between writes so no line is
+// ever split across files.
+type rotatingFile struct {
+	mu   sync.Mutex
+	path string
+	opts RotationOptions
+	file *os.File
+	size int64
+	// rename moves the current file to its backup name
+	rename func(oldpath, newpath string) error
+	// retryAt holds off rotation after a failed attempt
+	retryAt time.Time
+}
+
+func openRotatingFile(path string, opts RotationOptions) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, opts: opts, rename: os.Rename}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	maxSize := int64(f.opts.MaxSizeMB) * 1024 * 1024
+	if maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > maxSize && !time.Now().Before(f.retryAt) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// rotate moves the current file aside and opens a fresh one. The file is
+// closed first since open files can't be renamed on every platform. If the
+// rename fails the original path is reopened and appended to, so logging
+// carries on, and rotation is retried after rotateRetryInterval.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+
+	backup := f.path + "." + time.Now().Format(backupTimeFormat)
+	renameErr := f.rename(f.path, backup)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		f.retryAt = time.Now().Add(rotateRetryInterval)
+		return nil
+	}
+
+	f.prune()
+	return nil
+}
+
+// prune removes backups beyond MaxBackups or older than MaxAgeDays
+func (f *rotatingFile) prune() {
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	// Timestamp suffixes sort chronologically; newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	cutoff := time.Now().AddDate(0, 0, -f.opts.MaxAgeDays)
+	for i, backup := range backups {
+		stamp, err := time.ParseInLocation(backupTimeFormat, strings.TrimPrefix(backup, f.path+"."), time.Local)
+		if err != nil {
+			continue
+		}
+		tooMany := f.opts.MaxBackups > 0 && i >= f.opts.MaxBackups
+		tooOld := f.opts.MaxAgeDays > 0 && stamp.Before(cutoff)
+		if tooMany || tooOld {
+			os.Remove(backup)
+		}
+	}
+}
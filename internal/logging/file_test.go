@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gotunnel.log")
+	f, err := openRotatingFile(path, RotationOptions{MaxSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	line := strings.Repeat("x", 1023) + "\n"
+	for i := 0; i < 1025; i++ {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("got backups %v, want one", backups)
+	}
+	if data, _ := os.ReadFile(path); string(data) != line {
+		t.Errorf("current file holds %d bytes, want the last line only", len(data))
+	}
+}
+
+func TestRotatingFileKeepsWritingWhenRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gotunnel.log")
+	f, err := openRotatingFile(path, RotationOptions{MaxSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.rename = func(string, string) error { return errors.New("rename refused") }
+
+	line := strings.Repeat("x", 1023) + "\n"
+	for i := 0; i < 1030; i++ {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(1030 * len(line)); info.Size() != want {
+		t.Errorf("file holds %d bytes, want all %d appended to the original path", info.Size(), want)
+	}
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogfmtFormatter renders entries as key=value logfmt lines. Fields are
+// flattened into top-level pairs in sorted key order.
+type LogfmtFormatter struct {
+	TimestampFormat string
+}
+
+func (f *LogfmtFormatter) Format(entry LogEntry) ([]byte, error) {
+	timestampFormat := f.TimestampFormat
+	if timestampFormat == "" {
+		timestampFormat = time.RFC3339
+	}
+
+	var buf bytes.Buffer
+	writeLogfmtPair(&buf, "timestamp", time.Now().Format(timestampFormat))
+	writeLogfmtPair(&buf, "level", entry.Level)
+	writeLogfmtPair(&buf, "service", entry.Service)
+	writeLogfmtPair(&buf, "environment", entry.Environment)
+	if entry.Version != "" {
+		writeLogfmtPair(&buf, "version", entry.Version)
+	}
+	writeLogfmtPair(&buf, "msg", entry.Message)
+	if entry.TraceID != "" {
+		writeLogfmtPair(&buf, "trace_id", entry.TraceID)
+	}
+	if entry.SpanID != "" {
+		writeLogfmtPair(&buf, "span_id", entry.SpanID)
+	}
+	if entry.RequestID != "" {
+		writeLogfmtPair(&buf, "request_id", entry.RequestID)
+	}
+	if entry.Caller != "" {
+		writeLogfmtPair(&buf, "caller", entry.Caller)
+	}
+
+	keys := make([]string, 0, len(entry.Fields))
+	for k := range entry.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeLogfmtPair(&buf, k, fmt.Sprint(entry.Fields[k]))
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeLogfmtPair(buf *bytes.Buffer, key, value string) {
+	if buf.Len() > 0 {
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(key)
+	buf.WriteByte('=')
+	if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+		buf.WriteString(strconv.Quote(value))
+	} else {
+		buf.WriteString(value)
+	}
+}
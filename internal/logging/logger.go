@@ -2,10 +2,22 @@ package logging
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"gotunnel-pro/internal/metrics"
+	"gotunnel-pro/internal/version"
 )
 
 type Level int
@@ -18,13 +30,71 @@ const (
 	FATAL
 )
 
+// PrivacyMode controls how PII fields are written to the operational log
+type PrivacyMode int
+
+const (
+	// PrivacyOff logs PII fields as-is
+	PrivacyOff PrivacyMode = iota
+	// PrivacyHash replaces PII values with a truncated SHA-256 so entries can
+	// still be correlated without revealing the value
+	PrivacyHash
+	// PrivacyOmit drops PII fields entirely
+	PrivacyOmit
+	// PrivacyRedact keeps PII fields but replaces their values with
+	// "[REDACTED]"
+	PrivacyRedact
+)
+
+// DefaultPIIFields are the field names treated as PII in privacy mode
+var DefaultPIIFields = []string{"remote_addr", "client_ip", "client_cn", "identity", "cert_serial"}
+
+// ParsePrivacyMode parses a privacy mode name as used in config files:
+// off (or empty), hash, omit or redact
+func ParsePrivacyMode(name string) (PrivacyMode, error) {
+	switch name {
+	case "", "off":
+		return PrivacyOff, nil
+	case "hash":
+		return PrivacyHash, nil
+	case "omit":
+		return PrivacyOmit, nil
+	case "redact":
+		return PrivacyRedact, nil
+	default:
+		return PrivacyOff, fmt.Errorf("unknown privacy mode %q", name)
+	}
+}
+
 type Logger struct {
+	// loggerCore is shared with loggers derived by WithFields, so a level,
+	// output or formatter change on any of them applies to all
+	*loggerCore
+	baseFields map[string]interface{}
+}
+
+type loggerCore struct {
 	mu          sync.RWMutex
 	level       Level
 	serviceName string
 	environment string
 	formatter   Formatter
-	output      *os.File
+	output      io.Writer
+	// ownsOutput is set when the logger opened output itself and so
+	// closes it
+	ownsOutput  bool
+	auditOutput io.Writer
+	// ownsAuditOutput is set when the audit output is a file opened by
+	// SetAuditFile
+	ownsAuditOutput bool
+	maxFields       int
+	privacy         PrivacyMode
+	piiFields       map[string]struct{}
+	// reportCaller adds the file, line and function of the logging call
+	reportCaller bool
+	sampler      Sampler
+	// recent keeps the last entries written, for diagnostics
+	recent *recentBuffer
 }
 
 type Formatter interface {
@@ -40,9 +110,12 @@ type LogEntry struct {
 	Level       string                 `json:"level"`
 	Service     string                 `json:"service"`
 	Environment string                 `json:"environment"`
+	Version     string                 `json:"version,omitempty"`
 	Message     string                 `json:"message"`
 	TraceID     string                 `json:"trace_id,omitempty"`
 	SpanID      string                 `json:"span_id,omitempty"`
+	RequestID   string                 `json:"request_id,omitempty"`
+	Caller      string                 `json:"caller,omitempty"`
 	Fields      map[string]interface{} `json:"fields,omitempty"`
 }
 
@@ -58,75 +131,444 @@ func (f *JSONFormatter) Format(entry LogEntry) ([]byte, error) {
 	return json.Marshal(entry)
 }
 
+// NewLogger creates a logger writing JSON to stdout, or console lines in
+// the development environment
 func NewLogger(serviceName, environment string, level Level) *Logger {
-	return &Logger{
+	return &Logger{loggerCore: &loggerCore{
 		level:       level,
 		serviceName: serviceName,
 		environment: environment,
-		formatter:   &JSONFormatter{},
+		formatter:   defaultFormatter(environment, os.Stdout),
 		output:      os.Stdout,
+	}}
+}
+
+func defaultFormatter(environment string, output io.Writer) Formatter {
+	if environment == DevelopmentEnvironment {
+		return NewConsoleFormatter(output)
+	}
+	return &JSONFormatter{}
+}
+
+// NewFileLogger creates a logger writing to path, rotating the file once it
+// exceeds opts.MaxSizeMB and pruning old backups
+func NewFileLogger(serviceName, environment string, level Level, path string, opts RotationOptions) (*Logger, error) {
+	file, err := openRotatingFile(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	l := NewLogger(serviceName, environment, level)
+	l.output = file
+	l.ownsOutput = true
+	l.formatter = defaultFormatter(environment, file)
+	return l, nil
+}
+
+// Close flushes and closes the log and audit outputs if they were opened by
+// the logger, such as a log file or syslog connection. Writers passed to
+// SetOutput or SetAuditOutput and stdout are left open.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.Join(l.closeOutput(), l.closeAuditOutput())
+}
+
+func (l *Logger) closeOutput() error {
+	if closer, ok := l.output.(io.Closer); ok && l.ownsOutput {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (l *Logger) closeAuditOutput() error {
+	closer, ok := l.auditOutput.(io.Closer)
+	if !ok || !l.ownsAuditOutput {
+		return nil
+	}
+	l.auditOutput, l.ownsAuditOutput = nil, false
+	return closer.Close()
+}
+
+// SetOutput sends entries to w, e.g. a bytes.Buffer in tests or a custom
+// sink, for l and every logger derived from it with WithFields. Each entry
+// is a single Write made under the lock they share. The formatter is kept;
+// use SetFormatter to match it to w. An output the logger opened itself is
+// closed.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeOutput()
+	l.output = w
+	l.ownsOutput = false
+}
+
+// SetLevel changes the minimum level logged, e.g. to enable debug logging
+// on a running process
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+}
+
+// GetLevel returns the minimum level logged
+func (l *Logger) GetLevel() Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.level
+}
+
+// SetFormatter changes how entries are rendered, e.g. to a LogfmtFormatter
+// or ConsoleFormatter
+func (l *Logger) SetFormatter(formatter Formatter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.formatter = formatter
+}
+
+// SetRecentBuffer keeps the last n entries in memory, whatever the output,
+// so Recent can include them in diagnostics. Zero stops keeping them.
+func (l *Logger) SetRecentBuffer(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recent = nil
+	if n > 0 {
+		l.recent = newRecentBuffer(n)
 	}
 }
 
-func (l *Logger) log(ctx context.Context, level Level, msg string, fields map[string]interface{}) {
-	if level < l.level {
+// Recent returns the entries kept by SetRecentBuffer, oldest first, each
+// ending in a newline
+func (l *Logger) Recent() [][]byte {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.recent == nil {
+		return nil
+	}
+	return l.recent.list()
+}
+
+// SetReportCaller adds a caller field naming the file, line and function
+// of each logging call. It costs a stack walk per entry, so it is off by
+// default.
+func (l *Logger) SetReportCaller(enabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reportCaller = enabled
+}
+
+// SetSampler throttles repeated entries, e.g. during reconnect storms.
+// Dropped entries are counted in metrics. Audit entries are never sampled.
+// A nil sampler writes every entry.
+func (l *Logger) SetSampler(sampler Sampler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sampler = sampler
+}
+
+// SetMaxFields caps the number of keys in an entry's fields; extra keys are
+// dropped before formatting and reported in a fields_truncated field.
+// Audit entries and metric snapshots are never capped. Zero means
+// unlimited.
+func (l *Logger) SetMaxFields(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxFields = n
+}
+
+// SetPrivacy hashes, omits or redacts the named PII fields in operational
+// log entries. Audit entries always keep them.
+func (l *Logger) SetPrivacy(mode PrivacyMode, piiFields []string) {
+	set := make(map[string]struct{}, len(piiFields))
+	for _, f := range piiFields {
+		set[f] = struct{}{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.privacy = mode
+	l.piiFields = set
+}
+
+// SetAuditOutput sends audit entries to output, e.g. a separate,
+// access-controlled sink. Until an audit output is set audit entries are
+// dropped, so they never end up in the operational log by accident.
+func (l *Logger) SetAuditOutput(output io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeAuditOutput()
+	l.auditOutput = output
+}
+
+// SetAuditFile appends audit entries to the file at path, creating it
+// readable by the owner only. Close closes it.
+func (l *Logger) SetAuditFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeAuditOutput()
+	l.auditOutput = file
+	l.ownsAuditOutput = true
+	return nil
+}
+
+// Audit records a security-relevant event to the audit output. Audit
+// entries are never filtered by level or privacy mode. Without an audit
+// output they are dropped.
+func (l *Logger) Audit(ctx context.Context, msg string, fields map[string]interface{}) {
+	fields = l.mergeBaseFields(fields)
+
+	l.mu.RLock()
+	formatter := l.formatter
+	reportCaller := l.reportCaller
+	hasOutput := l.auditOutput != nil
+	l.mu.RUnlock()
+	if !hasOutput {
 		return
 	}
 
+	entry := l.newEntry(ctx, "AUDIT", msg, fields)
+	if reportCaller {
+		// Skip Audit itself
+		entry.Caller = caller(2)
+	}
+	data, err := formatter.Format(entry)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	output := l.auditOutput
+	if output == nil {
+		return
+	}
+	if w, ok := output.(*asyncWriter); ok {
+		w.writeBlocking(append(data, '\n'))
+		return
+	}
+	output.Write(append(data, '\n'))
+}
+
+// log writes an entry at level. capFields applies the SetMaxFields cap,
+// which snapshots skip since every one of their fields is a metric.
+func (l *Logger) log(ctx context.Context, level Level, msg string, fields map[string]interface{}, capFields bool) {
+	l.mu.RLock()
+	minLevel := l.level
+	maxFields := l.maxFields
+	privacy := l.privacy
+	piiFields := l.piiFields
+	formatter := l.formatter
+	reportCaller := l.reportCaller
+	sampler := l.sampler
+	l.mu.RUnlock()
+	if level < minLevel {
+		return
+	}
+	if sampler != nil && !sampler.Sample(level, msg) {
+		metrics.RecordLogDropped(level.String())
+		return
+	}
+
+	fields = l.mergeBaseFields(fields)
+	if capFields && maxFields > 0 && len(fields) > maxFields {
+		fields = truncateFields(fields, maxFields)
+	}
+	if privacy != PrivacyOff {
+		fields = scrubFields(fields, piiFields, privacy)
+	}
+
+	entry := l.newEntry(ctx, level.String(), msg, fields)
+	if reportCaller {
+		// Skip log and the Debug/Info/Warn/Error/Fatal wrapper
+		entry.Caller = caller(3)
+	}
+	data, err := formatter.Format(entry)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// A single write per entry so rotation never splits a line
+	data = append(data, '\n')
+	l.output.Write(data)
+	if l.recent != nil {
+		l.recent.add(data)
+	}
+}
+
+func (l *Logger) newEntry(ctx context.Context, level, msg string, fields map[string]interface{}) LogEntry {
 	entry := LogEntry{
-		Level:       level.String(),
+		Level:       level,
 		Service:     l.serviceName,
 		Environment: l.environment,
+		Version:     version.Version,
 		Message:     msg,
 		Fields:      fields,
 	}
 
 	// Extract trace/span IDs from context if available
-	if traceID := ctx.Value("trace_id"); traceID != nil {
-		entry.TraceID = traceID.(string)
+	if traceID, ok := ctx.Value(TraceIDKey).(string); ok {
+		entry.TraceID = traceID
+	}
+	if spanID, ok := ctx.Value(SpanIDKey).(string); ok {
+		entry.SpanID = spanID
 	}
-	if spanID := ctx.Value("span_id"); spanID != nil {
-		entry.SpanID = spanID.(string)
+	if requestID, ok := ctx.Value(RequestIDKey).(string); ok {
+		entry.RequestID = requestID
 	}
+	return entry
+}
 
-	data, err := l.formatter.Format(entry)
-	if err != nil {
-		return
+// caller describes the function skip frames above it as
+// "dir/file.go:line pkg.Function"
+func caller(skip int) string {
+	pc, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		return ""
 	}
+	file = filepath.Join(filepath.Base(filepath.Dir(file)), filepath.Base(file))
 
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	l.output.Write(data)
-	l.output.Write([]byte("\n"))
+	name := "unknown"
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		name = fn.Name()
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+	}
+	return fmt.Sprintf("%s:%d %s", file, line, name)
+}
+
+// mergeBaseFields combines the logger's base fields with per-call fields,
+// per-call values taking precedence on key collisions
+func (l *Logger) mergeBaseFields(fields map[string]interface{}) map[string]interface{} {
+	if len(l.baseFields) == 0 {
+		return fields
+	}
+
+	merged := make(map[string]interface{}, len(l.baseFields)+len(fields))
+	for k, v := range l.baseFields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return merged
+}
+
+// truncateFields keeps the first max keys of fields in sorted order and
+// records how many were dropped
+func truncateFields(fields map[string]interface{}, max int) map[string]interface{} {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	truncated := make(map[string]interface{}, max+1)
+	for _, k := range keys[:max] {
+		truncated[k] = fields[k]
+	}
+	truncated["fields_truncated"] = len(fields) - max
+	return truncated
+}
+
+// scrubFields returns a copy of fields with PII values hashed, removed or
+// redacted
+func scrubFields(fields map[string]interface{}, piiFields map[string]struct{}, mode PrivacyMode) map[string]interface{} {
+	scrubbed := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if _, ok := piiFields[k]; !ok {
+			scrubbed[k] = v
+			continue
+		}
+		switch mode {
+		case PrivacyHash:
+			sum := sha256.Sum256([]byte(fmt.Sprint(v)))
+			scrubbed[k] = "sha256:" + hex.EncodeToString(sum[:8])
+		case PrivacyRedact:
+			scrubbed[k] = "[REDACTED]"
+		}
+	}
+	return scrubbed
 }
 
 func (l *Logger) Debug(ctx context.Context, msg string, fields map[string]interface{}) {
-	l.log(ctx, DEBUG, msg, fields)
+	l.log(ctx, DEBUG, msg, fields, true)
 }
 
 func (l *Logger) Info(ctx context.Context, msg string, fields map[string]interface{}) {
-	l.log(ctx, INFO, msg, fields)
+	l.log(ctx, INFO, msg, fields, true)
 }
 
 func (l *Logger) Warn(ctx context.Context, msg string, fields map[string]interface{}) {
-	l.log(ctx, WARN, msg, fields)
+	l.log(ctx, WARN, msg, fields, true)
 }
 
 func (l *Logger) Error(ctx context.Context, msg string, fields map[string]interface{}) {
-	l.log(ctx, ERROR, msg, fields)
+	l.log(ctx, ERROR, msg, fields, true)
 }
 func (l *Logger) Fatal(ctx context.Context, msg string, fields map[string]interface{}) {
-	l.log(ctx, FATAL, msg, fields)
+	l.log(ctx, FATAL, msg, fields, true)
+	l.mu.Lock()
+	if w, ok := l.output.(*asyncWriter); ok {
+		w.close()
+	}
+	l.mu.Unlock()
 	os.Exit(1)
 }
 
+// WithFields returns a logger that adds fields to every entry, on top of any
+// base fields of l. It shares l's level, output and other settings, so
+// changing them on either logger changes both.
 func (l *Logger) WithFields(fields map[string]interface{}) *Logger {
-	return &Logger{
-		level:       l.level,
-		serviceName: l.serviceName,
-		environment: l.environment,
-		formatter:   l.formatter,
-		output:      l.output,
+	baseFields := make(map[string]interface{}, len(l.baseFields)+len(fields))
+	for k, v := range l.baseFields {
+		baseFields[k] = v
+	}
+	for k, v := range fields {
+		baseFields[k] = v
+	}
+
+	return &Logger{loggerCore: l.loggerCore, baseFields: baseFields}
+}
+
+// RunMetricsSnapshots logs the values returned by snapshot as a single
+// "metrics snapshot" entry every interval until ctx is cancelled, so
+// log-based dashboards can derive rates without Prometheus. Snapshots are
+// exempt from SetMaxFields, which would silently drop metrics.
+func (l *Logger) RunMetricsSnapshots(ctx context.Context, interval time.Duration, snapshot func() map[string]interface{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.log(ctx, INFO, "metrics snapshot", snapshot(), false)
+		}
+	}
+}
+
+// ParseLevel parses a level name as used in config files
+func ParseLevel(name string) (Level, error) {
+	switch name {
+	case "debug":
+		return DEBUG, nil
+	case "info":
+		return INFO, nil
+	case "warn":
+		return WARN, nil
+	case "error":
+		return ERROR, nil
+	default:
+		return INFO, fmt.Errorf("unknown log level %q", name)
 	}
 }
 
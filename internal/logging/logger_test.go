@@ -0,0 +1,339 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"gotunnel-pro/internal/metrics"
+	"gotunnel-pro/internal/version"
+)
+
+// newTestLogger returns a JSON logger writing to the returned buffer
+func newTestLogger(level Level) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := NewLogger("gotunnel-test", "test", level)
+	l.SetOutput(&buf)
+	return l, &buf
+}
+
+// decodeEntries parses each JSON line written to buf
+func decodeEntries(t *testing.T, buf *bytes.Buffer) []LogEntry {
+	t.Helper()
+	var entries []LogEntry
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var entry LogEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("decode log entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestWithFieldsChained(t *testing.T) {
+	l, buf := newTestLogger(INFO)
+	child := l.WithFields(map[string]interface{}{"tunnel": "web", "attempt": 1}).
+		WithFields(map[string]interface{}{"client": "alice", "attempt": 2})
+
+	child.Info(context.Background(), "connected", map[string]interface{}{"attempt": 3})
+	l.Info(context.Background(), "parent", nil)
+
+	entries := decodeEntries(t, buf)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	fields := entries[0].Fields
+	if fields["tunnel"] != "web" || fields["client"] != "alice" {
+		t.Errorf("fields = %v, want both sets of base fields", fields)
+	}
+	if fields["attempt"] != float64(3) {
+		t.Errorf("attempt = %v, want the per-call value 3", fields["attempt"])
+	}
+	if len(entries[1].Fields) != 0 {
+		t.Errorf("parent entry has fields %v, want none", entries[1].Fields)
+	}
+}
+
+func TestEntriesCarryBuildVersion(t *testing.T) {
+	defer func(v string) { version.Version = v }(version.Version)
+	version.Version = "v1.2.3"
+
+	l, buf := newTestLogger(INFO)
+	l.Info(context.Background(), "started", nil)
+	l.WithFields(map[string]interface{}{"tunnel": "web"}).Warn(context.Background(), "slow", nil)
+
+	entries := decodeEntries(t, buf)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Version != "v1.2.3" {
+			t.Errorf("%q entry version = %q, want v1.2.3", entry.Message, entry.Version)
+		}
+	}
+}
+
+func TestWithFieldsSharesSettings(t *testing.T) {
+	l, buf := newTestLogger(INFO)
+	child := l.WithFields(map[string]interface{}{"tunnel": "web"})
+
+	child.Debug(context.Background(), "hidden", nil)
+	l.SetLevel(DEBUG)
+	child.Debug(context.Background(), "shown", nil)
+
+	var redirected bytes.Buffer
+	l.SetOutput(&redirected)
+	child.Info(context.Background(), "redirected", nil)
+
+	if entries := decodeEntries(t, buf); len(entries) != 1 || entries[0].Message != "shown" {
+		t.Errorf("entries = %+v, want only the debug entry logged after SetLevel", entries)
+	}
+	if entries := decodeEntries(t, &redirected); len(entries) != 1 || entries[0].Message != "redirected" {
+		t.Errorf("entries = %+v, want the child's entry in the parent's new output", entries)
+	}
+}
+
+func TestAuditNeedsExplicitOutput(t *testing.T) {
+	l, buf := newTestLogger(INFO)
+	l.Audit(context.Background(), "rejected client", map[string]interface{}{"client_cn": "mallory"})
+	if buf.Len() != 0 {
+		t.Fatalf("audit entry written to the operational log without an audit output: %s", buf)
+	}
+
+	var audit bytes.Buffer
+	l.SetAuditOutput(&audit)
+	l.SetPrivacy(PrivacyOmit, DefaultPIIFields)
+	l.Audit(context.Background(), "rejected client", map[string]interface{}{"client_cn": "mallory"})
+	l.Info(context.Background(), "rejected client", map[string]interface{}{"client_cn": "mallory"})
+
+	entries := decodeEntries(t, &audit)
+	if len(entries) != 1 || entries[0].Level != "AUDIT" || entries[0].Fields["client_cn"] != "mallory" {
+		t.Errorf("audit entries = %+v, want one AUDIT entry keeping client_cn", entries)
+	}
+	entries = decodeEntries(t, buf)
+	if len(entries) != 1 || entries[0].Level != "INFO" || entries[0].Fields["client_cn"] != nil {
+		t.Errorf("operational entries = %+v, want one INFO entry without client_cn", entries)
+	}
+}
+
+func TestPrivacyScrubsIdentity(t *testing.T) {
+	tests := []struct {
+		mode PrivacyMode
+		want func(interface{}) bool
+	}{
+		{PrivacyHash, func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && strings.HasPrefix(s, "sha256:") && !strings.Contains(s, "edge-1")
+		}},
+		{PrivacyRedact, func(v interface{}) bool { return v == "[REDACTED]" }},
+	}
+	for _, tt := range tests {
+		l, buf := newTestLogger(INFO)
+		l.SetPrivacy(tt.mode, DefaultPIIFields)
+		l.Info(context.Background(), "client admitted", map[string]interface{}{"identity": "edge-1", "tunnel": "web"})
+		l.Info(context.Background(), "client admitted", map[string]interface{}{"identity": "edge-1"})
+
+		entries := decodeEntries(t, buf)
+		if len(entries) != 2 {
+			t.Fatalf("mode %d: got %d entries, want 2", tt.mode, len(entries))
+		}
+		if got := entries[0].Fields["identity"]; !tt.want(got) {
+			t.Errorf("mode %d: identity = %v, want it scrubbed", tt.mode, got)
+		}
+		if entries[0].Fields["tunnel"] != "web" {
+			t.Errorf("mode %d: tunnel = %v, want non-PII fields kept", tt.mode, entries[0].Fields["tunnel"])
+		}
+		// The same value scrubs the same way, so entries still correlate
+		if entries[0].Fields["identity"] != entries[1].Fields["identity"] {
+			t.Errorf("mode %d: identity scrubbed to %v and %v, want the same value", tt.mode, entries[0].Fields["identity"], entries[1].Fields["identity"])
+		}
+	}
+}
+
+func TestParsePrivacyMode(t *testing.T) {
+	for name, want := range map[string]PrivacyMode{"": PrivacyOff, "off": PrivacyOff, "hash": PrivacyHash, "omit": PrivacyOmit, "redact": PrivacyRedact} {
+		if got, err := ParsePrivacyMode(name); err != nil || got != want {
+			t.Errorf("ParsePrivacyMode(%q) = %d, %v, want %d", name, got, err, want)
+		}
+	}
+	if _, err := ParsePrivacyMode("scramble"); err == nil {
+		t.Error("ParsePrivacyMode(scramble) succeeded, want an error")
+	}
+}
+
+func TestReportCallerPointsAtCallSite(t *testing.T) {
+	l, buf := newTestLogger(INFO)
+	l.SetReportCaller(true)
+	l.Info(context.Background(), "from the test", nil)
+	l.WithFields(map[string]interface{}{"tunnel": "web"}).Warn(context.Background(), "from a child", nil)
+
+	for _, entry := range decodeEntries(t, buf) {
+		if !strings.Contains(entry.Caller, "logger_test.go:") || !strings.Contains(entry.Caller, "TestReportCallerPointsAtCallSite") {
+			t.Errorf("%q caller = %q, want this test's call site", entry.Message, entry.Caller)
+		}
+	}
+}
+
+func BenchmarkLogger(b *testing.B) {
+	fields := map[string]interface{}{"tunnel": "web", "bytes": 1024}
+	for _, reportCaller := range []bool{false, true} {
+		name := "NoCaller"
+		if reportCaller {
+			name = "ReportCaller"
+		}
+		b.Run(name, func(b *testing.B) {
+			l := NewLogger("gotunnel-bench", "test", INFO)
+			l.SetOutput(io.Discard)
+			l.SetReportCaller(reportCaller)
+			ctx := context.Background()
+			b.ReportAllocs()
+			for b.Loop() {
+				l.Info(ctx, "forwarded connection", fields)
+			}
+		})
+	}
+}
+
+func TestRecentBufferKeepsLastEntries(t *testing.T) {
+	l, _ := newTestLogger(INFO)
+	if got := l.Recent(); got != nil {
+		t.Fatalf("Recent() before SetRecentBuffer = %q, want nil", got)
+	}
+
+	l.SetRecentBuffer(2)
+	for _, msg := range []string{"first", "second", "third"} {
+		l.Info(context.Background(), msg, nil)
+	}
+	l.Debug(context.Background(), "filtered", nil)
+
+	var recent bytes.Buffer
+	for _, line := range l.Recent() {
+		recent.Write(line)
+	}
+	entries := decodeEntries(t, &recent)
+	if len(entries) != 2 || entries[0].Message != "second" || entries[1].Message != "third" {
+		t.Errorf("recent entries = %+v, want second and third", entries)
+	}
+}
+
+func TestMaxFieldsTruncatesAndCounts(t *testing.T) {
+	l, buf := newTestLogger(INFO)
+	l.SetMaxFields(3)
+	tunnelLogger := l.WithFields(map[string]interface{}{"tunnel": "web"})
+
+	tunnelLogger.Info(context.Background(), "connection opened", map[string]interface{}{
+		"remote_addr": "10.0.0.1:5000",
+		"bytes_in":    10,
+		"bytes_out":   20,
+		"duration_ms": 5,
+	})
+	l.Info(context.Background(), "connection closed", map[string]interface{}{"a": 1, "b": 2, "c": 3})
+
+	entries := decodeEntries(t, buf)
+	if len(entries) != 2 {
+		t.Fatalf("entries = %d, want 2", len(entries))
+	}
+	// Base fields count towards the cap; the first keys in sorted order stay
+	want := map[string]interface{}{
+		"bytes_in":         float64(10),
+		"bytes_out":        float64(20),
+		"duration_ms":      float64(5),
+		"fields_truncated": float64(2),
+	}
+	if !reflect.DeepEqual(entries[0].Fields, want) {
+		t.Errorf("truncated fields = %v, want %v", entries[0].Fields, want)
+	}
+	if _, ok := entries[1].Fields["fields_truncated"]; ok || len(entries[1].Fields) != 3 {
+		t.Errorf("fields at the cap = %v, want all 3 without fields_truncated", entries[1].Fields)
+	}
+}
+
+func TestMetricsSnapshotsIgnoreMaxFields(t *testing.T) {
+	l, buf := newTestLogger(INFO)
+	l.SetMaxFields(1)
+	snapshot := map[string]interface{}{
+		`gotunnel_bytes_transferred_total{direction="in",tunnel="web"}`: 10,
+		`gotunnel_bytes_transferred_total{direction="in",tunnel="ssh"}`: 20,
+		`gotunnel_active_connections{tunnel="web"}`:                     1,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.RunMetricsSnapshots(ctx, 10*time.Millisecond, func() map[string]interface{} {
+			cancel()
+			return snapshot
+		})
+	}()
+	<-done
+
+	entries := decodeEntries(t, buf)
+	if len(entries) == 0 {
+		t.Fatal("no snapshot logged")
+	}
+	if fields := entries[0].Fields; len(fields) != len(snapshot) || fields["fields_truncated"] != nil {
+		t.Errorf("snapshot fields = %v, want every metric despite the cap", fields)
+	}
+}
+
+func TestTickSamplerWritesFirstThenEveryNth(t *testing.T) {
+	l, buf := newTestLogger(INFO)
+	l.SetSampler(NewTickSampler(time.Hour, 3, 5))
+	dropped := metrics.Default.LogEntriesDropped.WithLabelValues(WARN.String())
+	var before dto.Metric
+	if err := dropped.Write(&before); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		l.Warn(context.Background(), "connection failed", map[string]interface{}{"attempt": i})
+	}
+	// Other messages and levels are sampled separately
+	l.Info(context.Background(), "connection failed", nil)
+	l.Warn(context.Background(), "session stopped", nil)
+
+	var attempts []float64
+	var others int
+	for _, entry := range decodeEntries(t, buf) {
+		if entry.Level == WARN.String() && entry.Message == "connection failed" {
+			attempts = append(attempts, entry.Fields["attempt"].(float64))
+		} else {
+			others++
+		}
+	}
+	// The first 3, then the 5th and 10th of the 17 after them
+	if want := []float64{0, 1, 2, 7, 12, 17}; !reflect.DeepEqual(attempts, want) {
+		t.Errorf("written attempts = %v, want %v", attempts, want)
+	}
+	if others != 2 {
+		t.Errorf("other entries written = %d, want 2", others)
+	}
+	var after dto.Metric
+	if err := dropped.Write(&after); err != nil {
+		t.Fatal(err)
+	}
+	if got := after.GetCounter().GetValue() - before.GetCounter().GetValue(); got != 14 {
+		t.Errorf("dropped entries counted = %v, want 14", got)
+	}
+}
+
+func TestTickSamplerResetsEveryTick(t *testing.T) {
+	sampler := NewTickSampler(50*time.Millisecond, 1, 0)
+	if !sampler.Sample(WARN, "flood") || sampler.Sample(WARN, "flood") {
+		t.Fatal("want only the first entry of the tick written")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !sampler.Sample(WARN, "flood") {
+		t.Error("first entry of the next tick was dropped")
+	}
+}
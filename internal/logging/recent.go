@@ -0,0 +1,38 @@
+package logging
+
+import "bytes"
+
+// recentBuffer is a ring of the last entries a logger wrote. It is guarded
+// by the logger's lock.
+type recentBuffer struct {
+	entries [][]byte
+	next    int
+	full    bool
+}
+
+func newRecentBuffer(n int) *recentBuffer {
+	return &recentBuffer{entries: make([][]byte, n)}
+}
+
+func (r *recentBuffer) add(entry []byte) {
+	r.entries[r.next] = bytes.Clone(entry)
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns copies of the buffered entries, oldest first
+func (r *recentBuffer) list() [][]byte {
+	var ordered [][]byte
+	if r.full {
+		ordered = append(ordered, r.entries[r.next:]...)
+	}
+	ordered = append(ordered, r.entries[:r.next]...)
+
+	list := make([][]byte, len(ordered))
+	for i, entry := range ordered {
+		list[i] = bytes.Clone(entry)
+	}
+	return list
+}
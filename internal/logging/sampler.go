@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"sync"
+	"time"
+)
+
+// Sampler decides whether an entry is written. Entries are keyed by level
+// and message so a flood of one message doesn't suppress others.
+type Sampler interface {
+	Sample(level Level, msg string) bool
+}
+
+type samplerKey struct {
+	level Level
+	msg   string
+}
+
+type samplerCount struct {
+	resetAt time.Time
+	n       int
+}
+
+// TickSampler writes the first First entries of each level and message per
+// Tick, then every Thereafter-th. A Thereafter of zero drops every entry
+// past the first First until the next tick.
+type TickSampler struct {
+	mu         sync.Mutex
+	tick       time.Duration
+	first      int
+	thereafter int
+	counts     map[samplerKey]*samplerCount
+}
+
+// NewTickSampler creates a first-N-then-every-Mth sampler
+func NewTickSampler(tick time.Duration, first, thereafter int) *TickSampler {
+	return &TickSampler{
+		tick:       tick,
+		first:      first,
+		thereafter: thereafter,
+		counts:     make(map[samplerKey]*samplerCount),
+	}
+}
+
+func (s *TickSampler) Sample(level Level, msg string) bool {
+	now := time.Now()
+	key := samplerKey{level: level, msg: msg}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count, ok := s.counts[key]
+	if !ok || !now.Before(count.resetAt) {
+		// Drop counters of messages not seen for a tick so the map
+		// doesn't grow without bound
+		if !ok {
+			s.prune(now)
+		}
+		count = &samplerCount{resetAt: now.Add(s.tick)}
+		s.counts[key] = count
+	}
+
+	count.n++
+	if count.n <= s.first {
+		return true
+	}
+	return s.thereafter > 0 && (count.n-s.first)%s.thereafter == 0
+}
+
+func (s *TickSampler) prune(now time.Time) {
+	for key, count := range s.counts {
+		if !now.Before(count.resetAt) {
+			delete(s.counts, key)
+		}
+	}
+}
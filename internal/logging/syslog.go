@@ -0,0 +1,221 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog facilities, see RFC 5424 section 6.2.1
+const (
+	FacilityUser   = 1
+	FacilityDaemon = 3
+	FacilityLocal0 = 16
+)
+
+// syslogRedialInterval limits reconnect attempts while the syslog daemon
+// is unreachable, so logging calls don't each wait on a dial
+const syslogRedialInterval = 5 * time.Second
+
+// localSyslogSockets are tried in order for the local daemon
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogFormatter renders entries as RFC 5424 syslog messages whose MSG is
+// the entry rendered by Inner. The severity comes from the entry's level.
+type SyslogFormatter struct {
+	Inner    Formatter
+	Facility int
+	Hostname string
+}
+
+func (f *SyslogFormatter) Format(entry LogEntry) ([]byte, error) {
+	msg, err := f.Inner.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname := f.Hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	appName := entry.Service
+	if appName == "" {
+		appName = "-"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d - - ",
+		f.Facility*8+syslogSeverity(entry.Level),
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname, appName, os.Getpid())
+	buf.Write(msg)
+	return buf.Bytes(), nil
+}
+
+// syslogSeverity maps a level name to its syslog severity
+func syslogSeverity(level string) int {
+	switch level {
+	case "DEBUG":
+		return 7
+	case "INFO":
+		return 6
+	case "AUDIT":
+		return 5
+	case "WARN":
+		return 4
+	case "ERROR":
+		return 3
+	case "FATAL":
+		return 2
+	default:
+		return 6
+	}
+}
+
+// SetSyslogOutput sends entries to a syslog daemon instead of the current
+// output. target is "local" for the local daemon's socket, or a URL such as
+// udp://host:514 or tcp://host:601 for a remote one. If the daemon can't be
+// reached the logger is left unchanged and the error returned, so callers
+// can warn and carry on logging to stdout. Once connected, a dropped
+// connection is redialed and entries written meanwhile go to stderr.
+func (l *Logger) SetSyslogOutput(target string, facility int) error {
+	w, err := dialSyslog(target)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeOutput()
+	l.output = w
+	l.ownsOutput = true
+	l.formatter = &SyslogFormatter{
+		Inner:    defaultFormatter(l.environment, w),
+		Facility: facility,
+		Hostname: hostname,
+	}
+	return nil
+}
+
+// syslogWriter writes formatted messages to a syslog daemon, one message
+// per Write, reconnecting when the connection drops
+type syslogWriter struct {
+	mu        sync.Mutex
+	network   string
+	addr      string
+	conn      net.Conn
+	lastDial  time.Time
+	stderr    io.Writer
+	datagrams bool
+}
+
+func dialSyslog(target string) (*syslogWriter, error) {
+	if target == "local" {
+		var lastErr error
+		for _, path := range localSyslogSockets {
+			for _, network := range []string{"unixgram", "unix"} {
+				w := &syslogWriter{network: network, addr: path, stderr: os.Stderr}
+				if lastErr = w.dial(); lastErr == nil {
+					return w, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("failed to connect to local syslog: %w", lastErr)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid syslog address %q: want local, udp://host:port or tcp://host:port", target)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", u.Scheme)
+	}
+
+	w := &syslogWriter{network: u.Scheme, addr: u.Host, stderr: os.Stderr}
+	if err := w.dial(); err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog at %s: %w", target, err)
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) dial() error {
+	w.lastDial = time.Now()
+	conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	w.datagrams = w.network == "udp" || w.network == "unixgram"
+	return nil
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	msg := bytes.TrimSuffix(p, []byte("\n"))
+	if w.conn == nil && time.Since(w.lastDial) >= syslogRedialInterval {
+		w.dial()
+	}
+	if w.conn != nil {
+		err := w.send(msg)
+		if err == nil {
+			return len(p), nil
+		}
+		// Redial once straight away; daemons restart and drop streams
+		w.conn.Close()
+		w.conn = nil
+		if w.dial() == nil && w.send(msg) == nil {
+			return len(p), nil
+		}
+		if w.conn != nil {
+			w.conn.Close()
+			w.conn = nil
+		}
+	}
+	return w.stderr.Write(p)
+}
+
+// send writes one message, framed with octet counting on streams (RFC 6587)
+func (w *syslogWriter) send(msg []byte) error {
+	if w.datagrams {
+		_, err := w.conn.Write(msg)
+		return err
+	}
+	_, err := w.conn.Write(append([]byte(fmt.Sprintf("%d ", len(msg))), msg...))
+	return err
+}
+
+func (w *syslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// ParseFacility parses a syslog facility name such as "daemon" or "local0"
+func ParseFacility(name string) (int, error) {
+	switch name := strings.ToLower(name); {
+	case name == "" || name == "daemon":
+		return FacilityDaemon, nil
+	case name == "user":
+		return FacilityUser, nil
+	case len(name) == 6 && strings.HasPrefix(name, "local") && name[5] >= '0' && name[5] <= '7':
+		return FacilityLocal0 + int(name[5]-'0'), nil
+	default:
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+}
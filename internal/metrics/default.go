@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+)
+
+// Package-level helpers recording into Default
+
+// InitMetrics applies cfg to Default
+func InitMetrics(cfg MetricsConfig) error {
+	return Default.Configure(cfg)
+}
+
+// SetTunnels declares the statically configured tunnel names on Default
+func SetTunnels(names []string) {
+	Default.SetTunnels(names)
+}
+
+// RecordConnection records a new connection on a tunnel
+func RecordConnection(tunnel string) {
+	Default.RecordConnection(tunnel)
+}
+
+// RecordDisconnection records a disconnection from a tunnel
+func RecordDisconnection(tunnel string) {
+	Default.RecordDisconnection(tunnel)
+}
+
+// RecordTunnelUp records a named tunnel becoming established
+func RecordTunnelUp(tunnel string) {
+	Default.RecordTunnelUp(tunnel)
+}
+
+// RecordTunnelDown records a named tunnel going down
+func RecordTunnelDown(tunnel string) {
+	Default.RecordTunnelDown(tunnel)
+}
+
+// RecordTraffic records bytes transferred on a tunnel
+func RecordTraffic(direction, tunnel string, bytes int64) {
+	Default.RecordTraffic(direction, tunnel, bytes)
+}
+
+// RecordTransfer records wire and payload bytes for a tunnel
+func RecordTransfer(direction, tunnel string, wireBytes, payloadBytes int64) {
+	Default.RecordTransfer(direction, tunnel, wireBytes, payloadBytes)
+}
+
+// RecordStreamOpened records a multiplexed stream being opened
+func RecordStreamOpened() {
+	Default.RecordStreamOpened()
+}
+
+// RecordStreamClosed records a multiplexed stream being closed
+func RecordStreamClosed() {
+	Default.RecordStreamClosed()
+}
+
+// RecordReconnectAttempt records a reconnect attempt with result
+// "success" or "failure"
+func RecordReconnectAttempt(tunnel, result string) {
+	Default.RecordReconnectAttempt(tunnel, result)
+}
+
+// SetReconnectBackoff records the current reconnect backoff of a tunnel
+func SetReconnectBackoff(tunnel string, backoff time.Duration) {
+	Default.SetReconnectBackoff(tunnel, backoff)
+}
+
+// SetTunnelRateLimit records the configured bandwidth limit of a tunnel
+func SetTunnelRateLimit(tunnel string, bytesPerSec int64) {
+	Default.SetTunnelRateLimit(tunnel, bytesPerSec)
+}
+
+// RecordThrottled records bytes that were delayed by a tunnel's bandwidth limit
+func RecordThrottled(direction, tunnel string, bytes int64) {
+	Default.RecordThrottled(direction, tunnel, bytes)
+}
+
+// RecordBackendPool records whether a backend connection was reused from a
+// tunnel's pool or had to be dialed
+func RecordBackendPool(tunnel string, hit bool) {
+	Default.RecordBackendPool(tunnel, hit)
+}
+
+// SetBackendPoolIdle records the idle connections held in a tunnel's pool
+func SetBackendPoolIdle(tunnel string, idle int) {
+	Default.SetBackendPoolIdle(tunnel, idle)
+}
+
+// RecordRequest records request metrics
+func RecordRequest(method, status string, duration time.Duration) {
+	Default.RecordRequest(method, status, duration)
+}
+
+// RecordSetupPhase records the duration of a connection setup phase
+func RecordSetupPhase(phase string, duration time.Duration) {
+	Default.RecordSetupPhase(phase, duration)
+}
+
+// RecordHandshake records the duration of a TLS handshake
+func RecordHandshake(result string, d time.Duration) {
+	Default.RecordHandshake(result, d)
+}
+
+// RecordConnectionError records a connection error not tied to a tunnel
+func RecordConnectionError(errorType string) {
+	Default.RecordConnectionError(errorType)
+}
+
+// RecordTunnelConnectionError records a connection error on a tunnel
+func RecordTunnelConnectionError(tunnel, errorType string) {
+	Default.RecordTunnelConnectionError(tunnel, errorType)
+}
+
+// RecordTunnelRejection records a connection rejected on a specific tunnel
+func RecordTunnelRejection(tunnel, reason string) {
+	Default.RecordTunnelRejection(tunnel, reason)
+}
+
+// ConnectionErrorTotal returns the sum of all connection errors recorded so far
+func ConnectionErrorTotal() float64 {
+	return Default.ConnectionErrorTotal()
+}
+
+// SetHealthStatus sets the health status
+func SetHealthStatus(healthy bool) {
+	Default.SetHealthStatus(healthy)
+}
+
+// SetBuildInfo publishes the build version and commit
+func SetBuildInfo(version, commit string) {
+	Default.SetBuildInfo(version, commit)
+}
+
+// SetCertificateExpiry sets certificate expiry timestamp
+func SetCertificateExpiry(timestamp float64) {
+	Default.SetCertificateExpiry(timestamp)
+}
+
+// SetOCSPNextUpdate sets the NextUpdate timestamp of the OCSP staple
+func SetOCSPNextUpdate(timestamp float64) {
+	Default.SetOCSPNextUpdate(timestamp)
+}
+
+// RecordCertReload records the outcome of a certificate reload
+func RecordCertReload(success bool) {
+	Default.RecordCertReload(success)
+}
+
+// RecordIdleScan records the cost and coverage of an idle connection scan
+func RecordIdleScan(duration time.Duration, connections int) {
+	Default.RecordIdleScan(duration, connections)
+}
+
+// RecordLogDropped records a log entry dropped by sampling
+func RecordLogDropped(level string) {
+	Default.RecordLogDropped(level)
+}
+
+// RecordLogOverflow records a log entry dropped by a full async buffer
+func RecordLogOverflow() {
+	Default.RecordLogOverflow()
+}
+
+// RecordLogStale records a log entry dropped for waiting too long in an
+// async buffer
+func RecordLogStale() {
+	Default.RecordLogStale()
+}
+
+// SetCAExpiry sets the nearest CA certificate expiry timestamp
+func SetCAExpiry(timestamp float64) {
+	Default.SetCAExpiry(timestamp)
+}
+
+// SetTunnelTimeout records the effective timeout of the given kind for a tunnel
+func SetTunnelTimeout(tunnel, kind string, timeout time.Duration) {
+	Default.SetTunnelTimeout(tunnel, kind, timeout)
+}
+
+// MetricsHandler returns the handler serving Default
+func MetricsHandler() http.Handler {
+	return Default.Handler()
+}
+
+// CurrentStatus returns the status summary of Default
+func CurrentStatus() Status {
+	return Default.Status()
+}
+
+// Snapshot returns the current values of Default
+func Snapshot() map[string]interface{} {
+	return Default.Snapshot()
+}
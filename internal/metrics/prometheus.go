@@ -1,98 +1,695 @@
 package metrics
 
 import (
+	"fmt"
 	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 )
 
-var (
-	// ActiveConnections Connection metrics
-	ActiveConnections = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "gotunnel_active_connections",
-		Help: "Number of active tunnel connections",
-	})
+// MetricsConfig configures metrics whose shape comes from config
+type MetricsConfig struct {
+	// DurationBuckets are the request duration histogram buckets in
+	// seconds. Empty uses prometheus.DefBuckets.
+	DurationBuckets []float64 `yaml:"duration_buckets" json:"duration_buckets"`
+}
+
+// Validate reports buckets that aren't strictly increasing, which
+// Prometheus rejects when the histogram is built
+func (c MetricsConfig) Validate() error {
+	for i := 1; i < len(c.DurationBuckets); i++ {
+		if c.DurationBuckets[i] <= c.DurationBuckets[i-1] {
+			return fmt.Errorf("metrics duration_buckets must be strictly increasing, got %g after %g", c.DurationBuckets[i], c.DurationBuckets[i-1])
+		}
+	}
+	return nil
+}
 
-	TotalConnections = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "gotunnel_connections_total",
-		Help: "Total number of connections established",
-	})
+// OtherTunnel is the tunnel label used for names outside the configured set
+const OtherTunnel = "other"
 
-	ConnectionErrors = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "gotunnel_connection_errors_total",
-		Help: "Total connection errors by type",
-	}, []string{"error_type"})
+// SessionTunnel is the tunnel label for the client's shared session, which
+// serves every tunnel rather than one
+const SessionTunnel = "session"
+
+// Metrics holds a private Prometheus registry and the gotunnel collectors
+// registered with it, so several tunnel instances can run in one process
+type Metrics struct {
+	registry *prometheus.Registry
+
+	tunnelLabelsMu sync.RWMutex
+	tunnelLabels   map[string]struct{}
+
+	// ActiveConnections Connection metrics
+	ActiveConnections *prometheus.GaugeVec
+	TotalConnections  prometheus.Counter
+	ConnectionErrors  *prometheus.CounterVec
+	TunnelRejections  *prometheus.CounterVec
+	// ActiveTunnels is 1 for each named tunnel that is established end to
+	// end and 0 while it is down; its sum is the number of tunnels up
+	ActiveTunnels *prometheus.GaugeVec
 
 	// BytesTransferred Traffic metrics
-	BytesTransferred = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "gotunnel_bytes_transferred_total",
-		Help: "Total bytes transferred",
-	}, []string{"direction"})
+	BytesTransferred *prometheus.CounterVec
+	// WireBytes and PayloadBytes split traffic into bytes on the wire (after
+	// compression) and logical payload bytes (before compression)
+	WireBytes    *prometheus.CounterVec
+	PayloadBytes *prometheus.CounterVec
+
+	// OpenStreams Stream multiplexing metrics
+	OpenStreams prometheus.Gauge
+
+	// ReconnectAttempts Client reconnect metrics
+	ReconnectAttempts       *prometheus.CounterVec
+	ReconnectBackoffSeconds *prometheus.GaugeVec
+
+	// TunnelRateLimit Bandwidth shaping metrics
+	TunnelRateLimit *prometheus.GaugeVec
+	ThrottledBytes  *prometheus.CounterVec
+
+	// BackendPoolRequests Backend connection pool metrics
+	BackendPoolRequests *prometheus.CounterVec
+	BackendPoolIdle     *prometheus.GaugeVec
+
+	// RequestDuration Request metrics. It is replaced by Configure, so it is
+	// guarded by requestDurationMu.
+	RequestDuration   *prometheus.HistogramVec
+	requestDurationMu sync.RWMutex
+
+	// ConnectionSetupDuration Connection setup phase metrics
+	ConnectionSetupDuration *prometheus.HistogramVec
+
+	// TLSHandshakeDuration TLS handshake metrics
+	TLSHandshakeDuration *prometheus.HistogramVec
+
+	// CertificateExpiry Certificate metrics
+	CertificateExpiry prometheus.Gauge
+
+	// OCSPNextUpdate OCSP stapling metrics
+	OCSPNextUpdate prometheus.Gauge
+
+	// TunnelTimeoutSeconds Effective per-tunnel timeout configuration
+	TunnelTimeoutSeconds *prometheus.GaugeVec
+
+	// CertReloads Certificate rotation metrics
+	CertReloads        prometheus.Counter
+	CertReloadFailures prometheus.Counter
+
+	// IdleScanDuration Idle reaper metrics
+	IdleScanDuration    prometheus.Gauge
+	IdleScanConnections prometheus.Gauge
+
+	// CAExpiry Nearest CA certificate expiry
+	CAExpiry prometheus.Gauge
+
+	// BuildInfo Build metrics
+	BuildInfo *prometheus.GaugeVec
+
+	// LogEntriesDropped Logging metrics
+	LogEntriesDropped *prometheus.CounterVec
+	// LogEntriesOverflowed counts entries an async logger dropped because
+	// its buffer was full
+	LogEntriesOverflowed prometheus.Counter
+	// LogEntriesStale counts entries an async logger dropped because they
+	// waited in its buffer longer than the configured max age
+	LogEntriesStale prometheus.Counter
+
+	// HealthStatus Health metrics
+	HealthStatus prometheus.Gauge
+}
+
+// Default is the instance used by the package-level helpers
+var Default = NewMetrics()
+
+// NewMetrics creates the gotunnel collectors on a new registry, along with
+// the Go runtime and process collectors
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		ActiveConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gotunnel_active_connections",
+			Help: "Number of active tunnel connections",
+		}, []string{"tunnel"}),
+
+		TotalConnections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gotunnel_connections_total",
+			Help: "Total number of connections established",
+		}),
+
+		ConnectionErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotunnel_connection_errors_total",
+			Help: "Total connection errors by type",
+		}, []string{"error_type", "tunnel"}),
+
+		TunnelRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotunnel_tunnel_rejections_total",
+			Help: "Total connections rejected per tunnel by reason",
+		}, []string{"tunnel", "reason"}),
+
+		ActiveTunnels: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gotunnel_active_tunnels",
+			Help: "Whether each tunnel is established end to end (1 = up, 0 = down)",
+		}, []string{"tunnel"}),
+
+		BytesTransferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotunnel_bytes_transferred_total",
+			Help: "Total bytes transferred",
+		}, []string{"direction", "tunnel"}),
+
+		WireBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotunnel_wire_bytes_total",
+			Help: "Total bytes sent or received on the wire, after compression",
+		}, []string{"direction", "tunnel"}),
+
+		PayloadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotunnel_payload_bytes_total",
+			Help: "Total logical payload bytes, before compression",
+		}, []string{"direction", "tunnel"}),
 
-	// RequestDuration Request metrics
-	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		OpenStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gotunnel_mux_open_streams",
+			Help: "Number of open multiplexed streams",
+		}),
+
+		ReconnectAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotunnel_reconnect_attempts_total",
+			Help: "Total client reconnect attempts by result",
+		}, []string{"tunnel", "result"}),
+
+		ReconnectBackoffSeconds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gotunnel_reconnect_backoff_seconds",
+			Help: "Current reconnect backoff of a tunnel (0 = connected)",
+		}, []string{"tunnel"}),
+
+		TunnelRateLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gotunnel_tunnel_rate_limit_bytes_per_second",
+			Help: "Configured per-direction bandwidth limit of a tunnel (0 = unlimited)",
+		}, []string{"tunnel"}),
+
+		ThrottledBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotunnel_throttled_bytes_total",
+			Help: "Total bytes delayed by a tunnel's bandwidth limit",
+		}, []string{"direction", "tunnel"}),
+
+		BackendPoolRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotunnel_backend_pool_requests_total",
+			Help: "Total backend connections taken from a tunnel's pool by result (hit or miss)",
+		}, []string{"tunnel", "result"}),
+
+		BackendPoolIdle: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gotunnel_backend_pool_idle_connections",
+			Help: "Number of idle backend connections held in a tunnel's pool",
+		}, []string{"tunnel"}),
+
+		RequestDuration: newRequestDuration(prometheus.DefBuckets),
+
+		ConnectionSetupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gotunnel_connection_setup_phase_seconds",
+			Help:    "Duration of each connection setup phase in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"phase"}),
+
+		TLSHandshakeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gotunnel_tls_handshake_duration_seconds",
+			Help:    "Duration of TLS handshakes in seconds by result",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+		}, []string{"result"}),
+
+		CertificateExpiry: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gotunnel_certificate_expiry_timestamp",
+			Help: "Certificate expiry timestamp",
+		}),
+
+		OCSPNextUpdate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gotunnel_ocsp_next_update_timestamp",
+			Help: "NextUpdate timestamp of the stapled OCSP response",
+		}),
+
+		TunnelTimeoutSeconds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gotunnel_tunnel_timeout_seconds",
+			Help: "Effective timeout applied to a tunnel by kind (0 = disabled)",
+		}, []string{"tunnel", "kind"}),
+
+		CertReloads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gotunnel_cert_reloads_total",
+			Help: "Total successful certificate reloads",
+		}),
+
+		CertReloadFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gotunnel_cert_reload_failures_total",
+			Help: "Total failed certificate reloads",
+		}),
+
+		IdleScanDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gotunnel_idle_scan_duration_seconds",
+			Help: "Duration of the last idle connection scan",
+		}),
+
+		IdleScanConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gotunnel_idle_scan_connections",
+			Help: "Number of connections inspected by the last idle connection scan",
+		}),
+
+		CAExpiry: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gotunnel_ca_nearest_expiry_timestamp",
+			Help: "Expiry timestamp of the CA certificate in the trust pool that expires first",
+		}),
+
+		BuildInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gotunnel_build_info",
+			Help: "Build information (always 1)",
+		}, []string{"version", "commit", "goversion"}),
+
+		LogEntriesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotunnel_log_entries_dropped_total",
+			Help: "Total log entries dropped by sampling, by level",
+		}, []string{"level"}),
+
+		LogEntriesOverflowed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gotunnel_log_entries_overflowed_total",
+			Help: "Total log entries dropped because the async log buffer was full",
+		}),
+		LogEntriesStale: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gotunnel_log_entries_stale_total",
+			Help: "Total log entries dropped because they waited too long in the async log buffer",
+		}),
+
+		HealthStatus: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gotunnel_health_status",
+			Help: "Health status (1 = healthy, 0 = unhealthy)",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.ActiveConnections,
+		m.TotalConnections,
+		m.ConnectionErrors,
+		m.TunnelRejections,
+		m.ActiveTunnels,
+		m.BytesTransferred,
+		m.WireBytes,
+		m.PayloadBytes,
+		m.OpenStreams,
+		m.ReconnectAttempts,
+		m.ReconnectBackoffSeconds,
+		m.TunnelRateLimit,
+		m.ThrottledBytes,
+		m.BackendPoolRequests,
+		m.BackendPoolIdle,
+		m.RequestDuration,
+		m.ConnectionSetupDuration,
+		m.TLSHandshakeDuration,
+		m.CertificateExpiry,
+		m.OCSPNextUpdate,
+		m.TunnelTimeoutSeconds,
+		m.CertReloads,
+		m.CertReloadFailures,
+		m.IdleScanDuration,
+		m.IdleScanConnections,
+		m.CAExpiry,
+		m.BuildInfo,
+		m.LogEntriesDropped,
+		m.LogEntriesOverflowed,
+		m.LogEntriesStale,
+		m.HealthStatus,
+	)
+	return m
+}
+
+func newRequestDuration(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "gotunnel_request_duration_seconds",
 		Help:    "Request duration in seconds",
-		Buckets: prometheus.DefBuckets,
+		Buckets: buckets,
 	}, []string{"method", "status"})
+}
 
-	// CertificateExpiry Certificate metrics
-	CertificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "gotunnel_certificate_expiry_timestamp",
-		Help: "Certificate expiry timestamp",
-	})
+// Configure rebuilds the config-dependent collectors. It may be called
+// again on config reload; observations recorded with the old buckets are
+// discarded.
+func (m *Metrics) Configure(cfg MetricsConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	buckets := cfg.DurationBuckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
 
-	// HealthStatus Health metrics
-	HealthStatus = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "gotunnel_health_status",
-		Help: "Health status (1 = healthy, 0 = unhealthy)",
-	})
-)
+	requestDuration := newRequestDuration(buckets)
+	m.requestDurationMu.Lock()
+	defer m.requestDurationMu.Unlock()
+	m.registry.Unregister(m.RequestDuration)
+	if err := m.registry.Register(requestDuration); err != nil {
+		return fmt.Errorf("failed to register request duration histogram: %w", err)
+	}
+	m.RequestDuration = requestDuration
+	return nil
+}
+
+// SetTunnels declares the statically configured tunnel names. Per-tunnel
+// metrics for any other name are recorded under OtherTunnel, so a client
+// can't create unbounded label values.
+func (m *Metrics) SetTunnels(names []string) {
+	labels := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		labels[name] = struct{}{}
+	}
+
+	m.tunnelLabelsMu.Lock()
+	defer m.tunnelLabelsMu.Unlock()
+	m.tunnelLabels = labels
+}
+
+// tunnelLabel maps a tunnel name to a bounded label value. The empty name
+// is kept for errors that happen before a tunnel is known, and SessionTunnel
+// for the client's session.
+func (m *Metrics) tunnelLabel(tunnel string) string {
+	if tunnel == "" || tunnel == SessionTunnel {
+		return tunnel
+	}
+
+	m.tunnelLabelsMu.RLock()
+	defer m.tunnelLabelsMu.RUnlock()
+	if _, ok := m.tunnelLabels[tunnel]; ok {
+		return tunnel
+	}
+	return OtherTunnel
+}
+
+// RecordConnection records a new connection on a tunnel
+func (m *Metrics) RecordConnection(tunnel string) {
+	m.TotalConnections.Inc()
+	m.ActiveConnections.WithLabelValues(m.tunnelLabel(tunnel)).Inc()
+}
+
+// RecordDisconnection records a disconnection from a tunnel
+func (m *Metrics) RecordDisconnection(tunnel string) {
+	m.ActiveConnections.WithLabelValues(m.tunnelLabel(tunnel)).Dec()
+}
+
+// RecordTunnelUp records a named tunnel becoming established
+func (m *Metrics) RecordTunnelUp(tunnel string) {
+	m.ActiveTunnels.WithLabelValues(m.tunnelLabel(tunnel)).Set(1)
+}
+
+// RecordTunnelDown records a named tunnel going down
+func (m *Metrics) RecordTunnelDown(tunnel string) {
+	m.ActiveTunnels.WithLabelValues(m.tunnelLabel(tunnel)).Set(0)
+}
+
+// RecordTraffic records bytes transferred on a tunnel
+func (m *Metrics) RecordTraffic(direction, tunnel string, bytes int64) {
+	m.BytesTransferred.WithLabelValues(direction, m.tunnelLabel(tunnel)).Add(float64(bytes))
+}
+
+// RecordTransfer records wire and payload bytes for a tunnel. Without
+// compression both counts are equal.
+func (m *Metrics) RecordTransfer(direction, tunnel string, wireBytes, payloadBytes int64) {
+	tunnel = m.tunnelLabel(tunnel)
+	m.WireBytes.WithLabelValues(direction, tunnel).Add(float64(wireBytes))
+	m.PayloadBytes.WithLabelValues(direction, tunnel).Add(float64(payloadBytes))
+}
+
+// RecordStreamOpened records a multiplexed stream being opened
+func (m *Metrics) RecordStreamOpened() {
+	m.OpenStreams.Inc()
+}
+
+// RecordStreamClosed records a multiplexed stream being closed
+func (m *Metrics) RecordStreamClosed() {
+	m.OpenStreams.Dec()
+}
+
+// RecordReconnectAttempt records a reconnect attempt with result
+// "success" or "failure"
+func (m *Metrics) RecordReconnectAttempt(tunnel, result string) {
+	m.ReconnectAttempts.WithLabelValues(m.tunnelLabel(tunnel), result).Inc()
+}
+
+// SetReconnectBackoff records the current reconnect backoff of a tunnel
+func (m *Metrics) SetReconnectBackoff(tunnel string, backoff time.Duration) {
+	m.ReconnectBackoffSeconds.WithLabelValues(m.tunnelLabel(tunnel)).Set(backoff.Seconds())
+}
 
-// RecordConnection records a new connection
-func RecordConnection() {
-	TotalConnections.Inc()
-	ActiveConnections.Inc()
+// SetTunnelRateLimit records the configured bandwidth limit of a tunnel
+func (m *Metrics) SetTunnelRateLimit(tunnel string, bytesPerSec int64) {
+	m.TunnelRateLimit.WithLabelValues(m.tunnelLabel(tunnel)).Set(float64(bytesPerSec))
 }
 
-// RecordDisconnection records a disconnection
-func RecordDisconnection() {
-	ActiveConnections.Dec()
+// RecordThrottled records bytes that were delayed by a tunnel's bandwidth limit
+func (m *Metrics) RecordThrottled(direction, tunnel string, bytes int64) {
+	m.ThrottledBytes.WithLabelValues(direction, m.tunnelLabel(tunnel)).Add(float64(bytes))
 }
 
-// RecordTraffic records bytes transferred
-func RecordTraffic(direction string, bytes int64) {
-	BytesTransferred.WithLabelValues(direction).Add(float64(bytes))
+// RecordBackendPool records whether a backend connection was reused from a
+// tunnel's pool or had to be dialed
+func (m *Metrics) RecordBackendPool(tunnel string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.BackendPoolRequests.WithLabelValues(m.tunnelLabel(tunnel), result).Inc()
+}
+
+// SetBackendPoolIdle records the idle connections held in a tunnel's pool
+func (m *Metrics) SetBackendPoolIdle(tunnel string, idle int) {
+	m.BackendPoolIdle.WithLabelValues(m.tunnelLabel(tunnel)).Set(float64(idle))
 }
 
 // RecordRequest records request metrics
-func RecordRequest(method, status string, duration time.Duration) {
-	RequestDuration.WithLabelValues(method, status).Observe(duration.Seconds())
+func (m *Metrics) RecordRequest(method, status string, duration time.Duration) {
+	m.requestDurationMu.RLock()
+	defer m.requestDurationMu.RUnlock()
+	m.RequestDuration.WithLabelValues(method, status).Observe(duration.Seconds())
+}
+
+// RecordSetupPhase records the duration of a connection setup phase
+func (m *Metrics) RecordSetupPhase(phase string, duration time.Duration) {
+	m.ConnectionSetupDuration.WithLabelValues(phase).Observe(duration.Seconds())
 }
 
-// RecordConnectionError records connection errors
-func RecordConnectionError(errorType string) {
-	ConnectionErrors.WithLabelValues(errorType).Inc()
+// RecordHandshake records the duration of a TLS handshake, with result
+// "success" or "failure"
+func (m *Metrics) RecordHandshake(result string, d time.Duration) {
+	m.TLSHandshakeDuration.WithLabelValues(result).Observe(d.Seconds())
+}
+
+// RecordConnectionError records a connection error not tied to a tunnel,
+// e.g. one during the handshake
+func (m *Metrics) RecordConnectionError(errorType string) {
+	m.RecordTunnelConnectionError("", errorType)
+}
+
+// RecordTunnelConnectionError records a connection error on a tunnel
+func (m *Metrics) RecordTunnelConnectionError(tunnel, errorType string) {
+	m.ConnectionErrors.WithLabelValues(errorType, m.tunnelLabel(tunnel)).Inc()
+}
+
+// RecordTunnelRejection records a connection rejected on a specific tunnel
+func (m *Metrics) RecordTunnelRejection(tunnel, reason string) {
+	m.TunnelRejections.WithLabelValues(m.tunnelLabel(tunnel), reason).Inc()
+}
+
+// ConnectionErrorTotal returns the sum of all connection errors recorded so far
+func (m *Metrics) ConnectionErrorTotal() float64 {
+	families, _ := m.registry.Gather()
+
+	var total float64
+	for _, family := range families {
+		if family.GetName() != "gotunnel_connection_errors_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			total += metric.GetCounter().GetValue()
+		}
+	}
+	return total
 }
 
 // SetHealthStatus sets the health status
-func SetHealthStatus(healthy bool) {
+func (m *Metrics) SetHealthStatus(healthy bool) {
 	if healthy {
-		HealthStatus.Set(1)
+		m.HealthStatus.Set(1)
 	} else {
-		HealthStatus.Set(0)
+		m.HealthStatus.Set(0)
 	}
 }
 
+// SetBuildInfo publishes the build version and commit along with the Go
+// version the binary was built with
+func (m *Metrics) SetBuildInfo(version, commit string) {
+	m.BuildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
+}
+
 // SetCertificateExpiry sets certificate expiry timestamp
-func SetCertificateExpiry(timestamp float64) {
-	CertificateExpiry.Set(timestamp)
+func (m *Metrics) SetCertificateExpiry(timestamp float64) {
+	m.CertificateExpiry.Set(timestamp)
+}
+
+// SetOCSPNextUpdate sets the NextUpdate timestamp of the OCSP staple
+func (m *Metrics) SetOCSPNextUpdate(timestamp float64) {
+	m.OCSPNextUpdate.Set(timestamp)
+}
+
+// RecordCertReload records the outcome of a certificate reload
+func (m *Metrics) RecordCertReload(success bool) {
+	if success {
+		m.CertReloads.Inc()
+	} else {
+		m.CertReloadFailures.Inc()
+	}
+}
+
+// RecordIdleScan records the cost and coverage of an idle connection scan
+func (m *Metrics) RecordIdleScan(duration time.Duration, connections int) {
+	m.IdleScanDuration.Set(duration.Seconds())
+	m.IdleScanConnections.Set(float64(connections))
+}
+
+// RecordLogDropped records a log entry dropped by sampling
+func (m *Metrics) RecordLogDropped(level string) {
+	m.LogEntriesDropped.WithLabelValues(level).Inc()
+}
+
+// RecordLogOverflow records a log entry dropped by a full async buffer
+func (m *Metrics) RecordLogOverflow() {
+	m.LogEntriesOverflowed.Inc()
+}
+
+// RecordLogStale records a log entry dropped for waiting too long in an
+// async buffer
+func (m *Metrics) RecordLogStale() {
+	m.LogEntriesStale.Inc()
+}
+
+// SetCAExpiry sets the nearest CA certificate expiry timestamp
+func (m *Metrics) SetCAExpiry(timestamp float64) {
+	m.CAExpiry.Set(timestamp)
 }
 
-// MetricsHandler returns the Prometheus metrics handler
-func MetricsHandler() http.Handler {
-	return promhttp.Handler()
+// SetTunnelTimeout records the effective timeout of the given kind for a tunnel
+func (m *Metrics) SetTunnelTimeout(tunnel, kind string, timeout time.Duration) {
+	m.TunnelTimeoutSeconds.WithLabelValues(m.tunnelLabel(tunnel), kind).Set(timeout.Seconds())
+}
+
+// Handler returns an HTTP handler serving the metrics of this instance
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Snapshot returns the current value of every gotunnel metric keyed by its
+// name and labels in Prometheus text form, e.g. gotunnel_bytes_transferred_total{direction="in"}.
+// Histograms contribute _count and _sum entries.
+func (m *Metrics) Snapshot() map[string]interface{} {
+	families, _ := m.registry.Gather()
+
+	snapshot := make(map[string]interface{})
+	for _, family := range families {
+		name := family.GetName()
+		if !strings.HasPrefix(name, "gotunnel_") {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			labels := make([]string, 0, len(metric.GetLabel()))
+			for _, pair := range metric.GetLabel() {
+				labels = append(labels, pair.GetName()+`="`+pair.GetValue()+`"`)
+			}
+			sort.Strings(labels)
+			suffix := ""
+			if len(labels) > 0 {
+				suffix = "{" + strings.Join(labels, ",") + "}"
+			}
+
+			switch {
+			case metric.GetCounter() != nil:
+				snapshot[name+suffix] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				snapshot[name+suffix] = metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				snapshot[name+"_count"+suffix] = metric.GetHistogram().GetSampleCount()
+				snapshot[name+"_sum"+suffix] = metric.GetHistogram().GetSampleSum()
+			case metric.GetUntyped() != nil:
+				snapshot[name+suffix] = metric.GetUntyped().GetValue()
+			}
+		}
+	}
+	return snapshot
+}
+
+// Status summarizes the metrics an operator looks at first during an
+// incident
+type Status struct {
+	ActiveConnections int64 `json:"active_connections"`
+	TotalConnections  int64 `json:"total_connections"`
+	BytesIn           int64 `json:"bytes_in"`
+	BytesOut          int64 `json:"bytes_out"`
+	// ReconnectAttempts counts client reconnect attempts by result
+	ReconnectAttempts map[string]int64 `json:"reconnect_attempts"`
+	// CertificateExpiry is nil until a certificate has been loaded
+	CertificateExpiry *time.Time `json:"certificate_expiry,omitempty"`
+}
+
+// Status reads the summary from the few collectors it needs rather than
+// gathering the whole registry, so it is cheap to serve on demand
+func (m *Metrics) Status() Status {
+	bytes := collectorValues(m.BytesTransferred, "direction")
+	status := Status{
+		ActiveConnections: int64(collectorValues(m.ActiveConnections, "")[""]),
+		TotalConnections:  int64(collectorValues(m.TotalConnections, "")[""]),
+		BytesIn:           int64(bytes["in"]),
+		BytesOut:          int64(bytes["out"]),
+		ReconnectAttempts: make(map[string]int64),
+	}
+	for result, count := range collectorValues(m.ReconnectAttempts, "result") {
+		status.ReconnectAttempts[result] = int64(count)
+	}
+	if expiry := collectorValues(m.CertificateExpiry, "")[""]; expiry > 0 {
+		t := time.Unix(int64(expiry), 0).UTC()
+		status.CertificateExpiry = &t
+	}
+	return status
+}
+
+// collectorValues sums the counter and gauge samples of c by the value of
+// label, or into "" when label is empty
+func collectorValues(c prometheus.Collector, label string) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	values := make(map[string]float64)
+	for metric := range ch {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			continue
+		}
+		key := ""
+		for _, pair := range pb.GetLabel() {
+			if pair.GetName() == label {
+				key = pair.GetValue()
+			}
+		}
+		switch {
+		case pb.GetCounter() != nil:
+			values[key] += pb.GetCounter().GetValue()
+		case pb.GetGauge() != nil:
+			values[key] += pb.GetGauge().GetValue()
+		}
+	}
+	return values
 }
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue returns the current value of c
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestTunnelLabelsBoundedToConfiguredNames(t *testing.T) {
+	m := NewMetrics()
+	m.SetTunnels([]string{"web"})
+
+	m.RecordTraffic("in", "web", 10)
+	m.RecordTraffic("in", "rogue", 20)
+	m.RecordTunnelConnectionError("web", "timeout")
+	m.RecordTunnelConnectionError("rogue", "timeout")
+	m.RecordConnectionError("handshake")
+
+	if got := counterValue(t, m.BytesTransferred.WithLabelValues("in", "web")); got != 10 {
+		t.Errorf("web bytes = %v, want 10 under its own label", got)
+	}
+	if got := counterValue(t, m.BytesTransferred.WithLabelValues("in", OtherTunnel)); got != 20 {
+		t.Errorf("other bytes = %v, want 20 from the unknown tunnel", got)
+	}
+	if got := counterValue(t, m.ConnectionErrors.WithLabelValues("timeout", "web")); got != 1 {
+		t.Errorf("web errors = %v, want 1", got)
+	}
+	if got := counterValue(t, m.ConnectionErrors.WithLabelValues("timeout", OtherTunnel)); got != 1 {
+		t.Errorf("other errors = %v, want 1", got)
+	}
+	// Errors before a tunnel is known keep the empty label
+	if got := counterValue(t, m.ConnectionErrors.WithLabelValues("handshake", "")); got != 1 {
+		t.Errorf("untunnelled errors = %v, want 1", got)
+	}
+
+	// A reload replaces the set
+	m.SetTunnels([]string{"rogue"})
+	m.RecordTraffic("in", "rogue", 5)
+	if got := counterValue(t, m.BytesTransferred.WithLabelValues("in", "rogue")); got != 5 {
+		t.Errorf("rogue bytes after SetTunnels = %v, want 5", got)
+	}
+}
+
+func TestSessionReconnectsKeepSessionLabel(t *testing.T) {
+	m := NewMetrics()
+	m.SetTunnels([]string{"web"})
+
+	m.RecordReconnectAttempt(SessionTunnel, "failure")
+
+	if got := counterValue(t, m.ReconnectAttempts.WithLabelValues(SessionTunnel, "failure")); got != 1 {
+		t.Errorf("session reconnects = %v, want 1 under the session label", got)
+	}
+}
+
+func TestBuildInfoIsExported(t *testing.T) {
+	m := NewMetrics()
+	m.SetBuildInfo("v1.2.3", "abc1234")
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf(`gotunnel_build_info{commit="abc1234",goversion=%q,version="v1.2.3"} 1`, runtime.Version())
+	if !strings.Contains(string(body), want) {
+		t.Errorf("scrape is missing %s:\n%s", want, body)
+	}
+}
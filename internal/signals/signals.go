@@ -0,0 +1,147 @@
+package signals
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+
+	"gotunnel-pro/internal/logging"
+)
+
+// State is the lifecycle state of the process
+type State int
+
+const (
+	Running State = iota
+	Reloading
+	ShuttingDown
+)
+
+func (s State) String() string {
+	switch s {
+	case Running:
+		return "running"
+	case Reloading:
+		return "reloading"
+	case ShuttingDown:
+		return "shutting_down"
+	default:
+		return "unknown"
+	}
+}
+
+// ReloadFunc applies a configuration reload. The context is cancelled when
+// shutdown begins so a long reload can abort cleanly.
+type ReloadFunc func(ctx context.Context) error
+
+// Controller serialises reload and shutdown requests. Once shutdown begins
+// reloads are skipped, and a reload in progress completes or aborts before
+// shutdown proceeds.
+type Controller struct {
+	mu           sync.Mutex
+	state        State
+	reloadDone   chan struct{}
+	cancelReload context.CancelFunc
+	logger       *logging.Logger
+}
+
+// NewController creates a controller in the running state
+func NewController(logger *logging.Logger) *Controller {
+	return &Controller{logger: logger}
+}
+
+// State returns the current lifecycle state
+func (c *Controller) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Reload runs reload unless the process is shutting down or already
+// reloading, in which case the request is logged and skipped
+func (c *Controller) Reload(ctx context.Context, reload ReloadFunc) error {
+	c.mu.Lock()
+	if c.state != Running {
+		state := c.state
+		c.mu.Unlock()
+		c.logger.Info(ctx, "Reload skipped", map[string]interface{}{
+			"state": state.String(),
+		})
+		return nil
+	}
+	reloadCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	c.state = Reloading
+	c.reloadDone = done
+	c.cancelReload = cancel
+	c.mu.Unlock()
+
+	defer func() {
+		cancel()
+		c.mu.Lock()
+		if c.state == Reloading {
+			c.state = Running
+		}
+		c.reloadDone = nil
+		c.cancelReload = nil
+		c.mu.Unlock()
+		close(done)
+	}()
+
+	return reload(reloadCtx)
+}
+
+// Shutdown moves to the shutting down state, cancels any reload in progress
+// and waits for it to finish or for ctx to expire
+func (c *Controller) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.state = ShuttingDown
+	done := c.reloadDone
+	if c.cancelReload != nil {
+		c.cancelReload()
+	}
+	c.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run dispatches signals until a shutdown signal arrives: SIGHUP triggers
+// reload, SIGINT and SIGTERM begin shutdown. It returns once any reload in
+// progress has finished, leaving the controller shutting down.
+func (c *Controller) Run(ctx context.Context, sigs <-chan os.Signal, reload ReloadFunc) {
+	for {
+		var sig os.Signal
+		select {
+		case <-ctx.Done():
+			c.Shutdown(context.Background())
+			return
+		case sig = <-sigs:
+		}
+
+		if sig == syscall.SIGHUP {
+			go func() {
+				if err := c.Reload(ctx, reload); err != nil {
+					c.logger.Error(ctx, "Reload failed", map[string]interface{}{
+						"error": err.Error(),
+					})
+				}
+			}()
+			continue
+		}
+
+		c.logger.Info(ctx, "Shutdown signal received", map[string]interface{}{
+			"signal": sig.String(),
+		})
+		c.Shutdown(context.Background())
+		return
+	}
+}
@@ -0,0 +1,143 @@
+package signals
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+)
+
+func newTestController() *Controller {
+	logger := logging.NewLogger("gotunnel-test", "test", logging.ERROR)
+	logger.SetOutput(io.Discard)
+	return NewController(logger)
+}
+
+// runController runs c on sigs in the background and returns a channel
+// closed once Run returns
+func runController(c *Controller, sigs <-chan os.Signal, reload ReloadFunc) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(context.Background(), sigs, reload)
+	}()
+	return done
+}
+
+func TestRunReloadsOnSIGHUP(t *testing.T) {
+	c := newTestController()
+	sigs := make(chan os.Signal)
+	reloaded := make(chan struct{})
+	done := runController(c, sigs, func(ctx context.Context) error {
+		close(reloaded)
+		return nil
+	})
+
+	sigs <- syscall.SIGHUP
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGHUP did not reload")
+	}
+
+	sigs <- syscall.SIGTERM
+	<-done
+	if state := c.State(); state != ShuttingDown {
+		t.Errorf("State() = %s, want shutting_down", state)
+	}
+}
+
+func TestRunShutdownWaitsForReload(t *testing.T) {
+	c := newTestController()
+	sigs := make(chan os.Signal)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var cancelled atomic.Bool
+	done := runController(c, sigs, func(ctx context.Context) error {
+		close(started)
+		<-release
+		cancelled.Store(ctx.Err() != nil)
+		return ctx.Err()
+	})
+
+	sigs <- syscall.SIGHUP
+	<-started
+	sigs <- syscall.SIGTERM
+
+	// Shutdown has begun, but Run waits for the reload to finish
+	deadline := time.Now().Add(5 * time.Second)
+	for c.State() != ShuttingDown {
+		if time.Now().After(deadline) {
+			t.Fatalf("State() = %s after SIGTERM, want shutting_down", c.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("Run returned while the reload was still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the reload finished")
+	}
+	if !cancelled.Load() {
+		t.Error("reload context was not cancelled by shutdown")
+	}
+}
+
+func TestReloadSkippedDuringShutdown(t *testing.T) {
+	c := newTestController()
+	sigs := make(chan os.Signal, 2)
+	var reloads atomic.Int32
+	reload := func(ctx context.Context) error {
+		reloads.Add(1)
+		return nil
+	}
+
+	// A SIGHUP queued behind SIGTERM is never dispatched
+	sigs <- syscall.SIGTERM
+	sigs <- syscall.SIGHUP
+	<-runController(c, sigs, reload)
+
+	// and one delivered once shutdown has begun is skipped
+	if err := c.Reload(context.Background(), reload); err != nil {
+		t.Errorf("Reload() during shutdown = %v, want nil", err)
+	}
+	if n := reloads.Load(); n != 0 {
+		t.Errorf("reloads = %d during shutdown, want 0", n)
+	}
+	if state := c.State(); state != ShuttingDown {
+		t.Errorf("State() = %s, want shutting_down", state)
+	}
+}
+
+func TestReloadSkippedWhileReloading(t *testing.T) {
+	c := newTestController()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go c.Reload(context.Background(), func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	var ran bool
+	c.Reload(context.Background(), func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	close(release)
+	if ran {
+		t.Error("second reload ran while the first was in progress")
+	}
+}
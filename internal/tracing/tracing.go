@@ -0,0 +1,251 @@
+// Package tracing records spans around tunnel connections and exports them
+// to an OpenTelemetry collector. Until an exporter is installed with
+// SetExporter every call is a no-op, so instrumented code pays nothing when
+// tracing is off.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+)
+
+// Span kinds, matching the OpenTelemetry SpanKind values
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+const (
+	// DefaultBatchSize is the number of spans sent per export
+	DefaultBatchSize = 512
+	// DefaultBatchTimeout is how long a finished span may wait for a batch
+	DefaultBatchTimeout = 5 * time.Second
+	// spanQueueSize bounds spans waiting for export; later spans are
+	// dropped rather than block the data path
+	spanQueueSize = 2048
+)
+
+// Exporter sends finished spans to a tracing backend
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+// Span is a timed operation within a trace. A nil *Span is valid and
+// ignores every call, which is what Start returns while tracing is off.
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	// Err is set when the operation failed
+	Err error
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	ended      bool
+}
+
+type spanKey struct{}
+
+// processor is the installed batch processor, nil while tracing is off
+var processor atomic.Pointer[batchProcessor]
+
+// Start begins a span named name as a child of the span in ctx, if any.
+// The returned context carries the span and its IDs, so log entries made
+// with it line up with the trace.
+func Start(ctx context.Context, name string, kind int, attributes map[string]interface{}) (context.Context, *Span) {
+	if processor.Load() == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		attributes: make(map[string]interface{}, len(attributes)),
+	}
+	for k, v := range attributes {
+		span.attributes[k] = v
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+
+	ctx = context.WithValue(ctx, spanKey{}, span)
+	ctx = logging.WithTraceID(ctx, hex.EncodeToString(span.TraceID[:]))
+	ctx = logging.WithSpanID(ctx, hex.EncodeToString(span.SpanID[:]))
+	return ctx, span
+}
+
+// SetAttribute records key on the span, replacing any earlier value
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// Attributes returns a copy of the span's attributes
+func (s *Span) Attributes() map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attributes := make(map[string]interface{}, len(s.attributes))
+	for k, v := range s.attributes {
+		attributes[k] = v
+	}
+	return attributes
+}
+
+// Finish ends the span with err as its outcome and queues it for export.
+// Only the first call has any effect.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.Err = err
+	s.mu.Unlock()
+
+	if p := processor.Load(); p != nil {
+		p.enqueue(s)
+	}
+}
+
+// SetExporter starts exporting finished spans to exporter in batches. The
+// returned function flushes queued spans and stops the exporter; call it on
+// shutdown. A nil exporter turns tracing off.
+func SetExporter(exporter Exporter, logger *logging.Logger) func(ctx context.Context) error {
+	if exporter == nil {
+		if old := processor.Swap(nil); old != nil {
+			old.shutdown(context.Background())
+		}
+		return func(context.Context) error { return nil }
+	}
+
+	p := &batchProcessor{
+		exporter: exporter,
+		logger:   logger,
+		spans:    make(chan *Span, spanQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	if old := processor.Swap(p); old != nil {
+		old.shutdown(context.Background())
+	}
+	return func(ctx context.Context) error {
+		processor.CompareAndSwap(p, nil)
+		return p.shutdown(ctx)
+	}
+}
+
+// batchProcessor exports spans from a background goroutine so finishing a
+// span never waits on the network
+type batchProcessor struct {
+	exporter Exporter
+	logger   *logging.Logger
+	spans    chan *Span
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	dropped  atomic.Int64
+}
+
+func (p *batchProcessor) enqueue(span *Span) {
+	select {
+	case p.spans <- span:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+func (p *batchProcessor) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(DefaultBatchTimeout)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, DefaultBatchSize)
+	export := func() {
+		if dropped := p.dropped.Swap(0); dropped > 0 {
+			p.logger.Warn(context.Background(), "Dropped spans, export queue full", map[string]interface{}{
+				"dropped": dropped,
+			})
+		}
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultBatchTimeout)
+		defer cancel()
+		if err := p.exporter.ExportSpans(ctx, batch); err != nil {
+			p.logger.Warn(ctx, "Failed to export spans", map[string]interface{}{
+				"spans": len(batch),
+				"error": err.Error(),
+			})
+		}
+		batch = make([]*Span, 0, DefaultBatchSize)
+	}
+
+	add := func(span *Span) {
+		batch = append(batch, span)
+		if len(batch) >= DefaultBatchSize {
+			export()
+		}
+	}
+
+	for {
+		select {
+		case span := <-p.spans:
+			add(span)
+		case <-ticker.C:
+			export()
+		case <-p.stop:
+			// Export whatever is still queued, then stop
+			for {
+				select {
+				case span := <-p.spans:
+					add(span)
+				default:
+					export()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *batchProcessor) shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
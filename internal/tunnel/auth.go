@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// DefaultAuthTimeout bounds how long the server waits for a client's token
+const DefaultAuthTimeout = 10 * time.Second
+
+// ErrAuthFailed is returned when a bearer token is missing or rejected
+var ErrAuthFailed = errors.New("token authentication failed")
+
+// TokenSource validates bearer tokens presented by clients. It lets the
+// accepted tokens come from config, a file or an external service.
+type TokenSource interface {
+	Validate(ctx context.Context, token string) bool
+}
+
+// StaticTokens is a TokenSource backed by a fixed set of tokens
+type StaticTokens struct {
+	tokens [][]byte
+}
+
+// NewStaticTokens creates a token source accepting any of tokens. Empty
+// tokens are ignored.
+func NewStaticTokens(tokens []string) *StaticTokens {
+	s := &StaticTokens{}
+	for _, token := range tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			s.tokens = append(s.tokens, []byte(token))
+		}
+	}
+	return s
+}
+
+// Validate compares token against every configured token in constant time,
+// so neither a match nor its position leaks through timing
+func (s *StaticTokens) Validate(_ context.Context, token string) bool {
+	match := 0
+	for _, candidate := range s.tokens {
+		match |= subtle.ConstantTimeCompare([]byte(token), candidate)
+	}
+	return match == 1
+}
+
+// SendAuthToken presents token to the server and waits for its verdict
+func SendAuthToken(conn net.Conn, fw *FrameWriter, token string) error {
+	if err := fw.WriteFrame(Frame{Type: FrameAuth, Payload: []byte(token)}); err != nil {
+		return fmt.Errorf("failed to send auth token: %w", err)
+	}
+
+	f, err := ReadFrame(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read auth result: %w", err)
+	}
+	if f.Type != FrameAuthResult {
+		return fmt.Errorf("unexpected frame type %d during authentication", f.Type)
+	}
+	if len(f.Payload) > 0 {
+		return fmt.Errorf("%w: %s", ErrAuthFailed, f.Payload)
+	}
+	return nil
+}
+
+// AuthenticateToken reads the client's token, which must be the first frame
+// after the handshake, and checks it against source. On failure the
+// connection is audited, told why and closed. It reports whether the client
+// was authenticated.
+func AuthenticateToken(ctx context.Context, logger *logging.Logger, source TokenSource, conn net.Conn, fw *FrameWriter, timeout time.Duration) bool {
+	if source == nil {
+		return true
+	}
+	if timeout <= 0 {
+		timeout = DefaultAuthTimeout
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	f, err := ReadFrame(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	reason := ""
+	switch {
+	case err != nil:
+		reason = "no token received"
+	case f.Type != FrameAuth:
+		reason = "expected auth frame"
+	case !source.Validate(ctx, string(f.Payload)):
+		reason = "invalid token"
+	}
+	if reason == "" {
+		return fw.WriteFrame(Frame{Type: FrameAuthResult}) == nil
+	}
+
+	metrics.RecordConnectionError("auth_failed")
+	logger.Audit(ctx, "Rejected connection with failed token authentication", map[string]interface{}{
+		"remote_addr": conn.RemoteAddr().String(),
+		"reason":      reason,
+	})
+	fw.WriteFrame(Frame{Type: FrameAuthResult, Payload: []byte(reason)})
+	conn.Close()
+	return false
+}
@@ -0,0 +1,132 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// ReasonBackendRefused is reported to the client when no backend would
+// hold a connection open
+const ReasonBackendRefused = "backend_refused"
+
+// ErrBackendRefused is returned when every backend failed to dial or
+// closed the connection immediately after accepting it
+var ErrBackendRefused = errors.New(ReasonBackendRefused)
+
+// DefaultImmediateCloseWindow is how long a freshly dialed backend is
+// watched for an immediate close
+const DefaultImmediateCloseWindow = 50 * time.Millisecond
+
+// DialFunc dials a backend address, e.g. (*net.Dialer).DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// BackendDialer dials backends in order, skipping ones that refuse the
+// connection or accept it and then close before sending anything, as
+// backends tend to do while restarting
+type BackendDialer struct {
+	dial   DialFunc
+	window time.Duration
+}
+
+// NewBackendDialer creates a backend dialer. A non-positive window uses
+// DefaultImmediateCloseWindow.
+func NewBackendDialer(dial DialFunc, window time.Duration) *BackendDialer {
+	if window <= 0 {
+		window = DefaultImmediateCloseWindow
+	}
+	return &BackendDialer{dial: dial, window: window}
+}
+
+// Dial connects to the first backend in addrs that holds the connection
+// open and returns the connection and the address it was made to. If all
+// backends fail the error wraps ErrBackendRefused.
+func (d *BackendDialer) Dial(ctx context.Context, addrs []string) (net.Conn, string, error) {
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := d.dial(ctx, "tcp", addr)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to dial backend %s: %w", addr, err)
+			continue
+		}
+
+		conn, err = d.probe(conn)
+		if err != nil {
+			metrics.RecordConnectionError("backend_immediate_close")
+			lastErr = fmt.Errorf("backend %s closed immediately: %w", addr, err)
+			continue
+		}
+		return conn, addr, nil
+	}
+
+	if lastErr == nil {
+		return nil, "", fmt.Errorf("%w: no backends configured", ErrBackendRefused)
+	}
+	return nil, "", fmt.Errorf("%w: %v", ErrBackendRefused, lastErr)
+}
+
+// probe waits up to the window for the backend to close the connection.
+// A backend that sends data first or stays silent is healthy, so only a
+// close with no data counts; a short-lived connection that responds
+// before closing is not misclassified.
+func (d *BackendDialer) probe(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(d.window)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var first [1]byte
+	n, err := conn.Read(first[:])
+	if n > 0 {
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &prefixConn{Conn: conn, prefix: first[:n]}, nil
+	}
+
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	conn.Close()
+	return nil, err
+}
+
+// prefixConn replays bytes read while probing before reading from Conn
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *prefixConn) unwrap() net.Conn { return c.Conn }
+
+// LogConnectionOpened logs a new tunnel connection together with the
+// backend it was routed to, so a connection problem on a load-balanced
+// tunnel can be pinned on one backend without correlating timestamps
+func LogConnectionOpened(ctx context.Context, logger *logging.Logger, tunnel string, remoteAddr net.Addr, backend string) {
+	logger.Info(ctx, "Tunnel connection opened", map[string]interface{}{
+		"tunnel":      tunnel,
+		"remote_addr": remoteAddr.String(),
+		"backend":     backend,
+	})
+}
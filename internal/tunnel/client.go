@@ -1 +1,857 @@
 package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// ReconnectConfig controls how the client reconnects after losing the server
+type ReconnectConfig struct {
+	Enabled     bool          `yaml:"enabled" json:"enabled"`
+	MaxAttempts int           `yaml:"max_attempts" json:"max_attempts"`
+	Interval    time.Duration `yaml:"interval" json:"interval"`
+	Backoff     float64       `yaml:"backoff" json:"backoff"`
+	MaxBackoff  time.Duration `yaml:"max_backoff" json:"max_backoff"`
+	// Jitter randomizes each delay downwards by up to this fraction of it,
+	// so clients that lost the server together don't reconnect in lockstep.
+	// 0 disables it, 0.5 is equal jitter and 1 is full jitter.
+	Jitter float64 `yaml:"jitter" json:"jitter"`
+	// StableAfter is how long a connection must stay up before the backoff
+	// resets to Interval. Connections that drop sooner continue from the
+	// previous delay, which dampens flapping. Zero resets on every connect.
+	StableAfter time.Duration `yaml:"stable_after" json:"stable_after"`
+	// MaxConcurrent is accepted so configs that set it still load, and
+	// ignored.
+	//
+	// Deprecated: the client reconnects one session carrying every tunnel,
+	// so there is never more than one reconnect in flight to limit. Jitter
+	// staggers reconnects across clients instead.
+	MaxConcurrent int `yaml:"max_concurrent" json:"max_concurrent,omitempty"`
+}
+
+// DefaultReconnectConfig returns the reconnect settings used when the
+// config omits them
+func DefaultReconnectConfig() ReconnectConfig {
+	return ReconnectConfig{
+		Enabled:     true,
+		MaxAttempts: 10,
+		Interval:    5 * time.Second,
+		Backoff:     2.0,
+		MaxBackoff:  60 * time.Second,
+		Jitter:      0.5,
+	}
+}
+
+// Validate reports every reconnect setting that would stall or spin the
+// reconnect loop
+func (c ReconnectConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	var errs []error
+	if c.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("reconnect max_attempts must not be negative, got %d", c.MaxAttempts))
+	}
+	if c.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("reconnect interval must be positive, got %s", c.Interval))
+	}
+	if c.Backoff < 1 {
+		errs = append(errs, fmt.Errorf("reconnect backoff must be at least 1.0, got %g", c.Backoff))
+	}
+	if c.MaxBackoff < 0 {
+		errs = append(errs, fmt.Errorf("reconnect max_backoff must not be negative, got %s", c.MaxBackoff))
+	} else if c.MaxBackoff > 0 && c.MaxBackoff < c.Interval {
+		errs = append(errs, fmt.Errorf("reconnect max_backoff %s is less than interval %s", c.MaxBackoff, c.Interval))
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		errs = append(errs, fmt.Errorf("reconnect jitter must be between 0 and 1, got %g", c.Jitter))
+	}
+	if c.StableAfter < 0 {
+		errs = append(errs, fmt.Errorf("reconnect stable_after must not be negative, got %s", c.StableAfter))
+	}
+	return errors.Join(errs...)
+}
+
+// ReconnectBackoff computes successive reconnect delays for a tunnel and
+// reports them, along with attempt outcomes, as metrics
+type ReconnectBackoff struct {
+	tunnel      string
+	cfg         ReconnectConfig
+	next        time.Duration
+	connectedAt time.Time
+	rand        func() float64
+}
+
+// NewReconnectBackoff creates a backoff for tunnel starting at cfg.Interval
+func NewReconnectBackoff(tunnel string, cfg ReconnectConfig) *ReconnectBackoff {
+	return &ReconnectBackoff{
+		tunnel: tunnel,
+		cfg:    cfg,
+		next:   cfg.Interval,
+		rand:   rand.Float64,
+	}
+}
+
+// SetRand replaces the source of jitter, a function returning values in
+// [0, 1), so delays can be made deterministic
+func (b *ReconnectBackoff) SetRand(rand func() float64) {
+	b.rand = rand
+}
+
+// Next returns the delay before the next attempt and grows the following
+// one. Jitter only shortens the delay, so the first retry after a drop
+// never waits longer than Interval.
+func (b *ReconnectBackoff) Next() time.Duration {
+	delay := b.next
+	if b.cfg.Jitter > 0 {
+		delay -= time.Duration(float64(delay) * b.cfg.Jitter * b.rand())
+	}
+
+	grown := time.Duration(float64(b.next) * b.cfg.Backoff)
+	if b.cfg.MaxBackoff > 0 && grown > b.cfg.MaxBackoff {
+		grown = b.cfg.MaxBackoff
+	}
+	if grown > b.next {
+		b.next = grown
+	}
+	metrics.SetReconnectBackoff(b.tunnel, delay)
+	return delay
+}
+
+// Failed records a reconnect attempt that did not connect
+func (b *ReconnectBackoff) Failed() {
+	metrics.RecordReconnectAttempt(b.tunnel, "failure")
+}
+
+// Connected records that a connection was established at now
+func (b *ReconnectBackoff) Connected(now time.Time) {
+	metrics.RecordReconnectAttempt(b.tunnel, "success")
+	metrics.SetReconnectBackoff(b.tunnel, 0)
+	b.connectedAt = now
+	if b.cfg.StableAfter == 0 {
+		b.next = b.cfg.Interval
+	}
+}
+
+// Disconnected records that the connection dropped at now, resetting the
+// backoff only if it stayed up for the stability window
+func (b *ReconnectBackoff) Disconnected(now time.Time) {
+	if !b.connectedAt.IsZero() && now.Sub(b.connectedAt) >= b.cfg.StableAfter {
+		b.next = b.cfg.Interval
+	}
+	b.connectedAt = time.Time{}
+}
+
+// ErrClientClosed is returned by Start after Shutdown
+var ErrClientClosed = errors.New("tunnel client closed")
+
+// ReasonServerDisconnected is the rejection reason for local connections
+// accepted while the tunnel has no session to the server
+const ReasonServerDisconnected = "server_disconnected"
+
+// ClientConfig configures a Client
+type ClientConfig struct {
+	ServerAddr string
+	TLSConfig  *tls.Config
+	Tunnels    []TunnelSpec
+	Logger     *logging.Logger
+	Reconnect  ReconnectConfig
+	// AuthToken is presented after the handshake when set
+	AuthToken string
+	// TCP tunes the server connection and connections accepted by local
+	// listeners
+	TCP TCPOptions
+	Mux MuxConfig
+	// Keepalive is how often an idle session pings the server so its read
+	// timeout doesn't expire. Zero uses DefaultKeepaliveInterval.
+	Keepalive time.Duration
+}
+
+// Client runs the client end of each tunnel. All tunnels share one mTLS
+// session to the server, each forwarded connection a stream on it, with a
+// single reconnect loop. Local listeners stay open across reconnects and
+// refuse connections while the session is down.
+type Client struct {
+	cfg    ClientConfig
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// session is the current session to the server, nil while disconnected
+	session atomic.Pointer[Mux]
+
+	mu      sync.Mutex
+	tunnels map[string]*clientTunnel
+	// sessionChanged is closed and replaced whenever session changes
+	sessionChanged chan struct{}
+	errs           []error
+	wg             sync.WaitGroup
+
+	// reconnecting, reconnectAttempts and lastError describe the session
+	// for Stats
+	reconnecting      atomic.Bool
+	reconnectAttempts atomic.Int64
+	lastError         atomic.Pointer[string]
+}
+
+// clientTunnel is one running tunnel loop
+type clientTunnel struct {
+	spec   TunnelSpec
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// active, bytesIn, bytesOut and lastError describe the connections
+	// accepted by the tunnel's local listener
+	active    atomic.Int64
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	lastError atomic.Pointer[string]
+}
+
+// setError records err as the last error of t
+func (t *clientTunnel) setError(err error) {
+	msg := err.Error()
+	t.lastError.Store(&msg)
+}
+
+// NewClient creates a client for cfg. Nothing connects until Start.
+func NewClient(cfg *ClientConfig) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{
+		cfg:            *cfg,
+		ctx:            ctx,
+		cancel:         cancel,
+		tunnels:        make(map[string]*clientTunnel),
+		sessionChanged: make(chan struct{}),
+	}
+	if client.cfg.Keepalive <= 0 {
+		client.cfg.Keepalive = DefaultKeepaliveInterval
+	}
+	return client
+}
+
+// Start runs every tunnel over a session to the server and blocks until
+// Shutdown is called, the session gives up reconnecting or every tunnel
+// has failed, in which case it returns why
+func (c *Client) Start() error {
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	for _, spec := range c.cfg.Tunnels {
+		c.startTunnel(spec)
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		err := c.runSession(c.ctx)
+		if err == nil {
+			return
+		}
+		c.cfg.Logger.Error(c.ctx, "Session stopped", map[string]interface{}{
+			"server": c.cfg.ServerAddr,
+			"error":  err.Error(),
+		})
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.errs = append(c.errs, fmt.Errorf("session: %w", err))
+		c.cancel()
+	}()
+	c.mu.Unlock()
+
+	<-c.ctx.Done()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return errors.Join(c.errs...)
+}
+
+// Shutdown stops every tunnel and the session and waits for their
+// connections to close or ctx to expire
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.cancel()
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to stop tunnels: %w", ctx.Err())
+	}
+}
+
+// Stats returns the status of every running tunnel in configured order.
+// A tunnel without an error of its own reports the session's last error.
+func (c *Client) Stats() []TunnelStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	connected := c.session.Load() != nil
+	var sessionErr string
+	if msg := c.lastError.Load(); msg != nil {
+		sessionErr = *msg
+	}
+
+	var stats []TunnelStatus
+	for _, spec := range c.specs() {
+		t := c.tunnels[spec.Name]
+		status := TunnelStatus{
+			Name:              spec.Name,
+			Connected:         connected,
+			ActiveConnections: int(t.active.Load()),
+			BytesIn:           t.bytesIn.Load(),
+			BytesOut:          t.bytesOut.Load(),
+			LastError:         sessionErr,
+			Reconnecting:      c.reconnecting.Load(),
+			ReconnectAttempts: int(c.reconnectAttempts.Load()),
+		}
+		if msg := t.lastError.Load(); msg != nil {
+			status.LastError = *msg
+		}
+		stats = append(stats, status)
+	}
+	return stats
+}
+
+// setError records err as the session's last error
+func (c *Client) setError(err error) {
+	msg := err.Error()
+	c.lastError.Store(&msg)
+}
+
+// UpdateTunnels replaces the running tunnels with specs: tunnels that were
+// removed or changed are stopped, waiting up to ctx for them, new or
+// changed ones are started and the new set is announced on the current
+// session. Unchanged tunnels keep their listeners and connections.
+func (c *Client) UpdateTunnels(ctx context.Context, specs []TunnelSpec) error {
+	specs = append([]TunnelSpec(nil), specs...)
+	if err := ValidateTunnelSpecs(specs); err != nil {
+		return err
+	}
+	wanted := make(map[string]TunnelSpec, len(specs))
+	for _, spec := range specs {
+		wanted[spec.Name] = spec
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx.Err() != nil {
+		return ErrClientClosed
+	}
+	for name, t := range c.tunnels {
+		if spec, ok := wanted[name]; ok && reflect.DeepEqual(spec, t.spec) {
+			continue
+		}
+		// Stop first so a changed tunnel can rebind its local address
+		t.cancel()
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			return fmt.Errorf("failed to stop tunnel %s: %w", name, ctx.Err())
+		}
+		delete(c.tunnels, name)
+	}
+	for _, spec := range specs {
+		if _, ok := c.tunnels[spec.Name]; !ok {
+			c.startTunnel(spec)
+		}
+	}
+	c.cfg.Tunnels = specs
+	c.announce()
+	return nil
+}
+
+// startTunnel starts the loop for spec; c.mu must be held
+func (c *Client) startTunnel(spec TunnelSpec) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	t := &clientTunnel{spec: spec, cancel: cancel, done: make(chan struct{})}
+	c.tunnels[spec.Name] = t
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		err := c.runTunnel(ctx, t)
+		metrics.RecordTunnelDown(spec.Name)
+		// UpdateTunnels waits for this holding c.mu
+		close(t.done)
+		if err == nil {
+			return
+		}
+		c.cfg.Logger.Error(ctx, "Tunnel stopped", map[string]interface{}{
+			"tunnel": spec.Name,
+			"error":  err.Error(),
+		})
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.errs = append(c.errs, fmt.Errorf("tunnel %s: %w", spec.Name, err))
+		if c.tunnels[spec.Name] == t {
+			delete(c.tunnels, spec.Name)
+			c.announce()
+		}
+		// With no tunnel left running there is nothing to wait for
+		if len(c.tunnels) == 0 {
+			c.cancel()
+		}
+	}()
+}
+
+// runTunnel serves spec's local end until ctx is cancelled, relaying over
+// whichever session is current. It returns an error when the tunnel can't
+// run.
+func (c *Client) runTunnel(ctx context.Context, t *clientTunnel) error {
+	spec := t.spec
+	local, err := c.listen(spec)
+	if err != nil {
+		return err
+	}
+	switch local := local.(type) {
+	case net.Listener:
+		defer local.Close()
+		return ServeListener(ctx, local, nil, func(conn net.Conn) {
+			c.serveLocal(ctx, t, conn, c.session.Load())
+		})
+	case net.PacketConn:
+		defer local.Close()
+		c.runUDP(ctx, spec, local)
+	default:
+		// Reverse tunnels are served by the session's accepted streams
+		<-ctx.Done()
+	}
+	return nil
+}
+
+// runUDP relays spec's datagrams over one stream of each session in turn
+// until ctx is cancelled. A stream that fails while its session stays up
+// is reopened after udpStreamRetry.
+func (c *Client) runUDP(ctx context.Context, spec TunnelSpec, pc net.PacketConn) {
+	for {
+		c.mu.Lock()
+		mux, changed := c.session.Load(), c.sessionChanged
+		c.mu.Unlock()
+
+		var retry <-chan time.Time
+		if mux != nil {
+			err := c.forwardUDP(ctx, spec, pc, mux)
+			select {
+			case <-mux.Done():
+			default:
+				if ctx.Err() == nil {
+					c.cfg.Logger.Warn(ctx, "UDP tunnel stream failed", map[string]interface{}{
+						"tunnel": spec.Name,
+						"error":  err.Error(),
+					})
+				}
+				retry = time.After(udpStreamRetry)
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-retry:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// udpStreamRetry is how long a UDP tunnel waits before reopening a stream
+// that failed while its session stayed up
+const udpStreamRetry = time.Second
+
+// forwardUDP relays spec's datagrams over a new stream on mux until the
+// stream fails or ctx is cancelled
+func (c *Client) forwardUDP(ctx context.Context, spec TunnelSpec, pc net.PacketConn, mux *Mux) error {
+	stream, err := mux.OpenStreamTo(spec.Name)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	// ForwardUDP sets a deadline to stop the previous stream's reads
+	pc.SetReadDeadline(time.Time{})
+	return ForwardUDP(ctx, spec.Name, pc, stream, spec.IdleTimeout)
+}
+
+// runSession keeps a session to the server up until ctx is cancelled,
+// reconnecting with backoff. It returns an error when it gives up.
+func (c *Client) runSession(ctx context.Context) error {
+	// The session serves every tunnel, so its reconnects are labelled as the
+	// session's rather than one tunnel's
+	backoff := NewReconnectBackoff(metrics.SessionTunnel, c.cfg.Reconnect)
+	failures := 0
+	for {
+		mux, err := c.connect(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			backoff.Failed()
+			failures++
+			c.setError(err)
+			c.reconnecting.Store(c.cfg.Reconnect.Enabled)
+			c.reconnectAttempts.Store(int64(failures))
+			c.cfg.Logger.Warn(ctx, "Failed to connect to server", map[string]interface{}{
+				"server":   c.cfg.ServerAddr,
+				"attempts": failures,
+				"error":    err.Error(),
+			})
+			if !c.cfg.Reconnect.Enabled {
+				return err
+			}
+			if c.cfg.Reconnect.MaxAttempts > 0 && failures >= c.cfg.Reconnect.MaxAttempts {
+				return fmt.Errorf("giving up after %d attempts: %w", failures, err)
+			}
+		} else {
+			failures = 0
+			c.reconnecting.Store(false)
+			c.reconnectAttempts.Store(0)
+			backoff.Connected(time.Now())
+			c.cfg.Logger.Info(ctx, "Connected to server", map[string]interface{}{
+				"server": c.cfg.ServerAddr,
+			})
+
+			c.serveSession(ctx, mux)
+			c.detach(mux)
+
+			backoff.Disconnected(time.Now())
+			if ctx.Err() != nil {
+				return nil
+			}
+			c.setError(mux.closeErr())
+			c.reconnecting.Store(c.cfg.Reconnect.Enabled)
+			c.cfg.Logger.Warn(ctx, "Disconnected from server", map[string]interface{}{
+				"server": c.cfg.ServerAddr,
+				"error":  mux.closeErr().Error(),
+			})
+			if !c.cfg.Reconnect.Enabled {
+				return fmt.Errorf("connection lost: %w", mux.closeErr())
+			}
+		}
+
+		timer := time.NewTimer(backoff.Next())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// listen opens spec's local end: a TCP listener for forward and SOCKS5
+// tunnels, a packet conn for UDP tunnels and nothing for reverse tunnels.
+// It stays open across reconnects so local clients see one address.
+func (c *Client) listen(spec TunnelSpec) (io.Closer, error) {
+	switch {
+	case spec.Reverse:
+		return nil, nil
+	case spec.Protocol == ProtocolUDP:
+		pc, err := net.ListenPacket("udp", spec.LocalAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", spec.LocalAddr, err)
+		}
+		return pc, nil
+	default:
+		ln, err := net.Listen("tcp", spec.LocalAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", spec.LocalAddr, err)
+		}
+		return TuneListener(ln, c.cfg.TCP), nil
+	}
+}
+
+// connect opens a connection to the server and attaches a new session on
+// it, announcing every running tunnel
+func (c *Client) connect(ctx context.Context) (*Mux, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mux := NewMux(conn, true, c.cfg.Mux)
+	if err := c.attach(mux); err != nil {
+		mux.Close()
+		return nil, err
+	}
+	return mux, nil
+}
+
+// dial connects to the server and runs the mTLS handshake and
+// authentication
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	raw, err := TuneDial((&net.Dialer{}).DialContext, c.cfg.TCP)(ctx, "tcp", c.cfg.ServerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial server: %w", err)
+	}
+	tlsConfig := c.cfg.TLSConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(c.cfg.ServerAddr)
+	}
+	conn := tls.Client(raw, tlsConfig)
+	if err := Handshake(ctx, conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	if c.cfg.AuthToken != "" {
+		if err := SendAuthToken(conn, NewFrameWriter(conn), c.cfg.AuthToken); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	// Renegotiation is refused; the server asking for it ends the connection
+	return GuardRenegotiation(ctx, c.cfg.Logger, conn), nil
+}
+
+// resume continues mux's session on a new connection after it lost its
+// own, retrying every reconnect interval. It returns false once the
+// session can't be resumed: the server no longer knows it, mux stopped
+// waiting or ctx was cancelled.
+func (c *Client) resume(ctx context.Context, mux *Mux) bool {
+	interval := c.cfg.Reconnect.Interval
+	if interval <= 0 {
+		interval = DefaultReconnectConfig().Interval
+	}
+	for {
+		err := c.resumeOnce(ctx, mux)
+		if err == nil {
+			c.cfg.Logger.Info(ctx, "Resumed session", map[string]interface{}{
+				"server": c.cfg.ServerAddr,
+			})
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		c.cfg.Logger.Warn(ctx, "Failed to resume session", map[string]interface{}{
+			"server": c.cfg.ServerAddr,
+			"error":  err.Error(),
+		})
+		if errors.Is(err, ErrSessionUnknown) {
+			return false
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-mux.Done():
+			timer.Stop()
+			return false
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// resumeOnce asks the server to continue mux's session on a new
+// connection and moves the session onto it
+func (c *Client) resumeOnce(ctx context.Context, mux *Mux) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	token, received := mux.resumeState()
+	if err := NewFrameWriter(conn).WriteFrame(resumeRequest(token, received)); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to request resume: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(DefaultTimeouts.Handshake))
+	f, err := ReadFrame(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to read resume answer: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	peerReceived, err := parseResumeReply(f)
+	if err == nil {
+		err = mux.resume(conn, peerReceived, false)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// attach announces the running tunnels on mux and makes it the current
+// session
+func (c *Client) attach(mux *Mux) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	specs := c.specs()
+	announce, err := TunnelsFrame(specs)
+	if err == nil {
+		err = mux.SendControl(announce)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to announce tunnels: %w", err)
+	}
+	c.session.Store(mux)
+	close(c.sessionChanged)
+	c.sessionChanged = make(chan struct{})
+	for _, spec := range specs {
+		metrics.RecordTunnelUp(spec.Name)
+	}
+	return nil
+}
+
+// detach clears mux as the current session once it has ended
+func (c *Client) detach(mux *Mux) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.session.CompareAndSwap(mux, nil) {
+		return
+	}
+	close(c.sessionChanged)
+	c.sessionChanged = make(chan struct{})
+	for _, spec := range c.specs() {
+		metrics.RecordTunnelDown(spec.Name)
+	}
+}
+
+// announce sends the running tunnels on the current session, if any, so
+// the server serves the new set. A session that can't take the
+// announcement is closed to reconnect with it. c.mu must be held.
+func (c *Client) announce() {
+	mux := c.session.Load()
+	if mux == nil {
+		return
+	}
+	specs := c.specs()
+	announce, err := TunnelsFrame(specs)
+	if err == nil {
+		err = mux.SendControl(announce)
+	}
+	if err != nil {
+		c.cfg.Logger.Warn(c.ctx, "Failed to announce tunnels", map[string]interface{}{
+			"server": c.cfg.ServerAddr,
+			"error":  err.Error(),
+		})
+		// Closing without waiting: the session loop needs c.mu to detach
+		go mux.Close()
+		return
+	}
+	for _, spec := range specs {
+		metrics.RecordTunnelUp(spec.Name)
+	}
+}
+
+// specs returns the running tunnels in configured order; c.mu must be held
+func (c *Client) specs() []TunnelSpec {
+	specs := make([]TunnelSpec, 0, len(c.tunnels))
+	for _, spec := range c.cfg.Tunnels {
+		if t, ok := c.tunnels[spec.Name]; ok && reflect.DeepEqual(t.spec, spec) {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// serveSession serves the streams the server opens on mux until the
+// session fails or ctx is cancelled, then closes mux. A lost connection
+// is replaced by resuming the session when the server allows it.
+func (c *Client) serveSession(ctx context.Context, mux *Mux) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer mux.Close()
+
+	// The server opens streams for reverse tunnels only
+	go func() {
+		for {
+			stream, err := mux.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			specs := c.specs()
+			c.mu.Unlock()
+			go ServeReverseStream(ctx, c.cfg.Logger, specs, stream)
+		}
+	}()
+
+	for {
+		connCtx, stopKeepalive := context.WithCancel(ctx)
+		go RunKeepalive(connCtx, mux.fw, c.cfg.Keepalive)
+		select {
+		case <-mux.Lost():
+			stopKeepalive()
+			c.reconnecting.Store(true)
+			if !c.resume(ctx, mux) {
+				return
+			}
+			c.reconnecting.Store(false)
+		case <-mux.Done():
+			stopKeepalive()
+			return
+		case <-ctx.Done():
+			stopKeepalive()
+			return
+		}
+	}
+}
+
+// serveLocal relays one connection accepted by t's local listener over
+// mux, refusing it while the tunnel is disconnected
+func (c *Client) serveLocal(ctx context.Context, t *clientTunnel, conn net.Conn, mux *Mux) {
+	spec := t.spec
+	if mux == nil {
+		metrics.RecordTunnelRejection(spec.Name, ReasonServerDisconnected)
+		conn.Close()
+		return
+	}
+	t.active.Add(1)
+	defer t.active.Add(-1)
+	if spec.Protocol == ProtocolSOCKS5 {
+		ServeSOCKS5(ctx, c.cfg.Logger, spec, conn, mux)
+		return
+	}
+
+	defer conn.Close()
+	ctx, span := startConnSpan(ctx, spec.Name, conn)
+	var bytesIn, bytesOut int64
+	var err error
+	defer func() { finishConnSpan(span, bytesIn, bytesOut, err) }()
+
+	stream, err := mux.OpenStreamTo(spec.Name)
+	if err != nil {
+		metrics.RecordTunnelConnectionError(spec.Name, "open_stream")
+		t.setError(err)
+		c.cfg.Logger.Warn(ctx, "Failed to open tunnel stream", map[string]interface{}{
+			"tunnel": spec.Name,
+			"error":  err.Error(),
+		})
+		return
+	}
+	defer stream.Close()
+
+	var tunnelConn net.Conn = stream
+	if codecs := LocalCodecs(spec.Compression); len(codecs) > 0 {
+		if tunnelConn, err = NegotiateCompression(stream, codecs, spec.Name, true); err != nil {
+			metrics.RecordTunnelConnectionError(spec.Name, "compression")
+			t.setError(err)
+			c.cfg.Logger.Warn(ctx, "Failed to negotiate tunnel compression", map[string]interface{}{
+				"tunnel": spec.Name,
+				"error":  err.Error(),
+			})
+			return
+		}
+	}
+	bytesIn, bytesOut = pipeStream(conn, tunnelConn)
+	t.bytesIn.Add(bytesIn)
+	t.bytesOut.Add(bytesOut)
+}
@@ -0,0 +1,324 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+)
+
+// testTLSConfigs returns server and client mTLS configs sharing one
+// self-signed certificate for 127.0.0.1
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	cert := testCertificate(t, "gotunnel-test")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	client := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return server, client
+}
+
+// testClientTLS returns a copy of clientTLS presenting a new certificate
+// with common name cn, which serverTLS is made to trust
+func testClientTLS(t *testing.T, serverTLS, clientTLS *tls.Config, cn string) *tls.Config {
+	t.Helper()
+	cert := testCertificate(t, cn)
+	serverTLS.ClientCAs.AddCert(cert.Leaf)
+	client := clientTLS.Clone()
+	client.Certificates = []tls.Certificate{cert}
+	return client
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1 with
+// common name cn
+func testCertificate(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// testLogger returns a logger that only reports errors
+func testLogger() *logging.Logger {
+	return logging.NewLogger("gotunnel-test", "test", logging.ERROR)
+}
+
+func TestClientReconnectsAndAnnounces(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Each session is dropped after its announcement, forcing a reconnect
+	announced := make(chan []TunnelSpec, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f, err := ReadFrame(conn)
+			if err == nil {
+				if specs, err := ParseTunnelsFrame(f); err == nil {
+					announced <- specs
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	client := NewClient(&ClientConfig{
+		ServerAddr: ln.Addr().String(),
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect: ReconnectConfig{
+			Enabled:  true,
+			Interval: 10 * time.Millisecond,
+			Backoff:  1,
+		},
+		Tunnels: []TunnelSpec{{
+			Name:       "proxy",
+			Protocol:   ProtocolSOCKS5,
+			LocalAddr:  "127.0.0.1:0",
+			SOCKSUsers: map[string]string{"alice": "secret"},
+		}},
+	})
+	started := make(chan error, 1)
+	go func() { started <- client.Start() }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case specs := <-announced:
+			if len(specs) != 1 || specs[0].Name != "proxy" {
+				t.Fatalf("announced %+v, want the proxy tunnel", specs)
+			}
+			if specs[0].SOCKSUsers != nil {
+				t.Error("SOCKS5 credentials were sent to the server")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no announcement for session %d", i+1)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("Start returned %v after Shutdown", err)
+	}
+}
+
+func TestClientAnnouncesEveryTunnelOnOneSession(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sessions := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			sessions <- conn
+		}
+	}()
+	announced := func(conn net.Conn) []string {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		f, err := ReadFrame(conn)
+		// Skip the UDP tunnel's stream
+		for err == nil && f.Type != FrameTunnels {
+			f, err = ReadFrame(conn)
+		}
+		if err != nil {
+			t.Fatalf("reading announcement: %v", err)
+		}
+		specs, err := ParseTunnelsFrame(f)
+		if err != nil {
+			t.Fatalf("parsing announcement: %v", err)
+		}
+		names := make([]string, len(specs))
+		for i, spec := range specs {
+			names[i] = spec.Name
+		}
+		return names
+	}
+
+	web := TunnelSpec{Name: "web", Protocol: ProtocolTCP, LocalAddr: freeAddr(t), RemoteAddr: "127.0.0.1:80"}
+	dns := TunnelSpec{Name: "dns", Protocol: ProtocolUDP, LocalAddr: freeAddr(t), RemoteAddr: "127.0.0.1:53"}
+	client := startClient(t, &ClientConfig{
+		ServerAddr: ln.Addr().String(),
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: time.Second, Backoff: 1},
+		Tunnels:    []TunnelSpec{web, dns},
+	})
+
+	var session net.Conn
+	select {
+	case session = <-sessions:
+		defer session.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("client never connected")
+	}
+	if got := announced(session); !slices.Equal(got, []string{"web", "dns"}) {
+		t.Errorf("announced %v, want [web dns] in one message", got)
+	}
+
+	// A new tunnel is announced on the same session along with the others
+	ssh := TunnelSpec{Name: "ssh", Protocol: ProtocolTCP, LocalAddr: freeAddr(t), RemoteAddr: "127.0.0.1:22"}
+	if err := client.UpdateTunnels(context.Background(), []TunnelSpec{web, dns, ssh}); err != nil {
+		t.Fatalf("UpdateTunnels: %v", err)
+	}
+	for {
+		got := announced(session)
+		if slices.Equal(got, []string{"web", "dns", "ssh"}) {
+			break
+		}
+		if !slices.Equal(got, []string{"web", "dns"}) {
+			t.Fatalf("announced %v after the update, want [web dns ssh]", got)
+		}
+	}
+	select {
+	case conn := <-sessions:
+		conn.Close()
+		t.Error("client opened a second session")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClientGivesUpAfterMaxAttempts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, clientTLS := testTLSConfigs(t)
+	client := NewClient(&ClientConfig{
+		ServerAddr: addr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect: ReconnectConfig{
+			Enabled:     true,
+			MaxAttempts: 2,
+			Interval:    time.Millisecond,
+			Backoff:     1,
+		},
+		Tunnels: []TunnelSpec{{Name: "web", Protocol: ProtocolTCP, LocalAddr: "127.0.0.1:0", RemoteAddr: "127.0.0.1:80"}},
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- client.Start() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Start returned nil after every tunnel gave up")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after the tunnel gave up")
+	}
+}
+
+func TestReconnectBackoffJitterAndReset(t *testing.T) {
+	b := NewReconnectBackoff("backoff-test", ReconnectConfig{
+		Enabled:     true,
+		Interval:    time.Second,
+		Backoff:     2,
+		MaxBackoff:  4 * time.Second,
+		Jitter:      0.5,
+		StableAfter: 10 * time.Second,
+	})
+	draws := []float64{0, 0.5, 0, 0.5, 0, 0}
+	b.SetRand(func() float64 {
+		r := draws[0]
+		draws = draws[1:]
+		return r
+	})
+
+	want := []time.Duration{
+		time.Second,             // the first retry is never later than Interval
+		1500 * time.Millisecond, // 2s shortened by half of the 0.5 jitter
+		4 * time.Second,         // capped at MaxBackoff
+		3 * time.Second,
+	}
+	for i, w := range want {
+		if got := b.Next(); got != w {
+			t.Errorf("delay %d = %s, want %s", i, got, w)
+		}
+	}
+
+	// A connection that drops before StableAfter keeps the backoff
+	start := time.Now()
+	b.Connected(start)
+	b.Disconnected(start.Add(5 * time.Second))
+	if got := b.Next(); got != 4*time.Second {
+		t.Errorf("delay after a short connection = %s, want 4s", got)
+	}
+
+	// One that stays up resets it
+	b.Connected(start)
+	b.Disconnected(start.Add(10 * time.Second))
+	if got := b.Next(); got != time.Second {
+		t.Errorf("delay after a stable connection = %s, want 1s", got)
+	}
+}
+
+func TestReconnectBackoffFullJitter(t *testing.T) {
+	b := NewReconnectBackoff("backoff-test", ReconnectConfig{Enabled: true, Interval: time.Second, Backoff: 1, Jitter: 1})
+	b.SetRand(func() float64 { return 0.75 })
+	if got := b.Next(); got != 250*time.Millisecond {
+		t.Errorf("delay = %s, want 250ms", got)
+	}
+}
@@ -0,0 +1,206 @@
+package tunnel
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+// SupportedCodecs are the codecs this build can compress and decompress
+var SupportedCodecs = []Codec{CodecZstd, CodecGzip}
+
+// LocalCodecs returns the codecs to advertise for a tunnel configured with
+// compression. Without compression only CodecNone is implied, so the
+// negotiation always settles on no compression.
+func LocalCodecs(compression Codec) []Codec {
+	if compression == "" || compression == CodecNone {
+		return nil
+	}
+	return []Codec{compression}
+}
+
+// validateCompression reports whether codec can be used in this build
+func validateCompression(codec Codec) error {
+	if codec == "" || codec == CodecNone || hasCodec(SupportedCodecs, codec) {
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", codec)
+}
+
+// CompressWriter wraps w so writes are compressed with codec. Each write is
+// flushed through to w so interactive traffic isn't held back waiting for
+// a full compression block. Wire and payload bytes are recorded for tunnel
+// under direction. Close flushes the compressor without closing w.
+func CompressWriter(w io.Writer, codec Codec, tunnel, direction string) (io.WriteCloser, error) {
+	counter := &countingWriter{w: w}
+	switch codec {
+	case CodecNone:
+		return &compressWriter{counter: counter, w: nopWriteCloser{counter}, tunnel: tunnel, direction: direction}, nil
+	case CodecGzip:
+		zw, err := gzip.NewWriterLevel(counter, gzip.DefaultCompression)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip writer: %w", err)
+		}
+		return &compressWriter{counter: counter, w: zw, flush: zw.Flush, tunnel: tunnel, direction: direction}, nil
+	case CodecZstd:
+		// One encoder goroutine per stream is plenty; more would only
+		// buffer data that must be flushed per write anyway
+		zw, err := zstd.NewWriter(counter, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+		}
+		return &compressWriter{counter: counter, w: zw, flush: zw.Flush, tunnel: tunnel, direction: direction}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", codec)
+	}
+}
+
+type compressWriter struct {
+	counter   *countingWriter
+	w         io.WriteCloser
+	flush     func() error
+	tunnel    string
+	direction string
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	before := c.counter.n
+	n, err := c.w.Write(p)
+	if err == nil && c.flush != nil {
+		err = c.flush()
+	}
+	metrics.RecordTransfer(c.direction, c.tunnel, c.counter.n-before, int64(n))
+	return n, err
+}
+
+func (c *compressWriter) Close() error {
+	before := c.counter.n
+	err := c.w.Close()
+	metrics.RecordTransfer(c.direction, c.tunnel, c.counter.n-before, 0)
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// DecompressReader wraps r so data compressed with codec by the peer's
+// CompressWriter is decompressed. The stream header is only read on the
+// first Read, so setup doesn't block waiting for the peer to send data.
+func DecompressReader(r io.Reader, codec Codec, tunnel, direction string) (io.Reader, error) {
+	switch codec {
+	case CodecNone, CodecGzip, CodecZstd:
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", codec)
+	}
+	return &decompressReader{counter: &countingReader{r: r}, codec: codec, tunnel: tunnel, direction: direction}, nil
+}
+
+type decompressReader struct {
+	counter   *countingReader
+	codec     Codec
+	r         io.Reader
+	tunnel    string
+	direction string
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	before := d.counter.n
+	if d.r == nil {
+		switch d.codec {
+		case CodecGzip:
+			zr, err := gzip.NewReader(d.counter)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read gzip header: %w", err)
+			}
+			d.r = zr
+		case CodecZstd:
+			zr, err := zstd.NewReader(d.counter, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return 0, fmt.Errorf("failed to create zstd reader: %w", err)
+			}
+			d.r = zr
+		default:
+			d.r = d.counter
+		}
+	}
+
+	n, err := d.r.Read(p)
+	metrics.RecordTransfer(d.direction, d.tunnel, d.counter.n-before, int64(n))
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NegotiateCompression exchanges codecs with the peer over conn, advertising
+// local, and returns conn wrapped to compress writes and decompress reads
+// with the agreed codec. Both ends of a stream call it before any data when
+// the tunnel has compression configured. Bytes toward the backend are
+// recorded as "in" and bytes back as "out".
+func NegotiateCompression(conn net.Conn, local []Codec, tunnel string, isClient bool) (net.Conn, error) {
+	codec, err := ExchangeCodecs(NewFrameWriter(conn), conn, local)
+	if err != nil {
+		return nil, err
+	}
+	if codec == CodecNone {
+		return conn, nil
+	}
+
+	readDirection, writeDirection := "in", "out"
+	if isClient {
+		readDirection, writeDirection = "out", "in"
+	}
+	w, err := CompressWriter(conn, codec, tunnel, writeDirection)
+	if err != nil {
+		return nil, err
+	}
+	r, err := DecompressReader(conn, codec, tunnel, readDirection)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedConn{Conn: conn, r: r, w: w}, nil
+}
+
+// compressedConn is a stream whose data is compressed on the wire
+type compressedConn struct {
+	net.Conn
+	r         io.Reader
+	w         io.WriteCloser
+	closeOnce sync.Once
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *compressedConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// CloseWrite ends the compressed stream so the peer can decode all of it,
+// then half-closes the conn
+func (c *compressedConn) CloseWrite() error {
+	var err error
+	c.closeOnce.Do(func() { err = c.w.Close() })
+	if err != nil {
+		return err
+	}
+	return closeWrite(c.Conn)
+}
+
+func (c *compressedConn) unwrap() net.Conn { return c.Conn }
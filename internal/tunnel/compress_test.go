@@ -0,0 +1,155 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  []Codec
+		remote []Codec
+		want   Codec
+	}{
+		{"both support everything", []Codec{CodecGzip, CodecZstd}, []Codec{CodecZstd, CodecGzip}, CodecZstd},
+		{"single overlap", []Codec{CodecGzip, CodecZstd}, []Codec{CodecGzip}, CodecGzip},
+		{"preference ignores advertised order", []Codec{CodecGzip, CodecZstd}, []Codec{CodecGzip, CodecZstd}, CodecZstd},
+		{"no overlap", []Codec{CodecZstd}, []Codec{CodecGzip}, CodecNone},
+		{"local without compression", nil, []Codec{CodecZstd, CodecGzip}, CodecNone},
+		{"remote without compression", []Codec{CodecZstd}, nil, CodecNone},
+		{"unknown remote codec", []Codec{CodecZstd}, []Codec{"brotli"}, CodecNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NegotiateCodec(tt.local, tt.remote); got != tt.want {
+				t.Errorf("NegotiateCodec(%v, %v) = %q, want %q", tt.local, tt.remote, got, tt.want)
+			}
+			// Both peers rank the same way, so they must agree
+			if got := NegotiateCodec(tt.remote, tt.local); got != tt.want {
+				t.Errorf("NegotiateCodec(%v, %v) = %q, want %q", tt.remote, tt.local, got, tt.want)
+			}
+		})
+	}
+}
+
+// exchangeCodecs runs ExchangeCodecs on both ends of a connection and returns
+// what each side settled on
+func exchangeCodecs(t *testing.T, client, server []Codec) (Codec, Codec) {
+	t.Helper()
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	type result struct {
+		codec Codec
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		codec, err := ExchangeCodecs(NewFrameWriter(serverConn), serverConn, server)
+		done <- result{codec, err}
+	}()
+
+	clientCodec, err := ExchangeCodecs(NewFrameWriter(clientConn), clientConn, client)
+	if err != nil {
+		t.Fatalf("client ExchangeCodecs() error = %v", err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("server ExchangeCodecs() error = %v", r.err)
+	}
+	return clientCodec, r.codec
+}
+
+func TestExchangeCodecs(t *testing.T) {
+	tests := []struct {
+		name   string
+		client []Codec
+		server []Codec
+		want   Codec
+	}{
+		{"overlapping", []Codec{CodecGzip}, SupportedCodecs, CodecGzip},
+		{"best shared codec", []Codec{CodecZstd, CodecGzip}, SupportedCodecs, CodecZstd},
+		{"non-overlapping falls back to none", []Codec{CodecZstd}, []Codec{CodecGzip}, CodecNone},
+		{"compression not configured", LocalCodecs(CodecNone), SupportedCodecs, CodecNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientCodec, serverCodec := exchangeCodecs(t, tt.client, tt.server)
+			if clientCodec != tt.want || serverCodec != tt.want {
+				t.Errorf("negotiated client %q, server %q, want %q", clientCodec, serverCodec, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateCompressionRecordsWireAndPayloadBytes(t *testing.T) {
+	const name = "compress-accounting"
+	metrics.SetTunnels([]string{name})
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := NegotiateCompression(serverConn, SupportedCodecs, name, false)
+		done <- result{conn, err}
+	}()
+	client, err := NegotiateCompression(clientConn, []Codec{CodecGzip}, name, true)
+	if err != nil {
+		t.Fatalf("client NegotiateCompression() error = %v", err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("server NegotiateCompression() error = %v", r.err)
+	}
+	server := r.conn
+
+	before := make(map[string][2]float64)
+	for _, direction := range []string{"in", "out"} {
+		before[direction] = [2]float64{
+			counterValue(t, metrics.Default.WireBytes.WithLabelValues(direction, name)),
+			counterValue(t, metrics.Default.PayloadBytes.WithLabelValues(direction, name)),
+		}
+	}
+
+	// "in" flows from the client toward the backend, "out" back again
+	data := []byte(strings.Repeat("compressible ", 4096))
+	transfer := func(from, to net.Conn) {
+		t.Helper()
+		go from.Write(data)
+		to.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(to, got); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("data changed in transit")
+		}
+	}
+	transfer(client, server)
+	transfer(server, client)
+
+	for _, direction := range []string{"in", "out"} {
+		wire := counterValue(t, metrics.Default.WireBytes.WithLabelValues(direction, name)) - before[direction][0]
+		payload := counterValue(t, metrics.Default.PayloadBytes.WithLabelValues(direction, name)) - before[direction][1]
+		// The writer and the reader each account for the bytes they handle
+		if want := float64(2 * len(data)); payload != want {
+			t.Errorf("%s payload bytes = %v, want %v", direction, payload, want)
+		}
+		if wire == 0 || wire >= payload {
+			t.Errorf("%s wire bytes = %v for %v payload bytes, want fewer but some", direction, wire, payload)
+		}
+	}
+}
@@ -1 +1,522 @@
 package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gotunnel-pro/internal/crypto"
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// Timeouts is the set of timeouts applied to a tunnel's connections.
+// A zero value means the timeout is disabled.
+type Timeouts struct {
+	Dial      time.Duration `json:"dial"`
+	Idle      time.Duration `json:"idle"`
+	Read      time.Duration `json:"read"`
+	Write     time.Duration `json:"write"`
+	Handshake time.Duration `json:"handshake"`
+	// IO is an absolute cap on any single read or write in the data path,
+	// a safety net against hung kernels or drivers. See WithIOTimeout.
+	IO time.Duration `json:"io"`
+}
+
+// DefaultTimeouts are conservative connection timeouts, so a client that
+// stalls or trickles bytes can't hold a connection and its goroutine
+// indefinitely. Read applies to the client's control connection and is
+// generous because keepalives arrive well within it.
+var DefaultTimeouts = Timeouts{
+	Dial:      10 * time.Second,
+	Read:      2 * time.Minute,
+	Write:     30 * time.Second,
+	Handshake: 10 * time.Second,
+}
+
+// Merge returns the timeouts with unset values taken from defaults
+func (t Timeouts) Merge(defaults Timeouts) Timeouts {
+	if t.Dial == 0 {
+		t.Dial = defaults.Dial
+	}
+	if t.Idle == 0 {
+		t.Idle = defaults.Idle
+	}
+	if t.Read == 0 {
+		t.Read = defaults.Read
+	}
+	if t.Write == 0 {
+		t.Write = defaults.Write
+	}
+	if t.Handshake == 0 {
+		t.Handshake = defaults.Handshake
+	}
+	if t.IO == 0 {
+		t.IO = defaults.IO
+	}
+	return t
+}
+
+// Stats returns the timeouts in seconds, keyed by kind, for stats output
+func (t Timeouts) Stats() map[string]float64 {
+	return map[string]float64{
+		"dial":      t.Dial.Seconds(),
+		"idle":      t.Idle.Seconds(),
+		"read":      t.Read.Seconds(),
+		"write":     t.Write.Seconds(),
+		"handshake": t.Handshake.Seconds(),
+		"io":        t.IO.Seconds(),
+	}
+}
+
+// Report exposes the effective timeouts of a tunnel as metrics
+func (t Timeouts) Report(tunnel string) {
+	metrics.SetTunnelTimeout(tunnel, "dial", t.Dial)
+	metrics.SetTunnelTimeout(tunnel, "idle", t.Idle)
+	metrics.SetTunnelTimeout(tunnel, "read", t.Read)
+	metrics.SetTunnelTimeout(tunnel, "write", t.Write)
+	metrics.SetTunnelTimeout(tunnel, "handshake", t.Handshake)
+	metrics.SetTunnelTimeout(tunnel, "io", t.IO)
+}
+
+// WithIOTimeout wraps conn so every read and write must complete within
+// timeout, resetting the deadline per operation. An operation that runs
+// past it is counted as io_timeout and the connection is closed. A
+// non-positive timeout returns conn unchanged.
+func WithIOTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &ioTimeoutConn{Conn: conn, read: timeout, write: timeout, errorType: "io_timeout"}
+}
+
+// WithTimeouts wraps conn so each read must complete within t.Read and
+// each write within t.Write, which stops a peer that sends nothing, or a
+// byte at a time, from holding the connection. An operation that runs past
+// its timeout is counted as a timeout connection error and the connection
+// is closed. Zero timeouts are not applied.
+func WithTimeouts(conn net.Conn, t Timeouts) net.Conn {
+	if t.Read <= 0 && t.Write <= 0 {
+		return conn
+	}
+	return &ioTimeoutConn{Conn: conn, read: t.Read, write: t.Write, errorType: "timeout"}
+}
+
+type ioTimeoutConn struct {
+	net.Conn
+	read      time.Duration
+	write     time.Duration
+	errorType string
+
+	// Deadlines set by the caller, which win when they come first
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *ioTimeoutConn) Read(p []byte) (int, error) {
+	if c.read <= 0 {
+		return c.Conn.Read(p)
+	}
+	c.mu.Lock()
+	deadline, own := earliest(c.readDeadline, c.read)
+	c.mu.Unlock()
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(p)
+	c.checkTimeout(err, own)
+	return n, err
+}
+
+func (c *ioTimeoutConn) Write(p []byte) (int, error) {
+	if c.write <= 0 {
+		return c.Conn.Write(p)
+	}
+	c.mu.Lock()
+	deadline, own := earliest(c.writeDeadline, c.write)
+	c.mu.Unlock()
+	if err := c.Conn.SetWriteDeadline(deadline); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(p)
+	c.checkTimeout(err, own)
+	return n, err
+}
+
+func (c *ioTimeoutConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *ioTimeoutConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *ioTimeoutConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// earliest returns the sooner of the caller's deadline and timeout from
+// now, and whether it is the latter
+func earliest(deadline time.Time, timeout time.Duration) (time.Time, bool) {
+	own := time.Now().Add(timeout)
+	if !deadline.IsZero() && deadline.Before(own) {
+		return deadline, false
+	}
+	return own, true
+}
+
+// checkTimeout counts and closes on a timeout of the conn's own deadline;
+// the caller's deadlines are left to the caller
+func (c *ioTimeoutConn) checkTimeout(err error, own bool) {
+	var netErr net.Error
+	if own && errors.As(err, &netErr) && netErr.Timeout() {
+		metrics.RecordConnectionError(c.errorType)
+		c.Conn.Close()
+	}
+}
+
+func (c *ioTimeoutConn) unwrap() net.Conn { return c.Conn }
+
+// DialWithTimeouts wraps dial so backend dials give up after t.Dial and
+// writes to the backend within t.Write. Backend reads get no timeout: one
+// direction of a forwarded connection is legitimately silent during a long
+// transfer, so quiet connections are left to the tunnel's idle timeout.
+func DialWithTimeouts(dial DialFunc, t Timeouts) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if t.Dial > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, t.Dial)
+			defer cancel()
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				metrics.RecordConnectionError("timeout")
+			}
+			return nil, err
+		}
+		return WithTimeouts(conn, Timeouts{Write: t.Write}), nil
+	}
+}
+
+// Handshake runs the TLS handshake on conn and records its duration by
+// result
+func Handshake(ctx context.Context, conn *tls.Conn) error {
+	start := time.Now()
+	err := conn.HandshakeContext(ctx)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.RecordHandshake(result, time.Since(start))
+	return err
+}
+
+// HandshakeWithTimeout runs Handshake bounded by timeout, so a client that
+// stalls mid-handshake can't hold the accepting goroutine. A handshake that
+// times out is also counted as a timeout connection error. A non-positive
+// timeout only applies ctx.
+func HandshakeWithTimeout(ctx context.Context, conn *tls.Conn, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := Handshake(ctx, conn)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		metrics.RecordConnectionError("timeout")
+	}
+	return err
+}
+
+// CloseOnRenegotiation closes conn when err shows the peer attempted a TLS
+// renegotiation, logging and counting the attempt. It reports whether the
+// connection was closed.
+func CloseOnRenegotiation(ctx context.Context, logger *logging.Logger, conn net.Conn, err error) bool {
+	if !crypto.IsRenegotiationAttempt(err) {
+		return false
+	}
+
+	metrics.RecordConnectionError("renegotiation_attempt")
+	logger.Audit(ctx, "Peer attempted TLS renegotiation, closing connection", map[string]interface{}{
+		"remote_addr": conn.RemoteAddr().String(),
+		"error":       err.Error(),
+	})
+	conn.Close()
+	return true
+}
+
+// GuardRenegotiation wraps a TLS connection so that a read failing because
+// the peer attempted renegotiation closes it through CloseOnRenegotiation
+func GuardRenegotiation(ctx context.Context, logger *logging.Logger, conn net.Conn) net.Conn {
+	return &renegotiationConn{Conn: conn, ctx: ctx, logger: logger}
+}
+
+type renegotiationConn struct {
+	net.Conn
+	ctx    context.Context
+	logger *logging.Logger
+}
+
+func (c *renegotiationConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		CloseOnRenegotiation(c.ctx, c.logger, c.Conn, err)
+	}
+	return n, err
+}
+
+func (c *renegotiationConn) unwrap() net.Conn { return c.Conn }
+
+// LingerOSDefault leaves SO_LINGER untouched when force-closing connections
+const LingerOSDefault = -1
+
+// lingerSetter is implemented by connections that support SO_LINGER, such as *net.TCPConn
+type lingerSetter interface {
+	SetLinger(sec int) error
+}
+
+// ForceClose closes a connection that outlived the shutdown deadline. A
+// linger of 0 discards unsent data and resets the connection (RST) instead
+// of leaving it in TIME_WAIT; a positive value lingers for that many seconds;
+// LingerOSDefault keeps the OS behaviour. Linger is set on the connection
+// under TLS and this package's wrappers, and ignored for connections that
+// don't support it, except that a linger of 0 resets a mux stream.
+func ForceClose(conn net.Conn, linger int) error {
+	if linger != LingerOSDefault {
+		target := conn
+		for {
+			if tlsConn, ok := target.(*tls.Conn); ok {
+				target = tlsConn.NetConn()
+			} else if wrapped, ok := target.(wrappedConn); ok {
+				target = wrapped.unwrap()
+			} else {
+				break
+			}
+		}
+		if ls, ok := target.(lingerSetter); ok {
+			ls.SetLinger(linger)
+		} else if stream, ok := target.(*MuxStream); ok && linger == 0 {
+			stream.Reset()
+		}
+	}
+	return conn.Close()
+}
+
+// HandshakeErrorLogger logs the cause of failed TLS handshakes at WARN,
+// allowing at most one entry per cause per interval and reporting how many
+// were suppressed in between
+type HandshakeErrorLogger struct {
+	mu         sync.Mutex
+	logger     *logging.Logger
+	interval   time.Duration
+	lastLogged map[string]time.Time
+	suppressed map[string]int
+}
+
+// NewHandshakeErrorLogger creates a rate-limited handshake error logger
+func NewHandshakeErrorLogger(logger *logging.Logger, interval time.Duration) *HandshakeErrorLogger {
+	return &HandshakeErrorLogger{
+		logger:     logger,
+		interval:   interval,
+		lastLogged: make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+// Log records a handshake failure with the peer at remoteAddr
+func (h *HandshakeErrorLogger) Log(ctx context.Context, remoteAddr string, err error) {
+	reason := crypto.DescribeHandshakeError(err)
+
+	h.mu.Lock()
+	now := time.Now()
+	if last, ok := h.lastLogged[reason]; ok && now.Sub(last) < h.interval {
+		h.suppressed[reason]++
+		h.mu.Unlock()
+		return
+	}
+	suppressed := h.suppressed[reason]
+	h.lastLogged[reason] = now
+	delete(h.suppressed, reason)
+	h.mu.Unlock()
+
+	h.logger.Warn(ctx, "TLS handshake failed", map[string]interface{}{
+		"reason":      reason,
+		"error":       err.Error(),
+		"remote_addr": remoteAddr,
+		"suppressed":  suppressed,
+	})
+}
+
+// IdleReaper closes connections that have been idle longer than their
+// timeout. Rather than a timer per connection it scans a registry of
+// last-activity timestamps once per interval, which scales better with
+// many connections. A connection is reaped within one interval of reaching
+// its timeout.
+type IdleReaper struct {
+	mu       sync.Mutex
+	conns    map[*idleConn]struct{}
+	interval time.Duration
+}
+
+// NewIdleReaper creates a reaper scanning every interval
+func NewIdleReaper(interval time.Duration) *IdleReaper {
+	return &IdleReaper{
+		conns:    make(map[*idleConn]struct{}),
+		interval: interval,
+	}
+}
+
+// Track registers conn of tunnel with the reaper, to be closed once idle
+// for timeout. Reads and writes through the returned conn count as
+// activity; closing it unregisters it.
+func (r *IdleReaper) Track(conn net.Conn, tunnel string, timeout time.Duration) net.Conn {
+	c := &idleConn{Conn: conn, reaper: r, tunnel: tunnel, timeout: timeout}
+	c.touch()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[c] = struct{}{}
+	return c
+}
+
+// Relay is Relay with the idle timeout enforced by the reaper's scans
+// instead of read deadlines. Only the client side is tracked: both
+// directions pass through it.
+func (r *IdleReaper) Relay(tunnel string, client, backend net.Conn, idleTimeout time.Duration) (bytesIn, bytesOut int64, err error) {
+	if idleTimeout <= 0 {
+		return Relay(tunnel, client, backend, 0)
+	}
+	tracked := r.Track(client, tunnel, idleTimeout).(*idleConn)
+	bytesIn, bytesOut, err = Relay(tunnel, tracked, backend, 0)
+	if tracked.reaped.Load() {
+		return bytesIn, bytesOut, ErrIdleTimeout
+	}
+	return bytesIn, bytesOut, err
+}
+
+// Run scans for idle connections every interval until ctx is cancelled
+func (r *IdleReaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.Scan(now)
+		}
+	}
+}
+
+// Scan closes every connection idle for its timeout as of now and returns
+// how many were reaped
+func (r *IdleReaper) Scan(now time.Time) int {
+	start := time.Now()
+
+	r.mu.Lock()
+	inspected := len(r.conns)
+	var idle []*idleConn
+	for c := range r.conns {
+		if c.lastActivity.Load() < now.Add(-c.timeout).UnixNano() {
+			idle = append(idle, c)
+			delete(r.conns, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range idle {
+		c.reaped.Store(true)
+		metrics.RecordTunnelConnectionError(c.tunnel, "idle_timeout")
+		c.Conn.Close()
+	}
+	metrics.RecordIdleScan(time.Since(start), inspected)
+	return len(idle)
+}
+
+func (r *IdleReaper) untrack(c *idleConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, c)
+}
+
+type idleConn struct {
+	net.Conn
+	reaper       *IdleReaper
+	tunnel       string
+	timeout      time.Duration
+	lastActivity atomic.Int64
+	reaped       atomic.Bool
+}
+
+func (c *idleConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.reaper.untrack(c)
+	return c.Conn.Close()
+}
+
+func (c *idleConn) unwrap() net.Conn { return c.Conn }
+
+// Connection setup phases, each timed from the end of the previous one
+const (
+	// PhaseHandshake runs from TCP accept until the TLS handshake completes
+	PhaseHandshake = "handshake"
+	// PhaseAuth runs from handshake completion until the client is authorised
+	PhaseAuth = "auth"
+	// PhaseBackend runs from a stream arriving on an authorised session
+	// until its backend is connected
+	PhaseBackend = "backend_dial"
+)
+
+// SetupTimer times the phases of connection setup so slowness can be
+// attributed to crypto, auth or the backend dial
+type SetupTimer struct {
+	last time.Time
+}
+
+// StartSetupTimer starts timing at the moment a connection is accepted
+func StartSetupTimer() *SetupTimer {
+	return &SetupTimer{last: time.Now()}
+}
+
+// Phase records the time since the previous phase ended under name
+func (t *SetupTimer) Phase(name string) {
+	now := time.Now()
+	metrics.RecordSetupPhase(name, now.Sub(t.last))
+	t.last = now
+}
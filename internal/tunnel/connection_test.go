@@ -0,0 +1,274 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// handshakeCount returns how many handshakes were observed with result
+func handshakeCount(t *testing.T, result string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metrics.Default.TLSHandshakeDuration.WithLabelValues(result).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// serverHandshake runs Handshake on the server side of a loopback
+// connection dialed with clientTLS
+func serverHandshake(t *testing.T, serverTLS, clientTLS *tls.Config) error {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientTLS)
+		if err != nil {
+			return
+		}
+		// Wait for the server to finish before hanging up
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}()
+
+	raw, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	return Handshake(context.Background(), tls.Server(raw, serverTLS))
+}
+
+func TestHandshakeRecordsResult(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	clientTLS.ServerName = "127.0.0.1"
+
+	success, failure := handshakeCount(t, "success"), handshakeCount(t, "failure")
+	if err := serverHandshake(t, serverTLS, clientTLS); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if got := handshakeCount(t, "success") - success; got != 1 {
+		t.Errorf("success observations = %d, want 1", got)
+	}
+	if got := handshakeCount(t, "failure") - failure; got != 0 {
+		t.Errorf("failure observations = %d, want 0", got)
+	}
+
+	// Without a client certificate the server rejects the handshake
+	anonymous := clientTLS.Clone()
+	anonymous.Certificates = nil
+	success = handshakeCount(t, "success")
+	if err := serverHandshake(t, serverTLS, anonymous); err == nil {
+		t.Fatal("handshake without a client certificate succeeded")
+	}
+	if got := handshakeCount(t, "failure") - failure; got != 1 {
+		t.Errorf("failure observations = %d, want 1", got)
+	}
+	if got := handshakeCount(t, "success") - success; got != 0 {
+		t.Errorf("success observations = %d, want 0", got)
+	}
+}
+
+// plaintextHandshake runs Handshake on a server that is sent plain HTTP
+// instead of a ClientHello
+func plaintextHandshake(t *testing.T, serverTLS *tls.Config) error {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: gotunnel\r\n\r\n"))
+		io.Copy(io.Discard, client)
+	}()
+	return Handshake(context.Background(), tls.Server(server, serverTLS))
+}
+
+func TestHandshakeErrorLoggerNamesCause(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	clientTLS.ServerName = "127.0.0.1"
+
+	anonymous := clientTLS.Clone()
+	anonymous.Certificates = nil
+	untrusted := clientTLS.Clone()
+	// Present the certificate even though the server won't accept its issuer
+	untrustedCert := testCertificate(t, "untrusted")
+	untrusted.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &untrustedCert, nil
+	}
+	oldVersion := clientTLS.Clone()
+	oldVersion.MaxVersion = tls.VersionTLS12
+	modernServer := serverTLS.Clone()
+	modernServer.MinVersion = tls.VersionTLS13
+
+	tests := []struct {
+		name      string
+		handshake func() error
+		want      string
+	}{
+		{"missing client certificate", func() error { return serverHandshake(t, serverTLS, anonymous) }, "client certificate required but not provided"},
+		{"untrusted client certificate", func() error { return serverHandshake(t, serverTLS, untrusted) }, "peer certificate signed by unknown CA"},
+		{"version mismatch", func() error { return serverHandshake(t, modernServer, oldVersion) }, "no mutually supported TLS version"},
+		{"plain text", func() error { return plaintextHandshake(t, serverTLS) }, "peer is not speaking TLS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.handshake()
+			if err == nil {
+				t.Fatal("handshake succeeded")
+			}
+
+			var out bytes.Buffer
+			logger := logging.NewLogger("gotunnel-test", "test", logging.INFO)
+			logger.SetOutput(&out)
+			NewHandshakeErrorLogger(logger, time.Minute).Log(context.Background(), "192.0.2.1:5000", err)
+
+			var entry logging.LogEntry
+			if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+				t.Fatalf("log entry %q: %v", out.String(), err)
+			}
+			if entry.Fields["reason"] != tt.want {
+				t.Errorf("reason = %v, want %q (error %v)", entry.Fields["reason"], tt.want, err)
+			}
+			if entry.Fields["remote_addr"] != "192.0.2.1:5000" {
+				t.Errorf("remote_addr = %v, want the peer", entry.Fields["remote_addr"])
+			}
+		})
+	}
+}
+
+func TestHandshakeErrorLoggerRateLimitsPerCause(t *testing.T) {
+	var out bytes.Buffer
+	logger := logging.NewLogger("gotunnel-test", "test", logging.INFO)
+	logger.SetOutput(&out)
+	h := NewHandshakeErrorLogger(logger, time.Hour)
+
+	timeout := &net.OpError{Op: "read", Err: errors.New("i/o timeout")}
+	for range 3 {
+		h.Log(context.Background(), "192.0.2.1:5000", timeout)
+	}
+	h.Log(context.Background(), "192.0.2.1:5000", io.EOF)
+
+	if got := strings.Count(out.String(), "TLS handshake failed"); got != 2 {
+		t.Errorf("logged %d entries, want one per cause:\n%s", got, out.String())
+	}
+}
+
+// readErrorConn fails every read with err and records whether it was closed
+type readErrorConn struct {
+	net.Conn
+	err    error
+	closed bool
+}
+
+func (c *readErrorConn) Read([]byte) (int, error) { return 0, c.err }
+
+func (c *readErrorConn) Close() error {
+	c.closed = true
+	return c.Conn.Close()
+}
+
+func TestGuardRenegotiationClosesConnection(t *testing.T) {
+	renegotiation := &net.OpError{Op: "local error", Err: errors.New("tls: no renegotiation")}
+	errorsBefore := counterValue(t, metrics.Default.ConnectionErrors.WithLabelValues("renegotiation_attempt", ""))
+
+	for _, tc := range []struct {
+		err       error
+		wantClose bool
+	}{
+		{renegotiation, true},
+		{io.EOF, false},
+	} {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		conn := &readErrorConn{Conn: local, err: tc.err}
+		guarded := GuardRenegotiation(context.Background(), testLogger(), conn)
+
+		if _, err := guarded.Read(make([]byte, 1)); err != tc.err {
+			t.Errorf("read error = %v, want %v", err, tc.err)
+		}
+		if conn.closed != tc.wantClose {
+			t.Errorf("after %v: closed = %v, want %v", tc.err, conn.closed, tc.wantClose)
+		}
+		local.Close()
+	}
+	if got := counterValue(t, metrics.Default.ConnectionErrors.WithLabelValues("renegotiation_attempt", "")) - errorsBefore; got != 1 {
+		t.Errorf("renegotiation attempts counted = %v, want 1", got)
+	}
+}
+
+func TestWithIOTimeoutClosesStalledConnection(t *testing.T) {
+	ioTimeouts := metrics.Default.ConnectionErrors.WithLabelValues("io_timeout", "")
+
+	for _, op := range []string{"read", "write"} {
+		t.Run(op, func(t *testing.T) {
+			before := counterValue(t, ioTimeouts)
+			// The peer of a pipe neither writes nor reads, so both block
+			local, peer := net.Pipe()
+			defer peer.Close()
+			conn := WithIOTimeout(local, 50*time.Millisecond)
+
+			start := time.Now()
+			var err error
+			if op == "read" {
+				_, err = conn.Read(make([]byte, 1))
+			} else {
+				_, err = conn.Write([]byte("x"))
+			}
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Fatalf("%s error = %v, want a timeout", op, err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("%s returned after %v, want about the 50ms timeout", op, elapsed)
+			}
+			if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+				t.Errorf("read after the timeout = %v, want the connection closed", err)
+			}
+			if got := counterValue(t, ioTimeouts) - before; got != 1 {
+				t.Errorf("io_timeout errors = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestWithIOTimeoutLeavesCallerDeadlines(t *testing.T) {
+	ioTimeouts := metrics.Default.ConnectionErrors.WithLabelValues("io_timeout", "")
+	before := counterValue(t, ioTimeouts)
+	local, peer := net.Pipe()
+	defer peer.Close()
+	conn := WithIOTimeout(local, time.Minute)
+
+	// The caller's own deadline comes first: its timeout is the caller's
+	// to handle, so the connection stays open
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read error = %v, want the caller's deadline", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	go peer.Write([]byte("x"))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Errorf("read after the caller's deadline = %v, want the connection still open", err)
+	}
+	if got := counterValue(t, ioTimeouts) - before; got != 0 {
+		t.Errorf("io_timeout errors = %v, want 0", got)
+	}
+}
@@ -0,0 +1,148 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+)
+
+// DefaultDrainTimeout is how long shutdown waits for forwarded connections
+// to finish before force-closing them
+const DefaultDrainTimeout = 30 * time.Second
+
+// drainPollInterval is how often Drain checks for remaining connections
+const drainPollInterval = 100 * time.Millisecond
+
+// ReasonDraining is the rejection reason for connections opened after
+// shutdown has started
+const ReasonDraining = "draining"
+
+// ErrDrainTimeout is returned by Drain when connections were still open at
+// the deadline and had to be force-closed
+var ErrDrainTimeout = errors.New("drain deadline exceeded")
+
+// ConnTracker tracks forwarded connections so shutdown can stop accepting
+// new ones and wait for the existing ones to finish
+type ConnTracker struct {
+	mu       sync.Mutex
+	conns    map[*drainConn]struct{}
+	draining bool
+	linger   int
+}
+
+// NewConnTracker creates an empty tracker
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{conns: make(map[*drainConn]struct{}), linger: LingerOSDefault}
+}
+
+// SetLinger sets the SO_LINGER that Drain force-closes connections with:
+// zero keeps the OS behaviour, a negative value resets them and a positive
+// one lingers for that long, rounded up to whole seconds. See ForceClose.
+func (t *ConnTracker) SetLinger(linger time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case linger < 0:
+		t.linger = 0
+	case linger == 0:
+		t.linger = LingerOSDefault
+	default:
+		t.linger = int((linger + time.Second - 1) / time.Second)
+	}
+}
+
+// Track registers conn until it is closed. It returns false once draining
+// has started, in which case the caller should reject the connection.
+func (t *ConnTracker) Track(conn net.Conn) (net.Conn, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return nil, false
+	}
+	c := &drainConn{Conn: conn, tracker: t}
+	t.conns[c] = struct{}{}
+	return c, true
+}
+
+// Active returns the number of tracked connections
+func (t *ConnTracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Draining reports whether Drain has been called
+func (t *ConnTracker) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// Drain stops accepting connections and waits for the tracked ones to
+// close until ctx is done, then force-closes the rest. It logs how many
+// connections drained and how many were forced.
+func (t *ConnTracker) Drain(ctx context.Context, logger *logging.Logger) error {
+	t.mu.Lock()
+	t.draining = true
+	initial := len(t.conns)
+	t.mu.Unlock()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	var forced int
+	for t.Active() > 0 {
+		select {
+		case <-ticker.C:
+			continue
+		case <-ctx.Done():
+		}
+
+		t.mu.Lock()
+		remaining := make([]*drainConn, 0, len(t.conns))
+		for c := range t.conns {
+			remaining = append(remaining, c)
+		}
+		t.conns = make(map[*drainConn]struct{})
+		linger := t.linger
+		t.mu.Unlock()
+
+		for _, c := range remaining {
+			ForceClose(c.Conn, linger)
+		}
+		forced = len(remaining)
+		break
+	}
+
+	logger.Info(ctx, "Connection drain finished", map[string]interface{}{
+		"drained": initial - forced,
+		"forced":  forced,
+	})
+	if forced > 0 {
+		return fmt.Errorf("%w: force-closed %d connections", ErrDrainTimeout, forced)
+	}
+	return nil
+}
+
+func (t *ConnTracker) untrack(c *drainConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+}
+
+type drainConn struct {
+	net.Conn
+	tracker *ConnTracker
+}
+
+func (c *drainConn) Close() error {
+	c.tracker.untrack(c)
+	return c.Conn.Close()
+}
+
+func (c *drainConn) unwrap() net.Conn { return c.Conn }
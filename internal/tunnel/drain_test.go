@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConnTrackerForceClosesWithLinger(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		linger  time.Duration
+		wantErr error
+	}{
+		{"os default", 0, io.EOF},
+		{"reset", -1, syscall.ECONNRESET},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tracker := NewConnTracker()
+			tracker.SetLinger(tc.linger)
+			server, client := tcpPair(t)
+			defer client.Close()
+			if _, ok := tracker.Track(server); !ok {
+				t.Fatal("Track refused a connection before draining")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := tracker.Drain(ctx, testLogger()); !errors.Is(err, ErrDrainTimeout) {
+				t.Fatalf("Drain error = %v, want ErrDrainTimeout", err)
+			}
+
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := client.Read(make([]byte, 1)); !errors.Is(err, tc.wantErr) {
+				t.Errorf("peer read error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestConnTrackerResetsForcedStreams(t *testing.T) {
+	client, server := muxPair(t, MuxConfig{})
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := acceptStream(t, server)
+
+	tracker := NewConnTracker()
+	tracker.SetLinger(-1)
+	tracker.Track(accepted)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracker.Drain(ctx, testLogger())
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("peer read error = %v, want ErrStreamReset", err)
+	}
+}
@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Origin headers injected into requests forwarded to HTTP backends
+const (
+	HeaderForwardedFor = "X-Forwarded-For"
+	HeaderTunnelClient = "X-Tunnel-Client"
+	HeaderTunnelName   = "X-Tunnel-Name"
+)
+
+// Origin describes where a tunneled HTTP request came from
+type Origin struct {
+	ClientIP   string
+	ClientCN   string
+	TunnelName string
+}
+
+// ForwardHTTP relays HTTP/1.x requests from src to dst, replacing any
+// client-supplied origin headers with the tunnel's own so backends can trust
+// them. It returns the number of bytes written to dst.
+func ForwardHTTP(dst io.Writer, src io.Reader, origin Origin) (int64, error) {
+	counter := &countingWriter{w: dst}
+	reader := bufio.NewReader(src)
+
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return counter.n, nil
+			}
+			return counter.n, fmt.Errorf("failed to read HTTP request: %w", err)
+		}
+
+		// Strip spoofed values before setting our own
+		req.Header.Del(HeaderForwardedFor)
+		req.Header.Del(HeaderTunnelClient)
+		req.Header.Del(HeaderTunnelName)
+		req.Header.Set(HeaderForwardedFor, origin.ClientIP)
+		req.Header.Set(HeaderTunnelClient, origin.ClientCN)
+		req.Header.Set(HeaderTunnelName, origin.TunnelName)
+
+		// Request.Write adds a Go User-Agent when none is present; an empty
+		// value suppresses it so the request is otherwise unchanged
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = []string{""}
+		}
+
+		err = req.Write(counter)
+		req.Body.Close()
+		if err != nil {
+			return counter.n, fmt.Errorf("failed to forward HTTP request: %w", err)
+		}
+	}
+}
+
+// InjectOrigin returns conn with the HTTP requests read from it rewritten
+// by ForwardHTTP for origin. Requests are parsed in the background and
+// handed over a pipe, so read deadlines apply to the pipe and never cut a
+// request short. A request that fails to parse ends the reads with the
+// error.
+func InjectOrigin(conn net.Conn, origin Origin) net.Conn {
+	r, w := net.Pipe()
+	c := &originConn{Conn: conn, r: r}
+	go func() {
+		_, err := ForwardHTTP(w, conn, origin)
+		c.err = err
+		w.Close()
+	}()
+	return c
+}
+
+// originConn is a conn whose reads are the requests rewritten by
+// ForwardHTTP
+type originConn struct {
+	net.Conn
+	r net.Conn
+	// err is set before the pipe is closed, so it is visible to the read
+	// that sees the pipe end
+	err error
+}
+
+func (c *originConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if errors.Is(err, io.EOF) && c.err != nil {
+		err = c.err
+	}
+	return n, err
+}
+
+func (c *originConn) Close() error {
+	c.r.Close()
+	return c.Conn.Close()
+}
+
+func (c *originConn) SetDeadline(t time.Time) error {
+	c.r.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *originConn) SetReadDeadline(t time.Time) error { return c.r.SetReadDeadline(t) }
+
+func (c *originConn) unwrap() net.Conn { return c.Conn }
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
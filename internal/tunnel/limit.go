@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// MaxConnsPolicy decides what happens to a connection accepted while a
+// tunnel is at its MaxConns limit
+type MaxConnsPolicy string
+
+const (
+	// MaxConnsReject fails new connections immediately
+	MaxConnsReject MaxConnsPolicy = "reject"
+	// MaxConnsQueue holds new connections until a slot frees up or the
+	// queue timeout passes
+	MaxConnsQueue MaxConnsPolicy = "queue"
+)
+
+// DefaultMaxConnsQueueTimeout bounds the wait for a slot under MaxConnsQueue
+const DefaultMaxConnsQueueTimeout = 5 * time.Second
+
+// ReasonMaxConns is the rejection reason when a tunnel is at its limit,
+// shared with TunnelLimiter
+const ReasonMaxConns = "tunnel_max_connections"
+
+// ErrMaxConns is returned when a tunnel has no free connection slot
+var ErrMaxConns = errors.New("tunnel connection limit reached")
+
+// ConnLimiter bounds the concurrent connections of a single tunnel from its
+// spec. Unlike TunnelLimiter it can queue connections at the limit, and its
+// release is idempotent.
+type ConnLimiter struct {
+	tunnel string
+	slots  chan struct{}
+	policy MaxConnsPolicy
+	wait   time.Duration
+	logger *logging.Logger
+}
+
+// NewConnLimiter creates the limiter for spec. A spec without MaxConns is
+// unlimited.
+func NewConnLimiter(spec TunnelSpec, logger *logging.Logger) *ConnLimiter {
+	l := &ConnLimiter{
+		tunnel: spec.Name,
+		policy: spec.MaxConnsPolicy,
+		wait:   spec.MaxConnsQueueTimeout,
+		logger: logger,
+	}
+	if spec.MaxConns > 0 {
+		l.slots = make(chan struct{}, spec.MaxConns)
+	}
+	if l.policy == "" {
+		l.policy = MaxConnsReject
+	}
+	if l.wait <= 0 {
+		l.wait = DefaultMaxConnsQueueTimeout
+	}
+	return l
+}
+
+// Acquire takes a connection slot at accept time, waiting under
+// MaxConnsQueue. The returned release frees the slot; it is safe to call
+// more than once, so it can be deferred and also called on early errors.
+func (l *ConnLimiter) Acquire(ctx context.Context, remoteAddr string) (func(), error) {
+	if l.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.releaser(), nil
+	default:
+	}
+
+	if l.policy == MaxConnsQueue {
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			return l.releaser(), nil
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	metrics.RecordTunnelRejection(l.tunnel, ReasonMaxConns)
+	l.logger.Warn(ctx, "Tunnel connection limit reached, rejecting connection", map[string]interface{}{
+		"tunnel":      l.tunnel,
+		"max_conns":   cap(l.slots),
+		"policy":      string(l.policy),
+		"remote_addr": remoteAddr,
+	})
+	return nil, fmt.Errorf("%w: %d connections on tunnel %s", ErrMaxConns, cap(l.slots), l.tunnel)
+}
+
+func (l *ConnLimiter) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.slots })
+	}
+}
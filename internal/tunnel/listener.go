@@ -0,0 +1,41 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ServeListener accepts connections on ln and passes each to handle in its
+// own goroutine until ctx is cancelled, which closes ln so a blocked Accept
+// returns promptly. Stopping through ctx or closing ln elsewhere returns
+// nil rather than a "use of closed network connection" error. A non-nil wg
+// counts each handler from before its goroutine starts, so the caller's
+// Wait can't miss one accepted while it shuts down.
+func ServeListener(ctx context.Context, ln net.Listener, wg *sync.WaitGroup, handle func(net.Conn)) error {
+	stop := context.AfterFunc(ctx, func() {
+		ln.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		if wg == nil {
+			go handle(conn)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handle(conn)
+		}()
+	}
+}
@@ -0,0 +1,106 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultMaintenanceMessage = "This service is undergoing planned maintenance. Please try again later."
+
+// MaintenanceResponse is what a tunnel in maintenance serves instead of
+// dialing its backend
+type MaintenanceResponse struct {
+	Tunnel string `json:"tunnel"`
+	// HTTP serves a 503 page; otherwise Message is written as a raw banner
+	HTTP    bool   `json:"http"`
+	Message string `json:"message,omitempty"`
+}
+
+// MaintenanceMode tracks which tunnels are in maintenance
+type MaintenanceMode struct {
+	mu      sync.RWMutex
+	tunnels map[string]MaintenanceResponse
+}
+
+// NewMaintenanceMode creates a maintenance registry with no tunnels in maintenance
+func NewMaintenanceMode() *MaintenanceMode {
+	return &MaintenanceMode{tunnels: make(map[string]MaintenanceResponse)}
+}
+
+// Enable puts a tunnel into maintenance
+func (m *MaintenanceMode) Enable(resp MaintenanceResponse) {
+	if resp.Message == "" {
+		resp.Message = defaultMaintenanceMessage
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tunnels[resp.Tunnel] = resp
+}
+
+// Disable returns a tunnel to normal forwarding
+func (m *MaintenanceMode) Disable(tunnel string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tunnels, tunnel)
+}
+
+// Enabled reports whether tunnel is in maintenance
+func (m *MaintenanceMode) Enabled(tunnel string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.tunnels[tunnel]
+	return ok
+}
+
+// List returns the tunnels currently in maintenance, sorted by name
+func (m *MaintenanceMode) List() []MaintenanceResponse {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]MaintenanceResponse, 0, len(m.tunnels))
+	for _, resp := range m.tunnels {
+		list = append(list, resp)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tunnel < list[j].Tunnel })
+	return list
+}
+
+// Serve answers conn with the maintenance response and closes it when the
+// tunnel is in maintenance, without dialing the backend. It reports whether
+// the connection was handled.
+func (m *MaintenanceMode) Serve(conn net.Conn, tunnel string) bool {
+	m.mu.RLock()
+	resp, ok := m.tunnels[tunnel]
+	m.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if !resp.HTTP {
+		conn.Write([]byte(resp.Message + "\r\n"))
+		return true
+	}
+
+	// Consume the request first so closing doesn't reset the connection
+	// before the client has read the response
+	if req, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+		req.Body.Close()
+	}
+
+	body := "<html><head><title>503 Service Unavailable</title></head><body><h1>Service Unavailable</h1><p>" +
+		resp.Message + "</p></body></html>\n"
+	fmt.Fprintf(conn, "HTTP/1.1 503 Service Unavailable\r\n"+
+		"Content-Type: text/html; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Retry-After: 300\r\n"+
+		"Connection: close\r\n\r\n%s", len(body), body)
+	return true
+}
@@ -0,0 +1,844 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+const (
+	// DefaultMaxConcurrentStreams is the stream limit when MuxConfig leaves it unset
+	DefaultMaxConcurrentStreams = 256
+	// DefaultStreamWindow is the per-stream receive window when MuxConfig leaves it unset
+	DefaultStreamWindow = 256 << 10
+
+	// maxStreamChunk bounds a single data frame so one busy stream can't
+	// monopolise the connection
+	maxStreamChunk = 32 << 10
+)
+
+var (
+	// ErrMuxClosed is returned by operations on a closed Mux
+	ErrMuxClosed = errors.New("multiplexed connection closed")
+	// ErrStreamReset is returned when a stream was aborted by either side
+	ErrStreamReset = errors.New("stream reset")
+	// ErrStreamLimit is returned when opening a stream would exceed MaxConcurrentStreams
+	ErrStreamLimit = errors.New("too many concurrent streams")
+)
+
+// MuxConfig configures stream multiplexing over one mTLS connection
+type MuxConfig struct {
+	// MaxConcurrentStreams limits the streams open at once in each
+	// direction. Zero uses DefaultMaxConcurrentStreams.
+	MaxConcurrentStreams int `yaml:"max_concurrent_streams" json:"max_concurrent_streams"`
+	// StreamWindow is how many unread bytes a stream buffers before the
+	// sender must wait. Zero uses DefaultStreamWindow.
+	StreamWindow uint32 `yaml:"stream_window" json:"stream_window"`
+	// ResumeWindow is how long a session whose connection was lost keeps
+	// its streams while the client reconnects to resume it. Zero ends the
+	// session with its connection.
+	ResumeWindow time.Duration `yaml:"resume_window" json:"resume_window"`
+}
+
+// Mux carries many logical streams over a single connection so each
+// forwarded connection doesn't pay for its own TLS handshake. Streams
+// have per-stream flow control and support half-close. The client opens
+// odd stream IDs and the server even ones, so both sides may open streams.
+// Stream ID 0 carries control frames that belong to the session rather
+// than a stream, such as FrameTunnels.
+//
+// With a ResumeWindow, frames are kept until the peer acknowledges them,
+// so a session can continue on a new connection without losing data.
+type Mux struct {
+	fw     *FrameWriter
+	cfg    MuxConfig
+	parity uint32
+
+	mu      sync.Mutex
+	conn    net.Conn
+	streams map[uint32]*MuxStream
+	nextID  uint32
+	err     error
+	// token identifies the session for resuming it; empty if it can't be
+	token string
+	// lost is closed when the connection is lost while the session waits
+	// to be resumed, and replaced when it is
+	lost     chan struct{}
+	detached bool
+	closing  bool
+
+	// sendMu orders counted frames with the replay buffer: replay holds
+	// the frames after the first acked, oldest first
+	sendMu sync.Mutex
+	acked  uint64
+	replay []Frame
+	// recv counts the frames received that the peer keeps for replay
+	recv atomic.Uint64
+
+	accept  chan *MuxStream
+	control chan Frame
+	resumed chan resumedConn
+	closeCh chan struct{}
+	closed  sync.Once
+	done    chan struct{}
+}
+
+// resumedConn hands a resumed session's connection to the read loop,
+// which closes adopted once it reads from it
+type resumedConn struct {
+	conn    net.Conn
+	adopted chan struct{}
+}
+
+// ackInterval is how many frames a Mux receives before acknowledging
+// them, which lets the peer drop them from its replay buffer
+const ackInterval = 64
+
+// sessionCloseTimeout bounds how long Close waits for the peer to hang up
+// after ending a resumable session
+const sessionCloseTimeout = time.Second
+
+// NewMux starts multiplexing over conn. isClient must be true on exactly
+// one side of the connection.
+func NewMux(conn net.Conn, isClient bool, cfg MuxConfig) *Mux {
+	if cfg.MaxConcurrentStreams <= 0 {
+		cfg.MaxConcurrentStreams = DefaultMaxConcurrentStreams
+	}
+	if cfg.StreamWindow == 0 {
+		cfg.StreamWindow = DefaultStreamWindow
+	}
+
+	m := &Mux{
+		conn:    conn,
+		fw:      NewFrameWriter(conn),
+		cfg:     cfg,
+		streams: make(map[uint32]*MuxStream),
+		nextID:  2,
+		accept:  make(chan *MuxStream, cfg.MaxConcurrentStreams),
+		control: make(chan Frame, 1),
+		lost:    make(chan struct{}),
+		resumed: make(chan resumedConn),
+		closeCh: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if isClient {
+		m.nextID = 1
+	}
+	m.parity = m.nextID % 2
+	go m.readLoop()
+	return m
+}
+
+// OpenStream opens a new stream to the peer
+func (m *Mux) OpenStream() (*MuxStream, error) {
+	return m.OpenStreamTo("")
+}
+
+// OpenStreamTo opens a new stream asking the peer to connect it to target,
+// for tunnels whose destination is chosen per connection
+func (m *Mux) OpenStreamTo(target string) (*MuxStream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	if len(m.streams) >= m.cfg.MaxConcurrentStreams {
+		m.mu.Unlock()
+		return nil, ErrStreamLimit
+	}
+	id := m.nextID
+	m.nextID += 2
+	stream := m.newStream(id, target)
+	m.mu.Unlock()
+
+	if err := m.send(Frame{Type: FrameStreamOpen, StreamID: id, Payload: []byte(target)}); err != nil {
+		m.removeStream(id)
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	return stream, nil
+}
+
+// AcceptStream waits for the peer to open a stream
+func (m *Mux) AcceptStream(ctx context.Context) (*MuxStream, error) {
+	select {
+	case stream := <-m.accept:
+		return stream, nil
+	case <-m.done:
+		return nil, m.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Control delivers control frames sent by the peer. Each one supersedes
+// the previous, so only the latest frame not yet received is kept.
+func (m *Mux) Control() <-chan Frame {
+	return m.control
+}
+
+// SendControl sends a control frame to the peer
+func (m *Mux) SendControl(f Frame) error {
+	f.StreamID = 0
+	return m.send(f)
+}
+
+// send writes a frame the peer counts towards acknowledgements. With a
+// ResumeWindow the frame is kept for replay, and a failed write only
+// closes the connection so the session can be resumed with it.
+func (m *Mux) send(f Frame) error {
+	if m.cfg.ResumeWindow <= 0 {
+		return m.fw.WriteFrame(f)
+	}
+	f.Payload = bytes.Clone(f.Payload)
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+	m.replay = append(m.replay, f)
+	if err := m.fw.WriteFrame(f); err != nil {
+		m.mu.Lock()
+		conn, resumable := m.conn, m.token != ""
+		m.mu.Unlock()
+		if !resumable {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// ack drops the frames the peer has received from the replay buffer
+func (m *Mux) ack(received uint64) {
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+	if received > m.acked && received-m.acked <= uint64(len(m.replay)) {
+		m.replay = m.replay[received-m.acked:]
+		m.acked = received
+	}
+}
+
+// setToken makes the session resumable under token
+func (m *Mux) setToken(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.token = token
+}
+
+// resumeState returns the session's token and how many frames it has
+// received, for a resume request
+func (m *Mux) resumeState() (string, uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.token, m.recv.Load()
+}
+
+// Lost is closed when the connection is lost while the session can still
+// be resumed. Each resumed connection has a new channel.
+func (m *Mux) Lost() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lost
+}
+
+// Detached reports whether the session is waiting to be resumed
+func (m *Mux) Detached() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.detached
+}
+
+// resume continues a detached session on conn. Frames the peer hasn't
+// received according to peerReceived are sent again, preceded when reply
+// is set by this side's own count, answering the peer's resume request.
+// It fails with ErrSessionAttached if the session isn't detached.
+func (m *Mux) resume(conn net.Conn, peerReceived uint64, reply bool) error {
+	m.mu.Lock()
+	if !m.detached || m.closing {
+		m.mu.Unlock()
+		return ErrSessionAttached
+	}
+	m.detached = false
+	m.mu.Unlock()
+
+	err := m.replayTo(conn, peerReceived, reply)
+	if err == nil {
+		adopted := make(chan struct{})
+		select {
+		case m.resumed <- resumedConn{conn: conn, adopted: adopted}:
+			<-adopted
+			return nil
+		case <-m.done:
+			err = ErrMuxClosed
+		}
+	}
+	m.mu.Lock()
+	m.detached = m.err == nil
+	m.mu.Unlock()
+	return err
+}
+
+// replayTo points the frame writer at conn and sends the frames after
+// peerReceived on it
+func (m *Mux) replayTo(conn net.Conn, peerReceived uint64, reply bool) error {
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+	if peerReceived < m.acked || peerReceived-m.acked > uint64(len(m.replay)) {
+		return fmt.Errorf("peer received %d frames, but frames %d to %d are kept", peerReceived, m.acked+1, m.acked+uint64(len(m.replay)))
+	}
+	m.replay = m.replay[peerReceived-m.acked:]
+	m.acked = peerReceived
+
+	m.fw.reset(conn)
+	if reply {
+		if err := m.fw.WriteFrame(resumeAccepted(m.recv.Load())); err != nil {
+			return fmt.Errorf("failed to accept resume: %w", err)
+		}
+	}
+	for _, f := range m.replay {
+		if err := m.fw.WriteFrame(f); err != nil {
+			return fmt.Errorf("failed to replay frames: %w", err)
+		}
+	}
+	return nil
+}
+
+// NumStreams returns the number of open streams
+func (m *Mux) NumStreams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+// Done is closed when the underlying connection has failed or been closed
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Close closes the underlying connection, resetting every open stream.
+// A resumable session is ended on both sides: the peer is told and given
+// up to sessionCloseTimeout to hang up first, so the notice isn't lost to
+// a reset connection.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	m.closing = true
+	conn, resumable := m.conn, m.token != "" && !m.detached
+	m.mu.Unlock()
+	m.closed.Do(func() { close(m.closeCh) })
+	if resumable && m.fw.WriteFrame(Frame{Type: FrameSessionClose}) == nil {
+		timer := time.NewTimer(sessionCloseTimeout)
+		select {
+		case <-m.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	err := conn.Close()
+	<-m.done
+	return err
+}
+
+func (m *Mux) localAddr() net.Addr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn.LocalAddr()
+}
+
+func (m *Mux) remoteAddr() net.Addr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn.RemoteAddr()
+}
+
+func (m *Mux) closeErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// newStream registers a stream; m.mu must be held
+func (m *Mux) newStream(id uint32, target string) *MuxStream {
+	stream := &MuxStream{
+		id:         id,
+		target:     target,
+		mux:        m,
+		sendWindow: m.cfg.StreamWindow,
+	}
+	stream.cond = sync.NewCond(&stream.mu)
+	m.streams[id] = stream
+	metrics.RecordStreamOpened()
+	return stream
+}
+
+func (m *Mux) removeStream(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.streams[id]; ok {
+		delete(m.streams, id)
+		metrics.RecordStreamClosed()
+	}
+}
+
+func (m *Mux) stream(id uint32) *MuxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+// readLoop dispatches incoming frames to their streams until the
+// connection fails and the session isn't resumed
+func (m *Mux) readLoop() {
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+	var err error
+	for conn != nil {
+		err = m.readFrames(conn)
+		conn = m.awaitResume()
+	}
+
+	m.mu.Lock()
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		m.err = ErrMuxClosed
+	} else {
+		m.err = fmt.Errorf("%w: %v", ErrMuxClosed, err)
+	}
+	streams := m.streams
+	m.streams = make(map[uint32]*MuxStream)
+	m.mu.Unlock()
+
+	for range streams {
+		metrics.RecordStreamClosed()
+	}
+	for _, stream := range streams {
+		stream.abort()
+	}
+	m.mu.Lock()
+	m.conn.Close()
+	m.mu.Unlock()
+	close(m.done)
+}
+
+// readFrames dispatches the frames read from conn until it fails,
+// acknowledging them every ackInterval frames
+func (m *Mux) readFrames(conn net.Conn) error {
+	var unacked int
+	for {
+		f, err := ReadFrame(conn)
+		if err != nil {
+			return err
+		}
+		switch f.Type {
+		case FrameSessionAck:
+			if len(f.Payload) != 8 {
+				return fmt.Errorf("invalid session ack of %d bytes", len(f.Payload))
+			}
+			m.ack(binary.BigEndian.Uint64(f.Payload))
+			continue
+		case FrameSessionClose:
+			m.mu.Lock()
+			m.closing = true
+			m.mu.Unlock()
+			return io.EOF
+		case FrameSessionResume:
+			// Only the server issues tokens, on the session's first
+			// connection
+			if m.parity == 1 {
+				m.setToken(string(f.Payload))
+			}
+			continue
+		}
+
+		received := m.recv.Add(1)
+		if err := m.handleFrame(f); err != nil {
+			return err
+		}
+		if unacked++; unacked >= ackInterval {
+			unacked = 0
+			var payload [8]byte
+			binary.BigEndian.PutUint64(payload[:], received)
+			m.fw.WriteFrame(Frame{Type: FrameSessionAck, Payload: payload[:]})
+		}
+	}
+}
+
+// awaitResume waits up to the ResumeWindow for a lost connection to be
+// replaced, returning the new one, or nil if the session ends instead
+func (m *Mux) awaitResume() net.Conn {
+	m.mu.Lock()
+	if m.closing || m.token == "" || m.cfg.ResumeWindow <= 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	m.conn.Close()
+	m.detached = true
+	close(m.lost)
+	m.mu.Unlock()
+
+	timer := time.NewTimer(m.cfg.ResumeWindow)
+	defer timer.Stop()
+	select {
+	case r := <-m.resumed:
+		m.mu.Lock()
+		m.conn = r.conn
+		m.lost = make(chan struct{})
+		closing := m.closing
+		m.mu.Unlock()
+		close(r.adopted)
+		if closing {
+			r.conn.Close()
+		}
+		return r.conn
+	case <-timer.C:
+	case <-m.closeCh:
+	}
+	m.mu.Lock()
+	m.detached = false
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Mux) handleFrame(f Frame) error {
+	switch f.Type {
+	case FrameStreamOpen:
+		// The peer may only open IDs of its own parity; accepting ours
+		// would let it hijack streams this side is about to open
+		if f.StreamID == 0 || f.StreamID%2 == m.parity {
+			return fmt.Errorf("peer opened stream %d with an ID reserved for this side", f.StreamID)
+		}
+		m.mu.Lock()
+		if _, exists := m.streams[f.StreamID]; exists {
+			m.mu.Unlock()
+			return fmt.Errorf("peer reopened stream %d", f.StreamID)
+		}
+		if len(m.streams) >= m.cfg.MaxConcurrentStreams {
+			m.mu.Unlock()
+			metrics.RecordConnectionError("stream_limit")
+			return m.send(Frame{Type: FrameStreamReset, StreamID: f.StreamID})
+		}
+		stream := m.newStream(f.StreamID, string(f.Payload))
+		m.mu.Unlock()
+
+		// accept has room for MaxConcurrentStreams so this never blocks
+		m.accept <- stream
+
+	case FrameData:
+		if stream := m.stream(f.StreamID); stream != nil {
+			stream.receive(f.Payload)
+		}
+
+	case FrameStreamFin:
+		if stream := m.stream(f.StreamID); stream != nil {
+			stream.remoteFin()
+		}
+
+	case FrameStreamReset:
+		if stream := m.stream(f.StreamID); stream != nil {
+			m.removeStream(f.StreamID)
+			stream.abort()
+		}
+
+	case FrameWindowUpdate:
+		if len(f.Payload) != 4 {
+			return fmt.Errorf("invalid window update of %d bytes", len(f.Payload))
+		}
+		if stream := m.stream(f.StreamID); stream != nil {
+			stream.grow(binary.BigEndian.Uint32(f.Payload))
+		}
+
+	case FrameTunnels:
+		// Only this goroutine sends, so after dropping an unread frame
+		// the send can't block
+		select {
+		case <-m.control:
+		default:
+		}
+		m.control <- f
+	}
+	return nil
+}
+
+// MuxStream is one logical stream of a Mux. It is a net.Conn with
+// CloseWrite for half-close, so it can be used with the same copy loops as
+// a TCP connection. Its addresses are those of the underlying connection.
+type MuxStream struct {
+	id     uint32
+	target string
+	mux    *Mux
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	buf           bytes.Buffer
+	unacked       uint32
+	sendWindow    uint32
+	finRecv       bool
+	finSent       bool
+	closed        bool
+	reset         bool
+	readDeadline  time.Time
+	readTimer     *time.Timer
+	writeDeadline time.Time
+	writeTimer    *time.Timer
+}
+
+var _ net.Conn = (*MuxStream)(nil)
+
+// ID returns the stream ID
+func (s *MuxStream) ID() uint32 {
+	return s.id
+}
+
+// Target returns what the opener passed to OpenStreamTo: the tunnel name
+// for forward and reverse tunnels, or the host:port to connect to for
+// SOCKS5 tunnels
+func (s *MuxStream) Target() string {
+	return s.target
+}
+
+// LocalAddr returns the local address of the underlying connection
+func (s *MuxStream) LocalAddr() net.Addr {
+	return s.mux.localAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection
+func (s *MuxStream) RemoteAddr() net.Addr {
+	return s.mux.remoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (s *MuxStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline makes pending and future reads fail with
+// os.ErrDeadlineExceeded once t has passed. A zero t disables it.
+func (s *MuxStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setDeadline(&s.readDeadline, &s.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline makes writes blocked on the peer's window, and future
+// writes, fail with os.ErrDeadlineExceeded once t has passed. A zero t
+// disables it.
+func (s *MuxStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setDeadline(&s.writeDeadline, &s.writeTimer, t)
+	return nil
+}
+
+// setDeadline stores t and wakes waiters when it passes; s.mu must be held
+func (s *MuxStream) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	s.cond.Broadcast()
+	if d := time.Until(t); !t.IsZero() && d > 0 {
+		*timer = time.AfterFunc(d, func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// Read reads data sent by the peer, returning io.EOF once the peer has
+// half-closed and the buffer is drained
+func (s *MuxStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && !s.finRecv && !s.reset && !s.closed && !expired(s.readDeadline) {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		defer s.mu.Unlock()
+		switch {
+		case s.reset:
+			return 0, ErrStreamReset
+		case s.closed:
+			return 0, io.ErrClosedPipe
+		case s.finRecv:
+			return 0, io.EOF
+		default:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n, _ := s.buf.Read(p)
+	s.unacked += uint32(n)
+	var grant uint32
+	// Batch window updates rather than sending one per read
+	if s.unacked >= s.mux.cfg.StreamWindow/2 {
+		grant = s.unacked
+		s.unacked = 0
+	}
+	s.mu.Unlock()
+
+	if grant > 0 {
+		s.sendWindowUpdate(grant)
+	}
+	return n, nil
+}
+
+// Write sends p to the peer, blocking while the peer's window is full
+func (s *MuxStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		for s.sendWindow == 0 && !s.reset && !s.finSent && !expired(s.writeDeadline) {
+			s.cond.Wait()
+		}
+		if s.reset {
+			s.mu.Unlock()
+			return written, ErrStreamReset
+		}
+		if s.finSent {
+			s.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if expired(s.writeDeadline) {
+			s.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		chunk := uint32(len(p) - written)
+		if chunk > s.sendWindow {
+			chunk = s.sendWindow
+		}
+		if chunk > maxStreamChunk {
+			chunk = maxStreamChunk
+		}
+		s.sendWindow -= chunk
+		s.mu.Unlock()
+
+		payload := p[written : written+int(chunk)]
+		if err := s.mux.send(Frame{Type: FrameData, StreamID: s.id, Payload: payload}); err != nil {
+			return written, err
+		}
+		written += int(chunk)
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream: the peer reads io.EOF once it has
+// consumed what was written, but can keep sending
+func (s *MuxStream) CloseWrite() error {
+	s.mu.Lock()
+	if s.finSent || s.reset {
+		s.mu.Unlock()
+		return nil
+	}
+	s.finSent = true
+	done := s.finRecv
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	err := s.mux.send(Frame{Type: FrameStreamFin, StreamID: s.id})
+	if done {
+		s.mux.removeStream(s.id)
+	}
+	return err
+}
+
+// Close half-closes the stream if it isn't already and stops reading.
+// Data still arriving from the peer is discarded.
+func (s *MuxStream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	grant := s.unacked + uint32(s.buf.Len())
+	s.unacked = 0
+	s.buf.Reset()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if grant > 0 && !s.isReset() {
+		s.sendWindowUpdate(grant)
+	}
+	return s.CloseWrite()
+}
+
+// Reset aborts the stream in both directions
+func (s *MuxStream) Reset() error {
+	s.mu.Lock()
+	if s.reset {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	s.abort()
+	s.mux.removeStream(s.id)
+	return s.mux.send(Frame{Type: FrameStreamReset, StreamID: s.id})
+}
+
+func (s *MuxStream) receive(payload []byte) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		// Keep the peer's window open so it isn't stuck writing to a
+		// stream nobody reads
+		s.sendWindowUpdate(uint32(len(payload)))
+		return
+	}
+	if uint32(s.buf.Len()+len(payload)) > s.mux.cfg.StreamWindow {
+		s.mu.Unlock()
+		// The peer ignored flow control
+		s.Reset()
+		return
+	}
+	s.buf.Write(payload)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *MuxStream) remoteFin() {
+	s.mu.Lock()
+	s.finRecv = true
+	done := s.finSent
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.mux.removeStream(s.id)
+	}
+}
+
+func (s *MuxStream) grow(increment uint32) {
+	s.mu.Lock()
+	s.sendWindow += increment
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *MuxStream) isReset() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reset
+}
+
+func (s *MuxStream) abort() {
+	s.mu.Lock()
+	s.reset = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *MuxStream) sendWindowUpdate(increment uint32) {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], increment)
+	s.mux.send(Frame{Type: FrameWindowUpdate, StreamID: s.id, Payload: payload[:]})
+}
@@ -0,0 +1,178 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// muxPair returns a client and server Mux joined by an in-memory pipe
+func muxPair(t *testing.T, cfg MuxConfig) (*Mux, *Mux) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	client := NewMux(c1, true, cfg)
+	server := NewMux(c2, false, cfg)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// acceptStream accepts one stream on m within a second
+func acceptStream(t *testing.T, m *Mux) *MuxStream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream, err := m.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	return stream
+}
+
+func TestMuxStreamFlowControl(t *testing.T) {
+	const window = 1024
+	client, server := muxPair(t, MuxConfig{StreamWindow: window})
+
+	out, err := client.OpenStreamTo("web")
+	if err != nil {
+		t.Fatalf("OpenStreamTo: %v", err)
+	}
+	in := acceptStream(t, server)
+	if in.Target() != "web" {
+		t.Errorf("Target() = %q, want web", in.Target())
+	}
+
+	data := bytes.Repeat([]byte("x"), 4*window)
+	written := make(chan error, 1)
+	go func() {
+		_, err := out.Write(data)
+		written <- err
+	}()
+
+	// The writer may send one window before the reader acknowledges
+	select {
+	case err := <-written:
+		t.Fatalf("Write of 4 windows finished without the reader consuming anything (err %v)", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(in, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("received data differs from sent data")
+	}
+}
+
+func TestMuxStreamHalfClose(t *testing.T) {
+	client, server := muxPair(t, MuxConfig{})
+
+	out, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	in := acceptStream(t, server)
+
+	if _, err := out.Write([]byte("request")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := out.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if _, err := out.Write([]byte("more")); err == nil {
+		t.Error("Write after CloseWrite succeeded")
+	}
+
+	request, err := io.ReadAll(in)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(request) != "request" {
+		t.Errorf("server read %q, want request", request)
+	}
+
+	// The other direction stays open after the peer's half-close
+	if _, err := in.Write([]byte("response")); err != nil {
+		t.Fatalf("Write after peer CloseWrite: %v", err)
+	}
+	in.CloseWrite()
+	response, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(response) != "response" {
+		t.Errorf("client read %q, want response", response)
+	}
+}
+
+func TestMuxStreamReadDeadline(t *testing.T) {
+	client, server := muxPair(t, MuxConfig{})
+
+	out, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	acceptStream(t, server)
+
+	out.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := out.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read error = %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+func TestMuxRejectsStreamWithOwnParity(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMux(c1, true, MuxConfig{})
+	defer client.Close()
+	peer := NewFrameWriter(c2)
+	go io.Copy(io.Discard, c2)
+
+	// Odd IDs belong to the client, so the server must not open one
+	if err := peer.WriteFrame(Frame{Type: FrameStreamOpen, StreamID: 1}); err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("mux accepted a stream opened with its own parity")
+	}
+	if _, err := client.OpenStream(); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("OpenStream error = %v, want ErrMuxClosed", err)
+	}
+}
+
+func TestMuxControlKeepsLatest(t *testing.T) {
+	client, server := muxPair(t, MuxConfig{})
+
+	for _, payload := range []string{"first", "second"} {
+		if err := client.SendControl(Frame{Type: FrameTunnels, Payload: []byte(payload)}); err != nil {
+			t.Fatalf("SendControl: %v", err)
+		}
+	}
+	// A stream opened afterwards proves both control frames were handled
+	if _, err := client.OpenStream(); err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	acceptStream(t, server)
+
+	select {
+	case f := <-server.Control():
+		if string(f.Payload) != "second" {
+			t.Errorf("Control() delivered %q, want second", f.Payload)
+		}
+	default:
+		t.Fatal("no control frame delivered")
+	}
+}
@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// ErrDestinationDenied is returned for backend addresses outside the allowlist
+var ErrDestinationDenied = errors.New("destination not allowed")
+
+// DestinationRule allows backends inside CIDR on the listed ports.
+// An empty port list allows any port.
+type DestinationRule struct {
+	CIDR  string `yaml:"cidr" json:"cidr"`
+	Ports []int  `yaml:"ports" json:"ports,omitempty"`
+}
+
+type destinationRule struct {
+	network *net.IPNet
+	ports   map[int]struct{}
+}
+
+// DestinationPolicy restricts which backend addresses dynamically added
+// tunnels may target, guarding against tunnels being used to reach
+// arbitrary internal services. A nil policy denies every destination.
+type DestinationPolicy struct {
+	rules  []destinationRule
+	logger *logging.Logger
+}
+
+// NewDestinationPolicy parses the allowlist rules
+func NewDestinationPolicy(rules []DestinationRule, logger *logging.Logger) (*DestinationPolicy, error) {
+	p := &DestinationPolicy{logger: logger}
+	for _, rule := range rules {
+		_, network, err := net.ParseCIDR(rule.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination CIDR %q: %w", rule.CIDR, err)
+		}
+		ports := make(map[int]struct{}, len(rule.Ports))
+		for _, port := range rule.Ports {
+			if port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid destination port %d", port)
+			}
+			ports[port] = struct{}{}
+		}
+		p.rules = append(p.rules, destinationRule{network: network, ports: ports})
+	}
+	return p, nil
+}
+
+// Check validates a backend address when a tunnel is created. Host names
+// are resolved and every resulting address must be allowed.
+func (p *DestinationPolicy) Check(ctx context.Context, tunnel, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid backend address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid backend port in %q", addr)
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return fmt.Errorf("failed to resolve backend %q: %w", host, err)
+		}
+	}
+
+	for _, ip := range ips {
+		if !p.allowed(ip, port) {
+			return p.reject(ctx, tunnel, addr, net.JoinHostPort(ip.String(), portStr))
+		}
+	}
+	return nil
+}
+
+// Dialer returns a dialer that re-checks the actual address being connected
+// to, so DNS changes after creation can't redirect a tunnel elsewhere
+func (p *DestinationPolicy) Dialer(ctx context.Context, tunnel string) *net.Dialer {
+	return &net.Dialer{
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, portStr, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			port, _ := strconv.Atoi(portStr)
+			if !p.allowed(net.ParseIP(host), port) {
+				return p.reject(ctx, tunnel, address, address)
+			}
+			return nil
+		},
+	}
+}
+
+func (p *DestinationPolicy) allowed(ip net.IP, port int) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+	for _, rule := range p.rules {
+		if !rule.network.Contains(ip) {
+			continue
+		}
+		if _, ok := rule.ports[port]; ok || len(rule.ports) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *DestinationPolicy) reject(ctx context.Context, tunnel, addr, resolved string) error {
+	metrics.RecordTunnelConnectionError(tunnel, "destination_denied")
+	if p != nil && p.logger != nil {
+		p.logger.Audit(ctx, "Rejected tunnel destination not in allowlist", map[string]interface{}{
+			"tunnel":      tunnel,
+			"destination": addr,
+			"resolved":    resolved,
+		})
+	}
+	return fmt.Errorf("%w: %s for tunnel %s", ErrDestinationDenied, resolved, tunnel)
+}
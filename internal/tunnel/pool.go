@@ -0,0 +1,275 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+// Backend pool defaults
+const (
+	DefaultPoolMaxIdle     = 8
+	DefaultPoolIdleTimeout = 90 * time.Second
+)
+
+// BackendPool keeps warm backend connections per remote address so a
+// tunnel can reuse them across forwarded streams. Reuse is only safe for
+// protocols that leave a connection idle at a message boundary, such as
+// HTTP/1.1 with keep-alive; it must not be used for opaque byte streams.
+type BackendPool struct {
+	tunnel      string
+	dial        DialFunc
+	maxIdle     int
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]pooledEntry
+	closed bool
+}
+
+type pooledEntry struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// NewBackendPool creates the pool for spec, dialing new connections with
+// dial. Unset limits use DefaultPoolMaxIdle and DefaultPoolIdleTimeout.
+func NewBackendPool(spec TunnelSpec, dial DialFunc) *BackendPool {
+	p := &BackendPool{
+		tunnel:      spec.Name,
+		dial:        dial,
+		maxIdle:     spec.PoolMaxIdle,
+		idleTimeout: spec.PoolIdleTimeout,
+		idle:        make(map[string][]pooledEntry),
+	}
+	if p.maxIdle <= 0 {
+		p.maxIdle = DefaultPoolMaxIdle
+	}
+	if p.idleTimeout <= 0 {
+		p.idleTimeout = DefaultPoolIdleTimeout
+	}
+	return p
+}
+
+// Get returns a connection to addr, reusing the most recently idled one
+// when it is still open and quiet, otherwise dialing. Closing the returned
+// connection hands it back to the pool unless it saw an error.
+func (p *BackendPool) Get(ctx context.Context, addr string) (net.Conn, error) {
+	for {
+		conn := p.take(addr)
+		if conn == nil {
+			break
+		}
+		if reusable(conn) {
+			metrics.RecordBackendPool(p.tunnel, true)
+			return &pooledConn{Conn: conn, pool: p, addr: addr}, nil
+		}
+		conn.Close()
+	}
+
+	metrics.RecordBackendPool(p.tunnel, false)
+	conn, err := p.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{Conn: conn, pool: p, addr: addr}, nil
+}
+
+// take pops the most recently idled connection to addr, closing any that
+// have been idle too long
+func (p *BackendPool) take(addr string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.report()
+
+	entries := p.idle[addr]
+	for len(entries) > 0 {
+		entry := entries[len(entries)-1]
+		entries = entries[:len(entries)-1]
+		p.idle[addr] = entries
+		if time.Since(entry.since) <= p.idleTimeout {
+			return entry.conn
+		}
+		entry.conn.Close()
+	}
+	return nil
+}
+
+func (p *BackendPool) put(addr string, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle[addr]) >= p.maxIdle {
+		conn.Close()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], pooledEntry{conn: conn, since: time.Now()})
+	p.report()
+}
+
+// Prune closes connections that have been idle longer than the idle
+// timeout and returns how many were closed
+func (p *BackendPool) Prune() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	removed := 0
+	for addr, entries := range p.idle {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if time.Since(entry.since) > p.idleTimeout {
+				entry.conn.Close()
+				removed++
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		p.idle[addr] = kept
+	}
+	p.report()
+	return removed
+}
+
+// Close closes every idle connection. Connections in use are closed
+// rather than returned once their users are done with them.
+func (p *BackendPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for addr, entries := range p.idle {
+		for _, entry := range entries {
+			entry.conn.Close()
+		}
+		delete(p.idle, addr)
+	}
+	p.report()
+}
+
+// report updates the idle gauge; p.mu must be held
+func (p *BackendPool) report() {
+	idle := 0
+	for _, entries := range p.idle {
+		idle += len(entries)
+	}
+	metrics.SetBackendPoolIdle(p.tunnel, idle)
+}
+
+// poolProbeWait is how long reusable waits for pending data or a close. An
+// already expired deadline fails reads without checking the socket, so it
+// must be slightly in the future.
+const poolProbeWait = time.Millisecond
+
+// reusable reports whether an idle connection is still open with nothing
+// unread. Leftover bytes, e.g. a response the previous user never read,
+// would be handed to the next stream, so such connections are dropped.
+func reusable(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(poolProbeWait)); err != nil {
+		return false
+	}
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	if n > 0 {
+		return false
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// pooledConn is a backend connection on loan from a BackendPool. Close
+// interrupts any I/O still in progress and returns the connection, unless
+// an error or unread data means it can't be reused.
+type pooledConn struct {
+	net.Conn
+	pool *BackendPool
+	addr string
+
+	mu       sync.Mutex
+	inflight sync.WaitGroup
+	closed   bool
+	broken   bool
+}
+
+func (c *pooledConn) Read(p []byte) (int, error) {
+	if !c.begin() {
+		return 0, net.ErrClosed
+	}
+	n, err := c.Conn.Read(p)
+	return n, c.end(n, err)
+}
+
+func (c *pooledConn) Write(p []byte) (int, error) {
+	if !c.begin() {
+		return 0, net.ErrClosed
+	}
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		// A partial write leaves the backend mid-message
+		c.mu.Lock()
+		c.broken = true
+		c.mu.Unlock()
+	}
+	return n, c.end(0, err)
+}
+
+func (c *pooledConn) begin() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.inflight.Add(1)
+	return true
+}
+
+// end marks the connection broken on any error other than a deadline, and
+// on data that arrived after Close started, since nobody will read it. A
+// deadline set by Close is reported to the caller as net.ErrClosed.
+func (c *pooledConn) end(n int, err error) error {
+	defer c.inflight.Done()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var netErr net.Error
+	timeout := errors.As(err, &netErr) && netErr.Timeout()
+	if err != nil && !timeout {
+		c.broken = true
+	}
+	if n > 0 && c.closed {
+		c.broken = true
+	}
+	if timeout && c.closed {
+		return net.ErrClosed
+	}
+	return err
+}
+
+func (c *pooledConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	// Unblock readers still waiting on the backend before handing it back
+	c.Conn.SetDeadline(time.Now())
+	c.inflight.Wait()
+
+	c.mu.Lock()
+	broken := c.broken
+	c.mu.Unlock()
+	if broken || c.Conn.SetDeadline(time.Time{}) != nil {
+		return c.Conn.Close()
+	}
+	c.pool.put(c.addr, c.Conn)
+	return nil
+}
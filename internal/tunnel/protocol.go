@@ -1 +1,258 @@
 package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FrameType identifies the kind of frame on the control connection
+type FrameType uint8
+
+const (
+	// FrameData carries stream payload
+	FrameData FrameType = iota
+	// FramePing keeps NAT and firewall mappings alive. It carries no payload,
+	// expects no reply and is discarded by the receiver.
+	FramePing
+	// FrameSessionResume issues a session token when the server sends it
+	// on a new session. A reconnecting client sends it as its first frame
+	// with the 8 byte count of frames it received followed by the token,
+	// and the server answers with its own count, or a single status byte
+	// if it refuses.
+	FrameSessionResume
+	// FrameCodecs advertises the compression codecs a peer supports as a
+	// comma-separated list
+	FrameCodecs
+	// FrameDatagram carries a single UDP datagram; the stream ID identifies
+	// the flow it belongs to
+	FrameDatagram
+	// FrameStreamOpen opens a multiplexed stream with the frame's stream ID
+	FrameStreamOpen
+	// FrameStreamFin half-closes a stream: the sender will write no more
+	FrameStreamFin
+	// FrameStreamReset aborts a stream in both directions
+	FrameStreamReset
+	// FrameWindowUpdate grants the peer more send window on a stream; the
+	// payload is the 4 byte increment
+	FrameWindowUpdate
+	// FrameAuth carries the client's bearer token, sent as the first frame
+	// after the TLS handshake when token auth is enabled
+	FrameAuth
+	// FrameAuthResult answers FrameAuth: an empty payload accepts the token,
+	// otherwise the payload is the reason for rejection
+	FrameAuthResult
+	// FrameTunnels announces the client's tunnels to the server as a JSON
+	// array of TunnelSpec. The client sends it once the session is up and
+	// again whenever its tunnels change; each one replaces the last.
+	FrameTunnels
+	// FrameSessionAck tells the peer how many frames have been received on
+	// the session as an 8 byte count, so it can drop them from its replay
+	// buffer
+	FrameSessionAck
+	// FrameSessionClose ends a resumable session on purpose. The receiver
+	// hangs up instead of waiting for the session to be resumed.
+	FrameSessionClose
+)
+
+const (
+	frameHeaderSize = 9
+	// MaxFramePayload is the largest payload a single frame may carry
+	MaxFramePayload = 1 << 20
+)
+
+// Frame is a single message on the control connection.
+// On the wire: 1 byte type, 4 bytes stream ID, 4 bytes payload length, payload.
+type Frame struct {
+	Type     FrameType
+	StreamID uint32
+	Payload  []byte
+}
+
+// FrameWriter serialises frame writes from concurrent goroutines
+type FrameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewFrameWriter creates a frame writer over w
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// reset makes fw write to w from now on, for a session resumed on a new
+// connection
+func (fw *FrameWriter) reset(w io.Writer) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.w = w
+}
+
+// WriteFrame writes a complete frame
+func (fw *FrameWriter) WriteFrame(f Frame) error {
+	if len(f.Payload) > MaxFramePayload {
+		return fmt.Errorf("frame payload of %d bytes exceeds limit of %d", len(f.Payload), MaxFramePayload)
+	}
+
+	buf := make([]byte, frameHeaderSize+len(f.Payload))
+	buf[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(buf[1:5], f.StreamID)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(f.Payload)))
+	copy(buf[frameHeaderSize:], f.Payload)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	_, err := fw.w.Write(buf)
+	return err
+}
+
+// ReadFrame reads the next frame from r, discarding keepalive pings
+func ReadFrame(r io.Reader) (Frame, error) {
+	var header [frameHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return Frame{}, err
+		}
+
+		f := Frame{
+			Type:     FrameType(header[0]),
+			StreamID: binary.BigEndian.Uint32(header[1:5]),
+		}
+		length := binary.BigEndian.Uint32(header[5:9])
+		if length > MaxFramePayload {
+			return Frame{}, fmt.Errorf("frame payload of %d bytes exceeds limit of %d", length, MaxFramePayload)
+		}
+
+		if f.Type == FramePing {
+			if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+				return Frame{}, err
+			}
+			continue
+		}
+
+		f.Payload = make([]byte, length)
+		if _, err := io.ReadFull(r, f.Payload); err != nil {
+			return Frame{}, err
+		}
+		return f, nil
+	}
+}
+
+// TunnelsFrame builds the FrameTunnels announcement of specs. SOCKS5
+// credentials are checked on the client and never leave it.
+func TunnelsFrame(specs []TunnelSpec) (Frame, error) {
+	announced := make([]TunnelSpec, len(specs))
+	for i, spec := range specs {
+		spec.SOCKSUsers = nil
+		announced[i] = spec
+	}
+	payload, err := json.Marshal(announced)
+	if err != nil {
+		return Frame{}, fmt.Errorf("failed to encode tunnels: %w", err)
+	}
+	return Frame{Type: FrameTunnels, Payload: payload}, nil
+}
+
+// ParseTunnelsFrame decodes and validates a FrameTunnels announcement
+func ParseTunnelsFrame(f Frame) ([]TunnelSpec, error) {
+	var specs []TunnelSpec
+	if err := json.Unmarshal(f.Payload, &specs); err != nil {
+		return nil, fmt.Errorf("failed to decode tunnels: %w", err)
+	}
+	if err := ValidateTunnelSpecs(specs); err != nil {
+		return nil, fmt.Errorf("invalid tunnels: %w", err)
+	}
+	return specs, nil
+}
+
+// Codec names a stream compression codec
+type Codec string
+
+const (
+	CodecNone Codec = "none"
+	CodecGzip Codec = "gzip"
+	CodecZstd Codec = "zstd"
+)
+
+// codecPreference lists codecs from best to worst. Both peers rank by the
+// same order so they always agree on the outcome.
+var codecPreference = []Codec{CodecZstd, CodecGzip, CodecNone}
+
+// NegotiateCodec returns the best codec supported by both sides, falling
+// back to no compression when there is no overlap
+func NegotiateCodec(local, remote []Codec) Codec {
+	for _, codec := range codecPreference {
+		if hasCodec(local, codec) && hasCodec(remote, codec) {
+			return codec
+		}
+	}
+	return CodecNone
+}
+
+// ExchangeCodecs advertises the local codecs, reads the peer's advertisement
+// from r and returns the negotiated codec. Both peers call it at stream setup.
+func ExchangeCodecs(fw *FrameWriter, r io.Reader, local []Codec) (Codec, error) {
+	names := make([]string, len(local))
+	for i, codec := range local {
+		names[i] = string(codec)
+	}
+	if err := fw.WriteFrame(Frame{Type: FrameCodecs, Payload: []byte(strings.Join(names, ","))}); err != nil {
+		return CodecNone, fmt.Errorf("failed to advertise codecs: %w", err)
+	}
+
+	f, err := ReadFrame(r)
+	if err != nil {
+		return CodecNone, fmt.Errorf("failed to read peer codecs: %w", err)
+	}
+	if f.Type != FrameCodecs {
+		return CodecNone, fmt.Errorf("unexpected frame type %d during codec negotiation", f.Type)
+	}
+
+	var remote []Codec
+	for _, name := range strings.Split(string(f.Payload), ",") {
+		if name != "" {
+			remote = append(remote, Codec(name))
+		}
+	}
+	return NegotiateCodec(local, remote), nil
+}
+
+func hasCodec(codecs []Codec, codec Codec) bool {
+	if codec == CodecNone {
+		return true
+	}
+	for _, c := range codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultKeepaliveInterval is how often clients ping an idle session, well
+// within the server's default read timeout
+const DefaultKeepaliveInterval = 30 * time.Second
+
+// RunKeepalive sends a ping frame every interval until ctx is cancelled or a
+// write fails. The interval should be shorter than typical NAT mapping
+// timeouts (30s is safe for most consumer routers).
+func RunKeepalive(ctx context.Context, fw *FrameWriter, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := fw.WriteFrame(Frame{Type: FramePing}); err != nil {
+				return fmt.Errorf("failed to send keepalive: %w", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyV2CmdLocal = 0x20
+	proxyV2CmdProxy = 0x21
+
+	proxyV2FamilyUnspec = 0x00
+	proxyV2FamilyTCP4   = 0x11
+	proxyV2FamilyUDP4   = 0x12
+	proxyV2FamilyTCP6   = 0x21
+	proxyV2FamilyUDP6   = 0x22
+)
+
+// ProxyHeaderV2 builds a binary PROXY protocol v2 header telling a backend
+// that the connection came from src and was addressed to dst. Addresses
+// that aren't TCP or UDP produce a LOCAL header, which backends treat as
+// carrying no client address.
+func ProxyHeaderV2(src, dst net.Addr) []byte {
+	srcIP, srcPort, srcUDP, ok := proxyAddr(src)
+	dstIP, dstPort, dstUDP, ok2 := proxyAddr(dst)
+	if !ok || !ok2 || srcUDP != dstUDP {
+		header := append([]byte{}, proxyV2Signature...)
+		return append(header, proxyV2CmdLocal, proxyV2FamilyUnspec, 0, 0)
+	}
+
+	var family byte
+	var addrs []byte
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		family = proxyV2FamilyTCP4
+		if srcUDP {
+			family = proxyV2FamilyUDP4
+		}
+		addrs = append(append(addrs, src4...), dst4...)
+	} else {
+		// A mix of families is sent as IPv6, with IPv4 addresses mapped
+		family = proxyV2FamilyTCP6
+		if srcUDP {
+			family = proxyV2FamilyUDP6
+		}
+		addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcPort))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstPort))
+
+	header := make([]byte, 0, len(proxyV2Signature)+4+len(addrs))
+	header = append(header, proxyV2Signature...)
+	header = append(header, proxyV2CmdProxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func proxyAddr(addr net.Addr) (net.IP, int, bool, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, false, a.IP != nil
+	case *net.UDPAddr:
+		return a.IP, a.Port, true, a.IP != nil
+	default:
+		return nil, 0, false, false
+	}
+}
+
+// SendProxyHeader writes a PROXY protocol v2 header to backend carrying the
+// original client address of the accepted connection client. It must be
+// sent before any payload.
+func SendProxyHeader(backend, client net.Conn) error {
+	if _, err := backend.Write(ProxyHeaderV2(client.RemoteAddr(), client.LocalAddr())); err != nil {
+		return fmt.Errorf("failed to send PROXY protocol header: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderV2(t *testing.T) {
+	signature := []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+	header := func(rest ...byte) []byte {
+		return append(append([]byte{}, signature...), rest...)
+	}
+
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		want     []byte
+	}{
+		{
+			name: "tcp4",
+			src:  &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234},
+			dst:  &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+			want: header(
+				0x21, 0x11, 0x00, 0x0C,
+				192, 0, 2, 10,
+				198, 51, 100, 1,
+				0xC8, 0x22, // 51234
+				0x01, 0xBB, // 443
+			),
+		},
+		{
+			name: "tcp6",
+			src:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234},
+			dst:  &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			want: header(
+				0x21, 0x21, 0x00, 0x24,
+				0x20, 0x01, 0x0D, 0xB8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+				0x20, 0x01, 0x0D, 0xB8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02,
+				0xC8, 0x22,
+				0x01, 0xBB,
+			),
+		},
+		{
+			name: "mixed families as mapped tcp6",
+			src:  &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 80},
+			dst:  &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			want: header(
+				0x21, 0x21, 0x00, 0x24,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 192, 0, 2, 10,
+				0x20, 0x01, 0x0D, 0xB8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02,
+				0x00, 0x50,
+				0x01, 0xBB,
+			),
+		},
+		{
+			name: "udp4",
+			src:  &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5353},
+			dst:  &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53},
+			want: header(
+				0x21, 0x12, 0x00, 0x0C,
+				192, 0, 2, 10,
+				198, 51, 100, 1,
+				0x14, 0xE9,
+				0x00, 0x35,
+			),
+		},
+		{
+			name: "unix is local",
+			src:  &net.UnixAddr{Name: "/run/client.sock", Net: "unix"},
+			dst:  &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+			want: header(0x20, 0x00, 0x00, 0x00),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ProxyHeaderV2(tt.src, tt.dst); !bytes.Equal(got, tt.want) {
+				t.Errorf("ProxyHeaderV2() =\n% x\nwant\n% x", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+// RateLimiter is a token bucket shaping a byte stream to a fixed rate,
+// with a burst of one second's worth of bytes. A nil RateLimiter is
+// unlimited.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter for bytesPerSec. It returns nil, which
+// is unlimited, for a non-positive rate.
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller
+// must wait before they may be sent. The bucket may go into debt so that
+// writes larger than the burst are delayed rather than rejected.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait blocks until n bytes may pass or ctx is cancelled, and reports
+// whether the bytes were throttled
+func (l *RateLimiter) Wait(ctx context.Context, n int) (bool, error) {
+	if l == nil || n <= 0 {
+		return false, nil
+	}
+	delay := l.reserve(n)
+	if delay == 0 {
+		return false, nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+// TunnelRateLimits holds a tunnel's independent limiters for each direction
+type TunnelRateLimits struct {
+	In  *RateLimiter
+	Out *RateLimiter
+}
+
+// NewTunnelRateLimits creates the limiters for spec and publishes its
+// configured limit
+func NewTunnelRateLimits(spec TunnelSpec) TunnelRateLimits {
+	metrics.SetTunnelRateLimit(spec.Name, spec.RateLimitBytesPerSec)
+	return TunnelRateLimits{
+		In:  NewRateLimiter(spec.RateLimitBytesPerSec),
+		Out: NewRateLimiter(spec.RateLimitBytesPerSec),
+	}
+}
+
+// LimitReader shapes reads from r with limiter. Bytes are throttled after
+// they are read, delaying the next read. A nil limiter returns r unchanged.
+func LimitReader(ctx context.Context, r io.Reader, limiter *RateLimiter, tunnel, direction string) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: limiter, tunnel: tunnel, direction: direction}
+}
+
+// LimitWriter shapes writes to w with limiter. A nil limiter returns w
+// unchanged.
+func LimitWriter(ctx context.Context, w io.Writer, limiter *RateLimiter, tunnel, direction string) io.Writer {
+	if limiter == nil {
+		return w
+	}
+	return &limitedWriter{ctx: ctx, w: w, limiter: limiter, tunnel: tunnel, direction: direction}
+}
+
+// LimitConn shapes a tunnel connection with limits: reads from conn, the
+// "in" direction, with In and writes to it with Out. Without limits conn is
+// returned unchanged.
+func LimitConn(ctx context.Context, conn net.Conn, limits TunnelRateLimits, tunnel string) net.Conn {
+	if limits.In == nil && limits.Out == nil {
+		return conn
+	}
+	return &limitedConn{
+		Conn: conn,
+		r:    LimitReader(ctx, conn, limits.In, tunnel, "in"),
+		w:    LimitWriter(ctx, conn, limits.Out, tunnel, "out"),
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *limitedConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func (c *limitedConn) unwrap() net.Conn { return c.Conn }
+
+type limitedReader struct {
+	ctx       context.Context
+	r         io.Reader
+	limiter   *RateLimiter
+	tunnel    string
+	direction string
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	throttled, waitErr := l.limiter.Wait(l.ctx, n)
+	if throttled {
+		metrics.RecordThrottled(l.direction, l.tunnel, int64(n))
+	}
+	if err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+type limitedWriter struct {
+	ctx       context.Context
+	w         io.Writer
+	limiter   *RateLimiter
+	tunnel    string
+	direction string
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	throttled, err := l.limiter.Wait(l.ctx, len(p))
+	if throttled {
+		metrics.RecordThrottled(l.direction, l.tunnel, int64(len(p)))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return l.w.Write(p)
+}
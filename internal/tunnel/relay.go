@@ -0,0 +1,183 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+// ErrIdleTimeout is returned by Relay when a connection was evicted after
+// no bytes flowed in either direction for the idle timeout
+var ErrIdleTimeout = errors.New("connection idle timeout")
+
+const relayBufferSize = 32 << 10
+
+// Relay copies data between client and backend in both directions until
+// both are done, then closes both. Each direction half-closes on its own:
+// when one side finishes sending, the other is sent a FIN while the reverse
+// direction keeps flowing, so a backend that replies after reading the whole
+// request still gets its response through. Bytes are recorded per direction
+// as "in" (client to backend) and "out" (backend to client). With a non-zero
+// idle timeout the connection is evicted once no bytes have flowed in either
+// direction for that long. It returns the bytes relayed in each direction.
+func Relay(tunnel string, client, backend net.Conn, idleTimeout time.Duration) (bytesIn, bytesOut int64, err error) {
+	r := &relay{tunnel: tunnel, idleTimeout: idleTimeout}
+	r.touch()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[0] = r.pipe(backend, client, "in", &bytesIn)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = r.pipe(client, backend, "out", &bytesOut)
+	}()
+	wg.Wait()
+	client.Close()
+	backend.Close()
+
+	if r.idle.Load() {
+		metrics.RecordTunnelConnectionError(tunnel, "idle_timeout")
+		return bytesIn, bytesOut, ErrIdleTimeout
+	}
+	for _, err := range errs {
+		// Closing both sides interrupts the other direction
+		if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+			return bytesIn, bytesOut, err
+		}
+	}
+	return bytesIn, bytesOut, nil
+}
+
+// writeError marks a copy that stopped because dst refused the data, as
+// opposed to src failing
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string { return e.err.Error() }
+
+func (e *writeError) Unwrap() error { return e.err }
+
+// pipe runs one direction of the relay and shuts it down. EOF from src is
+// passed on as a FIN to dst; a peer that stopped reading has its unread
+// input discarded. Either way the other direction carries on. Failures,
+// idle eviction, and conns that can't half-close tear down both sides.
+// Bytes written to dst are added to copied.
+func (r *relay) pipe(dst, src net.Conn, direction string, copied *int64) error {
+	err := r.copy(dst, src, direction, copied)
+	var werr *writeError
+	switch {
+	case r.idle.Load():
+	case err == nil:
+		if closeWrite(dst) == nil {
+			return nil
+		}
+	case errors.As(err, &werr):
+		if closeRead(src) == nil {
+			return nil
+		}
+		err = werr.err
+	}
+	dst.Close()
+	src.Close()
+	return err
+}
+
+type relay struct {
+	tunnel       string
+	idleTimeout  time.Duration
+	lastActivity atomic.Int64
+	idle         atomic.Bool
+}
+
+func (r *relay) touch() {
+	r.lastActivity.Store(time.Now().UnixNano())
+}
+
+// copy copies src to dst, resetting the read deadline after every
+// successful copy. When the deadline fires it only evicts if the other
+// direction has been quiet too. Write failures are returned as a
+// *writeError.
+func (r *relay) copy(dst, src net.Conn, direction string, copied *int64) error {
+	buf := make([]byte, relayBufferSize)
+	for {
+		if r.idleTimeout > 0 {
+			last := time.Unix(0, r.lastActivity.Load())
+			src.SetReadDeadline(last.Add(r.idleTimeout))
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			r.touch()
+			written, werr := dst.Write(buf[:n])
+			if written > 0 {
+				*copied += int64(written)
+				metrics.RecordTraffic(direction, r.tunnel, int64(written))
+			}
+			if werr != nil {
+				return &writeError{err: werr}
+			}
+			r.touch()
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && r.idleTimeout > 0 {
+			last := time.Unix(0, r.lastActivity.Load())
+			if time.Since(last) < r.idleTimeout {
+				// The other direction was active
+				continue
+			}
+			r.idle.Store(true)
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+}
+
+// wrappedConn is implemented by this package's conn wrappers that can be
+// half-closed through to the conn they wrap
+type wrappedConn interface {
+	unwrap() net.Conn
+}
+
+// closeWrite half-closes conn's write side, looking through wrappers
+func closeWrite(conn net.Conn) error {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite()
+		case wrappedConn:
+			conn = c.unwrap()
+		default:
+			return errors.ErrUnsupported
+		}
+	}
+}
+
+// closeRead half-closes conn's read side, looking through wrappers
+func closeRead(conn net.Conn) error {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseRead() error }:
+			return c.CloseRead()
+		case wrappedConn:
+			conn = c.unwrap()
+		default:
+			return errors.ErrUnsupported
+		}
+	}
+}
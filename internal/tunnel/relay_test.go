@@ -0,0 +1,242 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+// relayResult is what Relay returned
+type relayResult struct {
+	bytesIn, bytesOut int64
+	err               error
+}
+
+// startRelay relays between two in-memory pipes and returns the client's
+// and backend's ends of them
+func startRelay(t *testing.T, idleTimeout time.Duration) (client, backend net.Conn, done <-chan relayResult) {
+	t.Helper()
+	client, clientRelay := net.Pipe()
+	backendRelay, backend := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		backend.Close()
+	})
+
+	result := make(chan relayResult, 1)
+	go func() {
+		var r relayResult
+		r.bytesIn, r.bytesOut, r.err = Relay("idle-test", clientRelay, backendRelay, idleTimeout)
+		result <- r
+	}()
+	return client, backend, result
+}
+
+func TestRelayEvictsSilentConnection(t *testing.T) {
+	idleErrors := metrics.Default.ConnectionErrors.WithLabelValues("idle_timeout", metrics.OtherTunnel)
+	before := counterValue(t, idleErrors)
+	client, backend, done := startRelay(t, 100*time.Millisecond)
+
+	// One exchange, then both sides go silent without closing
+	go io.ReadFull(backend, make([]byte, 4))
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	select {
+	case r := <-done:
+		if !errors.Is(r.err, ErrIdleTimeout) {
+			t.Errorf("Relay() error = %v, want ErrIdleTimeout", r.err)
+		}
+		if r.bytesIn != 4 || r.bytesOut != 0 {
+			t.Errorf("Relay() bytes = %d in, %d out, want 4 in, 0 out", r.bytesIn, r.bytesOut)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("evicted after %s, want about the idle timeout", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent connection was never evicted")
+	}
+	if got := counterValue(t, idleErrors) - before; got != 1 {
+		t.Errorf("idle_timeout errors = %v, want 1", got)
+	}
+
+	// Both ends are closed
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("client end still open after eviction")
+	}
+}
+
+func TestRelayOneDirectionKeepsConnectionAlive(t *testing.T) {
+	client, backend, done := startRelay(t, 100*time.Millisecond)
+	go io.Copy(io.Discard, backend)
+
+	// Only the client talks, for several idle timeouts
+	for i := 0; i < 10; i++ {
+		if _, err := client.Write([]byte("tick")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		select {
+		case r := <-done:
+			t.Fatalf("Relay() returned %v while the client was sending", r.err)
+		case <-time.After(40 * time.Millisecond):
+		}
+	}
+
+	select {
+	case r := <-done:
+		if !errors.Is(r.err, ErrIdleTimeout) {
+			t.Errorf("Relay() error = %v, want ErrIdleTimeout once the client stopped", r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was never evicted after the client went silent")
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+func TestRelayDeliversResponseAfterRequestHalfClose(t *testing.T) {
+	client, clientRelay := tcpPair(t)
+	backendRelay, backend := tcpPair(t)
+	done := make(chan relayResult, 1)
+	go func() {
+		var r relayResult
+		r.bytesIn, r.bytesOut, r.err = Relay("http", clientRelay, backendRelay, 0)
+		done <- r
+	}()
+
+	request := "POST /upload HTTP/1.0\r\nContent-Length: 5\r\n\r\nhello"
+	response := "HTTP/1.0 200 OK\r\nContent-Length: 8\r\n\r\nreceived"
+
+	// The backend only answers once it has read the whole request body
+	go func() {
+		if _, err := io.ReadAll(backend); err != nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		backend.Write([]byte(response))
+		backend.Close()
+	}()
+
+	if _, err := client.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if string(got) != response {
+		t.Errorf("response = %q, want %q", got, response)
+	}
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Errorf("Relay() error = %v", r.err)
+		}
+		if r.bytesIn != int64(len(request)) || r.bytesOut != int64(len(response)) {
+			t.Errorf("Relay() bytes = %d in, %d out, want %d in, %d out", r.bytesIn, r.bytesOut, len(request), len(response))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay() didn't return after both directions finished")
+	}
+}
+
+func TestIdleReaperEvictsIdleRelays(t *testing.T) {
+	const relays = 50
+	const timeout, interval = 100 * time.Millisecond, 20 * time.Millisecond
+	reaper := NewIdleReaper(interval)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reaper.Run(ctx)
+
+	idleErrors := metrics.Default.ConnectionErrors.WithLabelValues("idle_timeout", metrics.OtherTunnel)
+	before := counterValue(t, idleErrors)
+	clients := make([]net.Conn, relays)
+	results := make([]chan relayResult, relays)
+	for i := range clients {
+		client, clientRelay := net.Pipe()
+		backendRelay, backend := net.Pipe()
+		t.Cleanup(func() {
+			client.Close()
+			backend.Close()
+		})
+		go io.Copy(io.Discard, backend)
+		clients[i], results[i] = client, make(chan relayResult, 1)
+		go func(result chan<- relayResult) {
+			var r relayResult
+			r.bytesIn, r.bytesOut, r.err = reaper.Relay("idle-test", clientRelay, backendRelay, timeout)
+			result <- r
+		}(results[i])
+	}
+
+	// Odd relays stay active for several timeouts, even ones go silent
+	start := time.Now()
+	for time.Since(start) < 4*timeout {
+		for i := 1; i < relays; i += 2 {
+			if _, err := clients[i].Write([]byte("tick")); err != nil {
+				t.Fatalf("active relay %d: %v", i, err)
+			}
+		}
+		time.Sleep(interval)
+	}
+
+	for i, result := range results {
+		select {
+		case r := <-result:
+			if i%2 == 1 {
+				t.Errorf("active relay %d ended with %v", i, r.err)
+			} else if !errors.Is(r.err, ErrIdleTimeout) {
+				t.Errorf("idle relay %d ended with %v, want ErrIdleTimeout", i, r.err)
+			}
+		default:
+			if i%2 == 0 {
+				t.Errorf("idle relay %d still open after %v", i, time.Since(start))
+			}
+		}
+	}
+	if got := counterValue(t, idleErrors) - before; got != relays/2 {
+		t.Errorf("idle_timeout errors = %v, want %d", got, relays/2)
+	}
+}
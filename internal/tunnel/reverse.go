@@ -0,0 +1,194 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// ReasonClientDisconnected is the rejection reason for reverse tunnel
+// connections accepted while no client session is attached
+const ReasonClientDisconnected = "client_disconnected"
+
+// ReasonReverseDenied is the rejection reason for reverse tunnels the
+// server has no binding for or that another client serves
+const ReasonReverseDenied = "reverse_denied"
+
+// ErrClientDisconnected is returned when a reverse tunnel has no client
+// session to relay a connection over
+var ErrClientDisconnected = errors.New("no client connected for reverse tunnel")
+
+// ReverseListener serves the server's end of a reverse tunnel: it accepts
+// connections on the tunnel's RemoteAddr and relays each one over the
+// attached client session, where the client dials its LocalAddr.
+//
+// Each connection is a stream opened by the server whose FrameStreamOpen
+// payload is the tunnel name. The client answers with a one byte dial
+// result (see WriteDialResult) before any data flows.
+type ReverseListener struct {
+	spec   TunnelSpec
+	logger *logging.Logger
+	active atomic.Int64
+
+	mu       sync.Mutex
+	mux      *Mux
+	attached chan struct{}
+}
+
+// NewReverseListener creates the listener for a reverse tunnel spec
+func NewReverseListener(spec TunnelSpec, logger *logging.Logger) *ReverseListener {
+	return &ReverseListener{
+		spec:     spec,
+		logger:   logger,
+		attached: make(chan struct{}),
+	}
+}
+
+// Attach makes mux the client session new connections are relayed over,
+// releasing any connections queued while the client was away
+func (r *ReverseListener) Attach(mux *Mux) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mux = mux
+	select {
+	case <-r.attached:
+	default:
+		close(r.attached)
+	}
+}
+
+// Detach drops mux if it is still the attached session. Connections
+// accepted afterwards are refused or queued until the client returns.
+func (r *ReverseListener) Detach(mux *Mux) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mux != mux {
+		return
+	}
+	r.mux = nil
+	r.attached = make(chan struct{})
+}
+
+// Serve accepts connections on ln until ctx is cancelled or ln fails
+func (r *ReverseListener) Serve(ctx context.Context, ln net.Listener) error {
+	return ServeListener(ctx, ln, nil, func(conn net.Conn) {
+		r.handle(ctx, conn)
+	})
+}
+
+// Active returns the number of connections being relayed
+func (r *ReverseListener) Active() int {
+	return int(r.active.Load())
+}
+
+func (r *ReverseListener) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	r.active.Add(1)
+	defer r.active.Add(-1)
+	ctx, span := startConnSpan(ctx, r.spec.Name, conn)
+	var bytesIn, bytesOut int64
+	var err error
+	defer func() { finishConnSpan(span, bytesIn, bytesOut, err) }()
+
+	stream, err := r.open(ctx)
+	if err == nil {
+		err = ReadDialResult(stream, r.spec.LocalAddr)
+		if err != nil {
+			stream.Close()
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrClientDisconnected) {
+			metrics.RecordTunnelRejection(r.spec.Name, ReasonClientDisconnected)
+		} else {
+			metrics.RecordTunnelConnectionError(r.spec.Name, "reverse_dial")
+		}
+		r.logger.Warn(ctx, "Reverse tunnel connection refused", map[string]interface{}{
+			"tunnel":      r.spec.Name,
+			"remote_addr": conn.RemoteAddr().String(),
+			"error":       err.Error(),
+		})
+		return
+	}
+	defer stream.Close()
+
+	bytesIn, bytesOut = pipeStream(conn, stream)
+}
+
+// open opens a stream on the attached session. Without one it waits up to
+// the spec's ReverseQueueTimeout for the client to connect.
+func (r *ReverseListener) open(ctx context.Context) (*MuxStream, error) {
+	r.mu.Lock()
+	mux, attached := r.mux, r.attached
+	r.mu.Unlock()
+
+	if mux == nil {
+		if r.spec.ReverseQueueTimeout <= 0 {
+			return nil, ErrClientDisconnected
+		}
+		timer := time.NewTimer(r.spec.ReverseQueueTimeout)
+		defer timer.Stop()
+		select {
+		case <-attached:
+		case <-timer.C:
+			return nil, ErrClientDisconnected
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		r.mu.Lock()
+		mux = r.mux
+		r.mu.Unlock()
+		if mux == nil {
+			return nil, ErrClientDisconnected
+		}
+	}
+	return mux.OpenStreamTo(r.spec.Name)
+}
+
+// ServeReverseStream handles a stream opened by the server for a reverse
+// tunnel on the client: it dials the tunnel's LocalAddr, reports the result
+// and relays bytes
+func ServeReverseStream(ctx context.Context, logger *logging.Logger, specs []TunnelSpec, stream *MuxStream) {
+	defer stream.Close()
+
+	var spec *TunnelSpec
+	for i := range specs {
+		if specs[i].Reverse && specs[i].Name == stream.Target() {
+			spec = &specs[i]
+			break
+		}
+	}
+	if spec == nil {
+		logger.Warn(ctx, "Server opened a stream for an unknown reverse tunnel", map[string]interface{}{
+			"tunnel": stream.Target(),
+		})
+		WriteDialResult(stream, fmt.Errorf("unknown reverse tunnel %q", stream.Target()))
+		return
+	}
+
+	backend, err := TraceDial(spec.Name, (&net.Dialer{}).DialContext)(ctx, "tcp", spec.LocalAddr)
+	if err != nil {
+		metrics.RecordTunnelConnectionError(spec.Name, "backend_dial")
+		logger.Warn(ctx, "Failed to dial reverse tunnel service", map[string]interface{}{
+			"tunnel":     spec.Name,
+			"local_addr": spec.LocalAddr,
+			"error":      err.Error(),
+		})
+	}
+	if werr := WriteDialResult(stream, err); werr != nil || err != nil {
+		if backend != nil {
+			backend.Close()
+		}
+		return
+	}
+	defer backend.Close()
+
+	pipeStream(backend, stream)
+}
@@ -1 +1,1307 @@
 package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gotunnel-pro/internal/crypto"
+	"gotunnel-pro/internal/health"
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+// DefaultMemorySampleInterval is how often MemoryGuard.Run samples usage
+// when no interval is given
+const DefaultMemorySampleInterval = time.Second
+
+// MemoryUsageFunc reports the current memory usage of the process in bytes
+type MemoryUsageFunc func() uint64
+
+// MemoryGuard sheds new connections while memory usage is above a threshold
+type MemoryGuard struct {
+	threshold uint64
+	usage     MemoryUsageFunc
+	logger    *logging.Logger
+	shedding  atomic.Bool
+}
+
+// NewMemoryGuard creates a memory guard. A zero threshold disables shedding
+// and a nil usage func falls back to RuntimeMemoryUsage.
+func NewMemoryGuard(threshold uint64, usage MemoryUsageFunc, logger *logging.Logger) *MemoryGuard {
+	if usage == nil {
+		usage = RuntimeMemoryUsage
+	}
+	return &MemoryGuard{
+		threshold: threshold,
+		usage:     usage,
+		logger:    logger,
+	}
+}
+
+// Run samples memory usage every interval, or DefaultMemorySampleInterval
+// when interval isn't positive, until ctx is cancelled. ReadMemStats stops
+// the world, so usage is sampled here rather than per accept.
+func (g *MemoryGuard) Run(ctx context.Context, interval time.Duration) {
+	if g.threshold == 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultMemorySampleInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		g.Sample(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample takes a single usage reading and updates the shedding state
+func (g *MemoryGuard) Sample(ctx context.Context) {
+	if g.threshold == 0 {
+		return
+	}
+
+	used := g.usage()
+	over := used >= g.threshold
+	if g.shedding.Swap(over) == over || g.logger == nil {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"memory_bytes":    used,
+		"threshold_bytes": g.threshold,
+	}
+	if over {
+		g.logger.Warn(ctx, "Memory threshold exceeded, shedding new connections", fields)
+	} else {
+		g.logger.Info(ctx, "Memory usage recovered, accepting new connections", fields)
+	}
+}
+
+// Allow reports whether a new connection may be accepted
+func (g *MemoryGuard) Allow() bool {
+	if !g.shedding.Load() {
+		return true
+	}
+	metrics.RecordConnectionError("memory_shed")
+	return false
+}
+
+// Shedding reports whether the guard is currently rejecting connections
+func (g *MemoryGuard) Shedding() bool {
+	return g.shedding.Load()
+}
+
+// RuntimeMemoryUsage returns the memory obtained from the OS that has not been
+// returned to it, as reported by the Go runtime.
+func RuntimeMemoryUsage() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.Sys - m.HeapReleased
+}
+
+// CgroupMemoryLimit returns the cgroup v2 memory limit of the process, if any
+func CgroupMemoryLimit() (uint64, bool) {
+	data, err := os.ReadFile("/sys/fs/cgroup/memory.max")
+	if err != nil {
+		return 0, false
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, false
+	}
+
+	limit, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return limit, true
+}
+
+// CgroupMemoryThreshold returns percent of the cgroup memory limit, for
+// shedding load before the process is OOM-killed. It reports false when
+// the process has no cgroup limit.
+func CgroupMemoryThreshold(percent int) (uint64, bool) {
+	limit, ok := CgroupMemoryLimit()
+	if !ok {
+		return 0, false
+	}
+	return limit / 100 * uint64(percent), true
+}
+
+// AdmitIdentity applies the identity gate to a connection whose handshake has
+// completed, closing and auditing it on rejection. It reports whether the
+// connection was admitted.
+func AdmitIdentity(ctx context.Context, logger *logging.Logger, gate *crypto.IdentityGate, conn *tls.Conn) bool {
+	if gate == nil {
+		return true
+	}
+
+	err := gate.Check(conn.ConnectionState())
+	if err == nil {
+		return true
+	}
+
+	metrics.RecordConnectionError("identity_rejected")
+	logger.Audit(ctx, "Rejected connection by certificate identity", map[string]interface{}{
+		"remote_addr": conn.RemoteAddr().String(),
+		"identity":    gate.Extractor().PeerIdentity(conn.ConnectionState()),
+		"error":       err.Error(),
+	})
+	conn.Close()
+	return false
+}
+
+// HandshakeLimiter bounds the number of TLS handshakes in progress, both in
+// total and per source IP, so a single source can't monopolise crypto CPU.
+// Zero limits are unlimited.
+type HandshakeLimiter struct {
+	mu       sync.Mutex
+	maxTotal int
+	maxPerIP int
+	total    int
+	perIP    map[string]int
+}
+
+// NewHandshakeLimiter creates a handshake limiter
+func NewHandshakeLimiter(maxTotal, maxPerIP int) *HandshakeLimiter {
+	return &HandshakeLimiter{
+		maxTotal: maxTotal,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+	}
+}
+
+// Acquire reserves a handshake slot for ip, recording handshake_throttled and
+// returning false when either limit is reached. Every successful Acquire must
+// be paired with a Release.
+func (h *HandshakeLimiter) Acquire(ip string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if (h.maxTotal > 0 && h.total >= h.maxTotal) || (h.maxPerIP > 0 && h.perIP[ip] >= h.maxPerIP) {
+		metrics.RecordConnectionError("handshake_throttled")
+		return false
+	}
+
+	h.total++
+	h.perIP[ip]++
+	return true
+}
+
+// Release frees a handshake slot for ip. State for an IP is dropped as soon
+// as it has no handshakes in progress, so idle sources cost nothing.
+func (h *HandshakeLimiter) Release(ip string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.total--
+	if h.perIP[ip] <= 1 {
+		delete(h.perIP, ip)
+		return
+	}
+	h.perIP[ip]--
+}
+
+// InProgress returns the number of handshakes in progress for ip
+func (h *HandshakeLimiter) InProgress(ip string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.perIP[ip]
+}
+
+// Priority orders tunnels for admission when the server is near capacity
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// ParsePriority parses a tunnel priority from config, defaulting to normal
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, fmt.Errorf("unknown tunnel priority %q", s)
+	}
+}
+
+// PriorityAdmission caps concurrent connections, holding back reserve slots
+// per priority step so that under contention lower-priority tunnels are shed
+// first. The reserve only applies while higher-priority connections are
+// active: without them a lower priority may use every slot, so capacity
+// isn't left idle waiting for demand that never comes.
+type PriorityAdmission struct {
+	mu       sync.Mutex
+	capacity int
+	reserve  int
+	active   map[Priority]int
+	total    int
+}
+
+// NewPriorityAdmission creates an admission controller for capacity
+// connections. Under contention high priority may use every slot, normal
+// priority all but reserve, and low priority all but twice reserve.
+func NewPriorityAdmission(capacity, reserve int) *PriorityAdmission {
+	return &PriorityAdmission{
+		capacity: capacity,
+		reserve:  reserve,
+		active:   make(map[Priority]int),
+	}
+}
+
+// Admit reserves a slot for a connection of the given priority, reporting
+// whether it was admitted. Admitted connections must call Release with the
+// same priority.
+func (a *PriorityAdmission) Admit(p Priority) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.total >= a.capacity {
+		metrics.RecordConnectionError("connection_limit")
+		return false
+	}
+	if a.total >= a.capacity-a.reserve*int(PriorityHigh-p) && a.contended(p) {
+		metrics.RecordConnectionError("shed_low_priority")
+		return false
+	}
+
+	a.active[p]++
+	a.total++
+	return true
+}
+
+// contended reports whether connections above priority p are active;
+// a.mu must be held
+func (a *PriorityAdmission) contended(p Priority) bool {
+	for higher := p + 1; higher <= PriorityHigh; higher++ {
+		if a.active[higher] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Release frees a slot reserved by Admit for priority p
+func (a *PriorityAdmission) Release(p Priority) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active[p]--
+	a.total--
+}
+
+// Active returns the number of admitted connections
+func (a *PriorityAdmission) Active() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.total
+}
+
+// Warmup rejects or holds new connections while the server finishes
+// initialising after binding its listener. Warmup ends when Complete is
+// called or the grace period elapses, whichever comes first.
+type Warmup struct {
+	ready chan struct{}
+	once  sync.Once
+	hold  bool
+}
+
+// NewWarmup creates a warmup gate. With hold set, connections arriving
+// during warmup wait for it to end instead of being rejected. A zero grace
+// disables warmup.
+func NewWarmup(grace time.Duration, hold bool) *Warmup {
+	w := &Warmup{
+		ready: make(chan struct{}),
+		hold:  hold,
+	}
+	if grace <= 0 {
+		w.Complete()
+	} else {
+		time.AfterFunc(grace, w.Complete)
+	}
+	return w
+}
+
+// Complete ends the warmup
+func (w *Warmup) Complete() {
+	w.once.Do(func() { close(w.ready) })
+}
+
+// Admit reports whether a connection may proceed. During warmup it either
+// waits for warmup to end (hold mode) or rejects with the warming_up error.
+func (w *Warmup) Admit(ctx context.Context) bool {
+	select {
+	case <-w.ready:
+		return true
+	default:
+	}
+
+	if w.hold {
+		select {
+		case <-w.ready:
+			return true
+		case <-ctx.Done():
+		}
+	}
+
+	metrics.RecordConnectionError("warming_up")
+	return false
+}
+
+// TunnelLimiter enforces a maximum number of concurrent connections per
+// tunnel, independent of per-client and global limits
+type TunnelLimiter struct {
+	mu     sync.Mutex
+	limits map[string]int
+	active map[string]int
+}
+
+// NewTunnelLimiter creates a limiter from per-tunnel limits. Tunnels without
+// a positive limit are unlimited.
+func NewTunnelLimiter(limits map[string]int) *TunnelLimiter {
+	return &TunnelLimiter{
+		limits: limits,
+		active: make(map[string]int),
+	}
+}
+
+// Acquire reserves a connection slot on tunnel, recording a tunnel-labeled
+// rejection when the tunnel is at its limit
+func (t *TunnelLimiter) Acquire(tunnel string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if limit := t.limits[tunnel]; limit > 0 && t.active[tunnel] >= limit {
+		metrics.RecordTunnelRejection(tunnel, ReasonMaxConns)
+		return false
+	}
+	t.active[tunnel]++
+	return true
+}
+
+// Release frees a slot reserved by Acquire
+func (t *TunnelLimiter) Release(tunnel string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active[tunnel]--; t.active[tunnel] <= 0 {
+		delete(t.active, tunnel)
+	}
+}
+
+// Counts returns the current number of connections per tunnel. Tunnels
+// without connections are left out.
+func (t *TunnelLimiter) Counts() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := make(map[string]int, len(t.active))
+	for tunnel, n := range t.active {
+		counts[tunnel] = n
+	}
+	return counts
+}
+
+// handshakeLogInterval rate-limits handshake failure logs per source
+const handshakeLogInterval = time.Minute
+
+// ServerConfig configures a Server
+type ServerConfig struct {
+	ListenAddr string
+	TLSConfig  *tls.Config
+	Logger     *logging.Logger
+	Mux        MuxConfig
+	// Handshakes bounds concurrent TLS handshakes in total and per source
+	// IP. Nil is unlimited.
+	Handshakes *HandshakeLimiter
+	// Admission caps concurrent tunnel connections, shedding lower
+	// priorities first. Nil is unlimited.
+	Admission *PriorityAdmission
+	// Priorities are the admission priorities of tunnels by name. Tunnels
+	// not listed are PriorityNormal.
+	Priorities map[string]Priority
+	// TunnelLimits caps concurrent connections per tunnel name. Nil is
+	// unlimited.
+	TunnelLimits *TunnelLimiter
+	// IdentityGate admits clients by certificate identity after the
+	// handshake. Nil admits every client the TLS config accepts.
+	IdentityGate *crypto.IdentityGate
+	// Policy restricts the backends announced tunnels and SOCKS5 targets
+	// may reach and the addresses reverse tunnels listen on. Nil denies
+	// all of them.
+	Policy *DestinationPolicy
+	// Timeouts bound the TLS handshake, each read and write on a client
+	// session and backend dials and writes. Zero values are not applied.
+	Timeouts Timeouts
+	// MemoryGuard sheds new client connections while memory usage is
+	// high. StartContext runs it. Nil never sheds.
+	MemoryGuard *MemoryGuard
+	// TCP tunes client sessions, reverse tunnel connections and backend
+	// connections
+	TCP TCPOptions
+	// TokenSource, when set, requires a bearer token from each client
+	// after the handshake
+	TokenSource TokenSource
+	// DrainTimeout bounds how long Shutdown waits for forwarded
+	// connections before force-closing them. Zero is DefaultDrainTimeout.
+	DrainTimeout time.Duration
+	// BackendCloseWindow, when set, treats a backend that closes a
+	// connection within this long of accepting it, without sending
+	// anything, as refusing it: the dial fails with ErrBackendRefused.
+	// Every backend dial is watched for up to the window.
+	BackendCloseWindow time.Duration
+	// IdleScanInterval, when set, enforces tunnel idle timeouts with one
+	// scan of every connection per interval instead of per-connection read
+	// deadlines; connections are closed up to one interval late. See
+	// IdleReaper.
+	IdleScanInterval time.Duration
+	// DrainLinger is the SO_LINGER of connections force-closed at the
+	// drain deadline: zero keeps the OS behaviour and a negative value
+	// resets them. See ConnTracker.SetLinger.
+	DrainLinger time.Duration
+	// Maintenance answers forward tunnels in maintenance without dialing
+	// their backend. Nil never puts a tunnel in maintenance.
+	Maintenance *MaintenanceMode
+	// ReverseTunnels binds reverse tunnels by name to a listen address and
+	// optionally the one client identity allowed to serve them. A reverse
+	// tunnel without a binding, or announced with a different address, is
+	// rejected.
+	ReverseTunnels map[string]ReverseBinding
+	// Backends sets what the server adds to the backend connections of
+	// forward TCP tunnels by name. It is never taken from the client's
+	// announcement, so backends can trust what it adds.
+	Backends map[string]BackendOptions
+	// Warmup rejects or holds connections accepted while the server is
+	// still starting. Nil accepts them straight away.
+	Warmup *Warmup
+	// Health, when set, gets a liveness check that fails once the server
+	// stops accepting connections, and a readiness check that fails while
+	// fewer than MinTunnels clients are connected
+	Health     *health.HealthService
+	MinTunnels int
+}
+
+// ReverseBinding is the server's setting for a reverse tunnel
+type ReverseBinding struct {
+	// Listen is the address the server listens on for the tunnel
+	Listen string
+	// Client is the identity allowed to serve the tunnel. Empty allows any
+	// admitted client, but the tunnel stays with the first identity to
+	// claim it until the server restarts.
+	Client string
+}
+
+// BackendOptions is the server's setting for a forward TCP tunnel's backend
+// connections
+type BackendOptions struct {
+	// ProxyProtocol sends a PROXY protocol v2 header with the original
+	// client address when connecting to the backend. Backend connections
+	// aren't pooled then, since the header describes a single client.
+	ProxyProtocol bool
+	// HTTPHeaders parses the tunnel's HTTP/1.x requests and sets the
+	// X-Forwarded-For, X-Tunnel-Client and X-Tunnel-Name headers, replacing
+	// any the client sent
+	HTTPHeaders bool
+}
+
+// Server accepts client sessions and serves the tunnels each client
+// announces: it dials the remote end of forward tunnels, relays UDP and
+// SOCKS5 traffic and listens for reverse tunnels
+type Server struct {
+	cfg             ServerConfig
+	tracker         *ConnTracker
+	handshakeErrors *HandshakeErrorLogger
+	// resumes holds the sessions clients may resume, nil without a
+	// Mux.ResumeWindow
+	resumes *SessionStore
+	// reaper enforces idle timeouts, nil without an IdleScanInterval
+	reaper *IdleReaper
+
+	// ctx outlives StartContext so sessions can drain during Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	ln net.Listener
+	// closed is set by Shutdown; StartContext won't listen after it
+	closed   bool
+	sessions map[*serverSession]struct{}
+	reverse  map[string]*reverseTunnel
+	active   map[string]int
+	wg       sync.WaitGroup
+	// listenErr is why StartContext stopped accepting before Shutdown
+	listenErr error
+}
+
+// serverSession is one client's mTLS connection and the tunnels it has
+// announced
+type serverSession struct {
+	mux *Mux
+	// identity is the client's certificate identity
+	identity string
+
+	mu      sync.Mutex
+	tunnels map[string]*sessionTunnel
+}
+
+// sessionTunnel is a tunnel announced by a session, with the state its
+// connections share
+type sessionTunnel struct {
+	spec     TunnelSpec
+	timeouts Timeouts
+	limiter  *ConnLimiter
+	rates    TunnelRateLimits
+	pool     *BackendPool
+}
+
+// reverseTunnel is a reverse tunnel listener, kept across client
+// reconnects so connections can queue while the client is away
+type reverseTunnel struct {
+	listener *ReverseListener
+	cancel   context.CancelFunc
+	// owner is the identity of the client serving the tunnel
+	owner string
+}
+
+// NewServer creates a server for cfg. Nothing listens until StartContext.
+func NewServer(cfg *ServerConfig) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &Server{
+		cfg:             *cfg,
+		tracker:         NewConnTracker(),
+		handshakeErrors: NewHandshakeErrorLogger(cfg.Logger, handshakeLogInterval),
+		ctx:             ctx,
+		cancel:          cancel,
+		sessions:        make(map[*serverSession]struct{}),
+		reverse:         make(map[string]*reverseTunnel),
+		active:          make(map[string]int),
+	}
+	server.tracker.SetLinger(cfg.DrainLinger)
+	if server.cfg.DrainTimeout <= 0 {
+		server.cfg.DrainTimeout = DefaultDrainTimeout
+	}
+	if cfg.Mux.ResumeWindow > 0 {
+		server.resumes = NewSessionStore()
+	}
+	if cfg.IdleScanInterval > 0 {
+		server.reaper = NewIdleReaper(cfg.IdleScanInterval)
+	}
+	if cfg.Health != nil {
+		cfg.Health.RegisterLivenessChecker(health.NewListenerChecker(server.ListenErr))
+	}
+	if cfg.Health != nil && cfg.MinTunnels > 0 {
+		cfg.Health.RegisterReadinessChecker(health.NewTunnelConnectionChecker(cfg.MinTunnels, server.ActiveConnectionCount))
+	}
+	return server
+}
+
+// StartContext listens on ListenAddr and accepts client connections until
+// ctx is cancelled. Sessions already accepted keep running until Shutdown.
+func (s *Server) StartContext(ctx context.Context) (err error) {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.closed || ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("listener closed")
+		}
+		s.listenErr = fmt.Errorf("not accepting tunnel connections: %w", err)
+	}()
+
+	ln, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.ListenAddr, err)
+	}
+	ln = TuneListener(ln, s.cfg.TCP)
+	if s.cfg.MemoryGuard != nil {
+		go s.cfg.MemoryGuard.Run(ctx, DefaultMemorySampleInterval)
+	}
+	if s.reaper != nil {
+		// Forwarded connections outlive ctx while they drain
+		go s.reaper.Run(s.ctx)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.ln = ln
+	// Counted before Shutdown can wait, so every handler it starts is too
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+
+	return ServeListener(ctx, ln, &s.wg, s.handleConn)
+}
+
+// Shutdown stops accepting connections, waits up to DrainTimeout (or until
+// ctx is done) for forwarded connections to finish, force-closing the rest,
+// and then closes every session
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for name, rt := range s.reverse {
+		rt.cancel()
+		delete(s.reverse, name)
+	}
+	s.mu.Unlock()
+
+	drainCtx, cancel := context.WithTimeout(ctx, s.cfg.DrainTimeout)
+	err := s.tracker.Drain(drainCtx, s.cfg.Logger)
+	cancel()
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = errors.Join(err, fmt.Errorf("failed to close sessions: %w", ctx.Err()))
+	}
+	return err
+}
+
+// ListenErr returns why the server stopped accepting client connections
+// before Shutdown, or nil while it accepts them or hasn't started
+func (s *Server) ListenErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listenErr
+}
+
+// ActiveConnectionCount returns the number of connected client sessions
+func (s *Server) ActiveConnectionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// ServerStats counts what connected clients hold open on the server
+type ServerStats struct {
+	// Sessions is the number of connected client sessions
+	Sessions int `json:"sessions"`
+	// Streams is the number of streams open across those sessions
+	Streams int `json:"open_streams"`
+	// TunnelConnections is the number of connections each tunnel holds
+	// against TunnelLimits, when it is set
+	TunnelConnections map[string]int `json:"tunnel_connections,omitempty"`
+}
+
+// Stats returns the server's current session, stream and per-tunnel
+// connection counts
+func (s *Server) Stats() ServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := ServerStats{Sessions: len(s.sessions)}
+	for sess := range s.sessions {
+		stats.Streams += sess.mux.NumStreams()
+	}
+	if s.cfg.TunnelLimits != nil {
+		stats.TunnelConnections = s.cfg.TunnelLimits.Counts()
+	}
+	return stats
+}
+
+// TunnelStates returns the state of every tunnel announced by a connected
+// client, and of reverse tunnels still listening for one
+func (s *Server) TunnelStates() []TunnelState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := make(map[string]TunnelState)
+	for sess := range s.sessions {
+		for _, spec := range sess.specs() {
+			states[spec.Name] = s.tunnelState(spec)
+		}
+	}
+	for name, rt := range s.reverse {
+		if _, ok := states[name]; !ok {
+			states[name] = s.tunnelState(rt.listener.spec)
+		}
+	}
+
+	list := make([]TunnelState, 0, len(states))
+	for _, state := range states {
+		list = append(list, state)
+	}
+	return list
+}
+
+// tunnelState describes spec from the server's side; s.mu must be held
+func (s *Server) tunnelState(spec TunnelSpec) TunnelState {
+	state := TunnelState{
+		Name:              spec.Name,
+		Type:              spec.Protocol,
+		Listen:            spec.LocalAddr,
+		Backends:          []string{spec.RemoteAddr},
+		Enabled:           s.cfg.Maintenance == nil || !s.cfg.Maintenance.Enabled(spec.Name),
+		Draining:          s.ctx.Err() != nil || s.tracker.Draining(),
+		ActiveConnections: s.active[spec.Name],
+		Timeouts:          tunnelTimeouts(spec, s.cfg.Timeouts).Stats(),
+	}
+	switch {
+	case spec.Reverse:
+		state.Type = "reverse"
+		state.Listen = spec.RemoteAddr
+		state.Backends = []string{spec.LocalAddr}
+		if rt, ok := s.reverse[spec.Name]; ok {
+			state.ActiveConnections = rt.listener.Active()
+		}
+	case spec.Protocol == ProtocolSOCKS5:
+		state.Backends = nil
+	}
+	return state
+}
+
+// handleConn runs the TLS handshake on an accepted connection and serves
+// the client's session until it ends or the server shuts down
+func (s *Server) handleConn(raw net.Conn) {
+	ctx := s.ctx
+	if s.cfg.MemoryGuard != nil && !s.cfg.MemoryGuard.Allow() {
+		raw.Close()
+		return
+	}
+	if s.cfg.Warmup != nil && !s.cfg.Warmup.Admit(ctx) {
+		raw.Close()
+		return
+	}
+	setup := StartSetupTimer()
+	conn, ok := s.handshake(ctx, raw)
+	if !ok {
+		return
+	}
+	setup.Phase(PhaseHandshake)
+	if !AdmitIdentity(ctx, s.cfg.Logger, s.cfg.IdentityGate, conn) {
+		return
+	}
+	if !AuthenticateToken(ctx, s.cfg.Logger, s.cfg.TokenSource, conn, NewFrameWriter(conn), 0) {
+		return
+	}
+	setup.Phase(PhaseAuth)
+
+	extractor := crypto.DefaultIdentityExtractor
+	if s.cfg.IdentityGate != nil {
+		extractor = s.cfg.IdentityGate.Extractor()
+	}
+	identity := extractor.PeerIdentity(conn.ConnectionState())
+
+	session := WithTimeouts(conn, Timeouts{Read: s.cfg.Timeouts.Read, Write: s.cfg.Timeouts.Write})
+	if s.resumes == nil {
+		s.serveSession(ctx, NewMux(session, false, s.cfg.Mux), identity, "")
+		return
+	}
+
+	// A client resuming a session says so in its first frame
+	first, err := ReadFrame(session)
+	if err != nil {
+		session.Close()
+		return
+	}
+	if first.Type == FrameSessionResume {
+		s.resume(ctx, session, first, identity)
+		return
+	}
+	mux := NewMux(unreadFrame(session, first), false, s.cfg.Mux)
+	token, err := s.resumes.Create(identity, mux)
+	if err == nil {
+		err = mux.issueToken(token)
+	}
+	if err != nil {
+		s.cfg.Logger.Warn(ctx, "Failed to make session resumable", map[string]interface{}{
+			"identity": identity,
+			"error":    err.Error(),
+		})
+		token = ""
+	}
+	s.serveSession(ctx, mux, identity, token)
+}
+
+// resume continues the session named by the resume request f on conn,
+// answering the client either way
+func (s *Server) resume(ctx context.Context, conn net.Conn, f Frame, identity string) {
+	token, received, err := parseResumeRequest(f)
+	var session *Session
+	if err == nil {
+		session, err = s.resumes.Resume(token, identity)
+	}
+	if err == nil {
+		err = session.mux.resume(conn, received, true)
+	}
+	if err != nil {
+		s.cfg.Logger.Warn(ctx, "Refused session resume", map[string]interface{}{
+			"identity":    identity,
+			"remote_addr": conn.RemoteAddr().String(),
+			"error":       err.Error(),
+		})
+		NewFrameWriter(conn).WriteFrame(resumeRefused(err))
+		conn.Close()
+		return
+	}
+	s.cfg.Logger.Info(ctx, "Resumed session", map[string]interface{}{
+		"identity":    identity,
+		"remote_addr": conn.RemoteAddr().String(),
+	})
+}
+
+// handshake runs the TLS handshake within the handshake limits, closing
+// raw on failure
+func (s *Server) handshake(ctx context.Context, raw net.Conn) (*tls.Conn, bool) {
+	if s.cfg.Handshakes != nil {
+		ip, _, _ := net.SplitHostPort(raw.RemoteAddr().String())
+		if !s.cfg.Handshakes.Acquire(ip) {
+			raw.Close()
+			return nil, false
+		}
+		defer s.cfg.Handshakes.Release(ip)
+	}
+
+	conn := tls.Server(raw, s.cfg.TLSConfig)
+	if err := HandshakeWithTimeout(ctx, conn, s.cfg.Timeouts.Handshake); err != nil {
+		s.handshakeErrors.Log(ctx, raw.RemoteAddr().String(), err)
+		conn.Close()
+		return nil, false
+	}
+	return conn, true
+}
+
+// serveSession dispatches the streams and tunnel announcements of a
+// client session until it ends
+func (s *Server) serveSession(ctx context.Context, mux *Mux, identity, token string) {
+	sess := &serverSession{mux: mux, identity: identity, tunnels: make(map[string]*sessionTunnel)}
+	s.mu.Lock()
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		mux.Close()
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		for _, rt := range s.reverse {
+			rt.listener.Detach(mux)
+		}
+		s.mu.Unlock()
+		sess.close()
+		if token != "" {
+			s.resumes.Close(token)
+		}
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			stream, err := mux.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serveStream(ctx, sess, stream)
+			}()
+		}
+	}()
+
+	prune := time.NewTicker(DefaultPoolIdleTimeout / 2)
+	defer prune.Stop()
+	for {
+		select {
+		case f := <-mux.Control():
+			specs, err := ParseTunnelsFrame(f)
+			if err != nil {
+				s.cfg.Logger.Warn(ctx, "Rejected tunnel announcement", map[string]interface{}{
+					"remote_addr": mux.remoteAddr().String(),
+					"error":       err.Error(),
+				})
+				continue
+			}
+			specs = s.checkDestinations(ctx, specs)
+			sess.announce(specs, s.cfg.Timeouts, s.cfg.Logger, s.dialer)
+			s.attachReverse(ctx, specs, sess)
+		case <-prune.C:
+			sess.prune()
+		case <-mux.Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// attachReverse makes sess the session for each reverse tunnel in specs
+// bound to it, starting listeners for new ones
+func (s *Server) attachReverse(ctx context.Context, specs []TunnelSpec, sess *serverSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	for _, spec := range specs {
+		if !spec.Reverse {
+			continue
+		}
+		rt, ok := s.reverse[spec.Name]
+		if err := s.checkReverse(spec, sess.identity, rt); err != nil {
+			metrics.RecordTunnelRejection(spec.Name, ReasonReverseDenied)
+			s.cfg.Logger.Audit(ctx, "Rejected reverse tunnel", map[string]interface{}{
+				"tunnel":      spec.Name,
+				"identity":    sess.identity,
+				"remote_addr": spec.RemoteAddr,
+				"error":       err.Error(),
+			})
+			continue
+		}
+		if ok && !reflect.DeepEqual(rt.listener.spec, spec) {
+			rt.cancel()
+			delete(s.reverse, spec.Name)
+			ok = false
+		}
+		if !ok {
+			ln, err := net.Listen("tcp", spec.RemoteAddr)
+			if err != nil {
+				s.cfg.Logger.Error(s.ctx, "Failed to listen for reverse tunnel", map[string]interface{}{
+					"tunnel":      spec.Name,
+					"remote_addr": spec.RemoteAddr,
+					"error":       err.Error(),
+				})
+				continue
+			}
+			ctx, cancel := context.WithCancel(s.ctx)
+			rt = &reverseTunnel{listener: NewReverseListener(spec, s.cfg.Logger), cancel: cancel, owner: sess.identity}
+			s.reverse[spec.Name] = rt
+			go rt.listener.Serve(ctx, TuneListener(ln, s.cfg.TCP))
+		}
+		rt.listener.Attach(sess.mux)
+	}
+}
+
+// checkReverse reports why a client with identity may not serve spec, given
+// the tunnel's current listener rt if there is one
+func (s *Server) checkReverse(spec TunnelSpec, identity string, rt *reverseTunnel) error {
+	binding, ok := s.cfg.ReverseTunnels[spec.Name]
+	switch {
+	case !ok:
+		return fmt.Errorf("no reverse tunnel %q is configured on the server", spec.Name)
+	case spec.RemoteAddr != binding.Listen:
+		return fmt.Errorf("reverse tunnel %q listens on %s, not %s", spec.Name, binding.Listen, spec.RemoteAddr)
+	case binding.Client != "" && binding.Client != identity:
+		return fmt.Errorf("reverse tunnel %q is reserved for another client", spec.Name)
+	case rt != nil && rt.owner != identity:
+		return fmt.Errorf("reverse tunnel %q is served by another client", spec.Name)
+	}
+	return nil
+}
+
+// checkDestinations drops announced tunnels whose remote address the
+// destination policy denies
+func (s *Server) checkDestinations(ctx context.Context, specs []TunnelSpec) []TunnelSpec {
+	allowed := specs[:0]
+	for _, spec := range specs {
+		// SOCKS5 targets are checked as each stream asks for one. The
+		// remote address of a reverse tunnel is where the server listens,
+		// which checkReverse holds to its configured listen address.
+		if spec.Protocol == ProtocolSOCKS5 || spec.Reverse {
+			allowed = append(allowed, spec)
+			continue
+		}
+		if err := s.cfg.Policy.Check(ctx, spec.Name, spec.RemoteAddr); err != nil {
+			s.cfg.Logger.Warn(ctx, "Rejected tunnel", map[string]interface{}{
+				"tunnel": spec.Name,
+				"error":  err.Error(),
+			})
+			continue
+		}
+		allowed = append(allowed, spec)
+	}
+	return allowed
+}
+
+// dialer returns the dial func for tunnel's backend connections, which
+// re-checks the destination policy on every dial, tunes the socket,
+// applies the dial and write timeouts and, with a BackendCloseWindow,
+// refuses backends that close immediately
+func (s *Server) dialer(tunnel string) DialFunc {
+	dial := s.cfg.Policy.Dialer(s.ctx, tunnel).DialContext
+	dial = DialWithTimeouts(TuneDial(dial, s.cfg.TCP), s.cfg.Timeouts)
+	if s.cfg.BackendCloseWindow <= 0 {
+		return dial
+	}
+	backends := NewBackendDialer(dial, s.cfg.BackendCloseWindow)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, _, err := backends.Dial(ctx, []string{addr})
+		return conn, err
+	}
+}
+
+// serveStream handles a stream opened by the client: streams named after a
+// forward tunnel go to its remote address, anything else is a SOCKS5
+// target when the session has a SOCKS5 tunnel
+func (s *Server) serveStream(ctx context.Context, sess *serverSession, stream *MuxStream) {
+	// The session is authorised, so the stream's setup is its backend dial
+	setup := StartSetupTimer()
+	t := sess.tunnel(stream.Target())
+	if t == nil {
+		t = sess.socks()
+	}
+	if t == nil || t.spec.Reverse {
+		stream.Reset()
+		return
+	}
+
+	name := t.spec.Name
+	conn, ok := s.tracker.Track(stream)
+	if !ok {
+		metrics.RecordTunnelRejection(name, ReasonDraining)
+		stream.Reset()
+		return
+	}
+	defer conn.Close()
+
+	if s.cfg.TunnelLimits != nil {
+		if !s.cfg.TunnelLimits.Acquire(name) {
+			stream.Reset()
+			return
+		}
+		defer s.cfg.TunnelLimits.Release(name)
+	}
+
+	if s.cfg.Admission != nil {
+		priority, ok := s.cfg.Priorities[name]
+		if !ok {
+			priority = PriorityNormal
+		}
+		if !s.cfg.Admission.Admit(priority) {
+			stream.Reset()
+			return
+		}
+		defer s.cfg.Admission.Release(priority)
+	}
+
+	// Only admitted streams count as active connections
+	s.mu.Lock()
+	s.active[name]++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.active[name]--; s.active[name] <= 0 {
+			delete(s.active, name)
+		}
+		s.mu.Unlock()
+	}()
+
+	switch t.spec.Protocol {
+	case ProtocolSOCKS5:
+		ServeSOCKS5Stream(ctx, name, stream, s.cfg.Policy, s.dialer(name))
+	case ProtocolUDP:
+		if err := RelayUDP(ctx, name, conn, t.spec.RemoteAddr, t.timeouts.Idle); err != nil && ctx.Err() == nil {
+			s.cfg.Logger.Warn(ctx, "UDP tunnel stream failed", map[string]interface{}{
+				"tunnel": name,
+				"error":  err.Error(),
+			})
+		}
+	default:
+		s.forward(ctx, t, conn, sess.identity, setup)
+	}
+}
+
+// forward relays a forward TCP tunnel connection from the client with
+// identity to the tunnel's remote address, recording the time until the
+// backend is connected on setup
+func (s *Server) forward(ctx context.Context, t *sessionTunnel, conn net.Conn, identity string, setup *SetupTimer) {
+	spec := t.spec
+	ctx, span := startConnSpan(ctx, spec.Name, conn)
+	var bytesIn, bytesOut int64
+	var err error
+	defer func() { finishConnSpan(span, bytesIn, bytesOut, err) }()
+
+	if len(LocalCodecs(spec.Compression)) > 0 {
+		var compressed net.Conn
+		if compressed, err = NegotiateCompression(conn, SupportedCodecs, spec.Name, false); err != nil {
+			metrics.RecordTunnelConnectionError(spec.Name, "compression")
+			conn.Close()
+			return
+		}
+		conn = compressed
+	}
+	if s.cfg.Maintenance != nil && s.cfg.Maintenance.Serve(conn, spec.Name) {
+		return
+	}
+	release, err := t.limiter.Acquire(ctx, conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer release()
+
+	options := s.cfg.Backends[spec.Name]
+	var backend net.Conn
+	if t.pool != nil && !options.ProxyProtocol {
+		backend, err = t.pool.Get(ctx, spec.RemoteAddr)
+	} else {
+		backend, err = TraceDial(spec.Name, s.dialer(spec.Name))(ctx, "tcp", spec.RemoteAddr)
+	}
+	if err != nil {
+		errorType := "backend_dial"
+		if errors.Is(err, ErrBackendRefused) {
+			errorType = ReasonBackendRefused
+		}
+		metrics.RecordTunnelConnectionError(spec.Name, errorType)
+		s.cfg.Logger.Warn(ctx, "Failed to dial tunnel backend", map[string]interface{}{
+			"tunnel":      spec.Name,
+			"remote_addr": spec.RemoteAddr,
+			"error":       err.Error(),
+		})
+		conn.Close()
+		return
+	}
+	setup.Phase(PhaseBackend)
+	if options.ProxyProtocol {
+		if err = SendProxyHeader(backend, conn); err != nil {
+			metrics.RecordTunnelConnectionError(spec.Name, "proxy_protocol")
+			backend.Close()
+			conn.Close()
+			return
+		}
+	}
+
+	if options.HTTPHeaders {
+		clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		conn = InjectOrigin(conn, Origin{ClientIP: clientIP, ClientCN: identity, TunnelName: spec.Name})
+	}
+
+	LogConnectionOpened(ctx, s.cfg.Logger, spec.Name, conn.RemoteAddr(), spec.RemoteAddr)
+	metrics.RecordConnection(spec.Name)
+	defer metrics.RecordDisconnection(spec.Name)
+	// The IO timeout is a safety net against any single read or write
+	// hanging, on top of the idle and write timeouts
+	backend = WithIOTimeout(backend, t.timeouts.IO)
+	client := LimitConn(ctx, WithIOTimeout(conn, t.timeouts.IO), t.rates, spec.Name)
+	relay := Relay
+	if s.reaper != nil {
+		relay = s.reaper.Relay
+	}
+	if bytesIn, bytesOut, err = relay(spec.Name, client, backend, t.timeouts.Idle); err != nil {
+		s.cfg.Logger.Debug(ctx, "Tunnel connection ended with error", map[string]interface{}{
+			"tunnel": spec.Name,
+			"error":  err.Error(),
+		})
+	}
+}
+
+// announce replaces the session's tunnels with specs, keeping the shared
+// state of tunnels whose spec is unchanged. New tunnels report their
+// timeouts, merged with defaults, as metrics.
+func (sess *serverSession) announce(specs []TunnelSpec, defaults Timeouts, logger *logging.Logger, dialer func(tunnel string) DialFunc) {
+	tunnels := make(map[string]*sessionTunnel, len(specs))
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for _, spec := range specs {
+		if t, ok := sess.tunnels[spec.Name]; ok && reflect.DeepEqual(t.spec, spec) {
+			tunnels[spec.Name] = t
+			delete(sess.tunnels, spec.Name)
+			continue
+		}
+		t := &sessionTunnel{
+			spec:     spec,
+			timeouts: tunnelTimeouts(spec, defaults),
+			limiter:  NewConnLimiter(spec, logger),
+			rates:    NewTunnelRateLimits(spec),
+		}
+		t.timeouts.Report(spec.Name)
+		if spec.PoolBackend {
+			t.pool = NewBackendPool(spec, TraceDial(spec.Name, dialer(spec.Name)))
+		}
+		tunnels[spec.Name] = t
+	}
+	for _, t := range sess.tunnels {
+		if t.pool != nil {
+			t.pool.Close()
+		}
+	}
+	sess.tunnels = tunnels
+}
+
+// tunnelTimeouts returns the timeouts applied to spec's connections: its
+// own idle timeout, and defaults for the rest
+func tunnelTimeouts(spec TunnelSpec, defaults Timeouts) Timeouts {
+	return Timeouts{Idle: spec.IdleTimeout}.Merge(defaults)
+}
+
+func (sess *serverSession) tunnel(name string) *sessionTunnel {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.tunnels[name]
+}
+
+// socks returns the session's SOCKS5 tunnel, if any
+func (sess *serverSession) socks() *sessionTunnel {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for _, t := range sess.tunnels {
+		if t.spec.Protocol == ProtocolSOCKS5 {
+			return t
+		}
+	}
+	return nil
+}
+
+func (sess *serverSession) specs() []TunnelSpec {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	specs := make([]TunnelSpec, 0, len(sess.tunnels))
+	for _, t := range sess.tunnels {
+		specs = append(specs, t.spec)
+	}
+	return specs
+}
+
+func (sess *serverSession) prune() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for _, t := range sess.tunnels {
+		if t.pool != nil {
+			t.pool.Prune()
+		}
+	}
+}
+
+func (sess *serverSession) close() {
+	sess.announce(nil, Timeouts{}, nil, nil)
+}
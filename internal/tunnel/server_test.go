@@ -0,0 +1,1506 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"gotunnel-pro/internal/crypto"
+	"gotunnel-pro/internal/health"
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+	"gotunnel-pro/internal/tracing"
+)
+
+// freeAddr returns a loopback address with a port that was free a moment ago
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// loopbackPolicy allows any destination on 127.0.0.0/8
+func loopbackPolicy(t *testing.T) *DestinationPolicy {
+	t.Helper()
+	policy, err := NewDestinationPolicy([]DestinationRule{{CIDR: "127.0.0.0/8"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+// startServer runs a Server for cfg until the test ends and returns it.
+// Without a Policy in cfg, loopback destinations are allowed.
+func startServer(t *testing.T, cfg *ServerConfig) *Server {
+	t.Helper()
+	if cfg.Policy == nil {
+		cfg.Policy = loopbackPolicy(t)
+	}
+	server := NewServer(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.StartContext(ctx)
+	t.Cleanup(func() {
+		cancel()
+		shutdownCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stop()
+		server.Shutdown(shutdownCtx)
+	})
+	return server
+}
+
+// startClient runs a Client for cfg until the test ends
+func startClient(t *testing.T, cfg *ClientConfig) *Client {
+	t.Helper()
+	client := NewClient(cfg)
+	go client.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client.Shutdown(ctx)
+	})
+	return client
+}
+
+// dialEventually dials addr until it accepts or a few seconds pass
+func dialEventually(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial %s: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// echoBackend serves connections by reading the whole request and writing
+// it back after the client half-closes
+func echoBackend(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				conn.Write(data)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// roundTrip sends request over addr, half-closes and returns the response.
+// A refused connection is closed without a response, so it is retried
+// while the tunnel comes up.
+func roundTrip(t *testing.T, addr, request string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn := dialEventually(t, addr)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(request))
+		conn.(*net.TCPConn).CloseWrite()
+		response, err := io.ReadAll(conn)
+		conn.Close()
+		if err == nil && len(response) > 0 {
+			return string(response)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no response through %s: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestServerForwardTunnel(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	server := startServer(t, &ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger()})
+
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+
+	if got := roundTrip(t, localAddr, "hello"); got != "hello" {
+		t.Errorf("response = %q, want hello", got)
+	}
+
+	states := server.TunnelStates()
+	if len(states) != 1 || states[0].Name != "echo" || states[0].Type != ProtocolTCP {
+		t.Errorf("TunnelStates() = %+v, want the echo tunnel", states)
+	}
+}
+
+func TestServerTunnelStatesMatchConfiguration(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr, reverseAddr := freeAddr(t), freeAddr(t)
+	maintenance := NewMaintenanceMode()
+	maintenance.Enable(MaintenanceResponse{Tunnel: "web"})
+	server := startServer(t, &ServerConfig{
+		ListenAddr:     serverAddr,
+		TLSConfig:      serverTLS,
+		Logger:         testLogger(),
+		Maintenance:    maintenance,
+		ReverseTunnels: map[string]ReverseBinding{"back": {Listen: reverseAddr}},
+	})
+
+	apiAddr, webAddr, proxyAddr := freeAddr(t), freeAddr(t), freeAddr(t)
+	backend := echoBackend(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels: []TunnelSpec{
+			{Name: "web", Protocol: ProtocolTCP, LocalAddr: webAddr, RemoteAddr: backend},
+			{Name: "api", Protocol: ProtocolTCP, LocalAddr: apiAddr, RemoteAddr: backend},
+			{Name: "proxy", Protocol: ProtocolSOCKS5, LocalAddr: proxyAddr},
+			{Name: "back", Protocol: ProtocolTCP, Reverse: true, LocalAddr: backend, RemoteAddr: reverseAddr},
+		},
+	})
+
+	// The echo backend holds the connection open until it half-closes
+	roundTrip(t, apiAddr, "up")
+	held := dialEventually(t, apiAddr)
+	defer held.Close()
+	held.Write([]byte("held"))
+
+	want := []TunnelState{
+		{Name: "api", Type: ProtocolTCP, Listen: apiAddr, Backends: []string{backend}, Enabled: true, ActiveConnections: 1},
+		{Name: "back", Type: "reverse", Listen: reverseAddr, Backends: []string{backend}, Enabled: true},
+		{Name: "proxy", Type: ProtocolSOCKS5, Listen: proxyAddr, Backends: []string{}, Enabled: true},
+		{Name: "web", Type: ProtocolTCP, Listen: webAddr, Backends: []string{backend}, Enabled: false},
+	}
+	var got []TunnelState
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got = NormalizeTunnelStates(server.TunnelStates())
+		for i := range got {
+			got[i].Timeouts = nil
+		}
+		if reflect.DeepEqual(got, want) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tunnel states =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestServerInjectsHTTPOriginHeaders(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{
+		ListenAddr: serverAddr,
+		TLSConfig:  serverTLS,
+		Logger:     testLogger(),
+		Backends:   map[string]BackendOptions{"web": {HTTPHeaders: true}},
+	})
+
+	// The client announces nothing about headers, so it can't turn the
+	// injection off, and forges them instead. The echo backend returns the
+	// requests as it received them.
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "web", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+
+	spoofed := "GET /a HTTP/1.1\r\nHost: web\r\nX-Forwarded-For: 10.0.0.1\r\nX-Tunnel-Client: admin\r\nX-Tunnel-Name: other\r\n\r\n"
+	plain := "POST /b HTTP/1.1\r\nHost: web\r\nContent-Length: 4\r\n\r\nbody"
+	received := bufio.NewReader(strings.NewReader(roundTrip(t, localAddr, spoofed+plain)))
+
+	for _, path := range []string{"/a", "/b"} {
+		req, err := http.ReadRequest(received)
+		if err != nil {
+			t.Fatalf("request %s: %v", path, err)
+		}
+		if req.URL.Path != path {
+			t.Errorf("path = %s, want %s", req.URL.Path, path)
+		}
+		want := map[string]string{
+			HeaderForwardedFor: "127.0.0.1",
+			HeaderTunnelClient: "gotunnel-test",
+			HeaderTunnelName:   "web",
+		}
+		for name, value := range want {
+			if got := req.Header.Values(name); len(got) != 1 || got[0] != value {
+				t.Errorf("request %s: %s = %q, want [%s]", path, name, got, value)
+			}
+		}
+		body, _ := io.ReadAll(req.Body)
+		if path == "/b" && string(body) != "body" {
+			t.Errorf("request %s: body = %q, want body", path, body)
+		}
+	}
+}
+
+func TestServerSendsProxyHeaderFromPolicy(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{
+		ListenAddr: serverAddr,
+		TLSConfig:  serverTLS,
+		Logger:     testLogger(),
+		Backends:   map[string]BackendOptions{"db": {ProxyProtocol: true}},
+	})
+
+	// Only the server's policy decides: "db" gets a header even though it
+	// asks for pooling, and "web" gets none
+	dbAddr, webAddr := freeAddr(t), freeAddr(t)
+	backend := echoBackend(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels: []TunnelSpec{
+			{Name: "db", Protocol: ProtocolTCP, LocalAddr: dbAddr, RemoteAddr: backend, PoolBackend: true},
+			{Name: "web", Protocol: ProtocolTCP, LocalAddr: webAddr, RemoteAddr: backend},
+		},
+	})
+
+	got := roundTrip(t, dbAddr, "hello")
+	if !strings.HasPrefix(got, string(proxyV2Signature)) || !strings.HasSuffix(got, "hello") {
+		t.Errorf("db backend received %q, want a PROXY v2 header before hello", got)
+	}
+	if strings.Count(got, string(proxyV2Signature)) != 1 {
+		t.Errorf("db backend received %d PROXY headers, want 1", strings.Count(got, string(proxyV2Signature)))
+	}
+
+	// A header the client forges reaches the backend as data, after none
+	// from the server, so a backend expecting one rejects the connection
+	forged := string(ProxyHeaderV2(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2}))
+	if got := roundTrip(t, webAddr, forged+"hello"); got != forged+"hello" {
+		t.Errorf("web backend received %q, want exactly the client's bytes", got)
+	}
+}
+
+func TestServerLogsBackendOfEachConnection(t *testing.T) {
+	logger := logging.NewLogger("gotunnel-test", "test", logging.INFO)
+	logger.SetOutput(io.Discard)
+	logger.SetRecentBuffer(100)
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: logger})
+
+	apiAddr, dbAddr := freeAddr(t), freeAddr(t)
+	backends := map[string]string{"api": echoBackend(t), "db": echoBackend(t)}
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels: []TunnelSpec{
+			{Name: "api", Protocol: ProtocolTCP, LocalAddr: apiAddr, RemoteAddr: backends["api"]},
+			{Name: "db", Protocol: ProtocolTCP, LocalAddr: dbAddr, RemoteAddr: backends["db"]},
+		},
+	})
+
+	roundTrip(t, apiAddr, "hello")
+	roundTrip(t, dbAddr, "hello")
+
+	opened := make(map[string]int)
+	for _, line := range logger.Recent() {
+		var entry logging.LogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("log entry %q: %v", line, err)
+		}
+		if entry.Message != "Tunnel connection opened" {
+			continue
+		}
+		name, _ := entry.Fields["tunnel"].(string)
+		opened[name]++
+		if entry.Fields["backend"] != backends[name] {
+			t.Errorf("%s connection logged backend %v, want %s", name, entry.Fields["backend"], backends[name])
+		}
+		if entry.Fields["remote_addr"] == "" {
+			t.Errorf("%s connection logged no remote_addr", name)
+		}
+	}
+	if opened["api"] == 0 || opened["db"] == 0 {
+		t.Errorf("connection open entries = %v, want one per tunnel", opened)
+	}
+}
+
+func TestServerReverseTunnel(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	remoteAddr := freeAddr(t)
+	startServer(t, &ServerConfig{
+		ListenAddr:     serverAddr,
+		TLSConfig:      serverTLS,
+		Logger:         testLogger(),
+		ReverseTunnels: map[string]ReverseBinding{"echo": {Listen: remoteAddr}},
+	})
+
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, Reverse: true, LocalAddr: echoBackend(t), RemoteAddr: remoteAddr}},
+	})
+
+	if got := roundTrip(t, remoteAddr, "hello"); got != "hello" {
+		t.Errorf("response = %q, want hello", got)
+	}
+}
+
+func TestServerReverseTunnelSkipsDestinationPolicy(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	remoteAddr := freeAddr(t)
+	// The listen address is outside the only allowed destination
+	policy, err := NewDestinationPolicy([]DestinationRule{{CIDR: "10.0.0.0/8"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startServer(t, &ServerConfig{
+		ListenAddr:     serverAddr,
+		TLSConfig:      serverTLS,
+		Logger:         testLogger(),
+		Policy:         policy,
+		ReverseTunnels: map[string]ReverseBinding{"echo": {Listen: remoteAddr}},
+	})
+
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, Reverse: true, LocalAddr: echoBackend(t), RemoteAddr: remoteAddr}},
+	})
+
+	if got := roundTrip(t, remoteAddr, "hello"); got != "hello" {
+		t.Errorf("response = %q, want hello", got)
+	}
+}
+
+func TestServerServesEveryTunnelOnOneSession(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr, reverseAddr := freeAddr(t), freeAddr(t)
+	server := startServer(t, &ServerConfig{
+		ListenAddr:     serverAddr,
+		TLSConfig:      serverTLS,
+		Logger:         testLogger(),
+		ReverseTunnels: map[string]ReverseBinding{"back": {Listen: reverseAddr}},
+	})
+
+	firstAddr, secondAddr := freeAddr(t), freeAddr(t)
+	backend := echoBackend(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels: []TunnelSpec{
+			{Name: "first", Protocol: ProtocolTCP, LocalAddr: firstAddr, RemoteAddr: backend},
+			{Name: "second", Protocol: ProtocolTCP, LocalAddr: secondAddr, RemoteAddr: backend},
+			{Name: "back", Protocol: ProtocolTCP, Reverse: true, LocalAddr: backend, RemoteAddr: reverseAddr},
+		},
+	})
+
+	for _, addr := range []string{firstAddr, secondAddr, reverseAddr} {
+		if got := roundTrip(t, addr, "hello"); got != "hello" {
+			t.Errorf("response via %s = %q, want hello", addr, got)
+		}
+	}
+	if got := server.ActiveConnectionCount(); got != 1 {
+		t.Errorf("client sessions = %d, want 1 for all three tunnels", got)
+	}
+}
+
+// gaugeValue returns the current value of g
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+// closingBackend listens on a loopback address and answers every
+// connection with reply, closing it straight away
+func closingBackend(t *testing.T, reply string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(reply))
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestServerRefusesBackendsThatCloseImmediately(t *testing.T) {
+	metrics.SetTunnels([]string{"closing", "short"})
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{
+		ListenAddr:         serverAddr,
+		TLSConfig:          serverTLS,
+		Logger:             testLogger(),
+		BackendCloseWindow: 200 * time.Millisecond,
+	})
+
+	closingAddr, shortAddr := freeAddr(t), freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels: []TunnelSpec{
+			{Name: "closing", Protocol: ProtocolTCP, LocalAddr: closingAddr, RemoteAddr: closingBackend(t, "")},
+			{Name: "short", Protocol: ProtocolTCP, LocalAddr: shortAddr, RemoteAddr: closingBackend(t, "bye")},
+		},
+	})
+
+	// A backend that answers before closing is a short connection, not a
+	// refusal
+	if got := roundTrip(t, shortAddr, "hello"); got != "bye" {
+		t.Fatalf("response = %q, want bye", got)
+	}
+
+	refused := metrics.Default.ConnectionErrors.WithLabelValues(ReasonBackendRefused, "closing")
+	before := counterValue(t, refused)
+	conn := dialEventually(t, closingAddr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if response, _ := io.ReadAll(conn); len(response) != 0 {
+		t.Errorf("response = %q, want the connection closed without one", response)
+	}
+	if got := counterValue(t, refused) - before; got != 1 {
+		t.Errorf("backend_refused errors = %v, want 1", got)
+	}
+	if got := counterValue(t, metrics.Default.ConnectionErrors.WithLabelValues(ReasonBackendRefused, "short")); got != 0 {
+		t.Errorf("backend_refused errors for the short backend = %v, want 0", got)
+	}
+}
+
+func TestServerIOTimeoutClosesStalledConnection(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{
+		ListenAddr: serverAddr,
+		TLSConfig:  serverTLS,
+		Logger:     testLogger(),
+		Timeouts:   Timeouts{IO: 200 * time.Millisecond},
+	})
+
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+	if got := roundTrip(t, localAddr, "up"); got != "up" {
+		t.Fatalf("response = %q, want up", got)
+	}
+
+	// The echo backend answers only after EOF, so both sides stall
+	ioTimeouts := metrics.Default.ConnectionErrors.WithLabelValues("io_timeout", "")
+	before := counterValue(t, ioTimeouts)
+	conn := dialEventually(t, localAddr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("stalled"))
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("read error = %v, want the connection closed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connection closed after %v, want about the 200ms IO timeout", elapsed)
+	}
+	if got := counterValue(t, ioTimeouts) - before; got < 1 {
+		t.Errorf("io_timeout errors = %v, want at least 1", got)
+	}
+}
+
+// setupPhaseCount returns how many setup durations were observed for phase
+func setupPhaseCount(t *testing.T, phase string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metrics.Default.ConnectionSetupDuration.WithLabelValues(phase).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestServerRecordsBackendDialPhase(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger()})
+
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+	if got := roundTrip(t, localAddr, "up"); got != "up" {
+		t.Fatalf("response = %q, want up", got)
+	}
+
+	before := setupPhaseCount(t, PhaseBackend)
+	for i := 0; i < 3; i++ {
+		if got := roundTrip(t, localAddr, "hello"); got != "hello" {
+			t.Fatalf("response = %q, want hello", got)
+		}
+	}
+	if got := setupPhaseCount(t, PhaseBackend) - before; got != 3 {
+		t.Errorf("backend dial observations = %d, want 3", got)
+	}
+}
+
+func TestServerMergesTunnelTimeouts(t *testing.T) {
+	metrics.SetTunnels([]string{"timeouts-own", "timeouts-default"})
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	server := startServer(t, &ServerConfig{
+		ListenAddr: serverAddr,
+		TLSConfig:  serverTLS,
+		Logger:     testLogger(),
+		Timeouts:   Timeouts{Dial: 7 * time.Second, Idle: time.Minute},
+	})
+
+	ownAddr, defaultAddr := freeAddr(t), freeAddr(t)
+	backend := echoBackend(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels: []TunnelSpec{
+			{Name: "timeouts-own", Protocol: ProtocolTCP, LocalAddr: ownAddr, RemoteAddr: backend, IdleTimeout: 3 * time.Second},
+			{Name: "timeouts-default", Protocol: ProtocolTCP, LocalAddr: defaultAddr, RemoteAddr: backend},
+		},
+	})
+	if got := roundTrip(t, ownAddr, "hello"); got != "hello" {
+		t.Fatalf("response = %q, want hello", got)
+	}
+
+	want := map[string]float64{"timeouts-own": 3, "timeouts-default": 60}
+	states := server.TunnelStates()
+	if len(states) != len(want) {
+		t.Fatalf("tunnel states = %+v, want %d tunnels", states, len(want))
+	}
+	for _, state := range states {
+		if got := state.Timeouts["idle"]; got != want[state.Name] {
+			t.Errorf("%s: idle timeout = %v, want %v", state.Name, got, want[state.Name])
+		}
+		if got := state.Timeouts["dial"]; got != 7 {
+			t.Errorf("%s: dial timeout = %v, want the server's 7", state.Name, got)
+		}
+		gauge := metrics.Default.TunnelTimeoutSeconds.WithLabelValues(state.Name, "idle")
+		if got := gaugeValue(t, gauge); got != want[state.Name] {
+			t.Errorf("%s: idle timeout gauge = %v, want %v", state.Name, got, want[state.Name])
+		}
+	}
+}
+
+func TestServerStatsCountsOpenStreams(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	server := startServer(t, &ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger()})
+
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+
+	waitStats := func(want ServerStats) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !reflect.DeepEqual(server.Stats(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Stats() = %+v, want %+v", server.Stats(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if got := roundTrip(t, localAddr, "hello"); got != "hello" {
+		t.Fatalf("response = %q, want hello", got)
+	}
+	waitStats(ServerStats{Sessions: 1, Streams: 0})
+
+	// The backend answers only after EOF, so these streams stay open
+	var conns []net.Conn
+	for range 2 {
+		conn := dialEventually(t, localAddr)
+		defer conn.Close()
+		conn.Write([]byte("ping"))
+		conns = append(conns, conn)
+	}
+	waitStats(ServerStats{Sessions: 1, Streams: 2})
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	waitStats(ServerStats{Sessions: 1, Streams: 0})
+}
+
+func TestServerRejectsUnboundReverseTunnels(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	intruderTLS := testClientTLS(t, serverTLS, clientTLS, "intruder")
+	serverAddr := freeAddr(t)
+	boundAddr, reservedAddr, movedAddr, strayAddr := freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t)
+	startServer(t, &ServerConfig{
+		ListenAddr: serverAddr,
+		TLSConfig:  serverTLS,
+		Logger:     testLogger(),
+		ReverseTunnels: map[string]ReverseBinding{
+			"bound":    {Listen: boundAddr},
+			"reserved": {Listen: reservedAddr, Client: "someone-else"},
+			"moved":    {Listen: freeAddr(t)},
+		},
+	})
+
+	denied := metrics.Default.TunnelRejections.WithLabelValues(metrics.OtherTunnel, ReasonReverseDenied)
+	waitDenied := func(want, before float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for counterValue(t, denied)-before < want {
+			if time.Now().After(deadline) {
+				t.Fatalf("reverse_denied rejections = %v, want %v", counterValue(t, denied)-before, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	before := counterValue(t, denied)
+	backend := echoBackend(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels: []TunnelSpec{
+			{Name: "bound", Protocol: ProtocolTCP, Reverse: true, LocalAddr: backend, RemoteAddr: boundAddr},
+			{Name: "reserved", Protocol: ProtocolTCP, Reverse: true, LocalAddr: backend, RemoteAddr: reservedAddr},
+			{Name: "moved", Protocol: ProtocolTCP, Reverse: true, LocalAddr: backend, RemoteAddr: movedAddr},
+			{Name: "stray", Protocol: ProtocolTCP, Reverse: true, LocalAddr: backend, RemoteAddr: strayAddr},
+		},
+	})
+	waitDenied(3, before)
+	if got := roundTrip(t, boundAddr, "hello"); got != "hello" {
+		t.Errorf("bound tunnel response = %q, want hello", got)
+	}
+	for _, addr := range []string{reservedAddr, movedAddr, strayAddr} {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("server listens on %s for a rejected reverse tunnel", addr)
+		}
+	}
+
+	// A second client announcing the same tunnel must not take it over
+	intruder, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.Close()
+	go func() {
+		for {
+			conn, err := intruder.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("intruder"))
+			conn.Close()
+		}
+	}()
+	before = counterValue(t, denied)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  intruderTLS,
+		Logger:     testLogger(),
+		Tunnels:    []TunnelSpec{{Name: "bound", Protocol: ProtocolTCP, Reverse: true, LocalAddr: intruder.Addr().String(), RemoteAddr: boundAddr}},
+	})
+	waitDenied(1, before)
+	if got := roundTrip(t, boundAddr, "hello"); got != "hello" {
+		t.Errorf("bound tunnel response after a second client = %q, want hello", got)
+	}
+}
+
+func TestServerReadinessTracksConnectedClients(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	healthService := health.NewHealthService()
+	server := startServer(t, &ServerConfig{
+		ListenAddr: serverAddr,
+		TLSConfig:  serverTLS,
+		Logger:     testLogger(),
+		Health:     healthService,
+		MinTunnels: 1,
+	})
+
+	if result := healthService.CheckReadiness(context.Background()); result["status"] != "unhealthy" {
+		t.Errorf("readiness without clients = %v, want unhealthy", result)
+	}
+
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+	if got := roundTrip(t, localAddr, "hello"); got != "hello" {
+		t.Fatalf("response = %q, want hello", got)
+	}
+
+	if got := server.ActiveConnectionCount(); got != 1 {
+		t.Errorf("ActiveConnectionCount() = %d, want 1", got)
+	}
+	if result := healthService.CheckReadiness(context.Background()); result["status"] != "healthy" {
+		t.Errorf("readiness with a client = %v, want healthy", result)
+	}
+}
+
+func TestServerLivenessTracksListener(t *testing.T) {
+	serverTLS, _ := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	healthService := health.NewHealthService()
+	server := startServer(t, &ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger(), Health: healthService})
+	dialEventually(t, serverAddr).Close()
+
+	if result := healthService.CheckLiveness(context.Background()); result["status"] != "healthy" {
+		t.Errorf("liveness while listening = %v, want healthy", result)
+	}
+
+	// Losing the listener outside Shutdown leaves the server unable to
+	// serve until restarted
+	server.mu.Lock()
+	server.ln.Close()
+	server.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.ListenErr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("ListenErr() stayed nil after the listener closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	result := healthService.CheckLiveness(context.Background())
+	check, _ := result["checks"].(map[string]interface{})["tunnel_listener"].(map[string]interface{})
+	if result["status"] != "unhealthy" || check["status"] != "unhealthy" {
+		t.Errorf("liveness after the listener closed = %v, want tunnel_listener unhealthy", result)
+	}
+	if result := healthService.CheckReadiness(context.Background()); result["status"] != "healthy" {
+		t.Errorf("readiness after the listener closed = %v, want healthy", result)
+	}
+
+	// Shutdown closing the listener is not a failure
+	other := startServer(t, &ServerConfig{ListenAddr: freeAddr(t), TLSConfig: serverTLS, Logger: testLogger()})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	other.Shutdown(ctx)
+	if err := other.ListenErr(); err != nil {
+		t.Errorf("ListenErr() after Shutdown = %v, want nil", err)
+	}
+}
+
+func TestServerWarmupGatesConnections(t *testing.T) {
+	for _, hold := range []bool{false, true} {
+		serverTLS, clientTLS := testTLSConfigs(t)
+		clientTLS.ServerName = "127.0.0.1"
+		serverAddr := freeAddr(t)
+		warmup := NewWarmup(time.Hour, hold)
+		startServer(t, &ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger(), Warmup: warmup})
+
+		conn := tls.Client(dialEventually(t, serverAddr), clientTLS)
+		handshake := make(chan error, 1)
+		go func() { handshake <- conn.Handshake() }()
+		select {
+		case err := <-handshake:
+			if hold || err == nil {
+				t.Errorf("hold=%v: handshake during warmup returned %v", hold, err)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if !hold {
+				t.Error("connection during warmup was held, want it rejected")
+			}
+		}
+
+		warmup.Complete()
+		if hold {
+			if err := <-handshake; err != nil {
+				t.Errorf("held handshake after warmup: %v", err)
+			}
+		}
+		conn.Close()
+
+		after := tls.Client(dialEventually(t, serverAddr), clientTLS)
+		if err := after.Handshake(); err != nil {
+			t.Errorf("hold=%v: handshake after warmup: %v", hold, err)
+		}
+		after.Close()
+	}
+}
+
+func TestServerDeniesDestinationsWithoutPolicy(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	server := NewServer(&ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger()})
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.StartContext(ctx)
+	t.Cleanup(func() {
+		cancel()
+		server.Shutdown(context.Background())
+	})
+
+	denied := metrics.Default.ConnectionErrors.WithLabelValues("destination_denied", metrics.OtherTunnel)
+	before := counterValue(t, denied)
+	localAddr, reverseAddr := freeAddr(t), freeAddr(t)
+	backend := echoBackend(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels: []TunnelSpec{
+			{Name: "forward", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: backend},
+			{Name: "reverse", Protocol: ProtocolTCP, Reverse: true, LocalAddr: backend, RemoteAddr: reverseAddr},
+		},
+	})
+
+	// The reverse tunnel isn't checked against destinations, but has no
+	// listen address configured on the server
+	deadline := time.Now().Add(5 * time.Second)
+	for counterValue(t, denied)-before < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("destination_denied errors = %v, want the forward tunnel denied", counterValue(t, denied)-before)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	conn := dialEventually(t, localAddr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	if response, _ := io.ReadAll(conn); len(response) != 0 {
+		t.Errorf("denied forward tunnel got response %q", response)
+	}
+	if conn, err := net.Dial("tcp", reverseAddr); err == nil {
+		conn.Close()
+		t.Error("server listens for an unconfigured reverse tunnel")
+	}
+}
+
+func TestServerRejectsDeniedIdentity(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{
+		ListenAddr:   serverAddr,
+		TLSConfig:    serverTLS,
+		Logger:       testLogger(),
+		IdentityGate: crypto.NewIdentityGate(nil, []string{"gotunnel-test"}, nil),
+	})
+
+	conn := dialEventually(t, serverAddr)
+	tlsConn := tls.Client(conn, &tls.Config{
+		Certificates: clientTLS.Certificates,
+		RootCAs:      clientTLS.RootCAs,
+		ServerName:   "127.0.0.1",
+	})
+	defer tlsConn.Close()
+	tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	if _, err := tlsConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read error = %v, want io.EOF from the server closing a denied client", err)
+	}
+}
+
+func TestServerLimitsHandshakesPerIP(t *testing.T) {
+	serverTLS, _ := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{
+		ListenAddr: serverAddr,
+		TLSConfig:  serverTLS,
+		Logger:     testLogger(),
+		Handshakes: NewHandshakeLimiter(0, 1),
+	})
+
+	// A client that never sends its hello holds the only slot
+	stalled := dialEventually(t, serverAddr)
+	defer stalled.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	throttled := dialEventually(t, serverAddr)
+	defer throttled.Close()
+	throttled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := throttled.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read error = %v, want io.EOF from the server closing a throttled connection", err)
+	}
+}
+
+func TestPriorityAdmissionReservesOnlyUnderContention(t *testing.T) {
+	admission := NewPriorityAdmission(4, 1)
+
+	// Without higher-priority demand, low priority may fill every slot
+	for i := 0; i < 4; i++ {
+		if !admission.Admit(PriorityLow) {
+			t.Fatalf("low-priority connection %d refused with no contention", i+1)
+		}
+	}
+	if admission.Admit(PriorityHigh) {
+		t.Fatal("connection admitted over capacity")
+	}
+	for i := 0; i < 4; i++ {
+		admission.Release(PriorityLow)
+	}
+
+	// With a high connection open, low is held to capacity - 2*reserve
+	if !admission.Admit(PriorityHigh) {
+		t.Fatal("high-priority connection refused")
+	}
+	if !admission.Admit(PriorityLow) {
+		t.Fatal("low-priority connection refused below its ceiling")
+	}
+	if admission.Admit(PriorityLow) {
+		t.Error("low-priority connection admitted above its ceiling under contention")
+	}
+	if !admission.Admit(PriorityNormal) {
+		t.Error("normal-priority connection refused below its ceiling")
+	}
+	if !admission.Admit(PriorityHigh) {
+		t.Error("high-priority connection refused below capacity")
+	}
+	if got := admission.Active(); got != 4 {
+		t.Errorf("Active() = %d, want 4", got)
+	}
+}
+
+func TestServerLimitsConnectionsPerTunnel(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	server := startServer(t, &ServerConfig{
+		ListenAddr:   serverAddr,
+		TLSConfig:    serverTLS,
+		Logger:       testLogger(),
+		TunnelLimits: NewTunnelLimiter(map[string]int{"limited": 1}),
+	})
+
+	backend := echoBackend(t)
+	limitedAddr, otherAddr := freeAddr(t), freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels: []TunnelSpec{
+			{Name: "limited", Protocol: ProtocolTCP, LocalAddr: limitedAddr, RemoteAddr: backend},
+			{Name: "other", Protocol: ProtocolTCP, LocalAddr: otherAddr, RemoteAddr: backend},
+		},
+	})
+	roundTrip(t, limitedAddr, "up")
+
+	// The echo backend holds a connection open until it half-closes
+	held := dialEventually(t, limitedAddr)
+	defer held.Close()
+	held.Write([]byte("held"))
+	time.Sleep(100 * time.Millisecond)
+
+	excess := dialEventually(t, limitedAddr)
+	defer excess.Close()
+	excess.SetDeadline(time.Now().Add(5 * time.Second))
+	excess.Write([]byte("excess"))
+	excess.(*net.TCPConn).CloseWrite()
+	if response, _ := io.ReadAll(excess); len(response) != 0 {
+		t.Fatalf("connection over the tunnel limit got response %q", response)
+	}
+	for _, state := range server.TunnelStates() {
+		if state.Name == "limited" && state.ActiveConnections != 1 {
+			t.Errorf("limited tunnel active connections = %d, want only the admitted one", state.ActiveConnections)
+		}
+	}
+	if got := server.Stats().TunnelConnections; !reflect.DeepEqual(got, map[string]int{"limited": 1}) {
+		t.Errorf("Stats().TunnelConnections = %v, want the admitted limited connection", got)
+	}
+
+	if got := roundTrip(t, otherAddr, "hello"); got != "hello" {
+		t.Errorf("other tunnel response = %q, want hello", got)
+	}
+
+	// Released tunnels drop out of the counts
+	held.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Stats().TunnelConnections) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Stats().TunnelConnections = %v after closing, want none", server.Stats().TunnelConnections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerAnswersTunnelInMaintenance(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	maintenance := NewMaintenanceMode()
+	server := startServer(t, &ServerConfig{
+		ListenAddr:  serverAddr,
+		TLSConfig:   serverTLS,
+		Logger:      testLogger(),
+		Maintenance: maintenance,
+	})
+
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+	roundTrip(t, localAddr, "up")
+
+	maintenance.Enable(MaintenanceResponse{Tunnel: "echo", Message: "back soon"})
+	if got := roundTrip(t, localAddr, "hello"); got != "back soon\r\n" {
+		t.Errorf("response = %q, want the maintenance message", got)
+	}
+	if states := server.TunnelStates(); len(states) != 1 || states[0].Enabled {
+		t.Errorf("TunnelStates() = %+v, want echo disabled", states)
+	}
+
+	maintenance.Disable("echo")
+	if got := roundTrip(t, localAddr, "hello"); got != "hello" {
+		t.Errorf("response = %q, want hello after maintenance", got)
+	}
+}
+
+func TestServerShutdownBoundsDrain(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	server := NewServer(&ServerConfig{
+		ListenAddr:   serverAddr,
+		TLSConfig:    serverTLS,
+		Logger:       testLogger(),
+		Policy:       loopbackPolicy(t),
+		DrainTimeout: 100 * time.Millisecond,
+	})
+	go server.StartContext(context.Background())
+
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+	roundTrip(t, localAddr, "up")
+
+	// The echo backend holds a connection open until it half-closes
+	held := dialEventually(t, localAddr)
+	defer held.Close()
+	held.Write([]byte("held"))
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := server.Shutdown(ctx); !errors.Is(err, ErrDrainTimeout) {
+		t.Errorf("Shutdown error = %v, want ErrDrainTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %v with a 100ms drain timeout", elapsed)
+	}
+}
+
+func TestServerShutdownBeforeStart(t *testing.T) {
+	serverTLS, _ := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	server := NewServer(&ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger()})
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if err := server.StartContext(context.Background()); err != nil {
+		t.Errorf("StartContext() after Shutdown = %v, want nil", err)
+	}
+	if conn, err := net.Dial("tcp", serverAddr); err == nil {
+		conn.Close()
+		t.Error("server listening after Shutdown")
+	}
+}
+
+func TestServeListenerCountsHandlersBeforeReturning(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	started := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeListener(ctx, ln, &wg, func(conn net.Conn) {
+			defer conn.Close()
+			close(started)
+			<-release
+		})
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-started
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("ServeListener() = %v", err)
+	}
+	waited := make(chan struct{})
+	go func() { wg.Wait(); close(waited) }()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while a handler was still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-waited
+}
+
+func TestServerRequiresAuthToken(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{
+		ListenAddr:  serverAddr,
+		TLSConfig:   serverTLS,
+		Logger:      testLogger(),
+		TokenSource: NewStaticTokens([]string{"secret"}),
+	})
+
+	backend := echoBackend(t)
+	validAddr, invalidAddr := freeAddr(t), freeAddr(t)
+	for _, c := range []struct{ token, addr string }{{"secret", validAddr}, {"wrong", invalidAddr}} {
+		startClient(t, &ClientConfig{
+			ServerAddr: serverAddr,
+			TLSConfig:  clientTLS,
+			Logger:     testLogger(),
+			AuthToken:  c.token,
+			Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+			Tunnels:    []TunnelSpec{{Name: "echo-" + c.token, Protocol: ProtocolTCP, LocalAddr: c.addr, RemoteAddr: backend}},
+		})
+	}
+
+	if got := roundTrip(t, validAddr, "hello"); got != "hello" {
+		t.Errorf("response = %q, want hello with a valid token", got)
+	}
+
+	conn := dialEventually(t, invalidAddr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	if response, _ := io.ReadAll(conn); len(response) != 0 {
+		t.Errorf("client with an invalid token got response %q", response)
+	}
+}
+
+func TestServerTimesOutStalledClients(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{
+		ListenAddr: serverAddr,
+		TLSConfig:  serverTLS,
+		Logger:     testLogger(),
+		Timeouts:   Timeouts{Handshake: 100 * time.Millisecond, Read: 100 * time.Millisecond},
+	})
+
+	// A client that never sends its hello is dropped at the handshake timeout
+	stalled := dialEventually(t, serverAddr)
+	defer stalled.Close()
+	stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stalled.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read error = %v, want io.EOF from the handshake timeout", err)
+	}
+
+	// A session that sends nothing after the handshake hits the read timeout
+	clientTLS.ServerName = "127.0.0.1"
+	conn := tls.Client(dialEventually(t, serverAddr), clientTLS)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read error = %v, want io.EOF from the read timeout", err)
+	}
+}
+
+func TestClientKeepaliveHoldsSessionOpen(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	server := startServer(t, &ServerConfig{
+		ListenAddr: serverAddr,
+		TLSConfig:  serverTLS,
+		Logger:     testLogger(),
+		Timeouts:   Timeouts{Read: 200 * time.Millisecond},
+	})
+	dialEventually(t, serverAddr).Close()
+
+	// Without reconnects, a session lost to the read timeout stops the tunnel
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Keepalive:  20 * time.Millisecond,
+		Reconnect:  ReconnectConfig{Enabled: false},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+	roundTrip(t, localAddr, "up")
+
+	time.Sleep(500 * time.Millisecond)
+	if got := roundTrip(t, localAddr, "hello"); got != "hello" {
+		t.Errorf("response = %q, want hello after idling past the read timeout", got)
+	}
+	if states := server.TunnelStates(); len(states) != 1 {
+		t.Errorf("TunnelStates() = %+v, want the session still open", states)
+	}
+}
+
+func TestMemoryGuardShedsAboveThreshold(t *testing.T) {
+	var usage atomic.Uint64
+	guard := NewMemoryGuard(100, usage.Load, testLogger())
+	ctx := context.Background()
+
+	usage.Store(99)
+	guard.Sample(ctx)
+	if !guard.Allow() {
+		t.Fatal("connection shed below the threshold")
+	}
+
+	usage.Store(100)
+	guard.Sample(ctx)
+	if guard.Allow() {
+		t.Fatal("connection allowed at the threshold")
+	}
+
+	usage.Store(50)
+	guard.Sample(ctx)
+	if !guard.Allow() || guard.Shedding() {
+		t.Fatal("still shedding after usage recovered")
+	}
+}
+
+func TestMemoryGuardRunDefaultsInterval(t *testing.T) {
+	var usage atomic.Uint64
+	usage.Store(200)
+	guard := NewMemoryGuard(100, usage.Load, testLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.Run(ctx, 0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !guard.Shedding() {
+		if time.Now().After(deadline) {
+			t.Fatal("Run with a zero interval never sampled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerShedsConnectionsUnderMemoryPressure(t *testing.T) {
+	serverTLS, _ := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	var usage atomic.Uint64
+	usage.Store(200)
+	guard := NewMemoryGuard(100, usage.Load, testLogger())
+	guard.Sample(context.Background())
+	startServer(t, &ServerConfig{
+		ListenAddr:  serverAddr,
+		TLSConfig:   serverTLS,
+		Logger:      testLogger(),
+		MemoryGuard: guard,
+	})
+
+	conn := dialEventually(t, serverAddr)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read error = %v, want io.EOF from the server shedding the connection", err)
+	}
+}
+
+func TestServerCompressedTunnel(t *testing.T) {
+	for _, codec := range []Codec{CodecGzip, CodecZstd} {
+		t.Run(string(codec), func(t *testing.T) {
+			name := "compressed-" + string(codec)
+			metrics.SetTunnels([]string{name})
+			serverTLS, clientTLS := testTLSConfigs(t)
+			serverAddr := freeAddr(t)
+			startServer(t, &ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger()})
+
+			localAddr := freeAddr(t)
+			startClient(t, &ClientConfig{
+				ServerAddr: serverAddr,
+				TLSConfig:  clientTLS,
+				Logger:     testLogger(),
+				Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+				Tunnels: []TunnelSpec{{
+					Name:        name,
+					Protocol:    ProtocolTCP,
+					LocalAddr:   localAddr,
+					RemoteAddr:  echoBackend(t),
+					Compression: codec,
+				}},
+			})
+
+			request := strings.Repeat("compressible ", 10000)
+			if got := roundTrip(t, localAddr, request); got != request {
+				t.Errorf("response of %d bytes differs from the %d byte request", len(got), len(request))
+			}
+			wire := counterValue(t, metrics.Default.WireBytes.WithLabelValues("in", name))
+			payload := counterValue(t, metrics.Default.PayloadBytes.WithLabelValues("in", name))
+			if payload == 0 || wire >= payload/10 {
+				t.Errorf("sent %v wire bytes for %v payload bytes, want compression", wire, payload)
+			}
+		})
+	}
+}
+
+// counterValue returns the current value of c
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// spanRecorder is a tracing exporter that keeps every span it is sent
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*tracing.Span
+}
+
+func (r *spanRecorder) ExportSpans(_ context.Context, spans []*tracing.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+// connSpans returns the recorded tunnel.connection spans of tunnel
+func (r *spanRecorder) connSpans(tunnel string) []*tracing.Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var spans []*tracing.Span
+	for _, span := range r.spans {
+		if span.Name == "tunnel.connection" && span.Attributes()["tunnel"] == tunnel {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func TestServerTracesForwardedConnections(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger()})
+
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "traced", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+	roundTrip(t, localAddr, "up")
+
+	recorder := &spanRecorder{}
+	shutdown := tracing.SetExporter(recorder, testLogger())
+	defer shutdown(context.Background())
+	roundTrip(t, localAddr, "hello")
+
+	// The client and the server each trace their end of the connection.
+	// Shutting the exporter down flushes finished spans, so it is
+	// reinstalled while waiting for a span still finishing.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		shutdown(context.Background())
+		spans := recorder.connSpans("traced")
+		if len(spans) == 2 {
+			for _, span := range spans {
+				attrs := span.Attributes()
+				if attrs["bytes_in"] != int64(5) || attrs["bytes_out"] != int64(5) || attrs["result"] != "success" {
+					t.Errorf("span attributes = %v, want 5 bytes each way and success", attrs)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recorded %d tunnel.connection spans, want 2", len(spans))
+		}
+		shutdown = tracing.SetExporter(recorder, testLogger())
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,188 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSessionUnknown is returned when resuming a session that doesn't exist or has expired
+	ErrSessionUnknown = errors.New("unknown or expired session")
+	// ErrSessionIdentity is returned when a session is resumed by a different client identity
+	ErrSessionIdentity = errors.New("session belongs to a different client identity")
+	// ErrSessionAttached is returned when resuming a session whose connection is still up
+	ErrSessionAttached = errors.New("session is still attached to a connection")
+)
+
+// Resume refusal status bytes, answering FrameSessionResume
+const (
+	resumeRefusedAttached byte = 1
+	resumeRefusedUnknown  byte = 2
+)
+
+// Session is a client session that outlives any single underlying connection,
+// so logical streams survive the client changing networks.
+type Session struct {
+	Identity string
+	Created  time.Time
+
+	mux *Mux
+}
+
+// SessionStore tracks resumable sessions so a client can resume one on a
+// new connection while its Mux waits out the resume window. Sessions are
+// looked up by a hash of their token so the token itself is never kept in
+// memory.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	now      func() time.Time
+}
+
+// NewSessionStore creates an empty session store
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*Session),
+		now:      time.Now,
+	}
+}
+
+// Create registers mux as the session of a client identity and returns
+// the token the client presents to resume it
+func (s *SessionStore) Create(identity string, mux *Mux) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate session token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[tokenKey(token)] = &Session{
+		Identity: identity,
+		Created:  s.now(),
+		mux:      mux,
+	}
+	return token, nil
+}
+
+// Resume looks up a session to continue on a new connection. The resuming
+// connection must present the token and the same certificate identity as
+// the original, and the session must have lost its connection.
+func (s *SessionStore) Resume(token, identity string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := tokenKey(token)
+	session, ok := s.sessions[key]
+	if ok {
+		select {
+		case <-session.mux.Done():
+			delete(s.sessions, key)
+			ok = false
+		default:
+		}
+	}
+	if !ok {
+		return nil, ErrSessionUnknown
+	}
+	if session.Identity != identity {
+		return nil, ErrSessionIdentity
+	}
+	if !session.mux.Detached() {
+		return nil, ErrSessionAttached
+	}
+	return session, nil
+}
+
+// Close removes a session once it has ended
+func (s *SessionStore) Close(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, tokenKey(token))
+}
+
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return string(sum[:])
+}
+
+// issueToken makes mux resumable under token and sends the token to the
+// client
+func (m *Mux) issueToken(token string) error {
+	m.setToken(token)
+	return m.fw.WriteFrame(Frame{Type: FrameSessionResume, Payload: []byte(token)})
+}
+
+// resumeRequest builds the FrameSessionResume a client sends to resume
+// the session token, having received received frames on it
+func resumeRequest(token string, received uint64) Frame {
+	payload := binary.BigEndian.AppendUint64(nil, received)
+	return Frame{Type: FrameSessionResume, Payload: append(payload, token...)}
+}
+
+// parseResumeRequest decodes a client's resume request
+func parseResumeRequest(f Frame) (string, uint64, error) {
+	if f.Type != FrameSessionResume || len(f.Payload) <= 8 {
+		return "", 0, fmt.Errorf("invalid session resume request")
+	}
+	return string(f.Payload[8:]), binary.BigEndian.Uint64(f.Payload), nil
+}
+
+// resumeAccepted builds the server's answer to a resume request it
+// accepted, having received received frames on the session
+func resumeAccepted(received uint64) Frame {
+	return Frame{Type: FrameSessionResume, Payload: binary.BigEndian.AppendUint64(nil, received)}
+}
+
+// resumeRefused builds the server's answer to a resume request it refused
+// with err
+func resumeRefused(err error) Frame {
+	status := resumeRefusedUnknown
+	if errors.Is(err, ErrSessionAttached) {
+		status = resumeRefusedAttached
+	}
+	return Frame{Type: FrameSessionResume, Payload: []byte{status}}
+}
+
+// parseResumeReply decodes the server's answer to a resume request,
+// returning how many frames it received on the session
+func parseResumeReply(f Frame) (uint64, error) {
+	switch {
+	case f.Type != FrameSessionResume:
+		return 0, fmt.Errorf("unexpected frame type %d answering session resume", f.Type)
+	case len(f.Payload) == 8:
+		return binary.BigEndian.Uint64(f.Payload), nil
+	case len(f.Payload) == 1 && f.Payload[0] == resumeRefusedAttached:
+		return 0, ErrSessionAttached
+	default:
+		return 0, ErrSessionUnknown
+	}
+}
+
+// unreadFrame returns conn with f put back in front of what is left to
+// read, for a first frame read to decide how to serve the connection
+func unreadFrame(conn net.Conn, f Frame) net.Conn {
+	var buf bytes.Buffer
+	NewFrameWriter(&buf).WriteFrame(f)
+	return &prefixedConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+}
+
+// prefixedConn reads from r instead of the connection
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,199 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionStoreResumesOnlyDetachedSessions(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	mux := NewMux(serverConn, false, MuxConfig{ResumeWindow: time.Minute})
+	defer mux.Close()
+	store := NewSessionStore()
+	token, err := store.Create("edge-1", mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.setToken(token)
+
+	if _, err := store.Resume(token, "edge-1"); !errors.Is(err, ErrSessionAttached) {
+		t.Fatalf("resuming a live session: err = %v, want ErrSessionAttached", err)
+	}
+
+	clientConn.Close()
+	deadline := time.Now().Add(time.Second)
+	for !mux.Detached() {
+		if time.Now().After(deadline) {
+			t.Fatal("session never detached from its lost connection")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := store.Resume(token, "edge-2"); !errors.Is(err, ErrSessionIdentity) {
+		t.Errorf("resuming as another identity: err = %v, want ErrSessionIdentity", err)
+	}
+	if _, err := store.Resume("bogus", "edge-1"); !errors.Is(err, ErrSessionUnknown) {
+		t.Errorf("resuming an unknown token: err = %v, want ErrSessionUnknown", err)
+	}
+	session, err := store.Resume(token, "edge-1")
+	if err != nil {
+		t.Fatalf("resuming a detached session: %v", err)
+	}
+
+	newClient, newServer := net.Pipe()
+	defer newClient.Close()
+	answered := make(chan Frame, 1)
+	go func() {
+		if f, err := ReadFrame(newClient); err == nil {
+			answered <- f
+		}
+	}()
+	if err := session.mux.resume(newServer, 0, true); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if received, err := parseResumeReply(<-answered); err != nil || received != 0 {
+		t.Errorf("resume answer = %d, %v, want 0 frames received", received, err)
+	}
+	if _, err := store.Resume(token, "edge-1"); !errors.Is(err, ErrSessionAttached) {
+		t.Errorf("resuming a resumed session: err = %v, want ErrSessionAttached", err)
+	}
+
+	store.Close(token)
+	if _, err := store.Resume(token, "edge-1"); !errors.Is(err, ErrSessionUnknown) {
+		t.Errorf("resuming a closed session: err = %v, want ErrSessionUnknown", err)
+	}
+}
+
+// severableProxy relays TCP connections to a target until sever cuts every
+// connection relayed so far, like a client changing networks
+type severableProxy struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+}
+
+func startSeverableProxy(t *testing.T, target string) *severableProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &severableProxy{ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		p.sever()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.accepted++
+			p.mu.Unlock()
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+	return p
+}
+
+func (p *severableProxy) sever() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *severableProxy) connections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accepted
+}
+
+// streamEchoBackend echoes whatever each connection sends as it arrives
+func streamEchoBackend(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestClientResumesSessionKeepingStreams(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	muxConfig := MuxConfig{ResumeWindow: 5 * time.Second}
+	server := startServer(t, &ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger(), Mux: muxConfig})
+	proxy := startSeverableProxy(t, serverAddr)
+
+	localAddr := freeAddr(t)
+	startClient(t, &ClientConfig{
+		ServerAddr: proxy.ln.Addr().String(),
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Mux:        muxConfig,
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: streamEchoBackend(t)}},
+	})
+	if got := roundTrip(t, localAddr, "hello"); got != "hello" {
+		t.Fatalf("response = %q, want hello", got)
+	}
+
+	conn := dialEventually(t, localAddr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	exchange := func(message string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatalf("write %q: %v", message, err)
+		}
+		reply := make([]byte, len(message))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("read echo of %q: %v", message, err)
+		}
+		if string(reply) != message {
+			t.Fatalf("echo = %q, want %q", reply, message)
+		}
+	}
+	exchange("before")
+
+	proxy.sever()
+	exchange("after the connection was lost")
+	exchange("and once more")
+
+	if got := proxy.connections(); got != 2 {
+		t.Errorf("connections to the server = %d, want the original and one resume", got)
+	}
+	if got := server.ActiveConnectionCount(); got != 1 {
+		t.Errorf("server sessions = %d, want the one resumed session", got)
+	}
+}
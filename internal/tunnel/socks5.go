@@ -0,0 +1,308 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"gotunnel-pro/internal/logging"
+	"gotunnel-pro/internal/metrics"
+)
+
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoMatch  = 0xFF
+	socks5CmdConnect   = 0x01
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+
+	socks5ReplySuccess        = 0x00
+	socks5ReplyFailure        = 0x01
+	socks5ReplyNotAllowed     = 0x02
+	socks5ReplyHostUnreach    = 0x04
+	socks5ReplyCmdUnsupported = 0x07
+)
+
+// ErrSOCKSAuth is returned when a SOCKS client fails authentication
+var ErrSOCKSAuth = errors.New("SOCKS5 authentication failed")
+
+// SOCKS5Handshake performs the proxy side of a SOCKS5 handshake on conn and
+// returns the CONNECT target as host:port. With users set, clients must
+// authenticate with one of the username/password pairs; otherwise no
+// authentication is offered.
+func SOCKS5Handshake(conn net.Conn, users map[string]string) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS greeting: %w", err)
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS methods: %w", err)
+	}
+
+	want := byte(socks5AuthNone)
+	if len(users) > 0 {
+		want = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5AuthNoMatch})
+		return "", fmt.Errorf("%w: no acceptable method offered", ErrSOCKSAuth)
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return "", fmt.Errorf("failed to write SOCKS method: %w", err)
+	}
+	if want == socks5AuthPassword {
+		if err := socks5Authenticate(conn, users); err != nil {
+			return "", err
+		}
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS request: %w", err)
+	}
+	if req[1] != socks5CmdConnect {
+		writeSOCKS5Reply(conn, socks5ReplyCmdUnsupported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("failed to read SOCKS address: %w", err)
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return "", fmt.Errorf("failed to read SOCKS address: %w", err)
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", fmt.Errorf("failed to read SOCKS address: %w", err)
+		}
+		host = string(name)
+	default:
+		writeSOCKS5Reply(conn, socks5ReplyFailure)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", req[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS port: %w", err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socks5Authenticate runs RFC 1929 username/password authentication
+func socks5Authenticate(conn net.Conn, users map[string]string) error {
+	readField := func() ([]byte, error) {
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		field := make([]byte, length[0])
+		_, err := io.ReadFull(conn, field)
+		return field, err
+	}
+
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return fmt.Errorf("failed to read SOCKS credentials: %w", err)
+	}
+	username, err := readField()
+	if err != nil {
+		return fmt.Errorf("failed to read SOCKS credentials: %w", err)
+	}
+	password, err := readField()
+	if err != nil {
+		return fmt.Errorf("failed to read SOCKS credentials: %w", err)
+	}
+
+	expected, ok := users[string(username)]
+	if !ok || subtle.ConstantTimeCompare(password, []byte(expected)) != 1 {
+		conn.Write([]byte{0x01, 0x01})
+		return ErrSOCKSAuth
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return err
+}
+
+// SOCKS5Reply answers the CONNECT request with the outcome of reaching the
+// target through the tunnel
+func SOCKS5Reply(conn net.Conn, err error) error {
+	switch {
+	case err == nil:
+		return writeSOCKS5Reply(conn, socks5ReplySuccess)
+	case errors.Is(err, ErrDestinationDenied):
+		return writeSOCKS5Reply(conn, socks5ReplyNotAllowed)
+	default:
+		return writeSOCKS5Reply(conn, socks5ReplyHostUnreach)
+	}
+}
+
+func writeSOCKS5Reply(conn net.Conn, code byte) error {
+	// The bound address isn't meaningful through a tunnel, so it is zero
+	_, err := conn.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Dial results sent by the server as the first byte of a stream opened
+// with OpenStreamTo
+const (
+	dialOK byte = iota
+	dialDenied
+	dialFailed
+)
+
+// WriteDialResult tells the client whether the server reached the target
+func WriteDialResult(w io.Writer, err error) error {
+	result := dialOK
+	switch {
+	case errors.Is(err, ErrDestinationDenied):
+		result = dialDenied
+	case err != nil:
+		result = dialFailed
+	}
+	_, werr := w.Write([]byte{result})
+	return werr
+}
+
+// ReadDialResult reads the server's dial result for a stream opened with
+// OpenStreamTo
+func ReadDialResult(r io.Reader, target string) error {
+	var result [1]byte
+	if _, err := io.ReadFull(r, result[:]); err != nil {
+		return fmt.Errorf("failed to read dial result: %w", err)
+	}
+	switch result[0] {
+	case dialOK:
+		return nil
+	case dialDenied:
+		return fmt.Errorf("%w: %s", ErrDestinationDenied, target)
+	default:
+		return fmt.Errorf("server failed to reach %s", target)
+	}
+}
+
+// ServeSOCKS5 handles one local SOCKS5 connection on the client: it runs
+// the handshake, asks the server to connect to the requested target over
+// a new stream and relays bytes once the server has connected
+func ServeSOCKS5(ctx context.Context, logger *logging.Logger, spec TunnelSpec, conn net.Conn, mux *Mux) {
+	defer conn.Close()
+	ctx, span := startConnSpan(ctx, spec.Name, conn)
+	var bytesIn, bytesOut int64
+	var err error
+	defer func() { finishConnSpan(span, bytesIn, bytesOut, err) }()
+
+	target, err := SOCKS5Handshake(conn, spec.SOCKSUsers)
+	if err != nil {
+		metrics.RecordTunnelConnectionError(spec.Name, "socks_handshake")
+		logger.Warn(ctx, "SOCKS5 handshake failed", map[string]interface{}{
+			"tunnel":      spec.Name,
+			"remote_addr": conn.RemoteAddr().String(),
+			"error":       err.Error(),
+		})
+		return
+	}
+
+	stream, err := mux.OpenStreamTo(target)
+	if err == nil {
+		err = ReadDialResult(stream, target)
+		if err != nil {
+			stream.Close()
+		}
+	}
+	if err != nil {
+		SOCKS5Reply(conn, err)
+		logger.Warn(ctx, "SOCKS5 connect failed", map[string]interface{}{
+			"tunnel": spec.Name,
+			"target": target,
+			"error":  err.Error(),
+		})
+		return
+	}
+	defer stream.Close()
+
+	span.SetAttribute("target", target)
+	if err = SOCKS5Reply(conn, nil); err != nil {
+		return
+	}
+	bytesIn, bytesOut = pipeStream(conn, stream)
+}
+
+// ServeSOCKS5Stream handles a stream opened by a client's SOCKS5 proxy on
+// the server: it checks the requested target against policy, which denies
+// every target when nil, dials it with dial, reports the result and relays
+// bytes
+func ServeSOCKS5Stream(ctx context.Context, tunnel string, stream *MuxStream, policy *DestinationPolicy, dial DialFunc) {
+	defer stream.Close()
+
+	var backend net.Conn
+	err := func() error {
+		if err := policy.Check(ctx, tunnel, stream.Target()); err != nil {
+			return err
+		}
+		var err error
+		backend, err = TraceDial(tunnel, dial)(ctx, "tcp", stream.Target())
+		return err
+	}()
+	if err != nil && !errors.Is(err, ErrDestinationDenied) {
+		metrics.RecordTunnelConnectionError(tunnel, "backend_dial")
+	}
+	if werr := WriteDialResult(stream, err); werr != nil || err != nil {
+		if backend != nil {
+			backend.Close()
+		}
+		return
+	}
+	defer backend.Close()
+
+	pipeStream(backend, stream)
+}
+
+// pipeStream copies between conn and stream in both directions,
+// half-closing each side as the other finishes. It returns the bytes copied
+// from conn to stream and from stream to conn.
+func pipeStream(conn, stream net.Conn) (int64, int64) {
+	var wg sync.WaitGroup
+	var toStream, toConn int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		toStream, _ = io.Copy(stream, conn)
+		closeWrite(stream)
+	}()
+	go func() {
+		defer wg.Done()
+		toConn, _ = io.Copy(conn, stream)
+		if tcp, ok := conn.(interface{ CloseWrite() error }); ok {
+			tcp.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+	wg.Wait()
+	return toStream, toConn
+}
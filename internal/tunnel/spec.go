@@ -0,0 +1,190 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Tunnel protocols
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+	// ProtocolSOCKS5 makes the client's local end a SOCKS5 proxy; the
+	// server dials whatever target each connection requests, so the
+	// tunnel has no RemoteAddr
+	ProtocolSOCKS5 = "socks5"
+)
+
+// TunnelSpec defines one service forwarded through the client's mTLS
+// connection. LocalAddr is the client's end of the tunnel and RemoteAddr
+// the server's.
+type TunnelSpec struct {
+	Name        string        `yaml:"name" json:"name"`
+	LocalAddr   string        `yaml:"local_addr" json:"local_addr"`
+	RemoteAddr  string        `yaml:"remote_addr" json:"remote_addr"`
+	Protocol    string        `yaml:"protocol" json:"protocol"`
+	IdleTimeout time.Duration `yaml:"idle_timeout" json:"idle_timeout"`
+	// MaxConns caps concurrent connections on the tunnel. Zero is unlimited.
+	MaxConns int `yaml:"max_conns" json:"max_conns"`
+	// MaxConnsPolicy is what happens to connections over MaxConns; the
+	// default is MaxConnsReject
+	MaxConnsPolicy MaxConnsPolicy `yaml:"max_conns_policy" json:"max_conns_policy"`
+	// MaxConnsQueueTimeout bounds the wait for a slot under MaxConnsQueue
+	MaxConnsQueueTimeout time.Duration `yaml:"max_conns_queue_timeout" json:"max_conns_queue_timeout"`
+	// RateLimitBytesPerSec caps throughput in each direction independently.
+	// Zero is unlimited.
+	RateLimitBytesPerSec int64 `yaml:"rate_limit_bytes_per_sec" json:"rate_limit_bytes_per_sec"`
+	// Compression compresses the tunnel's data if the peer agrees at stream
+	// setup. Empty or CodecNone disables it.
+	Compression Codec `yaml:"compression" json:"compression"`
+	// SOCKSUsers requires SOCKS5 clients to authenticate with one of these
+	// username/password pairs. Empty allows unauthenticated clients.
+	SOCKSUsers map[string]string `yaml:"socks_users" json:"socks_users"`
+	// Reverse flips the tunnel: the server listens on RemoteAddr and the
+	// client dials LocalAddr for each connection. Only TCP is supported.
+	Reverse bool `yaml:"reverse" json:"reverse"`
+	// ReverseQueueTimeout is how long the server holds connections to a
+	// reverse tunnel while the client is disconnected. Zero refuses them.
+	ReverseQueueTimeout time.Duration `yaml:"reverse_queue_timeout" json:"reverse_queue_timeout"`
+	// PoolBackend lets the server reuse idle backend connections across
+	// streams. Only enable it for protocols that are idle between messages,
+	// like HTTP/1.1 keep-alive; never for opaque byte streams.
+	PoolBackend bool `yaml:"pool_backend" json:"pool_backend"`
+	// PoolMaxIdle caps idle pooled connections per backend address
+	PoolMaxIdle int `yaml:"pool_max_idle" json:"pool_max_idle"`
+	// PoolIdleTimeout closes pooled connections left idle this long
+	PoolIdleTimeout time.Duration `yaml:"pool_idle_timeout" json:"pool_idle_timeout"`
+}
+
+// TunnelNames returns the names of specs, in order
+func TunnelNames(specs []TunnelSpec) []string {
+	names := make([]string, len(specs))
+	for i, spec := range specs {
+		names[i] = spec.Name
+	}
+	return names
+}
+
+// ValidateTunnelSpecs defaults each spec's protocol to TCP and reports
+// every invalid spec, duplicate name and overlapping local address.
+// Reverse tunnels don't listen on the client, so their local addresses
+// aren't checked for overlap.
+func ValidateTunnelSpecs(specs []TunnelSpec) error {
+	var errs []error
+	names := make(map[string]struct{}, len(specs))
+	var locals []TunnelSpec
+
+	for i := range specs {
+		spec := &specs[i]
+		if spec.Protocol == "" {
+			spec.Protocol = ProtocolTCP
+		}
+
+		if spec.Name == "" {
+			errs = append(errs, fmt.Errorf("tunnels[%d]: name is required", i))
+		} else if _, ok := names[spec.Name]; ok {
+			errs = append(errs, fmt.Errorf("tunnels[%d]: duplicate tunnel name %q", i, spec.Name))
+		} else {
+			names[spec.Name] = struct{}{}
+		}
+
+		switch spec.Protocol {
+		case ProtocolTCP, ProtocolUDP, ProtocolSOCKS5:
+		default:
+			errs = append(errs, fmt.Errorf("tunnel %q: unsupported protocol %q", spec.Name, spec.Protocol))
+		}
+		if spec.IdleTimeout < 0 {
+			errs = append(errs, fmt.Errorf("tunnel %q: idle_timeout must not be negative", spec.Name))
+		}
+		if spec.MaxConns < 0 {
+			errs = append(errs, fmt.Errorf("tunnel %q: max_conns must not be negative", spec.Name))
+		}
+		switch spec.MaxConnsPolicy {
+		case "", MaxConnsReject, MaxConnsQueue:
+		default:
+			errs = append(errs, fmt.Errorf("tunnel %q: unknown max_conns_policy %q", spec.Name, spec.MaxConnsPolicy))
+		}
+		if err := validateCompression(spec.Compression); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %q: %w", spec.Name, err))
+		}
+		if spec.RateLimitBytesPerSec < 0 {
+			errs = append(errs, fmt.Errorf("tunnel %q: rate_limit_bytes_per_sec must not be negative", spec.Name))
+		}
+		if spec.Protocol == ProtocolSOCKS5 {
+			if spec.RemoteAddr != "" {
+				errs = append(errs, fmt.Errorf("tunnel %q: remote_addr is not used by socks5 tunnels", spec.Name))
+			}
+		} else if _, _, err := net.SplitHostPort(spec.RemoteAddr); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %q: invalid remote_addr %q: %w", spec.Name, spec.RemoteAddr, err))
+		}
+		if len(spec.SOCKSUsers) > 0 && spec.Protocol != ProtocolSOCKS5 {
+			errs = append(errs, fmt.Errorf("tunnel %q: socks_users requires protocol socks5", spec.Name))
+		}
+		if spec.Reverse && spec.Protocol != ProtocolTCP {
+			errs = append(errs, fmt.Errorf("tunnel %q: reverse tunnels only support protocol tcp", spec.Name))
+		}
+		if spec.ReverseQueueTimeout < 0 {
+			errs = append(errs, fmt.Errorf("tunnel %q: reverse_queue_timeout must not be negative", spec.Name))
+		}
+		if spec.PoolBackend && (spec.Protocol != ProtocolTCP || spec.Reverse) {
+			errs = append(errs, fmt.Errorf("tunnel %q: pool_backend requires a forward tcp tunnel", spec.Name))
+		}
+		if spec.PoolMaxIdle < 0 || spec.PoolIdleTimeout < 0 {
+			errs = append(errs, fmt.Errorf("tunnel %q: pool_max_idle and pool_idle_timeout must not be negative", spec.Name))
+		}
+		if _, _, err := net.SplitHostPort(spec.LocalAddr); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %q: invalid local_addr %q: %w", spec.Name, spec.LocalAddr, err))
+			continue
+		}
+		if spec.Reverse {
+			continue
+		}
+
+		for _, other := range locals {
+			if addrsOverlap(spec.Protocol, spec.LocalAddr, other.Protocol, other.LocalAddr) {
+				errs = append(errs, fmt.Errorf("tunnel %q: local_addr %s overlaps tunnel %q", spec.Name, spec.LocalAddr, other.Name))
+			}
+		}
+		locals = append(locals, *spec)
+	}
+	return errors.Join(errs...)
+}
+
+// listenNetwork returns the network a tunnel's local end listens on
+func listenNetwork(protocol string) string {
+	if protocol == ProtocolUDP {
+		return ProtocolUDP
+	}
+	return ProtocolTCP
+}
+
+// addrsOverlap reports whether two host:port addresses refer to the same
+// socket, treating an empty or unspecified host as every interface
+func addrsOverlap(protoA, a, protoB, b string) bool {
+	if listenNetwork(protoA) != listenNetwork(protoB) {
+		return false
+	}
+	hostA, portA, _ := net.SplitHostPort(a)
+	hostB, portB, _ := net.SplitHostPort(b)
+	if portA != portB {
+		return false
+	}
+	if isWildcardHost(hostA) || isWildcardHost(hostB) {
+		return true
+	}
+	ipA, ipB := net.ParseIP(hostA), net.ParseIP(hostB)
+	if ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return hostA == hostB
+}
+
+func isWildcardHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
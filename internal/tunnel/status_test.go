@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotunnel-pro/internal/logging"
+)
+
+// readStatusFile decodes the status file at path
+func readStatusFile(t *testing.T, path string) statusFile {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status statusFile
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatalf("status file is not valid JSON: %v\n%s", err, data)
+	}
+	return status
+}
+
+func TestWriteStatusFileReplacesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "status.json")
+
+	if err := WriteStatusFile(path, []TunnelStatus{{Name: "web", Connected: true, BytesIn: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteStatusFile(path, []TunnelStatus{{Name: "web", LastError: "connection reset", Reconnecting: true, ReconnectAttempts: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	status := readStatusFile(t, path)
+	want := TunnelStatus{Name: "web", LastError: "connection reset", Reconnecting: true, ReconnectAttempts: 2}
+	if len(status.Tunnels) != 1 || status.Tunnels[0] != want {
+		t.Errorf("tunnels = %+v, want [%+v]", status.Tunnels, want)
+	}
+	if _, err := time.Parse(time.RFC3339, status.UpdatedAt); err != nil {
+		t.Errorf("updated_at = %q: %v", status.UpdatedAt, err)
+	}
+
+	// The temp files were renamed into place, none are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "status.json" {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("directory holds %v, want only status.json", names)
+	}
+}
+
+func TestRunStatusFileLogsWriteFailures(t *testing.T) {
+	var out bytes.Buffer
+	logger := logging.NewLogger("gotunnel-test", "test", logging.WARN)
+	logger.SetOutput(&out)
+	path := filepath.Join(t.TempDir(), "missing", "status.json")
+
+	// A cancelled context still writes once before returning
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	RunStatusFile(ctx, logger, path, time.Hour, func() []TunnelStatus { return nil })
+
+	logged := out.String()
+	if !strings.Contains(logged, "Failed to write status file") || !strings.Contains(logged, path) {
+		t.Errorf("log = %q, want a write failure for %s", logged, path)
+	}
+}
+
+func TestRunStatusFileTracksClientStats(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	serverAddr := freeAddr(t)
+	startServer(t, &ServerConfig{ListenAddr: serverAddr, TLSConfig: serverTLS, Logger: testLogger()})
+
+	localAddr := freeAddr(t)
+	client := startClient(t, &ClientConfig{
+		ServerAddr: serverAddr,
+		TLSConfig:  clientTLS,
+		Logger:     testLogger(),
+		Reconnect:  ReconnectConfig{Enabled: true, Interval: 20 * time.Millisecond, Backoff: 1},
+		Tunnels:    []TunnelSpec{{Name: "echo", Protocol: ProtocolTCP, LocalAddr: localAddr, RemoteAddr: echoBackend(t)}},
+	})
+
+	path := filepath.Join(t.TempDir(), "status.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RunStatusFile(ctx, testLogger(), path, 10*time.Millisecond, client.Stats)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// waitFor polls the file, which must parse on every read, until the
+	// echo tunnel's status satisfies ok
+	waitFor := func(what string, ok func(TunnelStatus) bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var last []TunnelStatus
+			if _, err := os.Stat(path); err == nil {
+				last = readStatusFile(t, path).Tunnels
+				if len(last) == 1 && last[0].Name == "echo" && ok(last[0]) {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("status file never showed %s, last tunnels %+v", what, last)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("a connected tunnel", func(s TunnelStatus) bool {
+		return s.Connected && !s.Reconnecting && s.BytesIn == 0
+	})
+	if got := roundTrip(t, localAddr, "hello"); got != "hello" {
+		t.Fatalf("response = %q, want hello", got)
+	}
+	waitFor("the relayed bytes", func(s TunnelStatus) bool {
+		return s.BytesIn == 5 && s.BytesOut == 5 && s.ActiveConnections == 0
+	})
+}
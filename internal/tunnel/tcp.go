@@ -0,0 +1,137 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TCPOptions tunes the sockets of accepted and dialed connections, e.g.
+// larger buffers for links with a high bandwidth-delay product. Zero values
+// keep Go's defaults: kernel-sized buffers, Nagle's algorithm disabled and
+// keepalives every 15s. Options only apply to TCP connections, including
+// TLS and this package's wrappers around one; other connections are left
+// as they are.
+type TCPOptions struct {
+	// ReadBufferBytes and WriteBufferBytes size the socket buffers
+	ReadBufferBytes  int `json:"read_buffer_bytes"`
+	WriteBufferBytes int `json:"write_buffer_bytes"`
+	// NoDelay sends small writes immediately; nil keeps Go's default of true
+	NoDelay *bool `json:"no_delay,omitempty"`
+	// KeepAlivePeriod is the interval between keepalive probes. Negative
+	// disables keepalives.
+	KeepAlivePeriod time.Duration `json:"keep_alive_period"`
+}
+
+// Validate reports negative buffer sizes
+func (o TCPOptions) Validate() error {
+	var errs []error
+	if o.ReadBufferBytes < 0 {
+		errs = append(errs, fmt.Errorf("tcp read buffer must not be negative, got %d", o.ReadBufferBytes))
+	}
+	if o.WriteBufferBytes < 0 {
+		errs = append(errs, fmt.Errorf("tcp write buffer must not be negative, got %d", o.WriteBufferBytes))
+	}
+	return errors.Join(errs...)
+}
+
+// Apply sets the options on conn's underlying *net.TCPConn. It is a no-op
+// when conn isn't backed by a TCP connection.
+func (o TCPOptions) Apply(conn net.Conn) error {
+	tcp, ok := tcpConn(conn)
+	if !ok {
+		return nil
+	}
+	if o.ReadBufferBytes > 0 {
+		if err := tcp.SetReadBuffer(o.ReadBufferBytes); err != nil {
+			return fmt.Errorf("failed to set read buffer: %w", err)
+		}
+	}
+	if o.WriteBufferBytes > 0 {
+		if err := tcp.SetWriteBuffer(o.WriteBufferBytes); err != nil {
+			return fmt.Errorf("failed to set write buffer: %w", err)
+		}
+	}
+	if o.NoDelay != nil {
+		if err := tcp.SetNoDelay(*o.NoDelay); err != nil {
+			return fmt.Errorf("failed to set no delay: %w", err)
+		}
+	}
+	switch {
+	case o.KeepAlivePeriod < 0:
+		if err := tcp.SetKeepAlive(false); err != nil {
+			return fmt.Errorf("failed to disable keepalive: %w", err)
+		}
+	case o.KeepAlivePeriod > 0:
+		if err := tcp.SetKeepAlive(true); err != nil {
+			return fmt.Errorf("failed to enable keepalive: %w", err)
+		}
+		if err := tcp.SetKeepAlivePeriod(o.KeepAlivePeriod); err != nil {
+			return fmt.Errorf("failed to set keepalive period: %w", err)
+		}
+	}
+	return nil
+}
+
+// TuneDial returns a DialFunc that applies opts to each connection dialed
+// by dial. A connection that can't be tuned is closed and the error
+// returned.
+func TuneDial(dial DialFunc, opts TCPOptions) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := opts.Apply(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// TuneListener returns a listener that applies opts to each accepted
+// connection before returning it
+func TuneListener(ln net.Listener, opts TCPOptions) net.Listener {
+	return &tunedListener{Listener: ln, opts: opts}
+}
+
+type tunedListener struct {
+	net.Listener
+	opts TCPOptions
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		// Options fail on sockets the peer already reset; drop those
+		// rather than failing Accept for everyone else
+		if err := l.opts.Apply(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// tcpConn finds the *net.TCPConn beneath TLS and this package's wrappers
+func tcpConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case *tls.Conn:
+			conn = c.NetConn()
+		case wrappedConn:
+			conn = c.unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
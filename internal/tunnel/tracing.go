@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"gotunnel-pro/internal/tracing"
+)
+
+// TraceDial wraps dial in a "tunnel.backend_dial" span per call, carrying
+// the tunnel name, target address and result. It costs nothing while
+// tracing is off.
+func TraceDial(tunnel string, dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, span := tracing.Start(ctx, "tunnel.backend_dial", tracing.KindClient, map[string]interface{}{
+			"tunnel":            tunnel,
+			"server.address":    addr,
+			"network.transport": network,
+		})
+		conn, err := dial(ctx, network, addr)
+		span.SetAttribute("result", spanResult(err))
+		span.Finish(err)
+		return conn, err
+	}
+}
+
+// startConnSpan starts the span covering one accepted tunnel connection
+func startConnSpan(ctx context.Context, tunnel string, conn net.Conn) (context.Context, *tracing.Span) {
+	return tracing.Start(ctx, "tunnel.connection", tracing.KindServer, map[string]interface{}{
+		"tunnel":      tunnel,
+		"remote_addr": conn.RemoteAddr().String(),
+	})
+}
+
+// finishConnSpan records the bytes relayed in each direction and the
+// outcome of a connection span
+func finishConnSpan(span *tracing.Span, bytesIn, bytesOut int64, err error) {
+	span.SetAttribute("bytes_in", bytesIn)
+	span.SetAttribute("bytes_out", bytesOut)
+	span.SetAttribute("result", spanResult(err))
+	span.Finish(err)
+}
+
+// spanResult names the outcome of a traced operation
+func spanResult(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, ErrDestinationDenied):
+		return "denied"
+	default:
+		return "failure"
+	}
+}
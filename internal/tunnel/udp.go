@@ -0,0 +1,317 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"gotunnel-pro/internal/metrics"
+)
+
+// UDP datagrams are carried whole, one per FrameDatagram, so they are
+// never fragmented or coalesced by the tunnel. The tunnel does not do path
+// MTU discovery though: a datagram larger than the path MTU on the far side
+// is fragmented by the IP layer there, or dropped if fragmentation isn't
+// allowed. Applications like QUIC that size packets for the client's path
+// should keep well below 1500 bytes to leave room for encapsulation.
+const (
+	// MaxDatagramSize is the largest UDP payload that can be relayed
+	MaxDatagramSize = 65507
+
+	// DefaultUDPFlowIdleTimeout is how long a UDP flow may stay silent in
+	// both directions before it is evicted
+	DefaultUDPFlowIdleTimeout = 60 * time.Second
+)
+
+// ForwardUDP relays datagrams between the local pc and the server over
+// stream until ctx is cancelled or either side fails. Each local source
+// address becomes a flow so replies are returned to the right sender;
+// flows idle for longer than idle are forgotten. The caller closes pc and
+// stream.
+func ForwardUDP(ctx context.Context, tunnel string, pc net.PacketConn, stream net.Conn, idle time.Duration) error {
+	if idle <= 0 {
+		idle = DefaultUDPFlowIdleTimeout
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		pc.SetReadDeadline(time.Now())
+		stream.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	fw := NewFrameWriter(stream)
+	flows := newUDPFlowTable(idle)
+	errCh := make(chan error, 2)
+
+	// Server to local sources
+	go func() {
+		for {
+			f, err := ReadFrame(stream)
+			if err != nil {
+				errCh <- fmt.Errorf("failed to read datagram from tunnel: %w", err)
+				return
+			}
+			if f.Type != FrameDatagram {
+				continue
+			}
+			addr, ok := flows.addr(f.StreamID)
+			if !ok {
+				// The flow was evicted; nobody is waiting for this reply
+				continue
+			}
+			if _, err := pc.WriteTo(f.Payload, addr); err != nil {
+				errCh <- fmt.Errorf("failed to write datagram to %s: %w", addr, err)
+				return
+			}
+			metrics.RecordTraffic("out", tunnel, int64(len(f.Payload)))
+		}
+	}()
+
+	// Local sources to server
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				errCh <- fmt.Errorf("failed to read local datagram: %w", err)
+				return
+			}
+			id := flows.id(addr)
+			if err := fw.WriteFrame(Frame{Type: FrameDatagram, StreamID: id, Payload: buf[:n]}); err != nil {
+				errCh <- fmt.Errorf("failed to write datagram to tunnel: %w", err)
+				return
+			}
+			metrics.RecordTraffic("in", tunnel, int64(n))
+		}
+	}()
+
+	go flows.run(ctx, nil)
+
+	err := <-errCh
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// RelayUDP is the server side of ForwardUDP. It reads framed datagrams from
+// stream and sends them to remoteAddr from one UDP socket per flow, so the
+// remote sees a distinct source per client sender, and frames the replies
+// back. Flows idle for longer than idle are closed.
+func RelayUDP(ctx context.Context, tunnel string, stream net.Conn, remoteAddr string, idle time.Duration) error {
+	if idle <= 0 {
+		idle = DefaultUDPFlowIdleTimeout
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		stream.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	fw := NewFrameWriter(stream)
+	flows := newUDPFlowTable(idle)
+	defer flows.closeAll()
+	go flows.run(ctx, func(conn net.Conn) {
+		conn.Close()
+	})
+
+	for {
+		f, err := ReadFrame(stream)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read datagram from tunnel: %w", err)
+		}
+		if f.Type != FrameDatagram {
+			continue
+		}
+
+		conn, err := flows.conn(f.StreamID, func() (net.Conn, error) {
+			conn, err := net.Dial("udp", remoteAddr)
+			if err != nil {
+				return nil, err
+			}
+			go relayReplies(tunnel, f.StreamID, conn, fw, flows)
+			return conn, nil
+		})
+		if err != nil {
+			metrics.RecordTunnelConnectionError(tunnel, "udp_dial")
+			continue
+		}
+		if _, err := conn.Write(f.Payload); err != nil {
+			metrics.RecordTunnelConnectionError(tunnel, "udp_write")
+			continue
+		}
+		metrics.RecordTraffic("in", tunnel, int64(len(f.Payload)))
+	}
+}
+
+// relayReplies frames datagrams from the remote back to the client until
+// the flow's socket is closed
+func relayReplies(tunnel string, id uint32, conn net.Conn, fw *FrameWriter, flows *udpFlowTable) {
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				flows.remove(id)
+				conn.Close()
+			}
+			return
+		}
+		flows.touch(id)
+		if err := fw.WriteFrame(Frame{Type: FrameDatagram, StreamID: id, Payload: buf[:n]}); err != nil {
+			return
+		}
+		metrics.RecordTraffic("out", tunnel, int64(n))
+	}
+}
+
+// udpFlowTable tracks UDP flows by ID with their last activity. The client
+// side maps source addresses to IDs; the server side maps IDs to sockets.
+type udpFlowTable struct {
+	mu     sync.Mutex
+	idle   time.Duration
+	nextID uint32
+	byAddr map[string]uint32
+	flows  map[uint32]*udpFlow
+}
+
+type udpFlow struct {
+	addr         net.Addr
+	conn         net.Conn
+	lastActivity time.Time
+}
+
+func newUDPFlowTable(idle time.Duration) *udpFlowTable {
+	return &udpFlowTable{
+		idle:   idle,
+		byAddr: make(map[string]uint32),
+		flows:  make(map[uint32]*udpFlow),
+	}
+}
+
+// id returns the flow ID for a local source address, allocating one for a
+// new source
+func (t *udpFlowTable) id(addr net.Addr) uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := addr.String()
+	if id, ok := t.byAddr[key]; ok {
+		t.flows[id].lastActivity = time.Now()
+		return id
+	}
+	t.nextID++
+	t.byAddr[key] = t.nextID
+	t.flows[t.nextID] = &udpFlow{addr: addr, lastActivity: time.Now()}
+	return t.nextID
+}
+
+// addr returns the local source address of a flow
+func (t *udpFlowTable) addr(id uint32) (net.Addr, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	flow, ok := t.flows[id]
+	if !ok {
+		return nil, false
+	}
+	flow.lastActivity = time.Now()
+	return flow.addr, true
+}
+
+// conn returns the remote socket for a flow, creating it with dial for a
+// new flow
+func (t *udpFlowTable) conn(id uint32, dial func() (net.Conn, error)) (net.Conn, error) {
+	t.mu.Lock()
+	if flow, ok := t.flows[id]; ok {
+		flow.lastActivity = time.Now()
+		t.mu.Unlock()
+		return flow.conn, nil
+	}
+	t.mu.Unlock()
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flows[id] = &udpFlow{conn: conn, lastActivity: time.Now()}
+	return conn, nil
+}
+
+func (t *udpFlowTable) touch(id uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if flow, ok := t.flows[id]; ok {
+		flow.lastActivity = time.Now()
+	}
+}
+
+func (t *udpFlowTable) remove(id uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if flow, ok := t.flows[id]; ok && flow.addr != nil {
+		delete(t.byAddr, flow.addr.String())
+	}
+	delete(t.flows, id)
+}
+
+// run evicts idle flows until ctx is cancelled, passing the socket of each
+// evicted server-side flow to evict
+func (t *udpFlowTable) run(ctx context.Context, evict func(net.Conn)) {
+	interval := t.idle / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, conn := range t.evictIdle(now) {
+				if evict != nil && conn != nil {
+					evict(conn)
+				}
+			}
+		}
+	}
+}
+
+func (t *udpFlowTable) evictIdle(now time.Time) []net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var evicted []net.Conn
+	for id, flow := range t.flows {
+		if now.Sub(flow.lastActivity) < t.idle {
+			continue
+		}
+		if flow.addr != nil {
+			delete(t.byAddr, flow.addr.String())
+		}
+		delete(t.flows, id)
+		evicted = append(evicted, flow.conn)
+	}
+	return evicted
+}
+
+func (t *udpFlowTable) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, flow := range t.flows {
+		if flow.conn != nil {
+			flow.conn.Close()
+		}
+		delete(t.flows, id)
+	}
+}
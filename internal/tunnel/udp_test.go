@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpEchoBackend echoes every datagram back to its sender
+func udpEchoBackend(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestUDPRoundTrip(t *testing.T) {
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientStream, serverStream := net.Pipe()
+	defer clientStream.Close()
+	defer serverStream.Close()
+	go RelayUDP(ctx, "dns", serverStream, udpEchoBackend(t), 0)
+	go ForwardUDP(ctx, "dns", local, clientStream, 0)
+
+	// Each sender is its own flow and must only see its own replies
+	senders := make([]net.Conn, 2)
+	for i := range senders {
+		conn, err := net.Dial("udp", local.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		senders[i] = conn
+	}
+	for round := 0; round < 3; round++ {
+		for i, conn := range senders {
+			msg := fmt.Sprintf("sender %d datagram %d", i, round)
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("sender %d round %d: %v", i, round, err)
+			}
+			if got := string(buf[:n]); got != msg {
+				t.Errorf("sender %d got %q, want %q", i, got, msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,23 @@
+// Package version holds build information injected at link time, e.g.
+//
+//	go build -ldflags "-X gotunnel-pro/internal/version.Version=v1.2.0 -X gotunnel-pro/internal/version.Commit=$(git rev-parse --short HEAD) -X gotunnel-pro/internal/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var (
+	// Version is the release version of the binary
+	Version = "dev"
+	// Commit is the git commit the binary was built from
+	Commit = "unknown"
+	// BuildDate is when the binary was built, in RFC 3339
+	BuildDate = "unknown"
+)
+
+// String describes the build for -version output
+func String(name string) string {
+	return fmt.Sprintf("%s %s (commit %s, built %s, %s)", name, Version, Commit, BuildDate, runtime.Version())
+}